@@ -0,0 +1,190 @@
+// dnsload is a load test for the gatekeeper DNS server, or any other. It keeps a fixed number of queries in flight over
+// UDP for a while and reports the rate the server sustained and how long it took to answer
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/thatjames-go/gatekeeper-go/internal/dns"
+)
+
+var (
+	server      string
+	names       string
+	queryType   string
+	concurrency int
+	duration    time.Duration
+	timeout     time.Duration
+)
+
+type result struct {
+	latencies []time.Duration
+	rcodes    map[dns.RCODE]uint64
+	timeouts  uint64
+	errors    uint64
+}
+
+func main() {
+	flag.StringVar(&server, "server", "127.0.0.1:53", "address of the DNS server to load")
+	flag.StringVar(&names, "names", "example.com", "comma separated names to query, picked at random for every query")
+	flag.StringVar(&queryType, "type", "A", "query type")
+	flag.IntVar(&concurrency, "concurrency", 64, "queries kept in flight, each from its own socket")
+	flag.DurationVar(&duration, "duration", time.Second*10, "how long to run for")
+	flag.DurationVar(&timeout, "timeout", time.Second*2, "how long to wait for an answer before counting the query as lost")
+	flag.Parse()
+
+	qtype, ok := parseType(queryType)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown query type %s\n", queryType)
+		os.Exit(1)
+	}
+	queries := make([][]byte, 0)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		query, err := buildQuery(name, qtype)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to build query for %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		queries = append(queries, query)
+	}
+	if len(queries) == 0 {
+		fmt.Fprintln(os.Stderr, "no names to query")
+		os.Exit(1)
+	}
+
+	fmt.Printf("querying %s with %d clients for %s\n", server, concurrency, duration)
+	var sent atomic.Uint64
+	results := make([]*result, concurrency)
+	deadline := time.Now().Add(duration)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range results {
+		results[i] = &result{rcodes: make(map[dns.RCODE]uint64)}
+		wg.Add(1)
+		go func(res *result, id uint16) {
+			defer wg.Done()
+			run(res, queries, id, deadline, &sent)
+		}(results[i], uint16(i))
+	}
+	wg.Wait()
+	report(results, sent.Load(), time.Since(start))
+}
+
+// run sends one query at a time from its own socket until the deadline
+func run(res *result, queries [][]byte, id uint16, deadline time.Time, sent *atomic.Uint64) {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to dial %s: %v\n", server, err)
+		res.errors++
+		return
+	}
+	defer conn.Close()
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
+	query := make([]byte, 0, 512)
+	buff := make([]byte, 65535)
+	for time.Now().Before(deadline) {
+		id++
+		query = append(query[:0], queries[rng.Intn(len(queries))]...)
+		binary.BigEndian.PutUint16(query, id)
+
+		sentAt := time.Now()
+		if _, err := conn.Write(query); err != nil {
+			res.errors++
+			continue
+		}
+		sent.Add(1)
+		conn.SetReadDeadline(sentAt.Add(timeout))
+		for {
+			n, err := conn.Read(buff)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					res.timeouts++
+				} else {
+					res.errors++
+				}
+				break
+			}
+			response, err := dns.ParseDNSMessage(buff[:n])
+			if err != nil {
+				res.errors++
+				break
+			}
+			// a late answer to a query that already timed out
+			if response.Header.ID != id {
+				continue
+			}
+			res.latencies = append(res.latencies, time.Since(sentAt))
+			res.rcodes[response.Header.RCODE()]++
+			break
+		}
+	}
+}
+
+func report(results []*result, sent uint64, elapsed time.Duration) {
+	total := &result{rcodes: make(map[dns.RCODE]uint64)}
+	for _, res := range results {
+		total.latencies = append(total.latencies, res.latencies...)
+		total.timeouts += res.timeouts
+		total.errors += res.errors
+		for rcode, n := range res.rcodes {
+			total.rcodes[rcode] += n
+		}
+	}
+	answered := len(total.latencies)
+	fmt.Printf("sent %d queries in %s, %d answered, %d timed out, %d errors\n",
+		sent, elapsed.Round(time.Millisecond), answered, total.timeouts, total.errors)
+	fmt.Printf("%.0f answered queries per second\n", float64(answered)/elapsed.Seconds())
+	if answered == 0 {
+		return
+	}
+
+	sort.Slice(total.latencies, func(i, j int) bool { return total.latencies[i] < total.latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return total.latencies[int(float64(answered-1)*p)]
+	}
+	fmt.Printf("latency p50 %s, p90 %s, p99 %s, max %s\n", percentile(0.5), percentile(0.9), percentile(0.99), total.latencies[answered-1])
+
+	rcodes := make([]dns.RCODE, 0, len(total.rcodes))
+	for rcode := range total.rcodes {
+		rcodes = append(rcodes, rcode)
+	}
+	sort.Slice(rcodes, func(i, j int) bool { return rcodes[i] < rcodes[j] })
+	for _, rcode := range rcodes {
+		fmt.Printf("rcode %d: %d\n", rcode, total.rcodes[rcode])
+	}
+}
+
+func buildQuery(name string, qtype dns.DNSType) ([]byte, error) {
+	msg := dns.NewDnsMessage()
+	msg.Header.SetRD(true)
+	msg.Questions = append(msg.Questions, &dns.DNSQuestion{
+		ParsedName: name,
+		Type:       qtype,
+		Class:      dns.DNSClassIN,
+	})
+	return dns.MarshalDNSMessage(msg)
+}
+
+func parseType(name string) (dns.DNSType, bool) {
+	for _, qtype := range []dns.DNSType{dns.DNSTypeA, dns.DNSTypeAAAA, dns.DNSTypeCNAME, dns.DNSTypeMX, dns.DNSTypeNS,
+		dns.DNSTypeTXT, dns.DNSTypePTR, dns.DNSTypeSOA, dns.DNSTypeANY} {
+		if strings.EqualFold(qtype.String(), name) {
+			return qtype, true
+		}
+	}
+	return 0, false
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"net"
@@ -10,6 +11,7 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"gitlab.com/thatjames-go/gatekeeper-go/internal/config"
@@ -47,9 +49,10 @@ func main() {
 	system.Version = version
 	log.Debugf("Config: %v", config.Config)
 
+	var dhcpServer *dhcp.DHCPServer
 	if config.Config.DHCP != nil {
 		log.Info("Registering DHCP server")
-		dhcpServer := dhcp.NewDHCPServerFromConfig(config.Config.DHCP)
+		dhcpServer = dhcp.NewDHCPServerFromConfig(config.Config.DHCP)
 		service.Register(dhcpServer, service.DHCP)
 
 	}
@@ -61,18 +64,181 @@ func main() {
 			localDomains[domain] = net.ParseIP(ip).To4()
 		}
 
+		var dnstapOpts *dns.DnstapOpts
+		if tapConfig := config.Config.DNS.Dnstap; tapConfig != nil {
+			dnstapOpts = &dns.DnstapOpts{
+				Network:   tapConfig.Network,
+				Address:   tapConfig.Address,
+				Identity:  tapConfig.Identity,
+				QueueSize: tapConfig.QueueSize,
+			}
+		}
+
+		var rateLimitOpts *dns.RateLimitOpts
+		if rateLimit := config.Config.DNS.RateLimit; rateLimit != nil {
+			rateLimitOpts = &dns.RateLimitOpts{
+				QueriesPerSecond:   rateLimit.QueriesPerSecond,
+				Burst:              rateLimit.Burst,
+				IPv4PrefixLength:   rateLimit.IPv4PrefixLength,
+				IPv6PrefixLength:   rateLimit.IPv6PrefixLength,
+				ResponsesPerSecond: rateLimit.ResponsesPerSecond,
+				Slip:               rateLimit.Slip,
+			}
+		}
+
+		var zoneOpts *dns.ZoneOpts
+		if zone := config.Config.DNS.Zone; zone != nil {
+			zoneOpts = &dns.ZoneOpts{
+				Name:          zone.Name,
+				NameServer:    zone.NameServer,
+				Admin:         zone.Admin,
+				TTL:           time.Second * time.Duration(zone.TTL),
+				JournalFile:   zone.JournalFile,
+				AllowTransfer: zone.AllowTransfer,
+				TransferKeys:  zone.TransferKeys,
+				Notify:        zone.Notify,
+			}
+		}
+
+		var tsigKeys []dns.TSIGKey
+		for _, key := range config.Config.DNS.TSIGKeys {
+			secret, err := base64.StdEncoding.DecodeString(key.Secret)
+			if err != nil {
+				log.Warnf("ignoring TSIG key %s, secret is not valid base64: %v", key.Name, err)
+				continue
+			}
+			tsigKeys = append(tsigKeys, dns.TSIGKey{
+				Name:      key.Name,
+				Algorithm: key.Algorithm,
+				Secret:    secret,
+			})
+		}
+
+		var views []dns.ViewOpts
+		for _, view := range config.Config.DNS.Views {
+			viewDomains := make(map[string]net.IP)
+			for domain, ip := range view.LocalDomains {
+				viewDomains[domain] = net.ParseIP(ip).To4()
+			}
+			views = append(views, dns.ViewOpts{
+				Name:         view.Name,
+				Clients:      view.Clients,
+				LocalDomains: viewDomains,
+			})
+		}
+
+		var policyZones []dns.ResponsePolicyZoneOpts
+		for _, zone := range config.Config.DNS.ResponsePolicyZones {
+			if zone.URL == "" && zone.Primary == "" {
+				log.Warnf("ignoring response policy zone %s, it has neither a URL nor a primary", zone.Name)
+				continue
+			}
+			policyZones = append(policyZones, dns.ResponsePolicyZoneOpts{
+				Name:            zone.Name,
+				URL:             zone.URL,
+				Primary:         zone.Primary,
+				TSIGKey:         zone.TSIGKey,
+				RefreshInterval: time.Second * time.Duration(zone.RefreshInterval),
+			})
+		}
+
+		strategy, ok := dns.ParseUpstreamStrategy(config.Config.DNS.UpstreamStrategy)
+		if !ok {
+			log.Warnf("unknown upstream strategy %s, using %s", config.Config.DNS.UpstreamStrategy, strategy)
+		}
+		resolverOpts := &dns.ResolverOpts{
+			LocalDomains: localDomains,
+			Upstreams:    config.Config.DNS.UpstreamServers,
+			Strategy:     strategy,
+			ClientGroups: config.Config.DNS.ClientGroups,
+		}
+		var clientMetrics bool
+		if metrics := config.Config.DNS.Metrics; metrics != nil {
+			resolverOpts.DomainMetrics = metrics.PerDomain
+			clientMetrics = metrics.PerClient
+		}
+		if health := config.Config.DNS.UpstreamHealth; health != nil {
+			resolverOpts.FailureThreshold = health.FailureThreshold
+			resolverOpts.ProbeInterval = time.Second * time.Duration(health.ProbeInterval)
+		}
+		if rebinding := config.Config.DNS.Rebinding; rebinding != nil {
+			action, ok := dns.ParseRebindingAction(rebinding.Action)
+			if !ok {
+				log.Warnf("unknown rebinding protection action %s, using %s", rebinding.Action, action)
+			}
+			resolverOpts.Rebinding = &dns.RebindingOpts{
+				Action:    action,
+				Allowlist: rebinding.Allowlist,
+			}
+		}
+		for _, rule := range config.Config.DNS.RewriteRules {
+			resolverOpts.RewriteRules = append(resolverOpts.RewriteRules, dns.RewriteRule{
+				Match:   dns.RewriteMatch(rule.Match),
+				Pattern: rule.Pattern,
+				Clients: rule.Clients,
+				Action:  dns.RewriteAction(rule.Action),
+				Value:   rule.Value,
+			})
+		}
+		if safeSearch := config.Config.DNS.SafeSearch; safeSearch != nil {
+			for _, group := range safeSearch.Groups {
+				if _, ok := config.Config.DNS.ClientGroups[group]; !ok {
+					log.Warnf("safe search is enabled for unknown client group %s", group)
+				}
+			}
+			resolverOpts.SafeSearch = &dns.SafeSearchOpts{
+				Enabled: safeSearch.Enabled,
+				Groups:  safeSearch.Groups,
+			}
+		}
+		if recursion := config.Config.DNS.Recursion; recursion != nil && recursion.Enabled {
+			resolverOpts.Recursion = &dns.RecursionOpts{
+				RootHints:  recursion.RootHints,
+				MaxQueries: recursion.MaxQueries,
+			}
+		}
+		if dns64 := config.Config.DNS.DNS64; dns64 != nil {
+			for _, group := range dns64.Groups {
+				if _, ok := config.Config.DNS.ClientGroups[group]; !ok {
+					log.Warnf("DNS64 is enabled for unknown client group %s", group)
+				}
+			}
+			resolverOpts.DNS64 = &dns.DNS64Opts{
+				Prefix:    dns64.Prefix,
+				Enabled:   dns64.Enabled,
+				Groups:    dns64.Groups,
+				Listeners: dns64.Listeners,
+				Exclude:   dns64.Exclude,
+			}
+		}
+
 		dnsServer := dns.NewDNSServerWithOpts(dns.DNSServerOpts{
-			Interface:      config.Config.DNS.Interface,
-			Upstream:       config.Config.DNS.UpstreamServers,
-			BlocklistUrls:  config.Config.DNS.BlockLists,
-			BlockedDomains: config.Config.DNS.BlockedDomains,
-			ResolverOpts: &dns.ResolverOpts{
-				LocalDomains: localDomains,
-				Upstreams:    config.Config.DNS.UpstreamServers,
-			},
-			Port: config.Config.DNS.Port,
+			Interface:           config.Config.DNS.Interface,
+			ListenAddresses:     config.Config.DNS.ListenAddresses,
+			Upstream:            config.Config.DNS.UpstreamServers,
+			BlocklistUrls:       config.Config.DNS.BlockLists,
+			BlockedDomains:      config.Config.DNS.BlockedDomains,
+			ResolverOpts:        resolverOpts,
+			Port:                config.Config.DNS.Port,
+			Dnstap:              dnstapOpts,
+			RateLimit:           rateLimitOpts,
+			Zone:                zoneOpts,
+			TSIGKeys:            tsigKeys,
+			ResponsePolicyZones: policyZones,
+			Views:               views,
+			ClientMetrics:       clientMetrics,
+			Workers:             config.Config.DNS.Workers,
+			ListenSockets:       config.Config.DNS.ListenSockets,
+			TCPConnections:      config.Config.DNS.TCPConnections,
 		}, nil, nil)
 		service.Register(dnsServer, service.DNS)
+
+		if dhcpServer != nil {
+			log.Info("Registering DHCP clients in DNS")
+			dhcpServer.LeaseDB().Subscribe(func(event dhcp.LeaseEvent) {
+				registerLease(dhcpServer, dnsServer, event)
+			})
+		}
 	}
 
 	if config.Config.Web != nil {
@@ -104,6 +270,23 @@ func main() {
 	}
 }
 
+// registerLease keeps the DNS records for a DHCP client in step with its lease
+func registerLease(dhcpServer *dhcp.DHCPServer, dnsServer *dns.DNSServer, event dhcp.LeaseEvent) {
+	lease := event.Lease
+	if event.Type != dhcp.LeaseBound {
+		dnsServer.UnregisterDHCPHost(lease.ClientId)
+		return
+	}
+	if lease.Hostname == "" {
+		return
+	}
+	if err := dnsServer.RegisterDHCPHost(lease.Hostname, dhcpServer.Options().DomainName, lease.IP, lease.ClientId, lease.Expiry); err != nil {
+		log.Warnf("unable to register %s for %s in DNS: %v", lease.Hostname, lease.ClientId, err)
+		return
+	}
+	log.Debugf("registered %s at %s in DNS", lease.Hostname, lease.IP)
+}
+
 type logFormatFunc func(*log.Entry) ([]byte, error)
 
 func (fn logFormatFunc) Format(e *log.Entry) ([]byte, error) {
@@ -194,12 +194,120 @@ type TLSConfig struct {
 }
 
 type DNS struct {
-	UpstreamServers []string          `yaml:"UpstreamServers"`
-	Interface       string            `yaml:"Interface"`
-	LocalDomains    map[string]string `yaml:"LocalDomains"`
-	Port            int               `yaml:"Port"`
-	BlockLists      []string          `yaml:"BlockLists"`
-	BlockedDomains  []string          `yaml:"BlockedDomains"`
+	UpstreamServers     []string             `yaml:"UpstreamServers"`
+	UpstreamStrategy    string               `yaml:"UpstreamStrategy,omitempty"`
+	UpstreamHealth      *UpstreamHealth      `yaml:"UpstreamHealth,omitempty"`
+	Recursion           *Recursion           `yaml:"Recursion,omitempty"`
+	Interface           string               `yaml:"Interface"`
+	ListenAddresses     []string             `yaml:"ListenAddresses,omitempty"`
+	LocalDomains        map[string]string    `yaml:"LocalDomains"`
+	Port                int                  `yaml:"Port"`
+	BlockLists          []string             `yaml:"BlockLists"`
+	BlockedDomains      []string             `yaml:"BlockedDomains"`
+	Dnstap              *Dnstap              `yaml:"Dnstap,omitempty"`
+	RateLimit           *RateLimit           `yaml:"RateLimit,omitempty"`
+	Zone                *Zone                `yaml:"Zone,omitempty"`
+	TSIGKeys            []TSIGKey            `yaml:"TSIGKeys,omitempty"`
+	Rebinding           *Rebinding           `yaml:"RebindingProtection,omitempty"`
+	ClientGroups        map[string][]string  `yaml:"ClientGroups,omitempty"`
+	SafeSearch          *SafeSearch          `yaml:"SafeSearch,omitempty"`
+	DNS64               *DNS64               `yaml:"DNS64,omitempty"`
+	RewriteRules        []RewriteRule        `yaml:"RewriteRules,omitempty"`
+	ResponsePolicyZones []ResponsePolicyZone `yaml:"ResponsePolicyZones,omitempty"`
+	Views               []View               `yaml:"Views,omitempty"`
+	Metrics             *Metrics             `yaml:"Metrics,omitempty"`
+	Workers             int                  `yaml:"Workers,omitempty"`
+	ListenSockets       int                  `yaml:"ListenSockets,omitempty"`
+	TCPConnections      int                  `yaml:"TCPConnections,omitempty"`
+}
+
+type Metrics struct {
+	PerDomain bool `yaml:"PerDomain"`
+	PerClient bool `yaml:"PerClient"`
+}
+
+type View struct {
+	Name         string            `yaml:"Name"`
+	Clients      []string          `yaml:"Clients"`
+	LocalDomains map[string]string `yaml:"LocalDomains,omitempty"`
+}
+
+type ResponsePolicyZone struct {
+	Name            string `yaml:"Name"`
+	URL             string `yaml:"URL,omitempty"`
+	Primary         string `yaml:"Primary,omitempty"`
+	TSIGKey         string `yaml:"TSIGKey,omitempty"`
+	RefreshInterval int    `yaml:"RefreshInterval,omitempty"`
+}
+
+type RewriteRule struct {
+	Match   string   `yaml:"Match"`
+	Pattern string   `yaml:"Pattern"`
+	Clients []string `yaml:"Clients,omitempty"`
+	Action  string   `yaml:"Action"`
+	Value   string   `yaml:"Value,omitempty"`
+}
+
+type SafeSearch struct {
+	Enabled bool     `yaml:"Enabled"`
+	Groups  []string `yaml:"Groups,omitempty"`
+}
+
+type Recursion struct {
+	Enabled    bool     `yaml:"Enabled"`
+	RootHints  []string `yaml:"RootHints,omitempty"`
+	MaxQueries int      `yaml:"MaxQueries,omitempty"`
+}
+
+type DNS64 struct {
+	Prefix    string   `yaml:"Prefix,omitempty"`
+	Enabled   bool     `yaml:"Enabled"`
+	Groups    []string `yaml:"Groups,omitempty"`
+	Listeners []string `yaml:"Listeners,omitempty"`
+	Exclude   []string `yaml:"Exclude,omitempty"`
+}
+
+type Rebinding struct {
+	Action    string   `yaml:"Action,omitempty"`
+	Allowlist []string `yaml:"Allowlist,omitempty"`
+}
+
+type Zone struct {
+	Name          string   `yaml:"Name"`
+	NameServer    string   `yaml:"NameServer,omitempty"`
+	Admin         string   `yaml:"Admin,omitempty"`
+	TTL           int      `yaml:"TTL,omitempty"`
+	JournalFile   string   `yaml:"JournalFile,omitempty"`
+	AllowTransfer []string `yaml:"AllowTransfer,omitempty"`
+	TransferKeys  []string `yaml:"TransferKeys,omitempty"`
+	Notify        []string `yaml:"Notify,omitempty"`
+}
+
+type TSIGKey struct {
+	Name      string `yaml:"Name"`
+	Algorithm string `yaml:"Algorithm,omitempty"`
+	Secret    string `yaml:"Secret"`
+}
+
+type RateLimit struct {
+	QueriesPerSecond   int `yaml:"QueriesPerSecond"`
+	Burst              int `yaml:"Burst"`
+	IPv4PrefixLength   int `yaml:"IPv4PrefixLength"`
+	IPv6PrefixLength   int `yaml:"IPv6PrefixLength"`
+	ResponsesPerSecond int `yaml:"ResponsesPerSecond"`
+	Slip               int `yaml:"Slip"`
+}
+
+type UpstreamHealth struct {
+	FailureThreshold int `yaml:"FailureThreshold"`
+	ProbeInterval    int `yaml:"ProbeInterval"`
+}
+
+type Dnstap struct {
+	Network   string `yaml:"Network"`
+	Address   string `yaml:"Address"`
+	Identity  string `yaml:"Identity"`
+	QueueSize int    `yaml:"QueueSize"`
 }
 
 func LoadConfig(filePath string) error {
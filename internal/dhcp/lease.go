@@ -52,6 +52,36 @@ func (l *Lease) String() string {
 	return fmt.Sprintf("%s: %s - %s: %s expiring at %s", l.Hostname, l.IP.String(), l.ClientId, l.State, l.Expiry.Format("15:04:05"))
 }
 
+// LeaseEventType describes what happened to a lease
+type LeaseEventType int
+
+const (
+	LeaseBound LeaseEventType = iota
+	LeaseReleased
+	LeaseExpired
+)
+
+func (t LeaseEventType) String() string {
+	switch t {
+	case LeaseBound:
+		return "Bound"
+	case LeaseReleased:
+		return "Released"
+	case LeaseExpired:
+		return "Expired"
+	default:
+		return "unknown"
+	}
+}
+
+// LeaseEvent is published whenever a client is bound to an address or loses it. Lease is a copy, so it is safe to keep
+type LeaseEvent struct {
+	Type  LeaseEventType
+	Lease Lease
+}
+
+type LeaseEventHandler func(LeaseEvent)
+
 func (l *Lease) Clear() {
 	l.ClientId = ""
 	l.Hostname = ""
@@ -65,6 +95,7 @@ type LeasePool struct {
 	leases            []*Lease
 	lock              *sync.Mutex
 	reservedAddresses map[string]*Lease
+	handlers          []LeaseEventHandler
 }
 
 func NewLeasePool(startAddr, endAddr net.IP) *LeasePool {
@@ -86,6 +117,36 @@ func NewLeasePool(startAddr, endAddr net.IP) *LeasePool {
 	}
 }
 
+// Subscribe registers a handler for lease events. Handlers are called synchronously, outside of the pool lock
+func (l *LeasePool) Subscribe(handler LeaseEventHandler) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.handlers = append(l.handlers, handler)
+}
+
+// publish hands events to every subscriber. It must not be called with the pool lock held
+func (l *LeasePool) publish(events ...LeaseEvent) {
+	if len(events) == 0 {
+		return
+	}
+	l.lock.Lock()
+	handlers := make([]LeaseEventHandler, len(l.handlers))
+	copy(handlers, l.handlers)
+	l.lock.Unlock()
+
+	for _, event := range events {
+		for _, handler := range handlers {
+			handler(event)
+		}
+	}
+}
+
+func leaseEvent(eventType LeaseEventType, lease *Lease) LeaseEvent {
+	event := LeaseEvent{Type: eventType, Lease: *lease}
+	event.Lease.IP = append(net.IP(nil), lease.IP...)
+	return event
+}
+
 func (l *LeasePool) GetLease(clientId string) *Lease {
 	l.lock.Lock()
 	defer l.lock.Unlock()
@@ -106,17 +167,24 @@ func (l *LeasePool) GetLease(clientId string) *Lease {
 
 func (l *LeasePool) AcceptLease(ls *Lease, ttl time.Duration) {
 	if ls.State == LeaseReserved {
+		// reserved leases never expire in the pool, but the client still has to renew within the TTL
+		event := leaseEvent(LeaseBound, ls)
+		event.Lease.Expiry = time.Now().Add(ttl)
+		l.publish(event)
 		return
 	}
 	l.lock.Lock()
-	defer l.lock.Unlock()
+	var events []LeaseEvent
 	for _, lease := range l.leases {
 		if lease.ClientId == ls.ClientId {
 			lease.State = LeaseActive
 			lease.Expiry = time.Now().Add(ttl)
-			return
+			events = append(events, leaseEvent(LeaseBound, lease))
+			break
 		}
 	}
+	l.lock.Unlock()
+	l.publish(events...)
 }
 
 func (l *LeasePool) UpdateLease(clientId string, ip net.IP) error {
@@ -265,16 +333,21 @@ func (l *LeasePool) LoadLeases(file string, ttl time.Duration) error {
 	}
 
 	l.lock.Lock()
-	defer l.lock.Unlock()
+	var events []LeaseEvent
 	for _, lease := range leases {
 		for j, createdLease := range l.leases {
 			if lease.IP.Equal(createdLease.IP) {
 				*l.leases[j] = *lease
 				log.Debug("restore lease ", l.leases[j])
+				if lease.State == LeaseActive {
+					events = append(events, leaseEvent(LeaseBound, l.leases[j]))
+				}
 			}
 		}
 	}
+	l.lock.Unlock()
 	log.Debugf("loaded %d leases", len(leases))
+	l.publish(events...)
 	return nil
 }
 
@@ -315,16 +388,40 @@ func (l *LeasePool) ReservedLeases() []Lease {
 
 func (l *LeasePool) ReleaseLease(relLease *Lease) {
 	l.lock.Lock()
-	defer l.lock.Unlock()
-	if _, ok := l.reservedAddresses[relLease.ClientId]; ok {
-		delete(l.reservedAddresses, relLease.ClientId)
-		delete(config.Config.DHCP.ReservedAddresses, relLease.ClientId)
+	// relLease is usually one of the pool's own leases, so take the ID before clearing it
+	clientId := relLease.ClientId
+	var events []LeaseEvent
+	if reserved, ok := l.reservedAddresses[clientId]; ok {
+		events = append(events, leaseEvent(LeaseReleased, reserved))
+		delete(l.reservedAddresses, clientId)
+		delete(config.Config.DHCP.ReservedAddresses, clientId)
 		config.UpdateConfig()
-		return
+	} else if clientId != "" {
+		for _, lease := range l.leases {
+			if strings.EqualFold(clientId, lease.ClientId) {
+				events = append(events, leaseEvent(LeaseReleased, lease))
+				lease.Clear()
+			}
+		}
 	}
+	l.lock.Unlock()
+	l.publish(events...)
+}
+
+// ExpireLeases frees every active lease that has passed its expiry and publishes an expired event for each of them
+func (l *LeasePool) ExpireLeases(now time.Time) []Lease {
+	l.lock.Lock()
+	var events []LeaseEvent
+	var expired []Lease
 	for _, lease := range l.leases {
-		if strings.EqualFold(relLease.ClientId, lease.ClientId) {
+		if lease.State == LeaseActive && now.After(lease.Expiry) {
+			event := leaseEvent(LeaseExpired, lease)
+			events = append(events, event)
+			expired = append(expired, event.Lease)
 			lease.Clear()
 		}
 	}
+	l.lock.Unlock()
+	l.publish(events...)
+	return expired
 }
@@ -105,3 +105,53 @@ func TestLeasePoolReserveLease(t *testing.T) {
 		t.Errorf("expected state Reserved, got %v", lease.State)
 	}
 }
+
+func TestLeasePoolPublishesLeaseEvents(t *testing.T) {
+	pool := NewLeasePool(net.ParseIP("192.168.1.100").To4(), net.ParseIP("192.168.1.110").To4())
+	var events []LeaseEvent
+	pool.Subscribe(func(event LeaseEvent) {
+		events = append(events, event)
+	})
+
+	lease := pool.NextAvailableLease("00:11:22:33:44:55")
+	lease.Hostname = "laptop"
+	pool.AcceptLease(lease, time.Minute)
+	pool.ReleaseLease(lease)
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if events[0].Type != LeaseBound || events[0].Lease.Hostname != "laptop" || !events[0].Lease.IP.Equal(net.ParseIP("192.168.1.100")) {
+		t.Errorf("unexpected bound event %v %s", events[0].Type, &events[0].Lease)
+	}
+	if events[1].Type != LeaseReleased || events[1].Lease.ClientId != "00:11:22:33:44:55" {
+		t.Errorf("unexpected released event %v %s", events[1].Type, &events[1].Lease)
+	}
+}
+
+func TestLeasePoolExpireLeases(t *testing.T) {
+	pool := NewLeasePool(net.ParseIP("192.168.1.100").To4(), net.ParseIP("192.168.1.110").To4())
+	var events []LeaseEvent
+	pool.Subscribe(func(event LeaseEvent) {
+		events = append(events, event)
+	})
+
+	lease := pool.NextAvailableLease("00:11:22:33:44:55")
+	lease.Hostname = "laptop"
+	pool.AcceptLease(lease, time.Minute)
+	events = nil
+
+	if expired := pool.ExpireLeases(time.Now()); len(expired) != 0 {
+		t.Fatalf("expected no expired leases, got %d", len(expired))
+	}
+	expired := pool.ExpireLeases(time.Now().Add(time.Minute * 2))
+	if len(expired) != 1 || expired[0].Hostname != "laptop" {
+		t.Fatalf("expected the lease to expire, got %v", expired)
+	}
+	if len(events) != 1 || events[0].Type != LeaseExpired {
+		t.Errorf("expected an expired event, got %v", events)
+	}
+	if lease.State != LeaseAvailable {
+		t.Errorf("expected expired lease to be available, got %v", lease.State)
+	}
+}
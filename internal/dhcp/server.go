@@ -19,6 +19,8 @@ import (
 
 const (
 	dhcpServerPort = 67
+	// how often active leases are checked for expiry
+	leaseSweepInterval = time.Second * 10
 )
 
 var (
@@ -31,7 +33,7 @@ var (
 	opCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "dhcp_op_counter",
 		Help: "Count by type of operations",
-	}, []string{"op", "client", "hostname"})
+	}, []string{"op"})
 
 	activeLeaseGauge = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "dhcp_active_lease_count",
@@ -178,6 +180,7 @@ func (z *DHCPServer) Start() error {
 	z.packetConn = packetConn
 	log.Debug("listen on ", z.interfaceAddr.String())
 	go z.listen()
+	go z.expireLeases()
 	for i := 0; i < 10; i++ {
 		go z.receivePacketWorker()
 		go z.responsePacketWorker()
@@ -249,22 +252,35 @@ func (z *DHCPServer) listen() {
 	}
 }
 
+// expireLeases periodically frees leases that were not renewed in time so subscribers learn about them
+func (z *DHCPServer) expireLeases() {
+	ticker := time.NewTicker(leaseSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-z.stopChan:
+			return
+		case now := <-ticker.C:
+			for _, lease := range z.issuedLeases.ExpireLeases(now) {
+				log.Infof("lease %s for %s expired", lease.IP.To4().String(), lease.ClientId)
+				activeLeaseGauge.Dec()
+			}
+		}
+	}
+}
+
 func (z *DHCPServer) receivePacketWorker() {
 	for req := range z.requestChan {
 		tsStart := time.Now()
 		resp := z.handleRequest(req)
 		opts := ParseOptions(req.Message)
-		host := req.Message.CHAddr().String()
-		if opts[OptionHostname] != nil {
-			host = string(opts[OptionHostname])
-		}
-		opCounter.With(prometheus.Labels{"op": DHCPMessageType(opts[OptionDHCPMessageType][0]).String(), "client": req.Message.CHAddr().String(), "hostname": host}).Inc()
+		opCounter.With(prometheus.Labels{"op": DHCPMessageType(opts[OptionDHCPMessageType][0]).String()}).Inc()
 		if resp != nil {
 			z.responseChan <- &DHCPPacket{
 				Message:      resp,
 				ResponseAddr: req.ResponseAddr,
 			}
-			opCounter.With(prometheus.Labels{"op": DHCPMessageType(ParseOptions(resp)[OptionDHCPMessageType][0]).String(), "client": req.Message.CHAddr().String(), "hostname": host}).Inc()
+			opCounter.With(prometheus.Labels{"op": DHCPMessageType(ParseOptions(resp)[OptionDHCPMessageType][0]).String()}).Inc()
 		}
 		tsEnd := time.Since(tsStart).Round(time.Millisecond)
 		reqDuration.Observe(float64(tsEnd.Milliseconds()))
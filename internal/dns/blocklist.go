@@ -68,7 +68,7 @@ func (f *HTTPBlocklistFetcher) Fetch(url string) ([]string, error) {
 		return nil, ErrInvalidBlocklistFormat
 	}
 
-	return hosts, nil
+	return normalizeDomains(hosts), nil
 }
 
 type FileBlocklistFetcher struct{}
@@ -85,5 +85,5 @@ func (f *FileBlocklistFetcher) Fetch(url string) ([]string, error) {
 		return nil, ErrInvalidBlocklistFormat
 	}
 
-	return hosts, nil
+	return normalizeDomains(hosts), nil
 }
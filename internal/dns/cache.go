@@ -0,0 +1,51 @@
+package dns
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dnsCache holds upstream answers until their TTL runs out. It has its own lock so that reading it never waits on
+// changes to the resolver's local data
+type dnsCache struct {
+	lock  sync.RWMutex
+	items map[string]*DNSCacheItem
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{items: make(map[string]*DNSCacheItem)}
+}
+
+func cacheKey(domain string, dnsType DNSType) string {
+	return domain + "|" + dnsType.String()
+}
+
+// get returns the cached answer for key if it has not expired by now, removing it if it has
+func (c *dnsCache) get(key string, now time.Time) (*DNSCacheItem, bool) {
+	c.lock.RLock()
+	item, ok := c.items[key]
+	c.lock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	if item.ttl.After(now) {
+		return item, true
+	}
+
+	log.Debugf("removing expired cache item for %s", key)
+	c.lock.Lock()
+	// another query may have refreshed the answer in the meantime
+	if c.items[key] == item {
+		delete(c.items, key)
+	}
+	c.lock.Unlock()
+	return nil, false
+}
+
+func (c *dnsCache) set(key string, item *DNSCacheItem) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.items[key] = item
+}
@@ -0,0 +1,66 @@
+package dns
+
+import (
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// parseNetworks turns a list of addresses and CIDRs into networks, a bare address being a network of one. Invalid
+// entries are logged as the given kind of entry and skipped
+func parseNetworks(entries []string, kind string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				log.Warnf("ignoring invalid %s %s", kind, entry)
+				continue
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Warnf("ignoring invalid %s %s: %v", kind, entry, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// clientGroups are named sets of clients that policies such as safe search can be applied to
+type clientGroups map[string][]*net.IPNet
+
+func newClientGroups(groups map[string][]string) clientGroups {
+	parsed := make(clientGroups, len(groups))
+	for name, members := range groups {
+		parsed[name] = parseNetworks(members, "member of client group "+name)
+	}
+	return parsed
+}
+
+// contains reports whether client is a member of any of the named groups
+func (g clientGroups) contains(client net.IP, names []string) bool {
+	if client == nil {
+		return false
+	}
+	for _, name := range names {
+		networks, ok := g[name]
+		if !ok {
+			continue
+		}
+		for _, network := range networks {
+			if network.Contains(client) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	networks := parseNetworks([]string{"192.168.1.10", "10.0.0.0/8", "::1", "not-an-address", "10.0.0.0/99"}, "test entry")
+	if len(networks) != 3 {
+		t.Fatalf("expected invalid entries to be skipped, got %v", networks)
+	}
+	tests := map[string]bool{"192.168.1.10": true, "192.168.1.11": false, "10.20.30.40": true, "::1": true}
+	for ip, expected := range tests {
+		found := false
+		for _, network := range networks {
+			found = found || network.Contains(net.ParseIP(ip))
+		}
+		if found != expected {
+			t.Errorf("%s: expected match %t", ip, expected)
+		}
+	}
+}
+
+func TestClientGroups_Contains(t *testing.T) {
+	groups := newClientGroups(map[string][]string{
+		"kids":   {"192.168.1.0/28"},
+		"guests": {"192.168.2.0/24", "fd00::/64"},
+	})
+
+	tests := []struct {
+		client   string
+		names    []string
+		expected bool
+	}{
+		{"192.168.1.5", []string{"kids"}, true},
+		{"192.168.1.50", []string{"kids"}, false},
+		{"192.168.2.7", []string{"kids", "guests"}, true},
+		{"fd00::10", []string{"guests"}, true},
+		{"192.168.1.5", []string{"unknown"}, false},
+		{"192.168.1.5", nil, false},
+	}
+	for _, tt := range tests {
+		if groups.contains(net.ParseIP(tt.client), tt.names) != tt.expected {
+			t.Errorf("%s in %v: expected %t", tt.client, tt.names, tt.expected)
+		}
+	}
+	if groups.contains(nil, []string{"kids"}) {
+		t.Error("expected an unknown client to be in no group")
+	}
+}
@@ -0,0 +1,45 @@
+package dns
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var cloakedDomainCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "dns_cloaked_domain_count",
+	Help: "count of queries blocked because their CNAME chain led to a blocked domain",
+}, []string{"domain", "cname"})
+
+// cnameChain follows the CNAME records in answers from domain, returning the names it passes through in order. Loops
+// are cut short at the first name seen twice
+func cnameChain(domain string, answers []*DNSRecord) []string {
+	targets := make(map[string]string)
+	for _, answer := range answers {
+		if answer.Type == DNSTypeCNAME && answer.ParsedRData != "" {
+			targets[canonicalName(answer.ParsedName)] = canonicalName(answer.ParsedRData)
+		}
+	}
+	var chain []string
+	seen := map[string]bool{canonicalName(domain): true}
+	for current := canonicalName(domain); ; {
+		target, ok := targets[current]
+		if !ok || seen[target] {
+			return chain
+		}
+		seen[target] = true
+		chain = append(chain, target)
+		current = target
+	}
+}
+
+// cloakedBy returns the part of the CNAME chain in answers up to and including the first blocked name, or nil if
+// nothing in the chain is blocked. Trackers hide behind first party names this way
+func (r *DNSResolver) cloakedBy(domain string, answers []*DNSRecord) []string {
+	chain := cnameChain(domain, answers)
+	for i, name := range chain {
+		if _, blocked := r.blacklist[name]; blocked {
+			return chain[:i+1]
+		}
+	}
+	return nil
+}
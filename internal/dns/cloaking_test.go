@@ -0,0 +1,88 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func cnameRecord(name, target string) *DNSRecord {
+	return &DNSRecord{
+		ParsedName:  name,
+		Name:        stringToDNSWireFormat(name),
+		Type:        DNSTypeCNAME,
+		Class:       DNSClassIN,
+		TTL:         300,
+		RData:       stringToDNSWireFormat(target),
+		ParsedRData: target,
+	}
+}
+
+// addressRecord is an A record for an IPv4 address and an AAAA record otherwise
+func addressRecord(name string, ip net.IP) *DNSRecord {
+	dnsType, data := DNSTypeAAAA, ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		dnsType, data = DNSTypeA, ip4
+	}
+	return &DNSRecord{Name: stringToDNSWireFormat(name), ParsedName: name, Type: dnsType, Class: DNSClassIN, TTL: 300, RData: data}
+}
+
+func TestCNAMEChain(t *testing.T) {
+	answers := []*DNSRecord{
+		{ParsedName: "c.tracker.net", Type: DNSTypeA, RData: []byte{10, 0, 0, 1}},
+		cnameRecord("b.cdn.net", "c.tracker.net"),
+		cnameRecord("Metrics.Example.com", "b.cdn.net."),
+	}
+	chain := cnameChain("metrics.example.com", answers)
+	if len(chain) != 2 || chain[0] != "b.cdn.net" || chain[1] != "c.tracker.net" {
+		t.Errorf("expected the chain in order, got %v", chain)
+	}
+
+	loop := []*DNSRecord{cnameRecord("a.example.com", "b.example.com"), cnameRecord("b.example.com", "a.example.com")}
+	if chain := cnameChain("a.example.com", loop); len(chain) != 1 {
+		t.Errorf("expected the loop to be cut short, got %v", chain)
+	}
+}
+
+func TestDNSResolver_CNAMECloaking(t *testing.T) {
+	resolver := NewDNSResolverWithOpts(ResolverOpts{Upstreams: []string{}})
+	resolver.AddBlocklistEntries([]string{"c.tracker.net"})
+	resolver.cache.set("metrics.example.com|A", &DNSCacheItem{
+		records: []*DNSRecord{
+			cnameRecord("metrics.example.com", "b.cdn.net"),
+			cnameRecord("b.cdn.net", "c.tracker.net"),
+			{ParsedName: "c.tracker.net", Name: stringToDNSWireFormat("c.tracker.net"), Type: DNSTypeA, Class: DNSClassIN, RData: []byte{10, 0, 0, 1}},
+		},
+		ttl: time.Now().Add(time.Minute),
+	})
+	resolver.cache.set("www.example.com|A", &DNSCacheItem{
+		records: []*DNSRecord{
+			cnameRecord("www.example.com", "b.cdn.net"),
+			{ParsedName: "b.cdn.net", Name: stringToDNSWireFormat("b.cdn.net"), Type: DNSTypeA, Class: DNSClassIN, RData: []byte{10, 0, 0, 2}},
+		},
+		ttl: time.Now().Add(time.Minute),
+	})
+
+	answers, _, err := resolver.Resolve("metrics.example.com", DNSTypeA)
+	if err != nil || len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.IPv4zero) {
+		t.Errorf("expected the cloaked tracker to be blocked, got %v (%v)", answers, err)
+	}
+	if answers, _, err := resolver.Resolve("www.example.com", DNSTypeA); err != nil || len(answers) != 2 {
+		t.Errorf("expected chains without a blocked name to be answered, got %v (%v)", answers, err)
+	}
+}
+
+func TestDNSResolver_CNAMECloakingPassthru(t *testing.T) {
+	resolver := NewDNSResolverWithOpts(ResolverOpts{Upstreams: []string{}})
+	resolver.AddBlocklistEntries([]string{"c.tracker.net"})
+	records, _ := parseZoneFile("metrics.example.com CNAME rpz-passthru.\n", "allow.rpz")
+	resolver.SetResponsePolicyZone(NewResponsePolicyZone("allow.rpz", records))
+	resolver.cache.set("metrics.example.com|A", &DNSCacheItem{
+		records: []*DNSRecord{cnameRecord("metrics.example.com", "c.tracker.net")},
+		ttl:     time.Now().Add(time.Minute),
+	})
+
+	if answers, _, err := resolver.Resolve("metrics.example.com", DNSTypeA); err != nil || len(answers) != 1 || answers[0].Type != DNSTypeCNAME {
+		t.Errorf("expected passthru to exempt the name, got %v (%v)", answers, err)
+	}
+}
@@ -0,0 +1,53 @@
+package dns
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var coalescedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dns_coalesced_query_count",
+	Help: "count of queries that shared the upstream answer of an identical query already in flight",
+})
+
+// upstreamCoalescer lets identical upstream lookups that overlap in time share the work of the first one, so a burst of
+// queries for a name that is not cached sends a single query upstream
+type upstreamCoalescer struct {
+	lock  sync.Mutex
+	calls map[string]*upstreamCall
+}
+
+type upstreamCall struct {
+	done chan struct{}
+	res  upstreamResult
+}
+
+func newUpstreamCoalescer() *upstreamCoalescer {
+	return &upstreamCoalescer{calls: make(map[string]*upstreamCall)}
+}
+
+// do runs fn for key, unless a call for the same key is already running, in which case it waits for that call and
+// returns its result instead
+func (c *upstreamCoalescer) do(key string, fn func() upstreamResult) upstreamResult {
+	c.lock.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.lock.Unlock()
+		coalescedCounter.Inc()
+		<-call.done
+		return call.res
+	}
+	call := &upstreamCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		delete(c.calls, key)
+		c.lock.Unlock()
+		close(call.done)
+	}()
+	call.res = fn()
+	return call.res
+}
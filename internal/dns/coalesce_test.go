@@ -0,0 +1,65 @@
+package dns
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamCoalescer_SharesInflightCall(t *testing.T) {
+	coalescer := newUpstreamCoalescer()
+	release := make(chan struct{})
+	var calls int32
+
+	var wg sync.WaitGroup
+	results := make([]upstreamResult, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = coalescer.do("example.com|A", func() upstreamResult {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return upstreamResult{upstream: net.ParseIP("1.1.1.1")}
+			})
+		}(i)
+	}
+	// let every caller reach the coalescer before the first call finishes
+	for {
+		coalescer.lock.Lock()
+		_, running := coalescer.calls["example.com|A"]
+		coalescer.lock.Unlock()
+		if running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(time.Millisecond * 20)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("expected a single upstream call, got %d", calls)
+	}
+	for i, res := range results {
+		if !res.upstream.Equal(net.ParseIP("1.1.1.1")) {
+			t.Errorf("caller %d: expected the shared result, got %v", i, res)
+		}
+	}
+}
+
+func TestUpstreamCoalescer_SeparateKeys(t *testing.T) {
+	coalescer := newUpstreamCoalescer()
+	var calls int32
+	for _, key := range []string{"example.com|A", "example.com|AAAA", "example.com|A"} {
+		coalescer.do(key, func() upstreamResult {
+			atomic.AddInt32(&calls, 1)
+			return upstreamResult{}
+		})
+	}
+	if calls != 3 {
+		t.Errorf("expected calls that do not overlap to run on their own, got %d", calls)
+	}
+}
@@ -0,0 +1,172 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// compression pointers have 14 bits for the offset, names written any further into a message can't be pointed to
+const maxCompressionOffset = 0x3fff
+
+// nameCompressor remembers where in a message every name and suffix of a name was written, so a later name that ends
+// the same way can point back at it instead of repeating it (RFC 1035 4.1.4). A nil compressor writes names out in full
+type nameCompressor struct {
+	start int            // where the message starts in the buffer, pointers are relative to it
+	names map[string]int // lower cased name to its offset in the message
+}
+
+func newNameCompressor(start int) *nameCompressor {
+	return &nameCompressor{start: start, names: make(map[string]int)}
+}
+
+// appendName appends name in wire format to buf, ending it with a pointer to an earlier copy of its longest suffix
+// already in the message
+func (c *nameCompressor) appendName(buf []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, fmt.Errorf("domain name %s is too long", name)
+	}
+	for name != "" {
+		var key string
+		if c != nil {
+			// names compare case insensitively, ToLower does not allocate for names that are already lower case
+			key = strings.ToLower(name)
+			if offset, ok := c.names[key]; ok {
+				return binary.BigEndian.AppendUint16(buf, 0xc000|uint16(offset)), nil
+			}
+			if offset := len(buf) - c.start; offset <= maxCompressionOffset {
+				c.names[key] = offset
+			}
+		}
+		label, rest, _ := strings.Cut(name, ".")
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid label %q in %s", label, name)
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+		name = rest
+	}
+	return append(buf, 0), nil
+}
+
+// appendRecord appends record in wire format to buf
+func (c *nameCompressor) appendRecord(buf []byte, record *DNSRecord) ([]byte, error) {
+	var err error
+	if buf, err = c.appendOwner(buf, record); err != nil {
+		return nil, err
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(record.Type))
+	buf = binary.BigEndian.AppendUint16(buf, record.Class)
+	buf = binary.BigEndian.AppendUint32(buf, record.TTL)
+
+	lengthAt := len(buf)
+	buf = append(buf, 0, 0)
+	if buf, err = c.appendRData(buf, record); err != nil {
+		return nil, err
+	}
+	length := len(buf) - lengthAt - 2
+	if length > 0xffff {
+		return nil, fmt.Errorf("data of %s record for %s is too long", record.Type, record.ParsedName)
+	}
+	binary.BigEndian.PutUint16(buf[lengthAt:], uint16(length))
+	return buf, nil
+}
+
+// appendOwner appends the name a record belongs to. The parsed name is the one to trust, the wire name of a record that
+// was built rather than parsed is only used when there is no parsed name
+func (c *nameCompressor) appendOwner(buf []byte, record *DNSRecord) ([]byte, error) {
+	if record.Type == DNSTypeOPT {
+		return append(buf, 0), nil
+	}
+	if record.ParsedName != "" || len(record.Name) == 0 {
+		return c.appendName(buf, record.ParsedName)
+	}
+	name, _, err := parseDNSName(record.Name, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name for %s record: %w", record.Type, err)
+	}
+	return c.appendName(buf, name)
+}
+
+// appendRData appends the data of a record, compressing the names in it where the record type allows
+func (c *nameCompressor) appendRData(buf []byte, record *DNSRecord) ([]byte, error) {
+	prefix, names, compress := rdataNames(record.Type, record.RData)
+	if names == 0 || !compress {
+		return append(buf, record.RData...), nil
+	}
+
+	// data whose names can't be read on their own is sent the way it came
+	start := len(buf)
+	buf = append(buf, record.RData[:prefix]...)
+	offset := prefix
+	for i := 0; i < names; i++ {
+		name, next, err := parseDNSName(record.RData, offset)
+		if err != nil {
+			return append(buf[:start], record.RData...), nil
+		}
+		if buf, err = c.appendName(buf, name); err != nil {
+			return nil, err
+		}
+		offset = next
+	}
+	return append(buf, record.RData[offset:]...), nil
+}
+
+// expandRData returns the data of a record parsed from data with any compressed names in it written out in full, so it
+// still means the same outside the message it came in
+func expandRData(data []byte, offset, length int, recordType DNSType) ([]byte, error) {
+	end := offset + length
+	prefix, names, _ := rdataNames(recordType, data[offset:end])
+	if names == 0 {
+		return append([]byte(nil), data[offset:end]...), nil
+	}
+
+	rdata := make([]byte, 0, length)
+	rdata = append(rdata, data[offset:offset+prefix]...)
+	offset += prefix
+	for i := 0; i < names; i++ {
+		name, next, err := parseDNSName(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next > end {
+			return nil, fmt.Errorf("name in %s record data extends beyond the record", recordType)
+		}
+		var nilCompressor *nameCompressor
+		if rdata, err = nilCompressor.appendName(rdata, name); err != nil {
+			return nil, err
+		}
+		offset = next
+	}
+	return append(rdata, data[offset:end]...), nil
+}
+
+// rdataNames returns how many bytes of rdata come before the names in it, how many names there are and whether they
+// may be compressed. Only the types RFC 1035 defines may be (RFC 3597 4), the names in SRV and NAPTR records are
+// expanded when parsing in case a server compressed them anyway. Names in any other type are left alone
+func rdataNames(recordType DNSType, rdata []byte) (prefix, names int, compress bool) {
+	switch recordType {
+	case DNSTypeCNAME, DNSTypeNS, DNSTypePTR:
+		names, compress = 1, true
+	case DNSTypeSOA:
+		names, compress = 2, true
+	case DNSTypeMX:
+		prefix, names, compress = 2, 1, true
+	case DNSTypeSRV:
+		prefix, names = 6, 1
+	case DNSTypeNAPTR:
+		// order and preference, then the flags, services and regexp character strings
+		prefix, names = 4, 1
+		for i := 0; i < 3 && prefix < len(rdata); i++ {
+			prefix += 1 + int(rdata[prefix])
+		}
+	default:
+		return 0, 0, false
+	}
+	// the empty data of an update that deletes records has no names in it
+	if prefix >= len(rdata) {
+		return 0, 0, false
+	}
+	return prefix, names, compress
+}
@@ -0,0 +1,198 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestMarshalDNSMessage_CompressesNames(t *testing.T) {
+	msg := NewDnsMessage()
+	msg.Header.ID = 0x1234
+	msg.Questions = append(msg.Questions, &DNSQuestion{ParsedName: "WWW.Example.com", Type: DNSTypeA, Class: DNSClassIN})
+	msg.Answers = append(msg.Answers,
+		&DNSRecord{ParsedName: "www.example.com", Type: DNSTypeCNAME, Class: DNSClassIN, TTL: 60, RData: stringToDNSWireFormat("cdn.example.com")},
+		&DNSRecord{ParsedName: "cdn.example.com", Type: DNSTypeA, Class: DNSClassIN, TTL: 60, RData: []byte{93, 184, 216, 34}},
+	)
+	msg.Authorities = append(msg.Authorities,
+		&DNSRecord{ParsedName: "example.com", Type: DNSTypeNS, Class: DNSClassIN, TTL: 60, RData: stringToDNSWireFormat("ns1.example.com")},
+	)
+
+	data, err := MarshalDNSMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// header, the question in full and then only the first label of every name that is new
+	expected := 12 + (17 + 4) + (2 + 10 + 6) + (2 + 10 + 4) + (2 + 10 + 6)
+	if len(data) != expected {
+		t.Errorf("expected %d bytes, got %d", expected, len(data))
+	}
+	// the answer owner names the question in a different case, the pointer still finds it
+	if !bytes.Equal(data[33:35], []byte{0xc0, 0x0c}) {
+		t.Errorf("expected the answer to point at the question, got %x", data[33:35])
+	}
+
+	parsed, err := ParseDNSMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// names share the case of the earlier copy they point at
+	if parsed.Answers[0].ParsedName != "WWW.Example.com" || parsed.Answers[0].ParsedRData != "cdn.Example.com" {
+		t.Errorf("unexpected CNAME %s -> %s", parsed.Answers[0].ParsedName, parsed.Answers[0].ParsedRData)
+	}
+	if parsed.Answers[1].ParsedName != "cdn.Example.com" {
+		t.Errorf("unexpected A record for %s", parsed.Answers[1].ParsedName)
+	}
+	if parsed.Authorities[0].ParsedName != "Example.com" || parsed.Authorities[0].ParsedRData != "ns1.Example.com" {
+		t.Errorf("unexpected NS %s -> %s", parsed.Authorities[0].ParsedName, parsed.Authorities[0].ParsedRData)
+	}
+}
+
+func TestMarshalDNSMessage_LeavesUnknownRDataAlone(t *testing.T) {
+	// TXT data that happens to look like a name must not be compressed
+	text := stringToDNSWireFormat("example.com")
+	msg := NewDnsMessage()
+	msg.Questions = append(msg.Questions, &DNSQuestion{ParsedName: "example.com", Type: DNSTypeTXT, Class: DNSClassIN})
+	msg.Answers = append(msg.Answers, &DNSRecord{ParsedName: "example.com", Type: DNSTypeTXT, Class: DNSClassIN, RData: text})
+
+	data, err := MarshalDNSMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(data, text) {
+		t.Errorf("expected the TXT data as is, got %x", data)
+	}
+}
+
+func TestAppendDNSMessage_PointsRelativeToMessage(t *testing.T) {
+	msg := NewDnsMessage()
+	msg.Questions = append(msg.Questions, &DNSQuestion{ParsedName: "example.com", Type: DNSTypeA, Class: DNSClassIN})
+	msg.Answers = append(msg.Answers, &DNSRecord{ParsedName: "example.com", Type: DNSTypeA, Class: DNSClassIN, RData: []byte{10, 0, 0, 1}})
+
+	data, err := AppendDNSMessage([]byte{0xff, 0xff}, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[:2], []byte{0xff, 0xff}) {
+		t.Errorf("expected the prefix to be kept, got %x", data[:2])
+	}
+	parsed, err := ParseDNSMessage(data[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Answers[0].ParsedName != "example.com" {
+		t.Errorf("expected the answer for example.com, got %s", parsed.Answers[0].ParsedName)
+	}
+}
+
+func TestMarshalDNSMessage_InvalidNames(t *testing.T) {
+	for _, name := range []string{"a..example.com", strings.Repeat("a", 64) + ".com", strings.Repeat("abcdefg.", 40) + "com"} {
+		msg := NewDnsMessage()
+		msg.Questions = append(msg.Questions, &DNSQuestion{ParsedName: name, Type: DNSTypeA, Class: DNSClassIN})
+		if _, err := MarshalDNSMessage(msg); err == nil {
+			t.Errorf("expected %s to be rejected", name)
+		}
+	}
+}
+
+func TestParseDNSMessage_ExpandsRDataNames(t *testing.T) {
+	// an SOA whose names point back into the question
+	data, _ := base64.StdEncoding.DecodeString("u82BgAABAAAAAQAABG1haWwEem9obwNjb20AABwAAcARAAYAAQAAAOAANQNuczEIem9ob2NvcnDAFghkbnNhZG1pbgZ2dGl0YW7AFni0lNkAABwgAAAHCAASdQAAAA4Q")
+	msg, err := ParseDNSMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	soa := msg.Authorities[0]
+	mname, offset, err := parseDNSName(soa.RData, 0)
+	if err != nil || mname != "ns1.zohocorp.com" {
+		t.Fatalf("expected the primary name server in full, got %s (%v)", mname, err)
+	}
+	rname, offset, err := parseDNSName(soa.RData, offset)
+	if err != nil || rname != "dnsadmin.vtitan.com" {
+		t.Fatalf("expected the mailbox in full, got %s (%v)", rname, err)
+	}
+	if len(soa.RData)-offset != 20 {
+		t.Errorf("expected 20 bytes of SOA fields after the names, got %d", len(soa.RData)-offset)
+	}
+	if !bytes.Equal(soa.Name, stringToDNSWireFormat("zoho.com")) {
+		t.Errorf("expected the owner name in full, got %x", soa.Name)
+	}
+}
+
+func FuzzDNSMessageRoundTrip(f *testing.F) {
+	for _, seed := range []string{
+		"xPsBAAABAAAAAAAABmdpdGxhYgNjb20AAAEAAQ==",
+		"xPuBgAABAAEAAAAABmdpdGxhYgNjb20AAAEAAcAMAAEAAQAAAF4ABKxB+04=",
+		"EjSFgAABAAEAAgACB2V4YW1wbGUDY29tAAABAAHADAABAAEAAAEsAARduNgiwAwAAgABAAFRgAAUAWEMaWFuYS1zZXJ2ZXJzA25ldADADAACAAEAAVGAABQBYgxpYW5hLXNlcnZlcnMDbmV0AAFhDGlhbmEtc2VydmVycwNuZXQAAAEAAQABUYAABMcrhzUBYgxpYW5hLXNlcnZlcnMDbmV0AAABAAEAAVGAAATHK4c1",
+		"n8oBIAABAAAAAAABBHRlc3QDY29tAAABAAEAACkE0AAAAAAADAAKAAjkbPIZw7kl8g==",
+		"u82BgAABAAAAAQAABG1haWwEem9obwNjb20AABwAAcARAAYAAQAAAOAANQNuczEIem9ob2NvcnDAFghkbnNhZG1pbgZ2dGl0YW7AFni0lNkAABwgAAAHCAASdQAAAA4Q",
+		"jQOBgAABAAIAAAAACmdhdGVrZWVwZXIHc2xpbWppbQN4eXoAAAEAAcAMAAUAAQAAADwABwRob21lwBfANAABAAEAAAEsAARUUgX0",
+	} {
+		data, _ := base64.StdEncoding.DecodeString(seed)
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ParseDNSMessage(data)
+		if err != nil {
+			return
+		}
+		marshaled, err := MarshalDNSMessage(msg)
+		if err != nil {
+			// labels can hold bytes, such as dots, that the parsed form of a name does not keep apart
+			return
+		}
+		reparsed, err := ParseDNSMessage(marshaled)
+		if err != nil {
+			t.Fatalf("unable to parse marshaled message %x: %v", marshaled, err)
+		}
+		sameRecords := func(section string, a, b []*DNSRecord) {
+			if len(a) != len(b) {
+				t.Fatalf("expected %d %s records, got %d", len(a), section, len(b))
+			}
+			for i := range a {
+				// compression may point a name at an earlier copy in a different case
+				if canonicalName(a[i].ParsedName) != canonicalName(b[i].ParsedName) || a[i].Type != b[i].Type ||
+					a[i].Class != b[i].Class || a[i].TTL != b[i].TTL || !bytes.EqualFold(a[i].RData, b[i].RData) {
+					t.Fatalf("%s record %d changed from %+v to %+v", section, i, a[i], b[i])
+				}
+			}
+		}
+		if len(reparsed.Questions) != len(msg.Questions) {
+			t.Fatalf("expected %d questions, got %d", len(msg.Questions), len(reparsed.Questions))
+		}
+		for i := range msg.Questions {
+			if canonicalName(msg.Questions[i].ParsedName) != canonicalName(reparsed.Questions[i].ParsedName) || msg.Questions[i].Type != reparsed.Questions[i].Type {
+				t.Fatalf("question changed from %+v to %+v", msg.Questions[i], reparsed.Questions[i])
+			}
+		}
+		sameRecords("answer", msg.Answers, reparsed.Answers)
+		sameRecords("authority", msg.Authorities, reparsed.Authorities)
+		sameRecords("additional", msg.Additionals, reparsed.Additionals)
+
+		again, err := MarshalDNSMessage(reparsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(marshaled, again) {
+			t.Fatalf("marshaling is not stable: %x then %x", marshaled, again)
+		}
+	})
+}
+
+func BenchmarkAppendDNSMessage(b *testing.B) {
+	data, _ := base64.StdEncoding.DecodeString("EjSFgAABAAEAAgACB2V4YW1wbGUDY29tAAABAAHADAABAAEAAAEsAARduNgiwAwAAgABAAFRgAAUAWEMaWFuYS1zZXJ2ZXJzA25ldADADAACAAEAAVGAABQBYgxpYW5hLXNlcnZlcnMDbmV0AAFhDGlhbmEtc2VydmVycwNuZXQAAAEAAQABUYAABMcrhzUBYgxpYW5hLXNlcnZlcnMDbmV0AAABAAEAAVGAAATHK4c1")
+	msg, err := ParseDNSMessage(data)
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 0, 512)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if buf, err = AppendDNSMessage(buf[:0], msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var dns64Counter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dns_dns64_synthesized_count",
+	Help: "count of AAAA answers synthesized from A records for DNS64 clients",
+})
+
+// DefaultDNS64Prefix is the well-known prefix of RFC 6052 that NAT64 gateways translate by default
+const DefaultDNS64Prefix = "64:ff9b::/96"
+
+type DNS64Opts struct {
+	Prefix    string   // the /96 prefix IPv4 addresses are embedded in, DefaultDNS64Prefix when empty
+	Enabled   bool     // synthesize for every client
+	Groups    []string // client groups to synthesize for when it is not enabled for everyone
+	Listeners []string // addresses the server listens on whose clients are all synthesized for
+	Exclude   []string // further IPv4 ranges not to synthesize from, and IPv6 ranges of AAAA records to ignore
+}
+
+// the IPv4 ranges no NAT64 gateway can reach, RFC 6147 5.1.4 and RFC 6890
+var dns64AlwaysExcluded = parseNetworks([]string{
+	"0.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16", "224.0.0.0/4", "240.0.0.0/4",
+}, "DNS64 exclusion")
+
+// the ranges the well-known prefix must not be used with, they are not global, RFC 6052 3.1
+var dns64WellKnownExcluded = parseNetworks([]string{
+	"10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16",
+	"198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24",
+}, "DNS64 exclusion")
+
+// dns64Policy synthesizes AAAA records for clients on IPv6-only networks behind a NAT64 gateway, RFC 6147. A nil policy
+// synthesizes nothing
+type dns64Policy struct {
+	prefix    net.IP // only the first 12 bytes are the prefix
+	reverse   string // the ip6.arpa name of the prefix
+	all       bool
+	groups    []string
+	listeners []net.IP
+	exclude   []*net.IPNet
+}
+
+func newDNS64Policy(opts *DNS64Opts) *dns64Policy {
+	if opts == nil || (!opts.Enabled && len(opts.Groups) == 0 && len(opts.Listeners) == 0) {
+		return nil
+	}
+	prefix := opts.Prefix
+	if prefix == "" {
+		prefix = DefaultDNS64Prefix
+	}
+	ip, network, err := net.ParseCIDR(prefix)
+	if ones, _ := maskSize(network); err != nil || ip.To4() != nil || ones != 96 {
+		log.Warnf("invalid DNS64 prefix %s, using %s", prefix, DefaultDNS64Prefix)
+		_, network, _ = net.ParseCIDR(DefaultDNS64Prefix)
+	}
+
+	exclude := slices.Concat(dns64AlwaysExcluded, parseNetworks(opts.Exclude, "DNS64 exclusion"))
+	if wellKnown, _, _ := net.ParseCIDR(DefaultDNS64Prefix); network.IP.Equal(wellKnown) {
+		exclude = append(exclude, dns64WellKnownExcluded...)
+	}
+	var listeners []net.IP
+	for _, listener := range opts.Listeners {
+		host, _, err := net.SplitHostPort(listener)
+		if err != nil {
+			host = strings.Trim(listener, "[]")
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			listeners = append(listeners, ip)
+		} else {
+			log.Warnf("ignoring invalid DNS64 listener %s", listener)
+		}
+	}
+
+	var reverse strings.Builder
+	for i := 11; i >= 0; i-- {
+		fmt.Fprintf(&reverse, "%x.%x.", network.IP[i]&0x0f, network.IP[i]>>4)
+	}
+	reverse.WriteString("ip6.arpa")
+	return &dns64Policy{
+		prefix:    network.IP,
+		reverse:   reverse.String(),
+		all:       opts.Enabled,
+		groups:    opts.Groups,
+		listeners: listeners,
+		exclude:   exclude,
+	}
+}
+
+// dns64WildcardAddrs returns the listen addresses DNS64 listeners can never match on. A socket bound to the unspecified
+// address reports that address for every query, not the one the client sent the query to
+func dns64WildcardAddrs(opts *DNS64Opts, addrs []string) []string {
+	if opts == nil || len(opts.Listeners) == 0 {
+		return nil
+	}
+	var wildcards []string
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			wildcards = append(wildcards, addr)
+		}
+	}
+	return wildcards
+}
+
+func maskSize(network *net.IPNet) (ones, bits int) {
+	if network == nil {
+		return 0, 0
+	}
+	return network.Mask.Size()
+}
+
+// appliesTo reports whether query gets synthesized answers, by the client that asked or the address it asked on
+func (p *dns64Policy) appliesTo(query Query, groups clientGroups) bool {
+	if p == nil {
+		return false
+	}
+	if p.all || groups.contains(query.Client, p.groups) {
+		return true
+	}
+	for _, listener := range p.listeners {
+		if listener.Equal(query.Listener) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *dns64Policy) excluded(ip net.IP) bool {
+	for _, network := range p.exclude {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// nativeAnswers returns the answers to an AAAA query without the AAAA records in excluded ranges, and whether any AAAA
+// records are left, in which case the answer is used as it is
+func (p *dns64Policy) nativeAnswers(answers []*DNSRecord) ([]*DNSRecord, bool) {
+	kept := make([]*DNSRecord, 0, len(answers))
+	found := false
+	for _, answer := range answers {
+		if answer.Type == DNSTypeAAAA {
+			// IPv4-mapped addresses are no IPv6 connectivity, a name with only those gets synthesized records
+			if ip := net.IP(answer.RData); ip.To4() != nil || p.excluded(ip) {
+				continue
+			}
+			found = true
+		}
+		kept = append(kept, answer)
+	}
+	return kept, found
+}
+
+// synthesize turns the answers to an A query into the answers to the AAAA query, embedding each address in the prefix.
+// The CNAME records leading to the addresses are kept, and no record lives longer than ttl
+func (p *dns64Policy) synthesize(answers []*DNSRecord, ttl uint32) []*DNSRecord {
+	synthesized := make([]*DNSRecord, 0, len(answers))
+	found := false
+	for _, answer := range answers {
+		if answer.Type != DNSTypeA {
+			synthesized = append(synthesized, answer)
+			continue
+		}
+		ip := net.IP(answer.RData).To4()
+		if ip == nil || p.excluded(ip) {
+			continue
+		}
+		found = true
+		// the cached A record is shared, the synthesized record is a new one
+		synthesized = append(synthesized, &DNSRecord{
+			Name:       answer.Name,
+			ParsedName: answer.ParsedName,
+			Type:       DNSTypeAAAA,
+			Class:      answer.Class,
+			TTL:        min(answer.TTL, ttl),
+			RData:      append(append(make([]byte, 0, net.IPv6len), p.prefix[:12]...), ip...),
+		})
+	}
+	if !found {
+		return nil
+	}
+	dns64Counter.Inc()
+	return synthesized
+}
+
+// reverseTarget returns the in-addr.arpa name a reverse lookup of a synthesized address is answered from, RFC 6147 5.3.1
+func (p *dns64Policy) reverseTarget(domain string) (string, bool) {
+	nibbles, ok := strings.CutSuffix(domain, "."+p.reverse)
+	if !ok {
+		return "", false
+	}
+	// the 8 nibbles of the embedded address, least significant first
+	labels := strings.Split(nibbles, ".")
+	if len(labels) != 8 {
+		return "", false
+	}
+	var ip [4]byte
+	for i, label := range labels {
+		nibble, err := strconv.ParseUint(label, 16, 8)
+		if err != nil || len(label) != 1 {
+			return "", false
+		}
+		ip[3-i/2] |= byte(nibble) << (4 * (i % 2))
+	}
+	return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip[3], ip[2], ip[1], ip[0]), true
+}
+
+// negativeTTL is how long the synthesized answers may be cached for, the negative caching time of the AAAA query or
+// 600 seconds when the upstream did not say, RFC 6147 5.1.7
+func negativeTTL(authorities []*DNSRecord) uint32 {
+	for _, authority := range authorities {
+		if authority.Type != DNSTypeSOA {
+			continue
+		}
+		if data, err := authority.Data(); err == nil {
+			return min(authority.TTL, data.(*SOARData).Minimum)
+		}
+	}
+	return 600
+}
+
+// resolveDNS64 answers an AAAA query for a DNS64 client. A name with AAAA records of its own gets those, otherwise the
+// answer is synthesized from its A records, which is never authoritative
+func (r *DNSResolver) resolveDNS64(query Query) (answers, authorities []*DNSRecord, authoritative bool, err error) {
+	answers, authorities, authoritative, err = r.resolve(query)
+	switch {
+	case err == ErrNxDomain || err == ErrQueryDropped:
+		// a name that does not exist has no A records either
+		return answers, authorities, authoritative, err
+	case err == nil:
+		native, ok := r.dns64.nativeAnswers(answers)
+		if ok {
+			return native, authorities, authoritative, nil
+		}
+	}
+	// any other failure is treated as the name having no AAAA records, RFC 6147 5.1.3
+
+	addrQuery := query
+	addrQuery.Type = DNSTypeA
+	addrAnswers, _, _, addrErr := r.resolve(addrQuery)
+	if addrErr != nil {
+		return answers, authorities, authoritative, err
+	}
+	synthesized := r.dns64.synthesize(addrAnswers, negativeTTL(authorities))
+	if synthesized == nil {
+		return answers, authorities, authoritative, err
+	}
+	log.Debugf("synthesized AAAA records for %s from its A records", query.Domain)
+	return synthesized, nil, false, nil
+}
@@ -0,0 +1,212 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func dns64Resolver(opts *DNS64Opts) *DNSResolver {
+	return NewDNSResolverWithOpts(ResolverOpts{
+		Upstreams:    []string{},
+		ClientGroups: map[string][]string{"nat64": {"2001:db8:1::/64"}},
+		DNS64:        opts,
+	})
+}
+
+func cacheRecords(resolver *DNSResolver, domain string, dnsType DNSType, records ...*DNSRecord) {
+	resolver.cache.set(cacheKey(domain, dnsType), &DNSCacheItem{records: records, ttl: time.Now().Add(time.Minute)})
+}
+
+func TestDNS64Policy(t *testing.T) {
+	groups := newClientGroups(map[string][]string{"nat64": {"2001:db8:1::/64"}})
+	inGroup, outside := net.ParseIP("2001:db8:1::10"), net.ParseIP("2001:db8:2::10")
+
+	if newDNS64Policy(nil) != nil || newDNS64Policy(&DNS64Opts{Prefix: "64:ff9b::/96"}) != nil {
+		t.Error("expected no policy when DNS64 is not enabled for anyone")
+	}
+
+	policy := newDNS64Policy(&DNS64Opts{Groups: []string{"nat64"}, Listeners: []string{"[2001:db8::53]:53"}})
+	if !policy.appliesTo(Query{Client: inGroup}, groups) {
+		t.Error("expected DNS64 for the group")
+	}
+	if policy.appliesTo(Query{Client: outside, Listener: net.ParseIP("2001:db8::1")}, groups) {
+		t.Error("expected clients outside the group to be left alone")
+	}
+	if !policy.appliesTo(Query{Client: outside, Listener: net.ParseIP("2001:db8::53")}, groups) {
+		t.Error("expected DNS64 for clients of the listener")
+	}
+
+	// a prefix that is not a /96 falls back to the well-known prefix
+	if policy := newDNS64Policy(&DNS64Opts{Enabled: true, Prefix: "2001:db8::/64"}); !policy.prefix.Equal(net.ParseIP("64:ff9b::")) {
+		t.Errorf("expected the well-known prefix, got %s", policy.prefix)
+	}
+	if policy := newDNS64Policy(&DNS64Opts{Enabled: true, Prefix: "not a prefix"}); !policy.prefix.Equal(net.ParseIP("64:ff9b::")) {
+		t.Errorf("expected the well-known prefix, got %s", policy.prefix)
+	}
+}
+
+func TestDNS64Policy_Exclusions(t *testing.T) {
+	wellKnown := newDNS64Policy(&DNS64Opts{Enabled: true})
+	local := newDNS64Policy(&DNS64Opts{Enabled: true, Prefix: "2001:db8:64::/96", Exclude: []string{"198.51.100.0/24", "2001:db8:dead::/48"}})
+
+	tests := []struct {
+		ip        string
+		wellKnown bool
+		local     bool
+	}{
+		{"93.184.216.34", false, false},
+		{"127.0.0.1", true, true},
+		{"169.254.1.1", true, true},
+		{"224.0.0.251", true, true},
+		{"0.0.0.0", true, true},
+		{"192.168.1.10", true, false},
+		{"100.64.0.1", true, false},
+		{"198.51.100.7", true, true},
+		{"2001:db8:dead::1", false, true},
+		{"2001:db8::1", false, false},
+	}
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		if excluded := wellKnown.excluded(ip); excluded != test.wellKnown {
+			t.Errorf("%s: expected excluded %v with the well-known prefix, got %v", test.ip, test.wellKnown, excluded)
+		}
+		if excluded := local.excluded(ip); excluded != test.local {
+			t.Errorf("%s: expected excluded %v with a local prefix, got %v", test.ip, test.local, excluded)
+		}
+	}
+}
+
+func TestDNS64WildcardAddrs(t *testing.T) {
+	opts := &DNS64Opts{Listeners: []string{"2001:db8:64::1"}}
+	addrs := []string{":53", "0.0.0.0:53", "[::]:53", "192.168.1.1:53", "[2001:db8:64::1]:53"}
+	if wildcards := dns64WildcardAddrs(opts, addrs); len(wildcards) != 3 || wildcards[0] != ":53" || wildcards[2] != "[::]:53" {
+		t.Errorf("expected the unspecified addresses, got %v", wildcards)
+	}
+	if wildcards := dns64WildcardAddrs(&DNS64Opts{Enabled: true}, addrs); wildcards != nil {
+		t.Errorf("expected no warning without listeners, got %v", wildcards)
+	}
+	if wildcards := dns64WildcardAddrs(nil, addrs); wildcards != nil {
+		t.Errorf("expected no warning without DNS64, got %v", wildcards)
+	}
+}
+
+// the ip6.arpa name of the well-known prefix
+const wellKnownReverse = "0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.b.9.f.f.4.6.0.0.ip6.arpa"
+
+func TestDNS64Policy_ReverseTarget(t *testing.T) {
+	policy := newDNS64Policy(&DNS64Opts{Enabled: true})
+	if policy.reverse != wellKnownReverse {
+		t.Fatalf("unexpected reverse name of the prefix %s", policy.reverse)
+	}
+	target, ok := policy.reverseTarget("2.2.8.d.8.b.d.5." + wellKnownReverse)
+	if !ok || target != "34.216.184.93.in-addr.arpa" {
+		t.Errorf("expected the embedded address, got %q", target)
+	}
+	for _, name := range []string{
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa",
+		"22.8d.8b.d5." + wellKnownReverse,
+		"2.2.8.d.8.b.x.5." + wellKnownReverse,
+		wellKnownReverse,
+	} {
+		if target, ok := policy.reverseTarget(name); ok {
+			t.Errorf("expected %s not to be mapped, got %s", name, target)
+		}
+	}
+}
+
+func TestDNSResolver_DNS64Synthesizes(t *testing.T) {
+	resolver := dns64Resolver(&DNS64Opts{Groups: []string{"nat64"}})
+	cname := &DNSRecord{Name: stringToDNSWireFormat("www.example.com"), ParsedName: "www.example.com", Type: DNSTypeCNAME,
+		Class: DNSClassIN, TTL: 3600, RData: stringToDNSWireFormat("example.com"), ParsedRData: "example.com"}
+	address := addressRecord("example.com", net.ParseIP("93.184.216.34"))
+	cacheRecords(resolver, "www.example.com", DNSTypeAAAA)
+	cacheRecords(resolver, "www.example.com", DNSTypeA, cname, address)
+
+	answers, _, _, err := resolver.ResolveQuery(Query{Domain: "www.example.com", Type: DNSTypeAAAA, Client: net.ParseIP("2001:db8:1::10")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(answers) != 2 || answers[0] != cname {
+		t.Fatalf("expected the CNAME and a synthesized record, got %v", answers)
+	}
+	if answers[1].Type != DNSTypeAAAA || !net.IP(answers[1].RData).Equal(net.ParseIP("64:ff9b::5db8:d822")) {
+		t.Errorf("expected the A record embedded in the prefix, got %v", answers[1])
+	}
+	if answers[1].ParsedName != "example.com" || answers[1].TTL != 300 {
+		t.Errorf("expected the name and TTL of the A record, got %v", answers[1])
+	}
+	if address.Type != DNSTypeA || len(address.RData) != net.IPv4len {
+		t.Error("expected the cached A record to be left alone")
+	}
+
+	// clients outside the group get the AAAA answer as it is
+	answers, _, _, err = resolver.ResolveQuery(Query{Domain: "www.example.com", Type: DNSTypeAAAA, Client: net.ParseIP("2001:db8:2::10")})
+	if err != nil || len(answers) != 0 {
+		t.Errorf("expected an empty answer, got %v (%v)", answers, err)
+	}
+}
+
+func TestDNSResolver_DNS64PrefersNative(t *testing.T) {
+	resolver := dns64Resolver(&DNS64Opts{Enabled: true})
+	cacheRecords(resolver, "example.com", DNSTypeA, addressRecord("example.com", net.ParseIP("93.184.216.34")))
+	cacheRecords(resolver, "example.com", DNSTypeAAAA, addressRecord("example.com", net.ParseIP("2606:2800:220:1::1")))
+
+	answers, _, err := resolver.Resolve("example.com", DNSTypeAAAA)
+	if err != nil || len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.ParseIP("2606:2800:220:1::1")) {
+		t.Errorf("expected the native AAAA record, got %v (%v)", answers, err)
+	}
+
+	// an IPv4-mapped address is no IPv6 connectivity
+	cacheRecords(resolver, "mapped.example.com", DNSTypeA, addressRecord("mapped.example.com", net.ParseIP("93.184.216.34")))
+	cacheRecords(resolver, "mapped.example.com", DNSTypeAAAA, addressRecord("mapped.example.com", net.ParseIP("::ffff:93.184.216.34")))
+	answers, _, err = resolver.Resolve("mapped.example.com", DNSTypeAAAA)
+	if err != nil || len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.ParseIP("64:ff9b::5db8:d822")) {
+		t.Errorf("expected a synthesized record, got %v (%v)", answers, err)
+	}
+}
+
+func TestDNSResolver_DNS64Excluded(t *testing.T) {
+	resolver := dns64Resolver(&DNS64Opts{Enabled: true})
+	cacheRecords(resolver, "printer.example.com", DNSTypeAAAA)
+	cacheRecords(resolver, "printer.example.com", DNSTypeA, addressRecord("printer.example.com", net.ParseIP("192.168.1.20")))
+
+	answers, _, err := resolver.Resolve("printer.example.com", DNSTypeAAAA)
+	if err != nil || len(answers) != 0 {
+		t.Errorf("expected nothing synthesized from a private address, got %v (%v)", answers, err)
+	}
+
+	// a name that does not exist stays that way
+	if _, _, err := resolver.Resolve("missing.example.com", DNSTypeAAAA); err != ErrNxDomain {
+		t.Errorf("expected NXDOMAIN, got %v", err)
+	}
+}
+
+func TestDNSResolver_DNS64BlockedStaysBlocked(t *testing.T) {
+	resolver := dns64Resolver(&DNS64Opts{Enabled: true})
+	resolver.AddBlocklistEntries([]string{"ads.example.com"})
+
+	answers, _, err := resolver.Resolve("ads.example.com", DNSTypeAAAA)
+	if err != nil || len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.IPv6unspecified) {
+		t.Errorf("expected the blocked answer, got %v (%v)", answers, err)
+	}
+}
+
+func TestDNSResolver_DNS64Reverse(t *testing.T) {
+	resolver := dns64Resolver(&DNS64Opts{Enabled: true})
+	cacheRecords(resolver, "34.216.184.93.in-addr.arpa", DNSTypePTR, &DNSRecord{
+		Name: stringToDNSWireFormat("34.216.184.93.in-addr.arpa"), ParsedName: "34.216.184.93.in-addr.arpa", Type: DNSTypePTR,
+		Class: DNSClassIN, TTL: 300, RData: stringToDNSWireFormat("example.com"), ParsedRData: "example.com",
+	})
+
+	answers, _, err := resolver.Resolve("2.2.8.d.8.b.d.5."+wellKnownReverse+".", DNSTypePTR)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(answers) != 2 || answers[0].Type != DNSTypeCNAME || answers[0].ParsedRData != "34.216.184.93.in-addr.arpa" {
+		t.Fatalf("expected a CNAME to the IPv4 reverse name, got %v", answers)
+	}
+	if answers[1].ParsedRData != "example.com" {
+		t.Errorf("expected the IPv4 reverse answer, got %v", answers[1])
+	}
+}
@@ -131,10 +131,10 @@ func (ts *DNSFeatureTestSuite) thatServerHasACacheForWithIP(domain string, ip st
 		TTL:   300,
 		RData: net.ParseIP(ip).To4(),
 	})
-	ts.resolver.cache[cacheKey] = &DNSCacheItem{
+	ts.resolver.cache.set(cacheKey, &DNSCacheItem{
 		ttl:     time.Now().Add(time.Second * 300),
 		records: records,
-	}
+	})
 	return nil
 }
 
@@ -0,0 +1,387 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	dnstapFrameCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_dnstap_frame_count",
+		Help: "count of dnstap frames by result",
+	}, []string{"result"})
+)
+
+// dnstapContentType is the Frame Streams content type negotiated with the collector
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types
+const (
+	fstrmControlAccept uint32 = 0x01
+	fstrmControlStart  uint32 = 0x02
+	fstrmControlStop   uint32 = 0x03
+	fstrmControlReady  uint32 = 0x04
+	fstrmControlFinish uint32 = 0x05
+
+	fstrmFieldContentType uint32 = 0x01
+
+	fstrmMaxControlFrameSize = 512
+)
+
+type dnstapMessageType uint64
+
+// Subset of dnstap.Message.Type that gatekeeper produces
+const (
+	dnstapResolverQuery     dnstapMessageType = 3
+	dnstapResolverResponse  dnstapMessageType = 4
+	dnstapClientQuery       dnstapMessageType = 5
+	dnstapClientResponse    dnstapMessageType = 6
+	dnstapForwarderQuery    dnstapMessageType = 7
+	dnstapForwarderResponse dnstapMessageType = 8
+)
+
+func (t dnstapMessageType) isQuery() bool {
+	return t == dnstapClientQuery || t == dnstapForwarderQuery || t == dnstapResolverQuery
+}
+
+var (
+	ErrFstrmUnexpectedFrame = errors.New("unexpected frame streams control frame")
+)
+
+type DnstapOpts struct {
+	Network           string // unix or tcp
+	Address           string
+	Identity          string
+	QueueSize         int
+	ReconnectInterval time.Duration
+	WriteTimeout      time.Duration
+}
+
+// DnstapWriter streams dnstap messages to a collector over Frame Streams. Messages are queued and
+// dropped when the queue is full so that a slow or absent collector never holds up a DNS query.
+// All methods are safe to call on a nil writer, which is how tapping is disabled.
+type DnstapWriter struct {
+	opts     DnstapOpts
+	queue    chan []byte
+	exitChan chan struct{}
+	wg       sync.WaitGroup
+	lock     sync.Mutex
+}
+
+func NewDnstapWriter(opts DnstapOpts) *DnstapWriter {
+	if opts.Network == "" {
+		opts.Network = "unix"
+	}
+	if opts.QueueSize == 0 {
+		opts.QueueSize = 1000
+	}
+	if opts.ReconnectInterval == 0 {
+		opts.ReconnectInterval = time.Second * 5
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = time.Second * 2
+	}
+	return &DnstapWriter{
+		opts:  opts,
+		queue: make(chan []byte, opts.QueueSize),
+	}
+}
+
+func (w *DnstapWriter) Start() {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.exitChan != nil {
+		return
+	}
+	w.exitChan = make(chan struct{})
+	w.wg.Add(1)
+	go w.run(w.exitChan)
+	log.Infof("dnstap output to %s://%s started", w.opts.Network, w.opts.Address)
+}
+
+func (w *DnstapWriter) Stop() {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.exitChan == nil {
+		return
+	}
+	close(w.exitChan)
+	w.wg.Wait()
+	w.exitChan = nil
+}
+
+func (w *DnstapWriter) ClientQuery(client, server net.Addr, msg []byte) {
+	w.emit(dnstapClientQuery, client, server, msg, time.Now())
+}
+
+func (w *DnstapWriter) ClientResponse(client, server net.Addr, msg []byte) {
+	w.emit(dnstapClientResponse, client, server, msg, time.Now())
+}
+
+func (w *DnstapWriter) ForwarderQuery(local, upstream net.Addr, msg []byte) {
+	w.emit(dnstapForwarderQuery, local, upstream, msg, time.Now())
+}
+
+func (w *DnstapWriter) ForwarderResponse(local, upstream net.Addr, msg []byte) {
+	w.emit(dnstapForwarderResponse, local, upstream, msg, time.Now())
+}
+
+func (w *DnstapWriter) ResolverQuery(local, server net.Addr, msg []byte) {
+	w.emit(dnstapResolverQuery, local, server, msg, time.Now())
+}
+
+func (w *DnstapWriter) ResolverResponse(local, server net.Addr, msg []byte) {
+	w.emit(dnstapResolverResponse, local, server, msg, time.Now())
+}
+
+func (w *DnstapWriter) emit(msgType dnstapMessageType, queryAddr, responseAddr net.Addr, msg []byte, ts time.Time) {
+	if w == nil {
+		return
+	}
+	frame := marshalDnstap([]byte(w.opts.Identity), msgType, queryAddr, responseAddr, msg, ts)
+	select {
+	case w.queue <- frame:
+	default:
+		dnstapFrameCounter.With(prometheus.Labels{"result": "dropped"}).Inc()
+	}
+}
+
+func (w *DnstapWriter) run(exitChan chan struct{}) {
+	defer w.wg.Done()
+	for {
+		conn, err := w.connect()
+		if err != nil {
+			log.Warnf("unable to connect to dnstap collector %s: %v", w.opts.Address, err)
+			select {
+			case <-exitChan:
+				return
+			case <-time.After(w.opts.ReconnectInterval):
+				continue
+			}
+		}
+		log.Debugf("connected to dnstap collector %s", w.opts.Address)
+		if done := w.writeFrames(conn, exitChan); done {
+			return
+		}
+	}
+}
+
+// writeFrames drains the queue onto the connection until it fails or the writer is stopped. It returns true if the writer was stopped
+func (w *DnstapWriter) writeFrames(conn net.Conn, exitChan chan struct{}) bool {
+	defer conn.Close()
+	buff := bufio.NewWriter(conn)
+	for {
+		select {
+		case <-exitChan:
+			w.finish(conn, buff)
+			return true
+		case frame := <-w.queue:
+			conn.SetWriteDeadline(time.Now().Add(w.opts.WriteTimeout))
+			if err := writeFstrmDataFrame(buff, frame); err != nil {
+				log.Warnf("unable to write dnstap frame: %v", err)
+				dnstapFrameCounter.With(prometheus.Labels{"result": "failed"}).Inc()
+				return false
+			}
+			// only flush once there is nothing else waiting, so bursts are batched into fewer writes
+			if len(w.queue) == 0 {
+				if err := buff.Flush(); err != nil {
+					log.Warnf("unable to flush dnstap frames: %v", err)
+					dnstapFrameCounter.With(prometheus.Labels{"result": "failed"}).Inc()
+					return false
+				}
+			}
+			dnstapFrameCounter.With(prometheus.Labels{"result": "sent"}).Inc()
+		}
+	}
+}
+
+func (w *DnstapWriter) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout(w.opts.Network, w.opts.Address, w.opts.WriteTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(w.opts.WriteTimeout))
+	if err := writeFstrmControlFrame(conn, fstrmControlReady); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := readFstrmControlFrame(conn, fstrmControlAccept); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := writeFstrmControlFrame(conn, fstrmControlStart); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (w *DnstapWriter) finish(conn net.Conn, buff *bufio.Writer) {
+	conn.SetDeadline(time.Now().Add(w.opts.WriteTimeout))
+	if err := buff.Flush(); err != nil {
+		log.Debugf("unable to flush dnstap frames on stop: %v", err)
+		return
+	}
+	if err := writeFstrmControlFrame(conn, fstrmControlStop); err != nil {
+		log.Debugf("unable to send dnstap stop frame: %v", err)
+		return
+	}
+	if err := readFstrmControlFrame(conn, fstrmControlFinish); err != nil {
+		log.Debugf("no finish frame from dnstap collector: %v", err)
+	}
+}
+
+func writeFstrmDataFrame(wr io.Writer, frame []byte) error {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(frame)))
+	if _, err := wr.Write(header); err != nil {
+		return err
+	}
+	_, err := wr.Write(frame)
+	return err
+}
+
+func writeFstrmControlFrame(wr io.Writer, controlType uint32) error {
+	frame := make([]byte, 12)
+	// frame[0:4] is the zero-length escape that marks a control frame
+	binary.BigEndian.PutUint32(frame[8:12], controlType)
+	if controlType != fstrmControlStop && controlType != fstrmControlFinish {
+		field := make([]byte, 8)
+		binary.BigEndian.PutUint32(field[0:4], fstrmFieldContentType)
+		binary.BigEndian.PutUint32(field[4:8], uint32(len(dnstapContentType)))
+		frame = append(frame, field...)
+		frame = append(frame, dnstapContentType...)
+	}
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(frame)-8))
+	_, err := wr.Write(frame)
+	return err
+}
+
+func readFstrmControlFrame(rd io.Reader, expected uint32) error {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(rd, header); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(header[0:4]) != 0 {
+		return ErrFstrmUnexpectedFrame
+	}
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length < 4 || length > fstrmMaxControlFrameSize {
+		return fmt.Errorf("invalid control frame length %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(rd, body); err != nil {
+		return err
+	}
+	if controlType := binary.BigEndian.Uint32(body[0:4]); controlType != expected {
+		return fmt.Errorf("%w: got type %d, expected %d", ErrFstrmUnexpectedFrame, controlType, expected)
+	}
+	return nil
+}
+
+// marshalDnstap hand-encodes a dnstap.Dnstap protobuf holding a single message, see https://github.com/dnstap/dnstap.pb
+func marshalDnstap(identity []byte, msgType dnstapMessageType, queryAddr, responseAddr net.Addr, msg []byte, ts time.Time) []byte {
+	var message []byte
+	message = protowire.AppendTag(message, 1, protowire.VarintType)
+	message = protowire.AppendVarint(message, uint64(msgType))
+
+	queryIP, queryPort := splitAddr(queryAddr)
+	responseIP, responsePort := splitAddr(responseAddr)
+
+	family := uint64(1) // INET
+	if queryIP != nil && queryIP.To4() == nil {
+		family = 2 // INET6
+	}
+	protocol := uint64(1) // UDP
+	if _, ok := queryAddr.(*net.TCPAddr); ok {
+		protocol = 2 // TCP
+	}
+	message = protowire.AppendTag(message, 2, protowire.VarintType)
+	message = protowire.AppendVarint(message, family)
+	message = protowire.AppendTag(message, 3, protowire.VarintType)
+	message = protowire.AppendVarint(message, protocol)
+
+	if queryIP != nil {
+		message = protowire.AppendTag(message, 4, protowire.BytesType)
+		message = protowire.AppendBytes(message, normaliseIP(queryIP, family))
+	}
+	if responseIP != nil {
+		message = protowire.AppendTag(message, 5, protowire.BytesType)
+		message = protowire.AppendBytes(message, normaliseIP(responseIP, family))
+	}
+	if queryAddr != nil {
+		message = protowire.AppendTag(message, 6, protowire.VarintType)
+		message = protowire.AppendVarint(message, uint64(queryPort))
+	}
+	if responseAddr != nil {
+		message = protowire.AppendTag(message, 7, protowire.VarintType)
+		message = protowire.AppendVarint(message, uint64(responsePort))
+	}
+
+	if msgType.isQuery() {
+		message = protowire.AppendTag(message, 8, protowire.VarintType)
+		message = protowire.AppendVarint(message, uint64(ts.Unix()))
+		message = protowire.AppendTag(message, 9, protowire.Fixed32Type)
+		message = protowire.AppendFixed32(message, uint32(ts.Nanosecond()))
+		message = protowire.AppendTag(message, 10, protowire.BytesType)
+		message = protowire.AppendBytes(message, msg)
+	} else {
+		message = protowire.AppendTag(message, 12, protowire.VarintType)
+		message = protowire.AppendVarint(message, uint64(ts.Unix()))
+		message = protowire.AppendTag(message, 13, protowire.Fixed32Type)
+		message = protowire.AppendFixed32(message, uint32(ts.Nanosecond()))
+		message = protowire.AppendTag(message, 14, protowire.BytesType)
+		message = protowire.AppendBytes(message, msg)
+	}
+
+	var frame []byte
+	if len(identity) > 0 {
+		frame = protowire.AppendTag(frame, 1, protowire.BytesType)
+		frame = protowire.AppendBytes(frame, identity)
+	}
+	frame = protowire.AppendTag(frame, 2, protowire.BytesType)
+	frame = protowire.AppendBytes(frame, []byte("gatekeeper"))
+	frame = protowire.AppendTag(frame, 14, protowire.BytesType)
+	frame = protowire.AppendBytes(frame, message)
+	frame = protowire.AppendTag(frame, 15, protowire.VarintType)
+	frame = protowire.AppendVarint(frame, 1) // MESSAGE
+	return frame
+}
+
+func splitAddr(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	default:
+		return nil, 0
+	}
+}
+
+func normaliseIP(ip net.IP, family uint64) []byte {
+	if family == 1 {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return ip.To16()
+}
@@ -0,0 +1,178 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fakeCollector accepts a single bidirectional Frame Streams connection and pushes every data frame it receives onto frames
+func fakeCollector(t *testing.T, listener net.Listener, frames chan<- []byte) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if err := readFstrmControlFrame(conn, fstrmControlReady); err != nil {
+		t.Errorf("expected READY frame: %v", err)
+		return
+	}
+	if err := writeFstrmControlFrame(conn, fstrmControlAccept); err != nil {
+		t.Errorf("unable to write ACCEPT frame: %v", err)
+		return
+	}
+	if err := readFstrmControlFrame(conn, fstrmControlStart); err != nil {
+		t.Errorf("expected START frame: %v", err)
+		return
+	}
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length == 0 {
+			// STOP control frame, reply with FINISH
+			body := make([]byte, 8)
+			io.ReadFull(conn, body)
+			writeFstrmControlFrame(conn, fstrmControlFinish)
+			return
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			return
+		}
+		frames <- frame
+	}
+}
+
+func dnstapField(t *testing.T, data []byte, field protowire.Number) []byte {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		data = data[n:]
+		switch typ {
+		case protowire.BytesType:
+			val, n := protowire.ConsumeBytes(data)
+			if num == field {
+				return val
+			}
+			data = data[n:]
+		case protowire.VarintType:
+			val, n := protowire.ConsumeVarint(data)
+			if num == field {
+				return protowire.AppendVarint(nil, val)
+			}
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+func TestDnstapWriter_StreamsMessages(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "dnstap.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	frames := make(chan []byte, 10)
+	go fakeCollector(t, listener, frames)
+
+	writer := NewDnstapWriter(DnstapOpts{
+		Network:  "unix",
+		Address:  socket,
+		Identity: "test-host",
+	})
+	writer.Start()
+	defer writer.Stop()
+
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.23"), Port: 40000}
+	server := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53}
+	writer.ClientQuery(client, server, []byte{0x01, 0x02})
+
+	select {
+	case frame := <-frames:
+		if identity := dnstapField(t, frame, 1); string(identity) != "test-host" {
+			t.Errorf("expected identity test-host, got %q", identity)
+		}
+		message := dnstapField(t, frame, 14)
+		if message == nil {
+			t.Fatal("expected message field")
+		}
+		if msgType := dnstapField(t, message, 1); !bytes.Equal(msgType, protowire.AppendVarint(nil, uint64(dnstapClientQuery))) {
+			t.Errorf("expected CLIENT_QUERY, got %v", msgType)
+		}
+		if queryAddr := dnstapField(t, message, 4); !net.IP(queryAddr).Equal(client.IP) {
+			t.Errorf("expected query address %s, got %v", client.IP, net.IP(queryAddr))
+		}
+		if queryMessage := dnstapField(t, message, 10); !bytes.Equal(queryMessage, []byte{0x01, 0x02}) {
+			t.Errorf("expected query message to be preserved, got %v", queryMessage)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for dnstap frame")
+	}
+}
+
+func TestDnstapWriter_DropsWhenQueueFull(t *testing.T) {
+	writer := NewDnstapWriter(DnstapOpts{
+		Network:   "unix",
+		Address:   filepath.Join(t.TempDir(), "missing.sock"),
+		QueueSize: 1,
+	})
+
+	// not started, so nothing drains the queue and the second message must not block
+	done := make(chan struct{})
+	go func() {
+		writer.ClientQuery(nil, nil, []byte{0x01})
+		writer.ClientQuery(nil, nil, []byte{0x02})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("emit blocked on a full queue")
+	}
+	if len(writer.queue) != 1 {
+		t.Errorf("expected 1 queued frame, got %d", len(writer.queue))
+	}
+}
+
+func TestDnstapWriter_NilIsNoop(t *testing.T) {
+	var writer *DnstapWriter
+	writer.Start()
+	writer.ClientQuery(nil, nil, []byte{0x01})
+	writer.ForwarderResponse(nil, nil, []byte{0x01})
+	writer.Stop()
+}
+
+func TestMarshalDnstap_ResponseUsesResponseFields(t *testing.T) {
+	local := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 5000}
+	upstream := &net.UDPAddr{IP: net.ParseIP("2606:4700:4700::1111"), Port: 53}
+	frame := marshalDnstap(nil, dnstapForwarderResponse, local, upstream, []byte{0xff}, time.Unix(100, 0))
+
+	message := dnstapField(t, frame, 14)
+	if family := dnstapField(t, message, 2); !bytes.Equal(family, protowire.AppendVarint(nil, 2)) {
+		t.Errorf("expected INET6 socket family, got %v", family)
+	}
+	if responseMessage := dnstapField(t, message, 14); !bytes.Equal(responseMessage, []byte{0xff}) {
+		t.Errorf("expected response message, got %v", responseMessage)
+	}
+	if queryMessage := dnstapField(t, message, 10); queryMessage != nil {
+		t.Errorf("expected no query message, got %v", queryMessage)
+	}
+}
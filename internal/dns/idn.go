@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile maps names the way RFC 5891 looks them up, but without the host name rules, which would reject the
+// underscores of service labels and the odd names blocklists hold
+var idnaProfile = idna.New(idna.MapForLookup(), idna.Transitional(false), idna.StrictDomainName(false), idna.CheckHyphens(false), idna.BidiRule())
+
+// NormalizeDomain returns name the way queries are matched against it: lower case, without a trailing dot and with
+// internationalized labels converted to their ASCII A-label, such as xn--bcher-kva.example for bücher.example
+func NormalizeDomain(name string) (string, error) {
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+	if isASCII(name) {
+		return strings.ToLower(name), nil
+	}
+	normalized, err := idnaProfile.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain name %s: %w", name, err)
+	}
+	return normalized, nil
+}
+
+// DisplayDomain returns name with its A-labels converted to the Unicode they stand for, the way a user would type it.
+// A name that does not convert is returned as it is
+func DisplayDomain(name string) string {
+	if !strings.Contains(name, "xn--") {
+		return name
+	}
+	display, err := idnaProfile.ToUnicode(name)
+	if err != nil {
+		return name
+	}
+	return display
+}
+
+// normalizeDomains normalizes a list of names, dropping the ones that are not valid
+func normalizeDomains(names []string) []string {
+	normalized := make([]string, 0, len(names))
+	for _, name := range names {
+		domain, err := NormalizeDomain(name)
+		if err != nil {
+			log.Debugf("skipping %v", err)
+			continue
+		}
+		normalized = append(normalized, domain)
+	}
+	return normalized
+}
+
+// normalizeLocalDomains returns local domains keyed by their normalized names, dropping the ones that are not valid
+func normalizeLocalDomains(domains map[string]net.IP) map[string]net.IP {
+	normalized := make(map[string]net.IP, len(domains))
+	for name, ip := range domains {
+		domain, err := NormalizeDomain(name)
+		if err != nil {
+			log.Warnf("ignoring local domain: %v", err)
+			continue
+		}
+		normalized[domain] = ip
+	}
+	return normalized
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := map[string]string{
+		"example.com":            "example.com",
+		"WWW.Example.COM.":       "www.example.com",
+		" router.lan ":           "router.lan",
+		"_sip._udp.example.com":  "_sip._udp.example.com",
+		"Bücher.Example":         "xn--bcher-kva.example",
+		"xn--bcher-kva.example.": "xn--bcher-kva.example",
+		"例え.テスト":                 "xn--r8jz45g.xn--zckzah",
+		"ｅｘａｍｐｌｅ.ｃｏｍ":            "example.com",
+	}
+	for name, expected := range tests {
+		normalized, err := NormalizeDomain(name)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", name, err)
+		} else if normalized != expected {
+			t.Errorf("NormalizeDomain(%q) = %q; want %q", name, normalized, expected)
+		}
+	}
+
+	if _, err := NormalizeDomain("a\u200d.example"); err == nil {
+		t.Error("expected a stray zero width joiner to be rejected")
+	}
+}
+
+func TestDisplayDomain(t *testing.T) {
+	tests := map[string]string{
+		"xn--bcher-kva.example":  "bücher.example",
+		"xn--r8jz45g.xn--zckzah": "例え.テスト",
+		"example.com":            "example.com",
+		"xn--zz.example":         "xn--zz.example",
+	}
+	for name, expected := range tests {
+		if display := DisplayDomain(name); display != expected {
+			t.Errorf("DisplayDomain(%q) = %q; want %q", name, display, expected)
+		}
+	}
+}
+
+func TestDNSResolver_InternationalizedLocalDomain(t *testing.T) {
+	resolver := NewDNSResolverWithOpts(ResolverOpts{
+		Upstreams:    []string{},
+		LocalDomains: map[string]net.IP{"Bücher.LAN": net.IPv4(10, 0, 0, 2)},
+	})
+	if err := resolver.AddLocalDomain("Café.lan.", net.IPv4(10, 0, 0, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]net.IP{
+		"xn--bcher-kva.lan": net.IPv4(10, 0, 0, 2),
+		"XN--CAF-DMA.LAN":   net.IPv4(10, 0, 0, 3),
+	} {
+		answers, _, err := resolver.Resolve(name, DNSTypeA)
+		if err != nil || len(answers) != 1 {
+			t.Fatalf("expected an answer for %s, got %v (%v)", name, answers, err)
+		}
+		if !net.IP(answers[0].RData).Equal(expected) {
+			t.Errorf("expected %s for %s, got %v", expected, name, net.IP(answers[0].RData))
+		}
+	}
+
+	resolver.DeleteLocalDomain("café.lan")
+	if _, ok := resolver.localDomains["xn--caf-dma.lan"]; ok {
+		t.Error("expected the local domain to be deleted by its Unicode name")
+	}
+}
+
+func TestDNSResolver_BlocklistMatchesAnyCase(t *testing.T) {
+	resolver := NewDNSResolverWithOpts(ResolverOpts{Upstreams: []string{}})
+	resolver.AddBlocklistEntries([]string{"ads.example.com"})
+
+	answers, _, err := resolver.Resolve("Ads.Example.COM.", DNSTypeA)
+	if err != nil || len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.IPv4zero) {
+		t.Errorf("expected the blocked answer, got %v (%v)", answers, err)
+	}
+}
+
+func TestFileBlocklistFetcher_NormalizesEntries(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "blocklist.txt")
+	os.WriteFile(tmpFile, []byte("0.0.0.0 Tracker.Example.com.\n0.0.0.0 Bücher.example\n0.0.0.0 a\u200d.example\n"), 0644)
+
+	hosts, err := (&FileBlocklistFetcher{}).Fetch(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 || hosts[0] != "tracker.example.com" || hosts[1] != "xn--bcher-kva.example" {
+		t.Errorf("expected the valid entries normalized, got %v", hosts)
+	}
+}
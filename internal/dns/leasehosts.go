@@ -0,0 +1,111 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	ErrHostConflict = errors.New("hostname already registered")
+)
+
+// leaseHost is a name registered on behalf of a DHCP client, it lives as long as the client's lease
+type leaseHost struct {
+	name   string
+	ip     net.IP
+	owner  string
+	expiry time.Time
+}
+
+// leaseHosts keeps the dynamically registered names indexed by name, address and owning client. It is not safe for
+// concurrent use, the resolver guards it with its domain lock
+type leaseHosts struct {
+	byName  map[string]*leaseHost
+	byOwner map[string]*leaseHost
+}
+
+func newLeaseHosts() *leaseHosts {
+	return &leaseHosts{
+		byName:  make(map[string]*leaseHost),
+		byOwner: make(map[string]*leaseHost),
+	}
+}
+
+// register adds or refreshes the name for owner. A name held by another client with an unexpired lease is not taken
+// over, the first client to claim a name keeps it until its lease goes away
+func (h *leaseHosts) register(name string, ip net.IP, owner string, expiry, now time.Time) error {
+	name = strings.ToLower(name)
+	if existing, ok := h.byName[name]; ok && existing.owner != owner && now.Before(existing.expiry) {
+		return ErrHostConflict
+	}
+	h.unregister(owner)
+	if existing, ok := h.byName[name]; ok {
+		delete(h.byOwner, existing.owner)
+	}
+	host := &leaseHost{name: name, ip: ip, owner: owner, expiry: expiry}
+	h.byName[name] = host
+	h.byOwner[owner] = host
+	return nil
+}
+
+func (h *leaseHosts) unregister(owner string) {
+	if host, ok := h.byOwner[owner]; ok {
+		delete(h.byOwner, owner)
+		if h.byName[host.name] == host {
+			delete(h.byName, host.name)
+		}
+	}
+}
+
+func (h *leaseHosts) lookup(name string, now time.Time) (*leaseHost, bool) {
+	host, ok := h.byName[strings.ToLower(name)]
+	if !ok || now.After(host.expiry) {
+		return nil, false
+	}
+	return host, true
+}
+
+// each calls fn for every host whose lease has not expired
+func (h *leaseHosts) each(now time.Time, fn func(host *leaseHost)) {
+	for _, host := range h.byName {
+		if now.Before(host.expiry) {
+			fn(host)
+		}
+	}
+}
+
+// ttl is the lease's remaining lifetime, capped at max so clients don't hold on to a name that is about to move
+func (host *leaseHost) ttl(max time.Duration, now time.Time) uint32 {
+	remaining := host.expiry.Sub(now)
+	if remaining > max {
+		remaining = max
+	}
+	if remaining < time.Second {
+		remaining = time.Second
+	}
+	return uint32(remaining.Seconds())
+}
+
+// LeaseHostname turns a DHCP client's hostname into a name under domain. Anything that is not valid in a DNS label is
+// replaced, and an empty result means the client cannot be registered
+func LeaseHostname(hostname, domain string) string {
+	hostname = strings.ToLower(strings.TrimSpace(hostname))
+	// clients sometimes send their fully qualified name, only the first label is theirs to claim
+	if idx := strings.IndexByte(hostname, '.'); idx >= 0 {
+		hostname = hostname[:idx]
+	}
+	label := []byte(hostname)
+	for i, c := range label {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			label[i] = '-'
+		}
+	}
+	hostname = strings.Trim(string(label), "-")
+	domain = strings.Trim(strings.ToLower(domain), ".")
+	if hostname == "" || len(hostname) > 63 || domain == "" {
+		return ""
+	}
+	return hostname + "." + domain
+}
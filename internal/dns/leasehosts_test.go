@@ -0,0 +1,102 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLeaseHostname(t *testing.T) {
+	tests := []struct {
+		hostname string
+		domain   string
+		expected string
+	}{
+		{"laptop", "home.lan", "laptop.home.lan"},
+		{"Laptop", "Home.Lan.", "laptop.home.lan"},
+		{"laptop.example.com", "home.lan", "laptop.home.lan"},
+		{"James's iPhone", "home.lan", "james-s-iphone.home.lan"},
+		{"--", "home.lan", ""},
+		{"laptop", "", ""},
+	}
+
+	for _, tt := range tests {
+		if result := LeaseHostname(tt.hostname, tt.domain); result != tt.expected {
+			t.Errorf("LeaseHostname(%q, %q) = %q; want %q", tt.hostname, tt.domain, result, tt.expected)
+		}
+	}
+}
+
+func TestDNSResolver_RegisterHostResolvesAAndPTR(t *testing.T) {
+	resolver := NewDNSResolverWithDefaultOpts()
+	ip := net.ParseIP("192.168.1.5")
+
+	if err := resolver.RegisterHost("laptop.home.lan", ip, "aa:bb", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	answers, _, err := resolver.Resolve("laptop.home.lan", DNSTypeA)
+	if err != nil || len(answers) != 1 {
+		t.Fatalf("expected one answer, got %v (%v)", answers, err)
+	}
+	if !net.IP(answers[0].RData).Equal(ip) {
+		t.Errorf("expected %s, got %v", ip, answers[0].RData)
+	}
+	if answers[0].TTL > uint32(resolver.cacheTTL.Seconds()) {
+		t.Errorf("expected TTL to be capped at the cache TTL, got %d", answers[0].TTL)
+	}
+
+	answers, _, err = resolver.Resolve("5.1.168.192.in-addr.arpa", DNSTypePTR)
+	if err != nil || len(answers) != 1 {
+		t.Fatalf("expected one PTR answer, got %v (%v)", answers, err)
+	}
+	if answers[0].ParsedName != "5.1.168.192.in-addr.arpa" || answers[0].ParsedRData != "laptop.home.lan" {
+		t.Errorf("expected PTR to point at laptop.home.lan, got %s -> %s", answers[0].ParsedName, answers[0].ParsedRData)
+	}
+
+	resolver.UnregisterHost("aa:bb")
+	if _, ok := resolver.leaseHosts.lookup("laptop.home.lan", time.Now()); ok {
+		t.Error("expected host to be removed with its lease")
+	}
+}
+
+func TestDNSResolver_RegisterHostStaticDomainWins(t *testing.T) {
+	resolver := NewDNSResolverWithDefaultOpts()
+	resolver.AddLocalDomain("nas.home.lan", net.ParseIP("192.168.1.2"))
+
+	if err := resolver.RegisterHost("nas.home.lan", net.ParseIP("192.168.1.5"), "aa:bb", time.Now().Add(time.Hour)); err != ErrHostConflict {
+		t.Errorf("expected ErrHostConflict, got %v", err)
+	}
+}
+
+func TestLeaseHosts_Conflicts(t *testing.T) {
+	hosts := newLeaseHosts()
+	now := time.Now()
+	ip1, ip2 := net.ParseIP("192.168.1.5").To4(), net.ParseIP("192.168.1.6").To4()
+
+	if err := hosts.register("laptop.home.lan", ip1, "aa", now.Add(time.Hour), now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := hosts.register("laptop.home.lan", ip2, "bb", now.Add(time.Hour), now); err != ErrHostConflict {
+		t.Errorf("expected a second client to be rejected, got %v", err)
+	}
+
+	// the owner may move to a new address or name
+	if err := hosts.register("laptop.home.lan", ip2, "aa", now.Add(time.Hour), now); err != nil {
+		t.Errorf("expected owner to refresh its registration, got %v", err)
+	}
+	if err := hosts.register("desktop.home.lan", ip2, "aa", now.Add(time.Hour), now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := hosts.lookup("laptop.home.lan", now); ok {
+		t.Error("expected old name to be released when the owner renamed")
+	}
+
+	// once the owner's lease is gone, another client can claim the name
+	if err := hosts.register("desktop.home.lan", ip1, "bb", now.Add(time.Hour), now.Add(time.Hour*2)); err != nil {
+		t.Errorf("expected expired registration to be taken over, got %v", err)
+	}
+	if _, ok := hosts.byOwner["aa"]; ok {
+		t.Error("expected previous owner to be dropped")
+	}
+}
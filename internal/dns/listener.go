@@ -0,0 +1,201 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dnsListener is the UDP sockets bound to an address, each with its own read loop, and the TCP socket on the same address
+type dnsListener struct {
+	addr     string
+	conns    []net.PacketConn
+	tcp      *net.TCPListener
+	exitChan chan struct{}
+}
+
+// listenAddresses works out which host:port pairs the server should be bound to. Explicit listen addresses win, otherwise
+// every address on the configured interface is used. Without either, the server falls back to all interfaces.
+func (d *DNSServer) listenAddresses() ([]string, error) {
+	port := strconv.Itoa(d.opts.Port)
+	addrs := make([]string, 0)
+
+	if len(d.opts.ListenAddresses) > 0 {
+		for _, addr := range d.opts.ListenAddresses {
+			if _, _, err := net.SplitHostPort(addr); err == nil {
+				addrs = append(addrs, addr)
+				continue
+			}
+			if net.ParseIP(addr) == nil {
+				return nil, fmt.Errorf("invalid listen address %s", addr)
+			}
+			addrs = append(addrs, net.JoinHostPort(addr, port))
+		}
+		return addrs, nil
+	}
+
+	if d.opts.Interface == "" {
+		return []string{":" + port}, nil
+	}
+
+	iface, err := net.InterfaceByName(d.opts.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find interface %s: %w", d.opts.Interface, err)
+	}
+	ifaceAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range ifaceAddrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		// link-local addresses need a zone and are not what clients are handed as a nameserver
+		if ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(ipNet.IP.String(), port))
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+func listenNetwork(addr string) string {
+	return "udp" + addressFamily(addr)
+}
+
+func addressFamily(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "6"
+	}
+	return "4"
+}
+
+// syncListeners binds any address that is not yet bound and stops listeners for addresses that have gone away
+func (d *DNSServer) syncListeners(addrs []string) error {
+	d.listenerLock.Lock()
+	defer d.listenerLock.Unlock()
+
+	// the server is stopping, don't bind anything that Stop would not know to wait for
+	select {
+	case <-d.exitChan:
+		return nil
+	default:
+	}
+
+	wanted := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		wanted[addr] = struct{}{}
+	}
+
+	for addr, l := range d.listeners {
+		if _, ok := wanted[addr]; !ok {
+			log.Infof("address %s is no longer available, unbinding DNS listener", addr)
+			close(l.exitChan)
+			delete(d.listeners, addr)
+		}
+	}
+
+	var bindErr error
+	for _, addr := range addrs {
+		if _, ok := d.listeners[addr]; ok {
+			continue
+		}
+		conns, err := d.bindUDP(addr)
+		if err != nil {
+			log.Errorf("unable to bind DNS listener on %s: %v", addr, err)
+			bindErr = err
+			continue
+		}
+		log.Infof("DNS server listening on %s", addr)
+		l := &dnsListener{
+			addr:     addr,
+			conns:    conns,
+			exitChan: make(chan struct{}),
+		}
+		// TCP shares the UDP port, which matters when the UDP port was picked by the system
+		tcpAddr := conns[0].LocalAddr().String()
+		if tcp, err := net.Listen("tcp"+addressFamily(addr), tcpAddr); err != nil {
+			log.Warnf("unable to bind DNS TCP listener on %s, zone transfers and truncated responses will not work: %v", tcpAddr, err)
+		} else {
+			l.tcp = tcp.(*net.TCPListener)
+			d.wg.Add(1)
+			go d.serveTCP(l)
+		}
+		d.listeners[addr] = l
+		for _, conn := range conns {
+			d.wg.Add(1)
+			go d.listen(l, conn)
+		}
+	}
+	return bindErr
+}
+
+// bindUDP binds the configured number of UDP sockets to addr. With more than one, the sockets share the address through
+// SO_REUSEPORT and the kernel spreads incoming queries across them. Failing to bind one of the extra sockets only costs
+// throughput, so the sockets bound so far are kept
+func (d *DNSServer) bindUDP(addr string) ([]net.PacketConn, error) {
+	if d.sockets <= 1 {
+		conn, err := net.ListenPacket(listenNetwork(addr), addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.PacketConn{conn}, nil
+	}
+
+	config := net.ListenConfig{Control: reusePort}
+	first, err := config.ListenPacket(context.Background(), listenNetwork(addr), addr)
+	if err != nil {
+		return nil, err
+	}
+	conns := []net.PacketConn{first}
+	// the rest bind to the first socket's address, which matters when the port was picked by the system
+	for len(conns) < d.sockets {
+		conn, err := config.ListenPacket(context.Background(), listenNetwork(addr), first.LocalAddr().String())
+		if err != nil {
+			log.Warnf("bound %d of %d DNS sockets on %s: %v", len(conns), d.sockets, addr, err)
+			break
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// watchInterface polls the configured interface and re-binds whenever its addresses change
+func (d *DNSServer) watchInterface(exitChan chan struct{}) {
+	defer d.wg.Done()
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exitChan:
+			return
+		case <-ticker.C:
+			addrs, err := d.listenAddresses()
+			if err != nil {
+				log.Debugf("unable to read addresses for %s: %v", d.opts.Interface, err)
+				addrs = nil
+			}
+			d.syncListeners(addrs)
+		}
+	}
+}
+
+func (d *DNSServer) stopListeners() {
+	d.listenerLock.Lock()
+	defer d.listenerLock.Unlock()
+	for addr, l := range d.listeners {
+		close(l.exitChan)
+		delete(d.listeners, addr)
+	}
+}
@@ -0,0 +1,265 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenAddresses_Explicit(t *testing.T) {
+	server := NewDNSServerWithOpts(DNSServerOpts{
+		Port:            5353,
+		ListenAddresses: []string{"10.0.0.1", "fd00::1", "127.0.0.1:53"},
+	}, newMockResolver(), nil)
+
+	addrs, err := server.listenAddresses()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"10.0.0.1:5353", "[fd00::1]:5353", "127.0.0.1:53"}
+	if len(addrs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, addrs)
+	}
+	for i := range expected {
+		if addrs[i] != expected[i] {
+			t.Errorf("expected %s, got %s", expected[i], addrs[i])
+		}
+	}
+}
+
+func TestListenAddresses_InvalidExplicit(t *testing.T) {
+	server := NewDNSServerWithOpts(DNSServerOpts{
+		Port:            53,
+		ListenAddresses: []string{"not-an-ip"},
+	}, newMockResolver(), nil)
+
+	if _, err := server.listenAddresses(); err == nil {
+		t.Error("expected error for invalid listen address")
+	}
+}
+
+func TestListenAddresses_NoInterface(t *testing.T) {
+	server := NewDNSServerWithOpts(DNSServerOpts{Port: 53}, newMockResolver(), nil)
+
+	addrs, err := server.listenAddresses()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0] != ":53" {
+		t.Errorf("expected wildcard listener, got %v", addrs)
+	}
+}
+
+func TestListenAddresses_Interface(t *testing.T) {
+	server := NewDNSServerWithOpts(DNSServerOpts{Interface: "lo", Port: 53}, newMockResolver(), nil)
+
+	addrs, err := server.listenAddresses()
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr == "127.0.0.1:53" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected 127.0.0.1:53 in %v", addrs)
+	}
+}
+
+func TestListenAddresses_UnknownInterface(t *testing.T) {
+	server := NewDNSServerWithOpts(DNSServerOpts{Interface: "does-not-exist0", Port: 53}, newMockResolver(), nil)
+
+	if _, err := server.listenAddresses(); err == nil {
+		t.Error("expected error for unknown interface")
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.1:53": "udp4",
+		"[::1]:53":    "udp6",
+		":53":         "udp",
+	}
+	for addr, expected := range tests {
+		if network := listenNetwork(addr); network != expected {
+			t.Errorf("listenNetwork(%s) = %s; want %s", addr, network, expected)
+		}
+	}
+}
+
+func TestDNSServer_ServesOnListenAddress(t *testing.T) {
+	server := NewDNSServerWithOpts(DNSServerOpts{
+		ListenAddresses: []string{"127.0.0.1:0"},
+		ReadDeadline:    time.Millisecond * 100,
+	}, newMockResolver(), nil)
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	defer server.Stop()
+
+	server.listenerLock.Lock()
+	serverAddr := server.listeners["127.0.0.1:0"].conns[0].LocalAddr()
+	server.listenerLock.Unlock()
+
+	conn, err := net.Dial("udp", serverAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	query := NewDnsMessage()
+	query.Header.ID = 0x1234
+	query.Questions = append(query.Questions, &DNSQuestion{
+		Name:  stringToDNSWireFormat("example.com"),
+		Type:  DNSTypeA,
+		Class: DNSClassIN,
+	})
+	data, _ := MarshalDNSMessage(query)
+	conn.Write(data)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	buff := make([]byte, 1500)
+	n, err := conn.Read(buff)
+	if err != nil {
+		t.Fatalf("no response from server: %v", err)
+	}
+	response, err := ParseDNSMessage(buff[:n])
+	if err != nil {
+		t.Fatalf("unable to parse response: %v", err)
+	}
+	if response.Header.ID != 0x1234 {
+		t.Errorf("expected response ID 0x1234, got %x", response.Header.ID)
+	}
+	if response.Header.Flags&0x8000 == 0 {
+		t.Error("expected QR bit to be set on the response")
+	}
+}
+
+func TestDNSServer_SyncListenersUnbindsRemovedAddresses(t *testing.T) {
+	server := NewDNSServerWithOpts(DNSServerOpts{ReadDeadline: time.Millisecond * 100}, newMockResolver(), nil)
+	server.exitChan = make(chan struct{})
+
+	if err := server.syncListeners([]string{"127.0.0.1:0"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(server.listeners) != 1 {
+		t.Fatalf("expected 1 listener, got %d", len(server.listeners))
+	}
+
+	server.syncListeners(nil)
+	if len(server.listeners) != 0 {
+		t.Errorf("expected listener to be removed, got %d", len(server.listeners))
+	}
+
+	close(server.exitChan)
+	server.wg.Wait()
+}
+
+func TestDNSServer_ServesOnReusePortSockets(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+	server := NewDNSServerWithOpts(DNSServerOpts{
+		ListenAddresses: []string{"127.0.0.1:0"},
+		ReadDeadline:    time.Millisecond * 100,
+		ListenSockets:   4,
+		Workers:         2,
+	}, newMockResolver(), nil)
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	defer server.Stop()
+
+	server.listenerLock.Lock()
+	conns := server.listeners["127.0.0.1:0"].conns
+	server.listenerLock.Unlock()
+	if len(conns) != 4 {
+		t.Fatalf("expected 4 sockets, got %d", len(conns))
+	}
+	for _, conn := range conns[1:] {
+		if conn.LocalAddr().String() != conns[0].LocalAddr().String() {
+			t.Errorf("expected every socket on %s, got %s", conns[0].LocalAddr(), conn.LocalAddr())
+		}
+	}
+
+	// the kernel picks a socket by the client's address, so several clients spread across them
+	for i := 0; i < 8; i++ {
+		conn, err := net.Dial("udp", conns[0].LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := exchangeUDP(conn, uint16(i))
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Header.ID != uint16(i) {
+			t.Errorf("expected response ID %d, got %d", i, response.Header.ID)
+		}
+	}
+}
+
+func exchangeUDP(conn net.Conn, id uint16) (*DNSMessage, error) {
+	query := NewDnsMessage()
+	query.Header.ID = id
+	query.Questions = append(query.Questions, &DNSQuestion{
+		Name:  stringToDNSWireFormat("example.com"),
+		Type:  DNSTypeA,
+		Class: DNSClassIN,
+	})
+	data, _ := MarshalDNSMessage(query)
+	if _, err := conn.Write(data); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	buff := make([]byte, 1500)
+	n, err := conn.Read(buff)
+	if err != nil {
+		return nil, fmt.Errorf("no response from server: %w", err)
+	}
+	return ParseDNSMessage(buff[:n])
+}
+
+// BenchmarkDNSServer_UDP is the load test for the UDP path. Every client is its own socket with one query in flight,
+// answered from the cache, so what is measured is the read loops, the workers and the resolver rather than an upstream.
+// Run with -cpu to see how the server scales, the qps metric is what the whole server sustained
+func BenchmarkDNSServer_UDP(b *testing.B) {
+	for _, sockets := range []int{1, 4} {
+		b.Run(fmt.Sprintf("sockets=%d", sockets), func(b *testing.B) {
+			resolver := newBenchmarkResolver(b)
+			server := NewDNSServerWithOpts(DNSServerOpts{
+				ListenAddresses: []string{"127.0.0.1:0"},
+				ReadDeadline:    time.Millisecond * 100,
+				ListenSockets:   sockets,
+			}, resolver, nil)
+			if err := server.Start(); err != nil {
+				b.Fatalf("unable to start server: %v", err)
+			}
+			defer server.Stop()
+			server.listenerLock.Lock()
+			addr := server.listeners["127.0.0.1:0"].conns[0].LocalAddr().String()
+			server.listenerLock.Unlock()
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := net.Dial("udp", addr)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer conn.Close()
+				for pb.Next() {
+					if _, err := exchangeUDP(conn, 0x1234); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "qps")
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package dns
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BlockingPause is blocklist matching switched off until a time, for one client or for every client when Client is
+// empty
+type BlockingPause struct {
+	Client string    `json:"client,omitempty"`
+	Until  time.Time `json:"until"`
+}
+
+// blockingPauses holds when blocking resumes for every client and for single clients. Pauses are never ended by a
+// timer, they simply stop applying once their time has passed. It is not safe for concurrent use, the resolver guards
+// it with its domain lock
+type blockingPauses struct {
+	all     time.Time
+	clients map[string]time.Time
+}
+
+func newBlockingPauses() *blockingPauses {
+	return &blockingPauses{clients: make(map[string]time.Time)}
+}
+
+// active reports whether blocking is paused for client, by a pause of its own or one for every client
+func (p *blockingPauses) active(client net.IP, now time.Time) bool {
+	if now.Before(p.all) {
+		return true
+	}
+	if client == nil {
+		return false
+	}
+	until, ok := p.clients[client.String()]
+	return ok && now.Before(until)
+}
+
+// pause sets when blocking resumes for client, every client when it is nil, replacing any earlier pause
+func (p *blockingPauses) pause(client net.IP, until time.Time) {
+	if client == nil {
+		p.all = until
+	} else if until.IsZero() {
+		delete(p.clients, client.String())
+	} else {
+		p.clients[client.String()] = until
+	}
+}
+
+// list returns the pauses that have not run out, the one for every client first, and forgets the rest
+func (p *blockingPauses) list(now time.Time) []BlockingPause {
+	pauses := make([]BlockingPause, 0)
+	if now.Before(p.all) {
+		pauses = append(pauses, BlockingPause{Until: p.all})
+	}
+	var clients []BlockingPause
+	for client, until := range p.clients {
+		if !now.Before(until) {
+			delete(p.clients, client)
+			continue
+		}
+		clients = append(clients, BlockingPause{Client: client, Until: until})
+	}
+	slices.SortFunc(clients, func(a, b BlockingPause) int { return strings.Compare(a.Client, b.Client) })
+	return append(pauses, clients...)
+}
+
+// PauseBlocking stops the blocklist, and the CNAME cloaking checks against it, from applying to client for d, to every
+// client when client is nil. Blocking resumes by itself once d has passed. Response policy zones and rewrite rules keep
+// applying
+func (r *DNSResolver) PauseBlocking(client net.IP, d time.Duration) BlockingPause {
+	until := time.Now().Add(d)
+	defer r.domainLock.Unlock()
+	r.domainLock.Lock()
+	r.pauses.pause(client, until)
+	if client == nil {
+		log.Infof("blocking paused for every client until %s", until.Format(time.RFC3339))
+		return BlockingPause{Until: until}
+	}
+	log.Infof("blocking paused for %s until %s", client, until.Format(time.RFC3339))
+	return BlockingPause{Client: client.String(), Until: until}
+}
+
+// ResumeBlocking ends a pause early, the one for client or the one for every client when client is nil
+func (r *DNSResolver) ResumeBlocking(client net.IP) {
+	defer r.domainLock.Unlock()
+	r.domainLock.Lock()
+	r.pauses.pause(client, time.Time{})
+	if client == nil {
+		log.Info("blocking resumed for every client")
+		return
+	}
+	log.Infof("blocking resumed for %s", client)
+}
+
+// BlockingPauses returns the pauses still running
+func (r *DNSResolver) BlockingPauses() []BlockingPause {
+	defer r.domainLock.Unlock()
+	r.domainLock.Lock()
+	return r.pauses.list(time.Now())
+}
@@ -0,0 +1,141 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBlockingPauses(t *testing.T) {
+	pauses := newBlockingPauses()
+	now := time.Now()
+	client, other := net.ParseIP("192.168.1.20"), net.ParseIP("192.168.1.21")
+
+	pauses.pause(client, now.Add(time.Minute))
+	if !pauses.active(client, now) || pauses.active(other, now) || pauses.active(nil, now) {
+		t.Error("expected only the client to be paused")
+	}
+	if pauses.active(client, now.Add(time.Minute)) {
+		t.Error("expected the pause to run out")
+	}
+
+	pauses.pause(nil, now.Add(time.Second))
+	if !pauses.active(other, now) || !pauses.active(nil, now) {
+		t.Error("expected every client to be paused")
+	}
+
+	list := pauses.list(now)
+	if len(list) != 2 || list[0].Client != "" || list[1].Client != "192.168.1.20" {
+		t.Fatalf("expected the pause for every client then the client's, got %v", list)
+	}
+	if list := pauses.list(now.Add(time.Hour)); len(list) != 0 || len(pauses.clients) != 0 {
+		t.Errorf("expected the pauses that ran out to be gone, got %v", list)
+	}
+
+	pauses.pause(client, now.Add(time.Minute))
+	pauses.pause(nil, now.Add(time.Minute))
+	pauses.pause(client, time.Time{})
+	pauses.pause(nil, time.Time{})
+	if pauses.active(client, now) || len(pauses.clients) != 0 {
+		t.Error("expected the pauses to be ended")
+	}
+}
+
+func pauseResolver() *DNSResolver {
+	resolver := NewDNSResolverWithOpts(ResolverOpts{Upstreams: []string{}})
+	resolver.AddBlocklistEntries([]string{"ads.example.com", "tracker.example.net"})
+	cacheRecords(resolver, "ads.example.com", DNSTypeA, addressRecord("ads.example.com", net.ParseIP("93.184.216.34")))
+	return resolver
+}
+
+func blocked(answers []*DNSRecord) bool {
+	return len(answers) == 1 && net.IP(answers[0].RData).Equal(net.IPv4zero)
+}
+
+func TestDNSResolver_PauseBlocking(t *testing.T) {
+	resolver := pauseResolver()
+	client := net.ParseIP("192.168.1.20")
+
+	pause := resolver.PauseBlocking(nil, time.Minute)
+	if pause.Client != "" || time.Until(pause.Until) <= 0 {
+		t.Errorf("unexpected pause %v", pause)
+	}
+	answers, _, _, err := resolver.ResolveQuery(Query{Domain: "ads.example.com", Type: DNSTypeA, Client: client})
+	if err != nil || blocked(answers) || len(answers) != 1 {
+		t.Errorf("expected the answer while blocking is paused, got %v (%v)", answers, err)
+	}
+
+	resolver.ResumeBlocking(nil)
+	answers, _, _, err = resolver.ResolveQuery(Query{Domain: "ads.example.com", Type: DNSTypeA, Client: client})
+	if err != nil || !blocked(answers) {
+		t.Errorf("expected the name to be blocked again, got %v (%v)", answers, err)
+	}
+	if pauses := resolver.BlockingPauses(); len(pauses) != 0 {
+		t.Errorf("expected no pauses, got %v", pauses)
+	}
+}
+
+func TestDNSResolver_PauseBlockingForClient(t *testing.T) {
+	resolver := pauseResolver()
+	client, other := net.ParseIP("192.168.1.20"), net.ParseIP("192.168.1.21")
+
+	resolver.PauseBlocking(client, time.Minute)
+	if answers, _, _, _ := resolver.ResolveQuery(Query{Domain: "ads.example.com", Type: DNSTypeA, Client: client}); blocked(answers) {
+		t.Error("expected blocking to be paused for the client")
+	}
+	if answers, _, _, _ := resolver.ResolveQuery(Query{Domain: "ads.example.com", Type: DNSTypeA, Client: other}); !blocked(answers) {
+		t.Error("expected other clients to stay blocked")
+	}
+	if answers, _, _ := resolver.Resolve("ads.example.com", DNSTypeA); !blocked(answers) {
+		t.Error("expected queries without a client to stay blocked")
+	}
+
+	pauses := resolver.BlockingPauses()
+	if len(pauses) != 1 || pauses[0].Client != "192.168.1.20" {
+		t.Errorf("expected the client's pause, got %v", pauses)
+	}
+}
+
+func TestDNSResolver_PauseBlockingResumesByItself(t *testing.T) {
+	resolver := pauseResolver()
+	resolver.PauseBlocking(nil, 50*time.Millisecond)
+	if answers, _, _ := resolver.Resolve("ads.example.com", DNSTypeA); blocked(answers) {
+		t.Fatal("expected blocking to be paused")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if answers, _, _ := resolver.Resolve("ads.example.com", DNSTypeA); !blocked(answers) {
+		t.Error("expected blocking to resume once the pause ran out")
+	}
+	if pauses := resolver.BlockingPauses(); len(pauses) != 0 {
+		t.Errorf("expected the pause to be gone, got %v", pauses)
+	}
+}
+
+func TestDNSResolver_PauseBlockingCloaking(t *testing.T) {
+	resolver := pauseResolver()
+	cname := &DNSRecord{Name: stringToDNSWireFormat("metrics.example.org"), ParsedName: "metrics.example.org", Type: DNSTypeCNAME,
+		Class: DNSClassIN, TTL: 300, RData: stringToDNSWireFormat("tracker.example.net"), ParsedRData: "tracker.example.net"}
+	cacheRecords(resolver, "metrics.example.org", DNSTypeA, cname, addressRecord("tracker.example.net", net.ParseIP("93.184.216.35")))
+
+	resolver.PauseBlocking(nil, time.Minute)
+	if answers, _, _ := resolver.Resolve("metrics.example.org", DNSTypeA); len(answers) != 2 {
+		t.Errorf("expected the CNAME chain while blocking is paused, got %v", answers)
+	}
+	resolver.ResumeBlocking(nil)
+	if answers, _, _ := resolver.Resolve("metrics.example.org", DNSTypeA); !blocked(answers) {
+		t.Errorf("expected the cloaked name to be blocked again, got %v", answers)
+	}
+}
+
+func TestDNSResolver_PauseBlockingKeepsPolicyZones(t *testing.T) {
+	resolver := pauseResolver()
+	zone := NewResponsePolicyZone("rpz.example", nil)
+	zone.exact["malware.example.com"] = &rpzTrigger{action: RPZActionNXDomain}
+	resolver.SetResponsePolicyZone(zone)
+
+	resolver.PauseBlocking(nil, time.Minute)
+	if _, _, err := resolver.Resolve("malware.example.com", DNSTypeA); err != ErrNxDomain {
+		t.Errorf("expected the response policy zone to keep applying, got %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	rateLimitedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_rate_limited_count",
+		Help: "count of rate limited DNS packets by limiter and action",
+	}, []string{"limiter", "action"})
+)
+
+type RateLimitOpts struct {
+	QueriesPerSecond   int // per client subnet, 0 disables query limiting
+	Burst              int
+	IPv4PrefixLength   int
+	IPv6PrefixLength   int
+	ResponsesPerSecond int // identical responses per client subnet, 0 disables response rate limiting
+	Slip               int // every Nth limited response is sent truncated instead of dropped, 0 drops them all
+}
+
+type rrlAction int
+
+const (
+	rrlSend rrlAction = iota
+	rrlDrop
+	rrlSlip
+)
+
+const (
+	// how long a bucket may sit idle before it is forgotten
+	rateLimitBucketIdle = time.Minute
+	// how many buckets a limiter holds, spoofed sources would otherwise add one each until the next sweep
+	maxRateLimitBuckets = 100000
+)
+
+type tokenBucket struct {
+	tokens    float64
+	last      time.Time
+	slipCount int
+}
+
+// rateLimiter is a set of token buckets keyed by an arbitrary string, normally derived from the client subnet
+type rateLimiter struct {
+	rate       float64
+	burst      float64
+	lock       sync.Mutex
+	buckets    map[string]*tokenBucket
+	maxBuckets int
+	lastSweep  time.Time
+}
+
+func newRateLimiter(rate, burst int) *rateLimiter {
+	if burst < rate {
+		burst = rate
+	}
+	return &rateLimiter{
+		rate:       float64(rate),
+		burst:      float64(burst),
+		buckets:    make(map[string]*tokenBucket),
+		maxBuckets: maxRateLimitBuckets,
+		lastSweep:  time.Now(),
+	}
+}
+
+// take removes a token from the bucket for key, returning false and the bucket if none were available. A new key is
+// limited without a bucket while the limiter is full, until the sweep frees the idle ones
+func (l *rateLimiter) take(key string, now time.Time) (bool, *tokenBucket) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitBucketIdle {
+		for k, bucket := range l.buckets {
+			if now.Sub(bucket.last) > rateLimitBucketIdle {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= l.maxBuckets {
+			return false, nil
+		}
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, bucket
+	}
+	bucket.tokens--
+	return true, bucket
+}
+
+// clientLimiter applies the per client subnet query limit and the RRL style identical response limit
+type clientLimiter struct {
+	queries   *rateLimiter
+	responses *rateLimiter
+	v4Mask    net.IPMask
+	v6Mask    net.IPMask
+	slip      int
+}
+
+func newClientLimiter(opts *RateLimitOpts) *clientLimiter {
+	if opts == nil || (opts.QueriesPerSecond == 0 && opts.ResponsesPerSecond == 0) {
+		return nil
+	}
+	v4Prefix := opts.IPv4PrefixLength
+	if v4Prefix < 0 || v4Prefix > 32 {
+		log.Warnf("invalid IPv4 rate limit prefix length %d, using 32", v4Prefix)
+		v4Prefix = 0
+	}
+	if v4Prefix == 0 {
+		v4Prefix = 32
+	}
+	v6Prefix := opts.IPv6PrefixLength
+	if v6Prefix < 0 || v6Prefix > 128 {
+		log.Warnf("invalid IPv6 rate limit prefix length %d, using 56", v6Prefix)
+		v6Prefix = 0
+	}
+	if v6Prefix == 0 {
+		v6Prefix = 56
+	}
+	limiter := &clientLimiter{
+		v4Mask: net.CIDRMask(v4Prefix, 32),
+		v6Mask: net.CIDRMask(v6Prefix, 128),
+		slip:   opts.Slip,
+	}
+	if opts.QueriesPerSecond > 0 {
+		limiter.queries = newRateLimiter(opts.QueriesPerSecond, opts.Burst)
+	}
+	if opts.ResponsesPerSecond > 0 {
+		limiter.responses = newRateLimiter(opts.ResponsesPerSecond, opts.ResponsesPerSecond)
+	}
+	return limiter
+}
+
+func (c *clientLimiter) subnet(addr net.Addr) string {
+	ip, _ := splitAddr(addr)
+	if ip == nil {
+		return addr.String()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(c.v4Mask).String()
+	}
+	return ip.Mask(c.v6Mask).String()
+}
+
+// allowQuery reports whether a query from addr is within the client's query rate
+func (c *clientLimiter) allowQuery(addr net.Addr, now time.Time) bool {
+	if c == nil || c.queries == nil {
+		return true
+	}
+	if ok, _ := c.queries.take(c.subnet(addr), now); !ok {
+		rateLimitedCounter.With(prometheus.Labels{"limiter": "query", "action": "dropped"}).Inc()
+		return false
+	}
+	return true
+}
+
+// checkResponse decides whether a response should be sent, dropped or slipped as a truncated reply, based on how often
+// the same answer has recently gone to the same client subnet
+func (c *clientLimiter) checkResponse(addr net.Addr, msg *DNSMessage, now time.Time) rrlAction {
+	if c == nil || c.responses == nil || len(msg.Questions) == 0 {
+		return rrlSend
+	}
+	question := msg.Questions[0]
+	// the name is folded, randomising its case would otherwise put every response in a bucket of its own
+	key := fmt.Sprintf("%s|%s|%d|%d", c.subnet(addr), canonicalName(question.ParsedName), question.Type, msg.Header.RCODE())
+	ok, bucket := c.responses.take(key, now)
+	if ok {
+		return rrlSend
+	}
+
+	if c.slip > 0 && bucket != nil {
+		c.responses.lock.Lock()
+		bucket.slipCount++
+		slip := bucket.slipCount%c.slip == 0
+		c.responses.lock.Unlock()
+		if slip {
+			rateLimitedCounter.With(prometheus.Labels{"limiter": "response", "action": "slipped"}).Inc()
+			return rrlSlip
+		}
+	}
+	rateLimitedCounter.With(prometheus.Labels{"limiter": "response", "action": "dropped"}).Inc()
+	return rrlDrop
+}
@@ -0,0 +1,151 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testResponse(domain string) *DNSMessage {
+	msg := NewDnsMessage()
+	msg.Questions = append(msg.Questions, &DNSQuestion{ParsedName: domain, Type: DNSTypeA, Class: DNSClassIN})
+	return msg
+}
+
+func TestNewClientLimiter_Disabled(t *testing.T) {
+	if limiter := newClientLimiter(nil); limiter != nil {
+		t.Error("expected nil limiter without options")
+	}
+	if limiter := newClientLimiter(&RateLimitOpts{}); limiter != nil {
+		t.Error("expected nil limiter with zero limits")
+	}
+
+	var limiter *clientLimiter
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	if !limiter.allowQuery(addr, time.Now()) {
+		t.Error("expected nil limiter to allow queries")
+	}
+	if limiter.checkResponse(addr, testResponse("example.com"), time.Now()) != rrlSend {
+		t.Error("expected nil limiter to send responses")
+	}
+}
+
+func TestClientLimiter_QueryBurstThenRefill(t *testing.T) {
+	limiter := newClientLimiter(&RateLimitOpts{QueriesPerSecond: 2, Burst: 3})
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !limiter.allowQuery(addr, now) {
+			t.Fatalf("expected query %d to be within burst", i+1)
+		}
+	}
+	if limiter.allowQuery(addr, now) {
+		t.Fatal("expected query beyond burst to be limited")
+	}
+	if !limiter.allowQuery(addr, now.Add(time.Millisecond*500)) {
+		t.Error("expected a token to be refilled after 500ms at 2qps")
+	}
+}
+
+func TestClientLimiter_SubnetsShareBucket(t *testing.T) {
+	limiter := newClientLimiter(&RateLimitOpts{QueriesPerSecond: 1, IPv4PrefixLength: 24})
+	now := time.Now()
+
+	if !limiter.allowQuery(&net.UDPAddr{IP: net.ParseIP("10.0.0.1")}, now) {
+		t.Fatal("expected first query to be allowed")
+	}
+	if limiter.allowQuery(&net.UDPAddr{IP: net.ParseIP("10.0.0.2")}, now) {
+		t.Error("expected query from the same /24 to share the bucket")
+	}
+	if !limiter.allowQuery(&net.UDPAddr{IP: net.ParseIP("10.0.1.1")}, now) {
+		t.Error("expected query from another /24 to be allowed")
+	}
+}
+
+func TestClientLimiter_InvalidPrefixLengths(t *testing.T) {
+	for _, opts := range []RateLimitOpts{
+		{QueriesPerSecond: 1, IPv4PrefixLength: 33, IPv6PrefixLength: 129},
+		{QueriesPerSecond: 1, IPv4PrefixLength: -1, IPv6PrefixLength: -8},
+	} {
+		limiter := newClientLimiter(&opts)
+		if ones, _ := limiter.v4Mask.Size(); ones != 32 {
+			t.Errorf("%d: expected the default IPv4 prefix length, got %d", opts.IPv4PrefixLength, ones)
+		}
+		if ones, _ := limiter.v6Mask.Size(); ones != 56 {
+			t.Errorf("%d: expected the default IPv6 prefix length, got %d", opts.IPv6PrefixLength, ones)
+		}
+
+		// clients still get a bucket each rather than all sharing one
+		now := time.Now()
+		for _, ip := range []string{"10.0.0.1", "10.0.0.2", "2001:db8:1::1", "2001:db8:2::1"} {
+			if !limiter.allowQuery(&net.UDPAddr{IP: net.ParseIP(ip)}, now) {
+				t.Errorf("%s: expected a bucket of its own", ip)
+			}
+		}
+	}
+}
+
+func TestClientLimiter_ResponseSlip(t *testing.T) {
+	limiter := newClientLimiter(&RateLimitOpts{ResponsesPerSecond: 1, Slip: 2})
+	addr := &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 53}
+	now := time.Now()
+
+	if action := limiter.checkResponse(addr, testResponse("example.com"), now); action != rrlSend {
+		t.Fatalf("expected first response to be sent, got %v", action)
+	}
+	if action := limiter.checkResponse(addr, testResponse("example.com"), now); action != rrlDrop {
+		t.Errorf("expected second response to be dropped, got %v", action)
+	}
+	if action := limiter.checkResponse(addr, testResponse("example.com"), now); action != rrlSlip {
+		t.Errorf("expected third response to slip, got %v", action)
+	}
+	if action := limiter.checkResponse(addr, testResponse("other.com"), now); action != rrlSend {
+		t.Errorf("expected a different response to be sent, got %v", action)
+	}
+}
+
+func TestRateLimiter_SweepsIdleBuckets(t *testing.T) {
+	limiter := newRateLimiter(1, 1)
+	now := time.Now()
+	limiter.take("a", now)
+	limiter.take("b", now.Add(rateLimitBucketIdle*2))
+
+	if _, ok := limiter.buckets["a"]; ok {
+		t.Error("expected idle bucket to be swept")
+	}
+	if _, ok := limiter.buckets["b"]; !ok {
+		t.Error("expected active bucket to remain")
+	}
+}
+
+func TestClientLimiter_ResponseNameCase(t *testing.T) {
+	limiter := newClientLimiter(&RateLimitOpts{ResponsesPerSecond: 1})
+	addr := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5353}
+	now := time.Now()
+
+	if action := limiter.checkResponse(addr, testResponse("example.com"), now); action != rrlSend {
+		t.Fatalf("expected first response to be sent, got %v", action)
+	}
+	if action := limiter.checkResponse(addr, testResponse("ExAmPlE.CoM"), now); action != rrlDrop {
+		t.Errorf("expected the same name in another case to share the bucket, got %v", action)
+	}
+}
+
+func TestRateLimiter_LimitsNewKeysWhenFull(t *testing.T) {
+	limiter := newRateLimiter(1, 1)
+	limiter.maxBuckets = 2
+	now := time.Now()
+	limiter.take("a", now)
+	limiter.take("b", now)
+
+	if ok, bucket := limiter.take("c", now); ok || bucket != nil || len(limiter.buckets) != 2 {
+		t.Error("expected a new key to be limited while the limiter is full")
+	}
+	if ok, _ := limiter.take("a", now.Add(time.Second)); !ok {
+		t.Error("expected known keys to keep their buckets")
+	}
+	if ok, _ := limiter.take("c", now.Add(rateLimitBucketIdle*2)); !ok {
+		t.Error("expected a new key to get a bucket once idle ones are swept")
+	}
+}
@@ -0,0 +1,536 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// RData is the typed form of the data of a record. ParseRData decodes it from the wire format a DNSRecord keeps and
+// MarshalRData encodes it back
+type RData interface {
+	// String returns the data the way a zone file would hold it
+	String() string
+	appendWire(buf []byte) ([]byte, error)
+}
+
+// AddressRData is the data of A and AAAA records
+type AddressRData struct {
+	IP net.IP
+}
+
+// NameRData is the data of CNAME, NS and PTR records
+type NameRData struct {
+	Name string
+}
+
+type MXRData struct {
+	Preference uint16
+	Exchange   string
+}
+
+type SOARData struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+type TXTRData struct {
+	Strings []string
+}
+
+// SRVRData is the data of an SRV record, RFC 2782
+type SRVRData struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+// NAPTRRData is the data of a NAPTR record, RFC 3403
+type NAPTRRData struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Services    string
+	Regexp      string
+	Replacement string
+}
+
+// CAARData is the data of a CAA record, RFC 8659
+type CAARData struct {
+	Flags uint8
+	Tag   string
+	Value string
+}
+
+// SVCBRData is the data of SVCB and HTTPS records, RFC 9460. A priority of 0 makes the record an alias for Target
+type SVCBRData struct {
+	Priority uint16
+	Target   string
+	Params   []SVCBParam
+}
+
+type SVCBParam struct {
+	Key   SVCBKey
+	Value []byte
+}
+
+type SVCBKey uint16
+
+const (
+	SVCBKeyMandatory     SVCBKey = 0
+	SVCBKeyALPN          SVCBKey = 1
+	SVCBKeyNoDefaultALPN SVCBKey = 2
+	SVCBKeyPort          SVCBKey = 3
+	SVCBKeyIPv4Hint      SVCBKey = 4
+	SVCBKeyECH           SVCBKey = 5
+	SVCBKeyIPv6Hint      SVCBKey = 6
+)
+
+func (k SVCBKey) String() string {
+	switch k {
+	case SVCBKeyMandatory:
+		return "mandatory"
+	case SVCBKeyALPN:
+		return "alpn"
+	case SVCBKeyNoDefaultALPN:
+		return "no-default-alpn"
+	case SVCBKeyPort:
+		return "port"
+	case SVCBKeyIPv4Hint:
+		return "ipv4hint"
+	case SVCBKeyECH:
+		return "ech"
+	case SVCBKeyIPv6Hint:
+		return "ipv6hint"
+	default:
+		return fmt.Sprintf("key%d", uint16(k))
+	}
+}
+
+// DSRData is the data of a DS record, RFC 4034
+type DSRData struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+// DNSKEYRData is the data of a DNSKEY record, RFC 4034
+type DNSKEYRData struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+// UnknownRData is the data of a record type there is no typed form for
+type UnknownRData struct {
+	Data []byte
+}
+
+var ErrRDataTooShort = errors.New("record data too short")
+
+// ParseRData decodes the data of a record of the given type. Names in the data must be written out in full, as they
+// are in records from ParseDNSMessage
+func ParseRData(recordType DNSType, rdata []byte) (RData, error) {
+	r := &rdataReader{data: rdata}
+	var data RData
+	switch recordType {
+	case DNSTypeA:
+		if len(rdata) != net.IPv4len {
+			return nil, fmt.Errorf("A record data is %d bytes", len(rdata))
+		}
+		return &AddressRData{IP: net.IP(r.bytes(net.IPv4len))}, nil
+	case DNSTypeAAAA:
+		if len(rdata) != net.IPv6len {
+			return nil, fmt.Errorf("AAAA record data is %d bytes", len(rdata))
+		}
+		return &AddressRData{IP: net.IP(r.bytes(net.IPv6len))}, nil
+	case DNSTypeCNAME, DNSTypeNS, DNSTypePTR:
+		data = &NameRData{Name: r.name()}
+	case DNSTypeMX:
+		data = &MXRData{Preference: r.uint16(), Exchange: r.name()}
+	case DNSTypeSOA:
+		data = &SOARData{MName: r.name(), RName: r.name(), Serial: r.uint32(), Refresh: r.uint32(), Retry: r.uint32(), Expire: r.uint32(), Minimum: r.uint32()}
+	case DNSTypeTXT:
+		txt := &TXTRData{}
+		for r.err == nil && r.remaining() > 0 {
+			txt.Strings = append(txt.Strings, r.characterString())
+		}
+		data = txt
+	case DNSTypeSRV:
+		data = &SRVRData{Priority: r.uint16(), Weight: r.uint16(), Port: r.uint16(), Target: r.name()}
+	case DNSTypeNAPTR:
+		data = &NAPTRRData{Order: r.uint16(), Preference: r.uint16(), Flags: r.characterString(), Services: r.characterString(), Regexp: r.characterString(), Replacement: r.name()}
+	case DNSTypeCAA:
+		caa := &CAARData{Flags: r.uint8()}
+		caa.Tag = r.characterString()
+		caa.Value = string(r.bytes(r.remaining()))
+		data = caa
+	case DNSTypeSVCB, DNSTypeHTTPS:
+		svcb := &SVCBRData{Priority: r.uint16(), Target: r.name()}
+		for r.err == nil && r.remaining() > 0 {
+			key := SVCBKey(r.uint16())
+			svcb.Params = append(svcb.Params, SVCBParam{Key: key, Value: r.bytes(int(r.uint16()))})
+		}
+		data = svcb
+	case DNSTypeDS:
+		data = &DSRData{KeyTag: r.uint16(), Algorithm: r.uint8(), DigestType: r.uint8(), Digest: r.bytes(r.remaining())}
+	case DNSTypeDNSKEY:
+		data = &DNSKEYRData{Flags: r.uint16(), Protocol: r.uint8(), Algorithm: r.uint8(), PublicKey: r.bytes(r.remaining())}
+	default:
+		return &UnknownRData{Data: r.bytes(len(rdata))}, nil
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid %s record data: %w", recordType, r.err)
+	}
+	if r.remaining() > 0 {
+		return nil, fmt.Errorf("invalid %s record data: %d bytes left over", recordType, r.remaining())
+	}
+	return data, nil
+}
+
+// MarshalRData encodes typed record data into the wire format a DNSRecord keeps
+func MarshalRData(data RData) ([]byte, error) {
+	return data.appendWire(nil)
+}
+
+// rdataReader reads the fields of record data in order. The first field that does not fit stops the reader, every
+// read after it returns the zero value and err says what went wrong
+type rdataReader struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func (r *rdataReader) remaining() int {
+	return len(r.data) - r.offset
+}
+
+func (r *rdataReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > r.remaining() {
+		r.err = ErrRDataTooShort
+		return nil
+	}
+	b := append([]byte(nil), r.data[r.offset:r.offset+n]...)
+	r.offset += n
+	return b
+}
+
+func (r *rdataReader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *rdataReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *rdataReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *rdataReader) characterString() string {
+	length := r.uint8()
+	return string(r.bytes(int(length)))
+}
+
+func (r *rdataReader) name() string {
+	if r.err != nil {
+		return ""
+	}
+	if r.remaining() == 0 {
+		r.err = ErrRDataTooShort
+		return ""
+	}
+	name, next, err := parseDNSName(r.data, r.offset)
+	if err != nil {
+		r.err = err
+		return ""
+	}
+	r.offset = next
+	return name
+}
+
+func appendCharacterString(buf []byte, s string) ([]byte, error) {
+	if len(s) > 255 {
+		return nil, fmt.Errorf("character string %q is longer than 255 bytes", s)
+	}
+	return append(append(buf, byte(len(s))), s...), nil
+}
+
+// appendRDataName appends a name to record data, in full as names in data are only compressed within a message
+func appendRDataName(buf []byte, name string) ([]byte, error) {
+	var nilCompressor *nameCompressor
+	return nilCompressor.appendName(buf, name)
+}
+
+func (d *AddressRData) appendWire(buf []byte) ([]byte, error) {
+	if ip4 := d.IP.To4(); ip4 != nil {
+		return append(buf, ip4...), nil
+	}
+	if len(d.IP) != net.IPv6len {
+		return nil, fmt.Errorf("invalid address %v", d.IP)
+	}
+	return append(buf, d.IP...), nil
+}
+
+func (d *AddressRData) String() string {
+	return d.IP.String()
+}
+
+func (d *NameRData) appendWire(buf []byte) ([]byte, error) {
+	return appendRDataName(buf, d.Name)
+}
+
+func (d *NameRData) String() string {
+	return presentationName(d.Name)
+}
+
+func (d *MXRData) appendWire(buf []byte) ([]byte, error) {
+	return appendRDataName(binary.BigEndian.AppendUint16(buf, d.Preference), d.Exchange)
+}
+
+func (d *MXRData) String() string {
+	return fmt.Sprintf("%d %s", d.Preference, presentationName(d.Exchange))
+}
+
+func (d *SOARData) appendWire(buf []byte) ([]byte, error) {
+	var err error
+	if buf, err = appendRDataName(buf, d.MName); err != nil {
+		return nil, err
+	}
+	if buf, err = appendRDataName(buf, d.RName); err != nil {
+		return nil, err
+	}
+	for _, field := range []uint32{d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum} {
+		buf = binary.BigEndian.AppendUint32(buf, field)
+	}
+	return buf, nil
+}
+
+func (d *SOARData) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", presentationName(d.MName), presentationName(d.RName), d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum)
+}
+
+func (d *TXTRData) appendWire(buf []byte) ([]byte, error) {
+	var err error
+	for _, s := range d.Strings {
+		if buf, err = appendCharacterString(buf, s); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func (d *TXTRData) String() string {
+	quoted := make([]string, 0, len(d.Strings))
+	for _, s := range d.Strings {
+		quoted = append(quoted, quoteCharacterString(s))
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (d *SRVRData) appendWire(buf []byte) ([]byte, error) {
+	buf = binary.BigEndian.AppendUint16(buf, d.Priority)
+	buf = binary.BigEndian.AppendUint16(buf, d.Weight)
+	buf = binary.BigEndian.AppendUint16(buf, d.Port)
+	return appendRDataName(buf, d.Target)
+}
+
+func (d *SRVRData) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.Priority, d.Weight, d.Port, presentationName(d.Target))
+}
+
+func (d *NAPTRRData) appendWire(buf []byte) ([]byte, error) {
+	buf = binary.BigEndian.AppendUint16(buf, d.Order)
+	buf = binary.BigEndian.AppendUint16(buf, d.Preference)
+	var err error
+	for _, s := range []string{d.Flags, d.Services, d.Regexp} {
+		if buf, err = appendCharacterString(buf, s); err != nil {
+			return nil, err
+		}
+	}
+	return appendRDataName(buf, d.Replacement)
+}
+
+func (d *NAPTRRData) String() string {
+	return fmt.Sprintf("%d %d %s %s %s %s", d.Order, d.Preference, quoteCharacterString(d.Flags),
+		quoteCharacterString(d.Services), quoteCharacterString(d.Regexp), presentationName(d.Replacement))
+}
+
+func (d *CAARData) appendWire(buf []byte) ([]byte, error) {
+	if d.Tag == "" {
+		return nil, errors.New("CAA record without a tag")
+	}
+	buf, err := appendCharacterString(append(buf, d.Flags), d.Tag)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, d.Value...), nil
+}
+
+func (d *CAARData) String() string {
+	return fmt.Sprintf("%d %s %s", d.Flags, d.Tag, quoteCharacterString(d.Value))
+}
+
+func (d *SVCBRData) appendWire(buf []byte) ([]byte, error) {
+	buf, err := appendRDataName(binary.BigEndian.AppendUint16(buf, d.Priority), d.Target)
+	if err != nil {
+		return nil, err
+	}
+	for _, param := range d.Params {
+		if len(param.Value) > 0xffff {
+			return nil, fmt.Errorf("value of %s is too long", param.Key)
+		}
+		buf = binary.BigEndian.AppendUint16(buf, uint16(param.Key))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(param.Value)))
+		buf = append(buf, param.Value...)
+	}
+	return buf, nil
+}
+
+func (d *SVCBRData) String() string {
+	fields := []string{strconv.Itoa(int(d.Priority)), presentationName(d.Target)}
+	for _, param := range d.Params {
+		fields = append(fields, param.String())
+	}
+	return strings.Join(fields, " ")
+}
+
+// String returns the parameter as key=value, values that don't decode are written in the generic form
+func (p SVCBParam) String() string {
+	value, ok := p.presentationValue()
+	switch {
+	case !ok:
+		return p.Key.String() + "=" + quoteCharacterString(string(p.Value))
+	case value == "":
+		return p.Key.String()
+	default:
+		return p.Key.String() + "=" + value
+	}
+}
+
+func (p SVCBParam) presentationValue() (string, bool) {
+	switch p.Key {
+	case SVCBKeyMandatory:
+		if len(p.Value)%2 != 0 {
+			return "", false
+		}
+		keys := make([]string, 0, len(p.Value)/2)
+		for i := 0; i < len(p.Value); i += 2 {
+			keys = append(keys, SVCBKey(binary.BigEndian.Uint16(p.Value[i:])).String())
+		}
+		return strings.Join(keys, ","), true
+	case SVCBKeyALPN:
+		r := &rdataReader{data: p.Value}
+		var protocols []string
+		for r.err == nil && r.remaining() > 0 {
+			protocols = append(protocols, r.characterString())
+		}
+		return strings.Join(protocols, ","), r.err == nil
+	case SVCBKeyNoDefaultALPN:
+		return "", len(p.Value) == 0
+	case SVCBKeyPort:
+		if len(p.Value) != 2 {
+			return "", false
+		}
+		return strconv.Itoa(int(binary.BigEndian.Uint16(p.Value))), true
+	case SVCBKeyIPv4Hint, SVCBKeyIPv6Hint:
+		size := net.IPv4len
+		if p.Key == SVCBKeyIPv6Hint {
+			size = net.IPv6len
+		}
+		if len(p.Value) == 0 || len(p.Value)%size != 0 {
+			return "", false
+		}
+		hints := make([]string, 0, len(p.Value)/size)
+		for i := 0; i < len(p.Value); i += size {
+			hints = append(hints, net.IP(p.Value[i:i+size]).String())
+		}
+		return strings.Join(hints, ","), true
+	case SVCBKeyECH:
+		return base64.StdEncoding.EncodeToString(p.Value), true
+	default:
+		return "", false
+	}
+}
+
+func (d *DSRData) appendWire(buf []byte) ([]byte, error) {
+	buf = binary.BigEndian.AppendUint16(buf, d.KeyTag)
+	return append(append(buf, d.Algorithm, d.DigestType), d.Digest...), nil
+}
+
+func (d *DSRData) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.KeyTag, d.Algorithm, d.DigestType, strings.ToUpper(hex.EncodeToString(d.Digest)))
+}
+
+func (d *DNSKEYRData) appendWire(buf []byte) ([]byte, error) {
+	buf = binary.BigEndian.AppendUint16(buf, d.Flags)
+	return append(append(buf, d.Protocol, d.Algorithm), d.PublicKey...), nil
+}
+
+func (d *DNSKEYRData) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.Flags, d.Protocol, d.Algorithm, base64.StdEncoding.EncodeToString(d.PublicKey))
+}
+
+func (d *UnknownRData) appendWire(buf []byte) ([]byte, error) {
+	return append(buf, d.Data...), nil
+}
+
+// String returns the data in the generic form from RFC 3597
+func (d *UnknownRData) String() string {
+	if len(d.Data) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %s`, len(d.Data), strings.ToUpper(hex.EncodeToString(d.Data)))
+}
+
+// presentationName returns a name fully qualified, the way zone files write it
+func presentationName(name string) string {
+	if name == "" || name == "." {
+		return "."
+	}
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// quoteCharacterString quotes s, escaping quotes and backslashes and writing bytes that are not printable as \DDD
+func quoteCharacterString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,123 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestRData_RoundTrip(t *testing.T) {
+	tests := []struct {
+		recordType DNSType
+		data       RData
+		expected   string
+	}{
+		{DNSTypeA, &AddressRData{IP: net.IPv4(10, 0, 0, 1).To4()}, "10.0.0.1"},
+		{DNSTypeAAAA, &AddressRData{IP: net.ParseIP("fd00::1")}, "fd00::1"},
+		{DNSTypeCNAME, &NameRData{Name: "cdn.example.com"}, "cdn.example.com."},
+		{DNSTypeMX, &MXRData{Preference: 10, Exchange: "mail.example.com"}, "10 mail.example.com."},
+		{DNSTypeSOA, &SOARData{MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 2024010101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300},
+			"ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300"},
+		{DNSTypeTXT, &TXTRData{Strings: []string{"v=spf1 -all", `say "hi"`}}, `"v=spf1 -all" "say \"hi\""`},
+		{DNSTypeSRV, &SRVRData{Priority: 10, Weight: 5, Port: 5060, Target: "sip.example.com"}, "10 5 5060 sip.example.com."},
+		{DNSTypeNAPTR, &NAPTRRData{Order: 100, Preference: 10, Flags: "S", Services: "SIP+D2U", Replacement: "_sip._udp.example.com"},
+			`100 10 "S" "SIP+D2U" "" _sip._udp.example.com.`},
+		{DNSTypeCAA, &CAARData{Tag: "issue", Value: "letsencrypt.org"}, `0 issue "letsencrypt.org"`},
+		{DNSTypeHTTPS, &SVCBRData{Priority: 1, Target: "", Params: []SVCBParam{
+			{Key: SVCBKeyALPN, Value: []byte("\x02h2\x02h3")},
+			{Key: SVCBKeyPort, Value: []byte{0x01, 0xbb}},
+			{Key: SVCBKeyIPv4Hint, Value: []byte{192, 0, 2, 1, 192, 0, 2, 2}},
+		}}, "1 . alpn=h2,h3 port=443 ipv4hint=192.0.2.1,192.0.2.2"},
+		{DNSTypeSVCB, &SVCBRData{Priority: 0, Target: "svc.example.com"}, "0 svc.example.com."},
+		{DNSTypeDS, &DSRData{KeyTag: 20326, Algorithm: 8, DigestType: 2, Digest: []byte{0xe0, 0x6d, 0x44, 0xb8}}, "20326 8 2 E06D44B8"},
+		{DNSTypeDNSKEY, &DNSKEYRData{Flags: 257, Protocol: 3, Algorithm: 8, PublicKey: []byte{1, 2, 3}}, "257 3 8 AQID"},
+		{DNSType(99), &UnknownRData{Data: []byte{0xde, 0xad}}, `\# 2 DEAD`},
+	}
+	for _, test := range tests {
+		t.Run(test.recordType.String(), func(t *testing.T) {
+			if s := test.data.String(); s != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, s)
+			}
+			wire, err := MarshalRData(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := ParseRData(test.recordType, wire)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(parsed, test.data) {
+				t.Errorf("expected %+v, got %+v", test.data, parsed)
+			}
+		})
+	}
+}
+
+func TestParseRData_Invalid(t *testing.T) {
+	if _, err := ParseRData(DNSTypeSRV, []byte{0, 10, 0, 5}); !errors.Is(err, ErrRDataTooShort) {
+		t.Errorf("expected a short SRV record to be rejected, got %v", err)
+	}
+	if _, err := ParseRData(DNSTypeTXT, []byte{5, 'a', 'b'}); !errors.Is(err, ErrRDataTooShort) {
+		t.Errorf("expected a truncated TXT string to be rejected, got %v", err)
+	}
+	if _, err := ParseRData(DNSTypeA, []byte{10, 0, 0}); err == nil {
+		t.Error("expected a 3 byte address to be rejected")
+	}
+	if _, err := ParseRData(DNSTypeMX, append(append([]byte{0, 10}, stringToDNSWireFormat("mail.example.com")...), 0xff)); err == nil {
+		t.Error("expected left over bytes to be rejected")
+	}
+}
+
+func TestDNSRecord_String(t *testing.T) {
+	record := &DNSRecord{ParsedName: "_sip._udp.example.com", Type: DNSTypeSRV, Class: DNSClassIN, TTL: 300,
+		RData: append([]byte{0, 10, 0, 5, 0x13, 0xc4}, stringToDNSWireFormat("sip.example.com")...)}
+	if s := record.String(); s != "_sip._udp.example.com. 300 IN SRV 10 5 5060 sip.example.com." {
+		t.Errorf("unexpected record %q", s)
+	}
+
+	// data that doesn't decode is still shown
+	record = &DNSRecord{ParsedName: "example.com", Type: DNSTypeCAA, Class: DNSClassIN, TTL: 60, RData: []byte{0}}
+	if s := record.String(); s != `example.com. 60 IN CAA \# 1 00` {
+		t.Errorf("unexpected record %q", s)
+	}
+}
+
+func TestParseDNSMessage_ExpandsSRVTarget(t *testing.T) {
+	// an upstream that compressed the SRV target against the question, which RFC 2782 does not allow
+	msg := []byte{0x12, 0x34, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0}
+	msg = append(msg, stringToDNSWireFormat("_sip._udp.example.com")...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(DNSTypeSRV))
+	msg = binary.BigEndian.AppendUint16(msg, DNSClassIN)
+	msg = append(msg, 0xc0, 0x0c)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(DNSTypeSRV))
+	msg = binary.BigEndian.AppendUint16(msg, DNSClassIN)
+	msg = binary.BigEndian.AppendUint32(msg, 300)
+	// priority, weight and port, then sip. pointing at example.com in the question
+	rdata := []byte{0, 10, 0, 5, 0x13, 0xc4, 3, 's', 'i', 'p', 0xc0, 0x16}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+	msg = append(msg, rdata...)
+
+	parsed, err := ParseDNSMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := parsed.Answers[0].Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv, ok := data.(*SRVRData); !ok || srv.Target != "sip.example.com" {
+		t.Fatalf("expected the target in full, got %+v", data)
+	}
+
+	// the target goes out in full even though the question holds the same suffix
+	marshaled, err := MarshalDNSMessage(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(marshaled, stringToDNSWireFormat("sip.example.com")) {
+		t.Errorf("expected the SRV target uncompressed, got %x", marshaled)
+	}
+}
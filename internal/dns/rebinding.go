@@ -0,0 +1,138 @@
+package dns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	rebindingCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_rebinding_count",
+		Help: "count of upstream answers pointing at private addresses by action taken",
+	}, []string{"action"})
+)
+
+type RebindingAction string
+
+const (
+	RebindingActionStrip RebindingAction = "strip" // remove the private answers and return whatever is left
+	RebindingActionBlock RebindingAction = "block" // answer NXDOMAIN for the whole response
+)
+
+func ParseRebindingAction(action string) (RebindingAction, bool) {
+	switch RebindingAction(action) {
+	case "", RebindingActionStrip:
+		return RebindingActionStrip, true
+	case RebindingActionBlock:
+		return RebindingActionBlock, true
+	default:
+		return RebindingActionStrip, false
+	}
+}
+
+type RebindingOpts struct {
+	Action    RebindingAction
+	Allowlist []string // domains, and everything below them, that may resolve to private addresses
+}
+
+// rebindingFilter keeps public names from resolving to addresses on the local network, which would let a web page
+// reach the router or other local services through the browser. A nil filter lets everything through
+type rebindingFilter struct {
+	action    RebindingAction
+	allowlist []string
+}
+
+func newRebindingFilter(opts *RebindingOpts) *rebindingFilter {
+	if opts == nil {
+		return nil
+	}
+	action := opts.Action
+	if action == "" {
+		action = RebindingActionStrip
+	}
+	allowlist := make([]string, 0, len(opts.Allowlist))
+	for _, domain := range opts.Allowlist {
+		allowlist = append(allowlist, canonicalName(domain))
+	}
+	return &rebindingFilter{action: action, allowlist: allowlist}
+}
+
+func (f *rebindingFilter) allowed(domain string) bool {
+	domain = canonicalName(domain)
+	for _, allowed := range f.allowlist {
+		if domain == allowed || strings.HasSuffix(domain, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter checks the answers an upstream gave for domain. It returns the answers to use, and whether the response
+// should be blocked altogether. Once every answer is stripped the result is empty rather than nil, the name still
+// exists, it just has no data the client may have
+func (f *rebindingFilter) filter(domain string, answers []*DNSRecord, upstream net.IP) ([]*DNSRecord, bool) {
+	if f == nil || f.allowed(domain) {
+		return answers, false
+	}
+	kept := make([]*DNSRecord, 0, len(answers))
+	emptied := make(map[string]bool)
+	for _, answer := range answers {
+		if isRebindingAnswer(answer) {
+			emptied[canonicalName(answer.ParsedName)] = true
+		} else {
+			kept = append(kept, answer)
+		}
+	}
+	stripped := len(answers) - len(kept)
+	if stripped == 0 {
+		return answers, false
+	}
+
+	rebindingCounter.With(prometheus.Labels{"action": string(f.action)}).Add(float64(stripped))
+	if f.action == RebindingActionBlock {
+		log.Warnf("blocked %s from %s, possible DNS rebinding with %d private answers", domain, upstream, stripped)
+		return nil, true
+	}
+	log.Warnf("stripped %d private answers for %s from %s, possible DNS rebinding", stripped, domain, upstream)
+	return dropDanglingAliases(kept, emptied), false
+}
+
+// dropDanglingAliases removes the CNAMEs whose targets were left with nothing by stripping, and the CNAMEs leading to
+// those in turn
+func dropDanglingAliases(answers []*DNSRecord, emptied map[string]bool) []*DNSRecord {
+	for _, answer := range answers {
+		if answer.Type != DNSTypeCNAME {
+			delete(emptied, canonicalName(answer.ParsedName))
+		}
+	}
+	for {
+		kept := make([]*DNSRecord, 0, len(answers))
+		for _, answer := range answers {
+			if answer.Type == DNSTypeCNAME && emptied[canonicalName(answer.ParsedRData)] {
+				emptied[canonicalName(answer.ParsedName)] = true
+				continue
+			}
+			kept = append(kept, answer)
+		}
+		if len(kept) == len(answers) {
+			return kept
+		}
+		answers = kept
+	}
+}
+
+// isRebindingAnswer reports whether an answer points at an address that is not reachable from the internet
+func isRebindingAnswer(answer *DNSRecord) bool {
+	if answer.Type != DNSTypeA && answer.Type != DNSTypeAAAA {
+		return false
+	}
+	ip := net.IP(answer.RData)
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return false
+	}
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestParseRebindingAction(t *testing.T) {
+	tests := map[string]RebindingAction{"": RebindingActionStrip, "strip": RebindingActionStrip, "block": RebindingActionBlock}
+	for input, expected := range tests {
+		if action, ok := ParseRebindingAction(input); !ok || action != expected {
+			t.Errorf("ParseRebindingAction(%q) = %s, %t; want %s", input, action, ok, expected)
+		}
+	}
+	if _, ok := ParseRebindingAction("drop"); ok {
+		t.Error("expected an unknown action to be rejected")
+	}
+}
+
+func TestIsRebindingAnswer(t *testing.T) {
+	tests := map[string]bool{
+		"192.168.1.1": true,
+		"10.1.2.3":    true,
+		"172.16.0.1":  true,
+		"127.0.0.1":   true,
+		"169.254.1.1": true,
+		"0.0.0.0":     true,
+		"fd00::1":     true,
+		"::1":         true,
+		"8.8.8.8":     false,
+		"172.32.0.1":  false,
+		"2606:4700::": false,
+	}
+	for ip, expected := range tests {
+		if isRebindingAnswer(addressRecord("evil.example.com", net.ParseIP(ip))) != expected {
+			t.Errorf("%s: expected rebinding %t", ip, expected)
+		}
+	}
+	cname := &DNSRecord{Type: DNSTypeCNAME, RData: []byte{10, 0, 0, 1}}
+	if isRebindingAnswer(cname) {
+		t.Error("expected only address records to be checked")
+	}
+}
+
+func TestRebindingFilter_Strip(t *testing.T) {
+	filter := newRebindingFilter(&RebindingOpts{})
+	answers := []*DNSRecord{addressRecord("evil.example.com", net.ParseIP("93.184.216.34")), addressRecord("evil.example.com", net.ParseIP("192.168.1.1"))}
+
+	kept, blocked := filter.filter("evil.example.com", answers, net.ParseIP("1.1.1.1"))
+	if blocked || len(kept) != 1 || !net.IP(kept[0].RData).Equal(net.ParseIP("93.184.216.34")) {
+		t.Errorf("expected only the public answer to be kept, got %v (blocked %t)", kept, blocked)
+	}
+
+	kept, blocked = filter.filter("evil.example.com", answers[1:], net.ParseIP("1.1.1.1"))
+	if blocked || kept == nil || len(kept) != 0 {
+		t.Errorf("expected an empty answer once every answer is stripped, got %v", kept)
+	}
+}
+
+func TestRebindingFilter_StripDropsDanglingAliases(t *testing.T) {
+	filter := newRebindingFilter(&RebindingOpts{})
+	private := addressRecord("internal.example.net", net.ParseIP("192.168.1.1"))
+	public := addressRecord("cdn.example.org", net.ParseIP("93.184.216.34"))
+
+	// www -> edge -> internal, which only has a private address, leaves nothing
+	answers := []*DNSRecord{cnameRecord("www.example.com", "edge.example.com"), cnameRecord("edge.example.com", "Internal.example.net."), private}
+	if kept, _ := filter.filter("www.example.com", answers, net.ParseIP("1.1.1.1")); kept == nil || len(kept) != 0 {
+		t.Errorf("expected the aliases to the stripped name to go as well, got %v", kept)
+	}
+
+	// an alias to a name that keeps a public address stays
+	answers = []*DNSRecord{cnameRecord("www.example.com", "cdn.example.org"), public, cnameRecord("api.example.com", "internal.example.net"), private}
+	kept, _ := filter.filter("www.example.com", answers, net.ParseIP("1.1.1.1"))
+	if len(kept) != 2 || kept[0] != answers[0] || kept[1] != public {
+		t.Errorf("expected the alias to the public name to be kept, got %v", kept)
+	}
+}
+
+func TestDNSResolver_RebindingStripAnswersNoData(t *testing.T) {
+	upstream := &authority{zone: "example.test", records: []*DNSRecord{
+		addressRecord("evil.example.test", net.IPv4(192, 168, 1, 1)),
+	}}
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+	upstream.serve(t, fmt.Sprintf("127.0.0.1:%d", port))
+
+	resolver := NewDNSResolverWithOpts(ResolverOpts{Upstreams: []string{"127.0.0.1"}, Rebinding: &RebindingOpts{}})
+	resolver.upstreams.port = port
+
+	answers, _, err := resolver.Resolve("evil.example.test", DNSTypeA)
+	if err != nil || len(answers) != 0 {
+		t.Errorf("expected an empty answer rather than NXDOMAIN, got %v (%v)", answers, err)
+	}
+}
+
+func TestRebindingFilter_Block(t *testing.T) {
+	filter := newRebindingFilter(&RebindingOpts{Action: RebindingActionBlock})
+	answers := []*DNSRecord{addressRecord("evil.example.com", net.ParseIP("93.184.216.34")), addressRecord("evil.example.com", net.ParseIP("10.0.0.1"))}
+
+	if _, blocked := filter.filter("evil.example.com", answers, net.ParseIP("1.1.1.1")); !blocked {
+		t.Error("expected the response to be blocked")
+	}
+	if kept, blocked := filter.filter("example.com", answers[:1], net.ParseIP("1.1.1.1")); blocked || len(kept) != 1 {
+		t.Error("expected public answers to pass")
+	}
+}
+
+func TestRebindingFilter_Allowlist(t *testing.T) {
+	filter := newRebindingFilter(&RebindingOpts{Allowlist: []string{"plex.direct."}})
+	answers := []*DNSRecord{addressRecord("evil.example.com", net.ParseIP("192.168.1.20"))}
+
+	for _, domain := range []string{"plex.direct", "192-168-1-20.abcdef.PLEX.direct"} {
+		if kept, _ := filter.filter(domain, answers, net.ParseIP("1.1.1.1")); len(kept) != 1 {
+			t.Errorf("expected %s to be allowed private answers", domain)
+		}
+	}
+	if kept, _ := filter.filter("notplex.direct.example.com", answers, net.ParseIP("1.1.1.1")); len(kept) != 0 {
+		t.Error("expected names merely containing the allowlisted domain to be filtered")
+	}
+}
+
+func TestRebindingFilter_Nil(t *testing.T) {
+	var filter *rebindingFilter
+	answers := []*DNSRecord{addressRecord("evil.example.com", net.ParseIP("192.168.1.1"))}
+	if kept, blocked := filter.filter("evil.example.com", answers, net.ParseIP("1.1.1.1")); blocked || len(kept) != 1 {
+		t.Error("expected a nil filter to let everything through")
+	}
+	if newRebindingFilter(nil) != nil {
+		t.Error("expected no filter without options")
+	}
+}
@@ -0,0 +1,475 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var recursionQueryCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "dns_recursion_query_count",
+	Help: "count of queries sent to authoritative servers while resolving recursively, by result",
+}, []string{"result"})
+
+// DefaultRootHints are the addresses of the IANA root servers, a to m
+var DefaultRootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13", "192.203.230.10", "192.5.5.241", "192.112.36.4",
+	"198.97.190.53", "192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42", "202.12.27.33",
+}
+
+var ErrRecursionLimit = errors.New("gave up resolving recursively")
+
+const (
+	defaultRecursionQueries = 64 // queries one lookup may send, counting the name servers it has to look up on the way
+	maxRecursionDepth       = 8  // CNAMEs and name server names followed from the name asked for
+	maxMinimisedQueries     = 10 // minimised queries before the full name is sent, RFC 9156 MAX_MINIMISE_COUNT
+	maxDelegationTTL        = 24 * time.Hour
+)
+
+type RecursionOpts struct {
+	RootHints  []string // addresses of the root servers, DefaultRootHints when empty
+	MaxQueries int      // queries one lookup may send to authoritative servers before giving up
+}
+
+// delegation is a zone and the servers it is delegated to. Servers come from glue, names are the name servers the
+// delegation had no glue for, which are looked up when the servers run out
+type delegation struct {
+	zone    string
+	servers []net.IP
+	names   []string
+	expiry  time.Time
+}
+
+type delegationCache struct {
+	lock  sync.Mutex
+	zones map[string]*delegation
+}
+
+func (c *delegationCache) get(zone string, now time.Time) *delegation {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	d, ok := c.zones[zone]
+	if !ok {
+		return nil
+	}
+	if now.After(d.expiry) {
+		delete(c.zones, zone)
+		return nil
+	}
+	return d
+}
+
+func (c *delegationCache) set(d *delegation) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.zones[d.zone] = d
+}
+
+// recursor resolves names itself, following referrals down from the root servers instead of asking upstreams
+type recursor struct {
+	roots       []net.IP
+	port        int // the port authoritative servers listen on
+	maxQueries  int
+	delegations *delegationCache
+	dialTimeout time.Duration
+	readTimeout time.Duration
+	timeout     time.Duration // how long one lookup may take, all queries together
+	tap         *DnstapWriter
+}
+
+func newRecursor(opts *RecursionOpts, dialTimeout, readTimeout, timeout time.Duration, tap *DnstapWriter) *recursor {
+	if opts == nil {
+		return nil
+	}
+	hints := opts.RootHints
+	if len(hints) == 0 {
+		hints = DefaultRootHints
+	}
+	roots := make([]net.IP, 0, len(hints))
+	for _, hint := range hints {
+		if ip := net.ParseIP(hint); ip != nil {
+			roots = append(roots, ip)
+		} else {
+			log.Warnf("ignoring invalid root hint %s", hint)
+		}
+	}
+	maxQueries := opts.MaxQueries
+	if maxQueries <= 0 {
+		maxQueries = defaultRecursionQueries
+	}
+	return &recursor{
+		roots:       roots,
+		port:        53,
+		maxQueries:  maxQueries,
+		delegations: &delegationCache{zones: make(map[string]*delegation)},
+		dialTimeout: dialTimeout,
+		readTimeout: readTimeout,
+		timeout:     timeout,
+		tap:         tap,
+	}
+}
+
+// iteration is the budget one lookup shares with the lookups it makes on the way
+type iteration struct {
+	queries  int
+	deadline time.Time
+}
+
+func (r *recursor) resolve(domain string, dnsType DNSType) upstreamResult {
+	it := &iteration{queries: r.maxQueries, deadline: time.Now().Add(r.timeout)}
+	return r.iterate(it, canonicalName(domain), dnsType, 0)
+}
+
+// iterate follows referrals from the closest delegation known for name down to the servers that answer for it. Names
+// are minimised on the way, each server is only told one label more than the zone it serves, RFC 9156
+func (r *recursor) iterate(it *iteration, name string, dnsType DNSType, depth int) upstreamResult {
+	if depth > maxRecursionDepth {
+		log.Warnf("giving up on %s after following %d names", name, depth)
+		return upstreamResult{err: ErrRecursionLimit}
+	}
+	zone := r.closest(name, dnsType)
+	known, minimised := zone.zone, 0
+	for {
+		qname, qtype := name, dnsType
+		if minimised < maxMinimisedQueries {
+			qname = nextName(known, name)
+		}
+		if qname != name {
+			// A draws fewer broken answers from old servers than NS, RFC 9156 2.1
+			qtype = DNSTypeA
+			minimised++
+		}
+
+		msg, server, err := r.ask(it, zone, qname, qtype, depth)
+		if err != nil {
+			return upstreamResult{err: err}
+		}
+		if msg.Header.RCODE() == RCODENameFailure {
+			// there is nothing below a name that does not exist, RFC 8020
+			return upstreamResult{upstream: server, err: ErrNxDomain}
+		}
+		if child := r.referral(msg, zone.zone, qname); child != nil {
+			log.Debugf("%s is delegated to %v %v", child.zone, child.servers, child.names)
+			r.delegations.set(child)
+			zone, known = child, child.zone
+			continue
+		}
+		if qname != name {
+			// the minimised name is part of the zone, the next label is asked of the same servers
+			known = qname
+			continue
+		}
+
+		answers := msg.Answers
+		if target, ok := aliasTarget(answers, name, dnsType); ok {
+			res := r.iterate(it, target, dnsType, depth+1)
+			if res.err != nil {
+				return res
+			}
+			res.answers = append(slices.Clip(answers), res.answers...)
+			return res
+		}
+		res := upstreamResult{upstream: server}
+		if len(answers) > 0 {
+			res.answers = answers
+		}
+		if len(msg.Authorities) > 0 {
+			res.authorities = msg.Authorities
+		}
+		return res
+	}
+}
+
+// closest returns the deepest delegation cached for name, the root servers when there is none. DS records live on the
+// parent side of a zone cut, so their lookups start above the name
+func (r *recursor) closest(name string, dnsType DNSType) *delegation {
+	now := time.Now()
+	zone := name
+	if dnsType == DNSTypeDS && zone != "" {
+		zone = parentName(zone)
+	}
+	for ; zone != ""; zone = parentName(zone) {
+		if d := r.delegations.get(zone, now); d != nil {
+			return d
+		}
+	}
+	return &delegation{servers: r.roots}
+}
+
+// ask sends the query to the servers of the zone until one answers. Name servers without glue are looked up once the
+// servers run out
+func (r *recursor) ask(it *iteration, zone *delegation, qname string, qtype DNSType, depth int) (*DNSMessage, net.IP, error) {
+	for _, server := range zone.servers {
+		msg, err := r.exchange(it, server, qname, qtype)
+		if err == nil {
+			return msg, server, nil
+		}
+		if err == ErrRecursionLimit {
+			return nil, nil, err
+		}
+		log.Debugf("unable to ask %s about %s: %v", server, qname, err)
+	}
+	for _, name := range zone.names {
+		if inZone(name, zone.zone) {
+			// without glue there is no way to reach a server that is only found through itself
+			continue
+		}
+		res := r.iterate(it, name, DNSTypeA, depth+1)
+		if res.err == ErrRecursionLimit {
+			return nil, nil, res.err
+		}
+		for _, answer := range res.answers {
+			if answer.Type != DNSTypeA {
+				continue
+			}
+			server := net.IP(answer.RData)
+			r.learnServer(zone, server)
+			msg, err := r.exchange(it, server, qname, qtype)
+			if err == nil {
+				return msg, server, nil
+			}
+			if err == ErrRecursionLimit {
+				return nil, nil, err
+			}
+			log.Debugf("unable to ask %s about %s: %v", server, qname, err)
+		}
+	}
+	log.Warnf("no server for %s answered about %s", zoneName(zone.zone), qname)
+	return nil, nil, ErrDNSServerFailure
+}
+
+// learnServer caches the address of a name server that was looked up, so the next lookup in the zone can use it
+func (r *recursor) learnServer(zone *delegation, server net.IP) {
+	if zone.zone == "" {
+		return
+	}
+	cached := r.delegations.get(zone.zone, time.Now())
+	if cached == nil || slices.ContainsFunc(cached.servers, server.Equal) {
+		return
+	}
+	r.delegations.set(&delegation{
+		zone:    cached.zone,
+		servers: append(slices.Clip(cached.servers), server),
+		names:   cached.names,
+		expiry:  cached.expiry,
+	})
+}
+
+// exchange sends a single non-recursive query to an authoritative server, over TCP when the answer does not fit UDP
+func (r *recursor) exchange(it *iteration, server net.IP, qname string, qtype DNSType) (*DNSMessage, error) {
+	if it.queries <= 0 || time.Now().After(it.deadline) {
+		log.Warnf("giving up on %s after running out of queries or time", qname)
+		return nil, ErrRecursionLimit
+	}
+	it.queries--
+
+	message := NewDnsMessage()
+	message.Header.ID = uint16(rand.Intn(65535))
+	message.Questions = append(message.Questions, &DNSQuestion{
+		Name:       stringToDNSWireFormat(qname),
+		ParsedName: qname,
+		Type:       qtype,
+		Class:      DNSClassIN,
+	})
+	query, err := MarshalDNSMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(server.String(), fmt.Sprint(r.port))
+	log.Tracef("asking %s for %s %s", addr, qname, qtype)
+	msg, err := r.exchangeOver("udp", addr, query)
+	if err == nil && msg.Header.TC() {
+		msg, err = r.exchangeOver("tcp", addr, query)
+	}
+	if err == nil {
+		err = checkReply(message, msg)
+	}
+	if err == nil {
+		switch msg.Header.RCODE() {
+		case RCODESuccess, RCODENameFailure:
+		default:
+			err = fmt.Errorf("answered %d", msg.Header.RCODE())
+		}
+	}
+	if err != nil {
+		recursionQueryCounter.With(prometheus.Labels{"result": "failed"}).Inc()
+		return nil, err
+	}
+	recursionQueryCounter.With(prometheus.Labels{"result": "success"}).Inc()
+	return msg, nil
+}
+
+func (r *recursor) exchangeOver(network, addr string, query []byte) (*DNSMessage, error) {
+	dialer := net.Dialer{Timeout: r.dialTimeout}
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.readTimeout))
+
+	var reply []byte
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		r.tap.ResolverQuery(conn.LocalAddr(), conn.RemoteAddr(), query)
+		if reply, err = readTCPMessage(conn); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		r.tap.ResolverQuery(conn.LocalAddr(), conn.RemoteAddr(), query)
+		buff := make([]byte, 1500)
+		n, err := conn.Read(buff)
+		if err != nil {
+			return nil, err
+		}
+		reply = buff[:n]
+	}
+	r.tap.ResolverResponse(conn.LocalAddr(), conn.RemoteAddr(), reply)
+	return ParseDNSMessage(reply)
+}
+
+// checkReply makes sure a reply answers the query that was sent, so a spoofed or stray packet is not taken for it
+func checkReply(query, reply *DNSMessage) error {
+	if !reply.Header.QR() || reply.Header.ID != query.Header.ID {
+		return errors.New("reply does not match the query")
+	}
+	if len(reply.Questions) != 1 || canonicalName(reply.Questions[0].ParsedName) != query.Questions[0].ParsedName ||
+		reply.Questions[0].Type != query.Questions[0].Type {
+		return errors.New("reply is for a different question")
+	}
+	return nil
+}
+
+// referral returns the delegation msg refers the resolver to, or nil when msg is not a referral. Only delegations
+// below zone and on the way to qname are followed, and only glue from within zone is trusted
+func (r *recursor) referral(msg *DNSMessage, zone, qname string) *delegation {
+	if len(msg.Answers) > 0 {
+		return nil
+	}
+	child := &delegation{}
+	var ttl uint32
+	for _, authority := range msg.Authorities {
+		if authority.Type == DNSTypeSOA {
+			// a negative answer from the zone itself
+			return nil
+		}
+		if authority.Type != DNSTypeNS {
+			continue
+		}
+		owner := canonicalName(authority.ParsedName)
+		if owner == zone || !inZone(owner, zone) || !inZone(qname, owner) {
+			log.Debugf("ignoring out of bailiwick delegation of %s from %s", owner, zoneName(zone))
+			continue
+		}
+		if child.zone != "" && owner != child.zone {
+			continue
+		}
+		child.zone = owner
+		child.names = append(child.names, canonicalName(authority.ParsedRData))
+		if ttl == 0 || authority.TTL < ttl {
+			ttl = authority.TTL
+		}
+	}
+	if child.zone == "" {
+		return nil
+	}
+
+	names := child.names
+	child.names = nil
+	for _, name := range names {
+		found := false
+		for _, glue := range msg.Additionals {
+			if glue.Type == DNSTypeA && canonicalName(glue.ParsedName) == name && inZone(name, zone) {
+				child.servers = append(child.servers, net.IP(glue.RData))
+				found = true
+			}
+		}
+		if !found {
+			child.names = append(child.names, name)
+		}
+	}
+	child.expiry = time.Now().Add(min(time.Duration(ttl)*time.Second, maxDelegationTTL))
+	return child
+}
+
+// aliasTarget returns where the CNAME chain in answers leads when it does not reach a record of the type asked for,
+// the name that has to be looked up next
+func aliasTarget(answers []*DNSRecord, name string, dnsType DNSType) (string, bool) {
+	if dnsType == DNSTypeCNAME {
+		return "", false
+	}
+	target := name
+	// a chain is never longer than the answers, which also ends a CNAME loop
+	for range answers {
+		next := ""
+		for _, answer := range answers {
+			if canonicalName(answer.ParsedName) != target {
+				continue
+			}
+			if answer.Type == dnsType {
+				return "", false
+			}
+			if answer.Type == DNSTypeCNAME {
+				next = canonicalName(answer.ParsedRData)
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	return target, target != name
+}
+
+// nextName returns name cut down to one label below known, the name a minimised query asks about
+func nextName(known, name string) string {
+	if known == name {
+		return name
+	}
+	rest := name
+	if known != "" {
+		var ok bool
+		if rest, ok = strings.CutSuffix(name, "."+known); !ok {
+			return name
+		}
+	}
+	label := rest[strings.LastIndexByte(rest, '.')+1:]
+	if known == "" {
+		return label
+	}
+	return label + "." + known
+}
+
+// inZone reports whether name is zone or below it, every name is in the root zone ""
+func inZone(name, zone string) bool {
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+func parentName(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+func zoneName(zone string) string {
+	if zone == "" {
+		return "."
+	}
+	return zone
+}
@@ -0,0 +1,393 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// authority stands in for the authoritative servers of a zone. NS records for names below the zone are delegations,
+// answered with a referral and whatever glue the authority holds for the name servers
+type authority struct {
+	zone    string
+	records []*DNSRecord
+	delay   time.Duration // how long each answer takes, queries are answered concurrently when it is set
+	lock    sync.Mutex
+	asked   []string
+}
+
+func testRecord(name string, dnsType DNSType, data RData) *DNSRecord {
+	rdata, err := MarshalRData(data)
+	if err != nil {
+		panic(err)
+	}
+	record := &DNSRecord{Name: stringToDNSWireFormat(name), ParsedName: name, Type: dnsType, Class: DNSClassIN, TTL: 300, RData: rdata}
+	if target, ok := data.(*NameRData); ok {
+		record.ParsedRData = target.Name
+	}
+	return record
+}
+
+func (a *authority) questions() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return slices.Clone(a.asked)
+}
+
+func (a *authority) answer(query *DNSMessage) *DNSMessage {
+	question := query.Questions[0]
+	name := canonicalName(question.ParsedName)
+	a.lock.Lock()
+	a.asked = append(a.asked, fmt.Sprintf("%s %s", name, question.Type))
+	a.lock.Unlock()
+
+	reply := &DNSMessage{Header: query.Header, Questions: query.Questions}
+	reply.Header.SetQR(true)
+
+	cut := ""
+	for _, record := range a.records {
+		if record.Type == DNSTypeNS && record.ParsedName != a.zone && inZone(name, record.ParsedName) {
+			cut = record.ParsedName
+		}
+	}
+	if cut != "" {
+		for _, record := range a.records {
+			if record.Type == DNSTypeNS && record.ParsedName == cut {
+				reply.Authorities = append(reply.Authorities, record)
+				for _, glue := range a.records {
+					if glue.Type == DNSTypeA && glue.ParsedName == record.ParsedRData {
+						reply.Additionals = append(reply.Additionals, glue)
+					}
+				}
+			}
+		}
+		return reply
+	}
+
+	reply.Header.SetAA(true)
+	exists := name == a.zone
+	for _, record := range a.records {
+		if record.ParsedName == name && (record.Type == question.Type || record.Type == DNSTypeCNAME) {
+			reply.Answers = append(reply.Answers, record)
+		}
+		exists = exists || inZone(record.ParsedName, name)
+	}
+	if len(reply.Answers) == 0 {
+		reply.Authorities = append(reply.Authorities, testRecord(a.zone, DNSTypeSOA, &SOARData{
+			MName: "ns." + a.zone, RName: "hostmaster." + a.zone, Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minimum: 60,
+		}))
+		if !exists {
+			reply.Header.SetRCODE(RCODENameFailure)
+		}
+	}
+	return reply
+}
+
+func (a *authority) serve(t testing.TB, addr string) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("unable to listen on %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := ParseDNSMessage(buf[:n])
+			if err != nil || len(query.Questions) != 1 {
+				continue
+			}
+			reply, err := MarshalDNSMessage(a.answer(query))
+			if err != nil {
+				t.Errorf("unable to marshal reply: %v", err)
+				continue
+			}
+			if a.delay > 0 {
+				go func() {
+					time.Sleep(a.delay)
+					conn.WriteTo(reply, from)
+				}()
+				continue
+			}
+			conn.WriteTo(reply, from)
+		}
+	}()
+}
+
+type testHierarchy struct {
+	root, tld, example, other *authority
+	port                      int
+}
+
+// startHierarchy serves a root zone that delegates test., which delegates example.test. with glue and other.test. to a
+// name server in example.test. without. Each zone has its own loopback address, all on the same port
+func startHierarchy(t *testing.T) *testHierarchy {
+	h := &testHierarchy{
+		root: &authority{zone: "", records: []*DNSRecord{
+			testRecord("test", DNSTypeNS, &NameRData{Name: "ns.nic.test"}),
+			addressRecord("ns.nic.test", net.IPv4(127, 0, 0, 2)),
+		}},
+		tld: &authority{zone: "test", records: []*DNSRecord{
+			testRecord("example.test", DNSTypeNS, &NameRData{Name: "ns.example.test"}),
+			addressRecord("ns.example.test", net.IPv4(127, 0, 0, 3)),
+			testRecord("other.test", DNSTypeNS, &NameRData{Name: "ns.hosting.example.test"}),
+		}},
+		example: &authority{zone: "example.test", records: []*DNSRecord{
+			addressRecord("ns.example.test", net.IPv4(127, 0, 0, 3)),
+			addressRecord("ns.hosting.example.test", net.IPv4(127, 0, 0, 4)),
+			addressRecord("web.example.test", net.IPv4(192, 0, 2, 10)),
+			testRecord("www.example.test", DNSTypeCNAME, &NameRData{Name: "web.example.test"}),
+			addressRecord("a.b.deep.example.test", net.IPv4(192, 0, 2, 20)),
+		}},
+		other: &authority{zone: "other.test", records: []*DNSRecord{
+			addressRecord("www.other.test", net.IPv4(192, 0, 2, 30)),
+			testRecord("alias.other.test", DNSTypeCNAME, &NameRData{Name: "web.example.test"}),
+		}},
+	}
+
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.port = probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+	for i, zone := range []*authority{h.root, h.tld, h.example, h.other} {
+		zone.serve(t, fmt.Sprintf("127.0.0.%d:%d", i+1, h.port))
+	}
+	return h
+}
+
+func (h *testHierarchy) recursor(opts *RecursionOpts) *recursor {
+	if opts == nil {
+		opts = &RecursionOpts{}
+	}
+	opts.RootHints = []string{"127.0.0.1"}
+	r := newRecursor(opts, defaultResolverOpts.DialTimeout, defaultResolverOpts.ReadTimeout, defaultResolverOpts.UpstreamTimeout, nil)
+	r.port = h.port
+	return r
+}
+
+func answerAddresses(answers []*DNSRecord) []string {
+	var addresses []string
+	for _, answer := range answers {
+		switch answer.Type {
+		case DNSTypeA:
+			addresses = append(addresses, net.IP(answer.RData).String())
+		case DNSTypeCNAME:
+			addresses = append(addresses, "CNAME "+answer.ParsedRData)
+		}
+	}
+	return addresses
+}
+
+func TestRecursor_Resolve(t *testing.T) {
+	h := startHierarchy(t)
+	r := h.recursor(nil)
+
+	tests := []struct {
+		name     string
+		expected []string
+	}{
+		{"web.example.test", []string{"192.0.2.10"}},
+		{"WWW.Example.Test.", []string{"CNAME web.example.test", "192.0.2.10"}},
+		{"a.b.deep.example.test", []string{"192.0.2.20"}},
+		{"www.other.test", []string{"192.0.2.30"}},
+		{"alias.other.test", []string{"CNAME web.example.test", "192.0.2.10"}},
+	}
+	for _, test := range tests {
+		res := r.resolve(test.name, DNSTypeA)
+		if res.err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, res.err)
+			continue
+		}
+		if addresses := answerAddresses(res.answers); !slices.Equal(addresses, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, addresses)
+		}
+	}
+}
+
+func TestRecursor_NegativeAnswers(t *testing.T) {
+	h := startHierarchy(t)
+	r := h.recursor(nil)
+
+	if res := r.resolve("missing.example.test", DNSTypeA); res.err != ErrNxDomain {
+		t.Errorf("expected NXDOMAIN, got %v", res.err)
+	}
+	// nothing below a name that does not exist is asked about
+	if res := r.resolve("a.missing.nowhere", DNSTypeA); res.err != ErrNxDomain {
+		t.Errorf("expected NXDOMAIN, got %v", res.err)
+	}
+	if asked := h.root.questions(); slices.Contains(asked, "missing.nowhere A") {
+		t.Errorf("expected the resolver to stop at the missing TLD, root was asked %v", asked)
+	}
+
+	res := r.resolve("web.example.test", DNSTypeAAAA)
+	if res.err != nil || res.answers != nil {
+		t.Fatalf("expected an empty answer, got %v (%v)", res.answers, res.err)
+	}
+	if len(res.authorities) != 1 || res.authorities[0].Type != DNSTypeSOA {
+		t.Errorf("expected the SOA of the zone, got %v", res.authorities)
+	}
+}
+
+func TestRecursor_MinimisesNames(t *testing.T) {
+	h := startHierarchy(t)
+	r := h.recursor(nil)
+
+	if res := r.resolve("a.b.deep.example.test", DNSTypeA); res.err != nil {
+		t.Fatal(res.err)
+	}
+	expected := map[*authority][]string{
+		h.root:    {"test A"},
+		h.tld:     {"example.test A"},
+		h.example: {"deep.example.test A", "b.deep.example.test A", "a.b.deep.example.test A"},
+	}
+	for zone, questions := range expected {
+		if asked := zone.questions(); !slices.Equal(asked, questions) {
+			t.Errorf("%s: expected to be asked %v, got %v", zoneName(zone.zone), questions, asked)
+		}
+	}
+}
+
+func TestRecursor_CachesDelegations(t *testing.T) {
+	h := startHierarchy(t)
+	r := h.recursor(nil)
+
+	for _, name := range []string{"web.example.test", "www.other.test", "www.example.test", "www.other.test"} {
+		if res := r.resolve(name, DNSTypeA); res.err != nil {
+			t.Fatalf("%s: %v", name, res.err)
+		}
+	}
+	if asked := h.root.questions(); len(asked) != 1 {
+		t.Errorf("expected the root to be asked once, got %v", asked)
+	}
+	// the name server of other.test was looked up once and then remembered
+	lookups := 0
+	for _, question := range h.example.questions() {
+		if question == "ns.hosting.example.test A" {
+			lookups++
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("expected the name server to be looked up once, got %v", h.example.questions())
+	}
+}
+
+func TestRecursor_QueryLimit(t *testing.T) {
+	h := startHierarchy(t)
+	r := h.recursor(&RecursionOpts{MaxQueries: 2})
+
+	if res := r.resolve("web.example.test", DNSTypeA); res.err != ErrRecursionLimit {
+		t.Errorf("expected the lookup to give up, got %v (%v)", res.answers, res.err)
+	}
+}
+
+func TestRecursor_UnreachableServers(t *testing.T) {
+	r := newRecursor(&RecursionOpts{RootHints: []string{"127.0.0.1"}}, defaultResolverOpts.DialTimeout, 100*time.Millisecond, defaultResolverOpts.UpstreamTimeout, nil)
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.port = probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	if res := r.resolve("example.test", DNSTypeA); res.err != ErrDNSServerFailure {
+		t.Errorf("expected a server failure, got %v", res.err)
+	}
+}
+
+func TestRecursor_Referral(t *testing.T) {
+	r := newRecursor(&RecursionOpts{}, 0, 0, 0, nil)
+	msg := &DNSMessage{
+		Header: &DNSHeader{},
+		Authorities: []*DNSRecord{
+			testRecord("example.test", DNSTypeNS, &NameRData{Name: "ns1.example.test"}),
+			testRecord("example.test", DNSTypeNS, &NameRData{Name: "ns.elsewhere.net"}),
+			// a server for test. can not speak for other zones
+			testRecord("victim.net", DNSTypeNS, &NameRData{Name: "ns.attacker.test"}),
+		},
+		Additionals: []*DNSRecord{
+			addressRecord("ns1.example.test", net.IPv4(192, 0, 2, 53)),
+			addressRecord("ns.elsewhere.net", net.IPv4(198, 51, 100, 66)),
+		},
+	}
+
+	child := r.referral(msg, "test", "www.example.test")
+	if child == nil || child.zone != "example.test" {
+		t.Fatalf("expected a delegation of example.test, got %+v", child)
+	}
+	if len(child.servers) != 1 || !child.servers[0].Equal(net.IPv4(192, 0, 2, 53)) {
+		t.Errorf("expected only the glue from within the zone, got %v", child.servers)
+	}
+	if !slices.Equal(child.names, []string{"ns.elsewhere.net"}) {
+		t.Errorf("expected the name server without trusted glue to be looked up, got %v", child.names)
+	}
+
+	if child := r.referral(msg, "example.test", "www.example.test"); child != nil {
+		t.Errorf("expected a delegation of the zone itself to be ignored, got %+v", child)
+	}
+	if child := r.referral(msg, "test", "www.other.test"); child != nil {
+		t.Errorf("expected a delegation off the path to be ignored, got %+v", child)
+	}
+}
+
+func TestNextName(t *testing.T) {
+	tests := []struct{ known, name, expected string }{
+		{"", "www.example.test", "test"},
+		{"test", "www.example.test", "example.test"},
+		{"example.test", "www.example.test", "www.example.test"},
+		{"www.example.test", "www.example.test", "www.example.test"},
+		{"", "test", "test"},
+	}
+	for _, test := range tests {
+		if next := nextName(test.known, test.name); next != test.expected {
+			t.Errorf("%q below %q: expected %q, got %q", test.name, test.known, test.expected, next)
+		}
+	}
+}
+
+func TestDNSResolver_Recursion(t *testing.T) {
+	h := startHierarchy(t)
+	resolver := NewDNSResolverWithOpts(ResolverOpts{Upstreams: []string{}, Recursion: &RecursionOpts{RootHints: []string{"127.0.0.1"}}})
+	resolver.recursor.port = h.port
+
+	answers, _, err := resolver.Resolve("www.example.test", DNSTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addresses := answerAddresses(answers); !slices.Equal(addresses, []string{"CNAME web.example.test", "192.0.2.10"}) {
+		t.Errorf("unexpected answers %v", addresses)
+	}
+	if _, ok := resolver.cache.get(cacheKey("www.example.test", DNSTypeA), time.Now()); !ok {
+		t.Error("expected the answer to be cached")
+	}
+}
+
+func TestDNSResolver_RecursionQueryLabels(t *testing.T) {
+	h := startHierarchy(t)
+	resolver := NewDNSResolverWithOpts(ResolverOpts{Upstreams: []string{}, Recursion: &RecursionOpts{RootHints: []string{"127.0.0.1"}}})
+	resolver.recursor.port = h.port
+
+	recursed := queryCounter.WithLabelValues("recursion", "success")
+	before, series := testutil.ToFloat64(recursed), testutil.CollectAndCount(queryCounter)
+	// each name is answered by a different authoritative server
+	for _, name := range []string{"web.example.test", "www.other.test"} {
+		if _, _, err := resolver.Resolve(name, DNSTypeA); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := testutil.ToFloat64(recursed); count != before+2 {
+		t.Errorf("expected both answers counted as recursion, got %v", count-before)
+	}
+	if count := testutil.CollectAndCount(queryCounter); count != series {
+		t.Errorf("expected no series for the authoritative servers, got %d new", count-series)
+	}
+}
@@ -21,47 +21,97 @@ var (
 	ErrInvalidBlocklistFormat = errors.New("invalid blocklist format")
 )
 
-var (
-	compressedDomainVal = []byte{0xc0, 0x0c}
-)
+// Query is a question together with the client that asked it, for policies that apply to some clients only
+type Query struct {
+	Domain   string
+	Type     DNSType
+	Client   net.IP // nil when the query did not come from a client
+	Listener net.IP // the address the query was received on, nil when it did not come from a client
+	View     string // the view the server placed the client in, empty for the default view
+	hops     int    // aliases followed so far by rewrites
+}
 
 type Resolver interface {
 	Resolve(domain string, dnsType DNSType) (answers, authorities []*DNSRecord, err error)
+	// ResolveQuery also reports whether the answer comes from a zone served here, which goes out marked authoritative
+	ResolveQuery(query Query) (answers, authorities []*DNSRecord, authoritative bool, err error)
+	Upstreams() []UpstreamStatus
 	AddLocalDomain(domain string, ip net.IP) error
 	DeleteLocalDomain(domain string)
+	AddViewLocalDomain(view, domain string, ip net.IP) error
+	DeleteViewLocalDomain(view, domain string)
+	RegisterHost(name string, ip net.IP, owner string, expiry time.Time) error
+	UnregisterHost(owner string)
+	SetRewriteRules(rules []RewriteRule) error
+	SetResponsePolicyZone(zone *ResponsePolicyZone)
 	AddBlocklistEntries(entries []string)
 	DeleteBlocklistEntry(domain string)
 	FlushBlocklist()
+	PauseBlocking(client net.IP, d time.Duration) BlockingPause
+	ResumeBlocking(client net.IP)
+	BlockingPauses() []BlockingPause
 }
 
 type DNSResolver struct {
-	cache           map[string]*DNSCacheItem
-	upstream        []net.IP
+	cache           *dnsCache
+	inflight        *upstreamCoalescer
+	upstreams       *upstreamPool
 	blacklist       map[string]struct{}
 	localDomains    map[string]net.IP
+	views           map[string]map[string]net.IP // local domains of each view
+	leaseHosts      *leaseHosts
 	domainLock      *sync.RWMutex
 	cacheTTL        time.Duration
 	upstreamTimeout time.Duration
 	dialTimeout     time.Duration
 	readTimeout     time.Duration
+	tap             *DnstapWriter
+	zone            *LocalZone
+	rebinding       *rebindingFilter
+	clientGroups    clientGroups
+	safeSearch      *safeSearchPolicy
+	dns64           *dns64Policy
+	recursor        *recursor // resolves from the root servers instead of the upstreams, nil when it does not
+	pauses          *blockingPauses
+	rewrites        []*rewriteRule
+	policyZones     []*ResponsePolicyZone
+	domainMetrics   bool
+	stats           *QueryStats
 }
 
 type ResolverOpts struct {
-	Upstreams       []string
-	LocalDomains    map[string]net.IP
-	CacheTTL        time.Duration
-	UpstreamTimeout time.Duration
-	DialTimeout     time.Duration
-	ReadTimeout     time.Duration
+	Upstreams        []string
+	LocalDomains     map[string]net.IP
+	CacheTTL         time.Duration
+	UpstreamTimeout  time.Duration
+	DialTimeout      time.Duration
+	ReadTimeout      time.Duration
+	Strategy         UpstreamStrategy
+	FailureThreshold int           // consecutive failures before an upstream is marked down
+	ProbeInterval    time.Duration // how often an upstream that is down gets retried
+	Tap              *DnstapWriter
+	Zone             *LocalZone
+	Rebinding        *RebindingOpts      // filters private addresses out of upstream answers, nil disables it
+	ClientGroups     map[string][]string // named groups of client addresses and networks
+	SafeSearch       *SafeSearchOpts
+	DNS64            *DNS64Opts     // synthesizes AAAA records from A records for IPv6-only clients, nil disables it
+	Recursion        *RecursionOpts // resolves names from the root servers instead of asking the upstreams, nil disables it
+	RewriteRules     []RewriteRule  // evaluated in order before anything else, the first match wins
+	Views            []ViewOpts     // local domains that only clients placed in a view see
+	DomainMetrics    bool           // keep per domain metric series, which grow with every name queried
+	Stats            *QueryStats    // counts blocked names, nil counts nothing
 }
 
 var defaultResolverOpts = ResolverOpts{
-	Upstreams:       []string{"1.1.1.1", "9.9.9.9"},
-	LocalDomains:    make(map[string]net.IP),
-	CacheTTL:        time.Minute * 5,
-	UpstreamTimeout: time.Second * 5,
-	DialTimeout:     time.Second * 2,
-	ReadTimeout:     time.Second * 2,
+	Upstreams:        []string{"1.1.1.1", "9.9.9.9"},
+	LocalDomains:     make(map[string]net.IP),
+	CacheTTL:         time.Minute * 5,
+	UpstreamTimeout:  time.Second * 5,
+	DialTimeout:      time.Second * 2,
+	ReadTimeout:      time.Second * 2,
+	Strategy:         UpstreamStrategyParallel,
+	FailureThreshold: 3,
+	ProbeInterval:    time.Second * 30,
 }
 
 type DNSCacheItem struct {
@@ -84,6 +134,8 @@ func NewDNSResolverWithOpts(options ResolverOpts) *DNSResolver {
 		upstreamAddrs = append(upstreamAddrs, ip)
 	}
 
+	localDomains := normalizeLocalDomains(options.LocalDomains)
+
 	cacheTTL := options.CacheTTL
 	if cacheTTL == 0 {
 		cacheTTL = time.Minute * 5
@@ -100,106 +152,510 @@ func NewDNSResolverWithOpts(options ResolverOpts) *DNSResolver {
 	if readTimeout == 0 {
 		readTimeout = time.Second * 2
 	}
+	strategy := options.Strategy
+	if strategy == "" {
+		strategy = UpstreamStrategyParallel
+	}
+	failureThreshold := options.FailureThreshold
+	if failureThreshold == 0 {
+		failureThreshold = 3
+	}
+	probeInterval := options.ProbeInterval
+	if probeInterval == 0 {
+		probeInterval = time.Second * 30
+	}
+
+	views := make(map[string]map[string]net.IP)
+	for _, view := range options.Views {
+		viewDomains := make(map[string]net.IP)
+		for domain, ip := range normalizeLocalDomains(view.LocalDomains) {
+			if addr := ip.To4(); addr != nil {
+				viewDomains[domain] = addr
+			}
+		}
+		views[view.Name] = viewDomains
+	}
+
+	rewrites := make([]*rewriteRule, 0, len(options.RewriteRules))
+	for _, rule := range options.RewriteRules {
+		rewrite, err := newRewriteRule(rule)
+		if err != nil {
+			log.Warnf("ignoring rewrite rule: %v", err)
+			continue
+		}
+		rewrites = append(rewrites, rewrite)
+	}
 
 	return &DNSResolver{
-		cache:           make(map[string]*DNSCacheItem),
-		upstream:        upstreamAddrs,
-		localDomains:    options.LocalDomains,
+		cache:           newDNSCache(),
+		inflight:        newUpstreamCoalescer(),
+		upstreams:       newUpstreamPool(upstreamAddrs, strategy, failureThreshold, probeInterval),
+		localDomains:    localDomains,
+		views:           views,
+		domainMetrics:   options.DomainMetrics,
+		stats:           options.Stats,
+		leaseHosts:      newLeaseHosts(),
 		domainLock:      new(sync.RWMutex),
 		blacklist:       make(map[string]struct{}),
 		cacheTTL:        cacheTTL,
 		upstreamTimeout: upstreamTimeout,
 		dialTimeout:     dialTimeout,
 		readTimeout:     readTimeout,
+		tap:             options.Tap,
+		zone:            options.Zone,
+		rebinding:       newRebindingFilter(options.Rebinding),
+		clientGroups:    newClientGroups(options.ClientGroups),
+		safeSearch:      newSafeSearchPolicy(options.SafeSearch),
+		dns64:           newDNS64Policy(options.DNS64),
+		recursor:        newRecursor(options.Recursion, dialTimeout, readTimeout, upstreamTimeout, options.Tap),
+		pauses:          newBlockingPauses(),
+		rewrites:        rewrites,
 	}
 }
 
 func (r *DNSResolver) Resolve(domain string, dnsType DNSType) (answers, authorities []*DNSRecord, err error) {
-	r.domainLock.Lock()
-	defer r.domainLock.Unlock()
+	answers, authorities, _, err = r.ResolveQuery(Query{Domain: domain, Type: dnsType})
+	return answers, authorities, err
+}
+
+// ResolveQuery resolves a query, applying the policies that depend on which client asked. It reports whether the answer
+// comes from the local zone or a private reverse zone, which are served here with authority
+func (r *DNSResolver) ResolveQuery(query Query) (answers, authorities []*DNSRecord, authoritative bool, err error) {
+	// names on the wire are already ASCII, they only differ from what they are matched against in case
+	query.Domain = canonicalName(query.Domain)
+	if r.dns64.appliesTo(query, r.clientGroups) {
+		switch query.Type {
+		case DNSTypeAAAA:
+			return r.resolveDNS64(query)
+		case DNSTypePTR:
+			// the synthesized addresses only point back at names through the IPv4 address they embed
+			if target, ok := r.dns64.reverseTarget(query.Domain); ok {
+				answers, authorities, err = r.resolveAlias(query, target, "dns64")
+				return answers, authorities, false, err
+			}
+		}
+	}
+	return r.resolve(query)
+}
+
+// resolveStep is what the data held in the resolver says to do with a query. Whatever needs the network, asking the
+// upstreams, forwarding for a rewrite rule or resolving the target of an alias, is left for once the lock is released
+type resolveStep struct {
+	answers     []*DNSRecord
+	authorities []*DNSRecord
+	err         error
+	alias       string       // answer with a CNAME to alias followed by its records
+	source      string       // what made the alias, for the query counter
+	forward     *rewriteRule // answer from the upstream the rule forwards to
+	upstream    bool         // answer from the upstreams
+	passthru    bool         // a response policy zone exempted the name from blocking, or blocking is paused
+	authority   bool         // answered from a zone served here
+}
 
-	answers, authorities = make([]*DNSRecord, 0), make([]*DNSRecord, 0)
+// resolve answers a query, reporting whether the answer comes from a zone served here
+func (r *DNSResolver) resolve(query Query) (answers, authorities []*DNSRecord, authoritative bool, err error) {
+	r.domainLock.RLock()
+	step := r.resolveLocal(query)
+	r.domainLock.RUnlock()
+
+	switch {
+	case step.alias != "":
+		answers, authorities, err = r.resolveAlias(query, step.alias, step.source)
+	case step.forward != nil:
+		answers, authorities, err = r.forward(query, step.forward)
+	case step.upstream:
+		answers, authorities, err = r.resolveRemote(query, step.passthru)
+	default:
+		return step.answers, step.authorities, step.authority, step.err
+	}
+	return answers, authorities, false, err
+}
+
+// resolveLocal answers a query from the policies, local records and cache. The caller must hold at least a read lock
+func (r *DNSResolver) resolveLocal(query Query) resolveStep {
+	domain, dnsType := query.Domain, query.Type
+	answers := make([]*DNSRecord, 0)
 	log.Debugf("resolving %s", domain)
 
-	if _, blocked := r.blacklist[domain]; blocked {
+	if rule, nodata := findRewrite(r.rewrites, query); rule != nil {
+		return r.rewrite(query, rule)
+	} else if nodata {
+		return resolveStep{}
+	}
+
+	passthru := false
+	if zone, trigger := r.policyMatch(domain); trigger != nil {
+		rpzHitCounter.With(prometheus.Labels{"zone": zone.name, "action": string(trigger.action)}).Inc()
+		if trigger.action != RPZActionPassthru {
+			return r.applyPolicy(query, trigger)
+		}
+		passthru = true
+	}
+
+	// while blocking is paused the blocklist lets names through the same way a passthru trigger does
+	passthru = passthru || r.pauses.active(query.Client, time.Now())
+	if _, blocked := r.blacklist[domain]; blocked && !passthru {
 		log.Infof("rejected %s in blacklist", domain)
-		var result []byte
-		if dnsType == DNSTypeA {
-			result = make([]byte, 4)
-		} else if dnsType == DNSTypeAAAA {
-			result = net.IPv6zero
+		r.countBlocked(domain, query.Client, "blocklist")
+		return resolveStep{answers: r.blockedAnswer(domain, dnsType)}
+	}
+
+	// rewritten answers depend on the client, so they are not cached under the searched name
+	if target, ok := r.safeSearch.target(domain, query.Client, r.clientGroups); ok {
+		return resolveStep{alias: target, source: "safe-search"}
+	}
+
+	// view records shadow everything below, including answers cached for clients outside the view
+	if responseIP, ok := r.views[query.View][domain]; ok {
+		log.Debugf("found %s in view %s", domain, query.View)
+		if dnsType != DNSTypeA {
+			return resolveStep{}
 		}
-		blockedDomainCounter.With(prometheus.Labels{"domain": domain}).Inc()
+		r.countQuery(domain, "view", "success")
 		answers = append(answers, &DNSRecord{
-			Name:       compressedDomainVal,
+			Name:       stringToDNSWireFormat(domain),
 			Type:       dnsType,
 			Class:      DNSClassIN,
 			TTL:        uint32(r.cacheTTL.Seconds()),
 			ParsedName: domain,
-			RData:      result,
+			RData:      responseIP,
 		})
-		return answers, nil, nil
+		return resolveStep{answers: answers}
 	}
 
-	// Generate cache key
-	cacheKey := domain + "|" + dnsType.String()
-
-	// Check cache
-	if cacheItem, ok := r.cache[cacheKey]; ok {
-		if cacheItem.ttl.After(time.Now()) {
-			queryCounter.With(prometheus.Labels{"domain": domain, "upstream": "cache", "result": "success"}).Inc()
-			answers = cacheItem.records
-			return answers, nil, nil
-		} else {
-			log.Debugf("removing expired cache item for %s", domain)
-			delete(r.cache, cacheKey)
+	if cacheItem, ok := r.cache.get(cacheKey(domain, dnsType), time.Now()); ok {
+		// the blocklist may have changed since the answer was cached
+		if chain := r.cloakedBy(domain, cacheItem.records); chain != nil && !passthru {
+			return resolveStep{answers: r.rejectCloaked(domain, dnsType, query.Client, chain)}
 		}
+		r.countQuery(domain, "cache", "success")
+		return resolveStep{answers: cacheItem.records}
 	}
 
 	if responseIP, ok := r.localDomains[domain]; ok {
 		log.Debugf("found %s in local domains", domain)
 		if dnsType != DNSTypeA {
-			return nil, nil, nil
+			return resolveStep{}
 		}
-		queryCounter.With(prometheus.Labels{"domain": domain, "upstream": "local-domain", "result": "success"}).Inc()
+		r.countQuery(domain, "local-domain", "success")
 		answers = append(answers, &DNSRecord{
-			Name:       compressedDomainVal,
+			Name:       stringToDNSWireFormat(domain),
 			Type:       dnsType,
 			Class:      DNSClassIN,
 			TTL:        uint32(r.cacheTTL.Seconds()),
 			ParsedName: domain,
 			RData:      responseIP.To4(),
 		})
-		return answers, nil, nil
+		return resolveStep{answers: answers}
+	}
+
+	if host, ok := r.leaseHosts.lookup(domain, time.Now()); ok {
+		log.Debugf("found %s in DHCP leases", domain)
+		if dnsType != DNSTypeA {
+			return resolveStep{}
+		}
+		r.countQuery(domain, "dhcp-lease", "success")
+		answers = append(answers, &DNSRecord{
+			Name:       stringToDNSWireFormat(domain),
+			Type:       dnsType,
+			Class:      DNSClassIN,
+			TTL:        host.ttl(r.cacheTTL, time.Now()),
+			ParsedName: domain,
+			RData:      host.ip.To4(),
+		})
+		return resolveStep{answers: answers}
 	}
 
-	type result struct {
-		answers     []*DNSRecord
-		authorities []*DNSRecord
-		upstream    net.IP
-		err         error
+	if dnsType == DNSTypePTR {
+		if ip := reverseAddr(domain); ip != nil {
+			if answers := r.localPTR(domain, ip, query.View, time.Now()); len(answers) > 0 {
+				log.Debugf("answering %s from the local names of %s", domain, ip)
+				r.countQuery(domain, "local-reverse", "success")
+				// the names of private addresses are part of the private reverse zones served here
+				_, private := privateReverseZone(domain)
+				return resolveStep{answers: answers, authority: private}
+			}
+		}
 	}
 
+	if zoneAnswers, zoneAuthorities, ok, err := r.zone.Lookup(domain, dnsType); ok {
+		log.Debugf("answering %s from zone %s", domain, r.zone.Name())
+		r.countQuery(domain, "local-zone", "success")
+		return resolveStep{answers: zoneAnswers, authorities: zoneAuthorities, err: err, authority: true}
+	}
+
+	if zone, ok := privateReverseZone(domain); ok {
+		log.Debugf("answering %s from the private reverse zone %s", domain, zone)
+		r.countQuery(domain, "private-reverse", "success")
+		step := r.privateReverse(query, zone)
+		step.authority = true
+		return step
+	}
+
+	return resolveStep{upstream: true, passthru: passthru}
+}
+
+// resolveRemote answers a query from the upstreams and caches the answer. Identical queries that arrive while one is
+// waiting on the upstreams share its answer rather than each sending their own
+func (r *DNSResolver) resolveRemote(query Query, passthru bool) (answers, authorities []*DNSRecord, err error) {
+	domain, dnsType := query.Domain, query.Type
+	key := cacheKey(domain, dnsType)
+	res := r.inflight.do(key, func() upstreamResult {
+		return r.resolveUpstream(domain, dnsType)
+	})
+	if res.err != nil {
+		return nil, nil, res.err
+	}
+
+	filtered, blocked := r.rebinding.filter(domain, res.answers, res.upstream)
+	if blocked {
+		return nil, nil, ErrNxDomain
+	}
+	res.answers = filtered
+
+	if res.answers == nil && res.authorities == nil {
+		return nil, nil, ErrNxDomain
+	}
+
+	r.domainLock.RLock()
+	chain := r.cloakedBy(domain, res.answers)
+	r.domainLock.RUnlock()
+	if chain != nil && !passthru {
+		return r.rejectCloaked(domain, dnsType, query.Client, chain), nil, nil
+	}
+
+	// recursive answers come from whichever authoritative server holds the name, counting them by server would grow a
+	// series for every one of them
+	source := res.upstream.String()
+	if r.recursor != nil {
+		source = "recursion"
+	}
+	r.countQuery(domain, source, "success")
+
+	// an answer emptied by the rebinding filter has nothing to take a TTL from, so it is not cached
+	if len(res.answers) > 0 || len(res.authorities) > 0 {
+		var ttl time.Time
+		if len(res.answers) > 0 {
+			ttl = time.Now().Add(time.Duration(res.answers[0].TTL) * time.Second)
+		} else {
+			ttl = time.Now().Add(time.Duration(res.authorities[0].TTL) * time.Second)
+			log.Debugf("TTL: %v", ttl)
+		}
+		r.cache.set(key, &DNSCacheItem{
+			records: res.answers,
+			ttl:     ttl,
+		})
+	}
+	log.Debugf("Processing response from upstream %v", res.upstream)
+
+	return res.answers, res.authorities, nil
+}
+
+// blockedAnswer is the answer given for a blocked name, the unspecified address for address queries
+func (r *DNSResolver) blockedAnswer(domain string, dnsType DNSType) []*DNSRecord {
+	var result []byte
+	if dnsType == DNSTypeA {
+		result = make([]byte, 4)
+	} else if dnsType == DNSTypeAAAA {
+		result = net.IPv6zero
+	}
+	return []*DNSRecord{{
+		Name:       stringToDNSWireFormat(domain),
+		Type:       dnsType,
+		Class:      DNSClassIN,
+		TTL:        uint32(r.cacheTTL.Seconds()),
+		ParsedName: domain,
+		RData:      result,
+	}}
+}
+
+// rejectCloaked blocks a name whose CNAME chain leads to a blocked name
+func (r *DNSResolver) rejectCloaked(domain string, dnsType DNSType, client net.IP, chain []string) []*DNSRecord {
+	target := chain[len(chain)-1]
+	log.Infof("rejected %s cloaking %s in blacklist via %s", domain, target, strings.Join(append([]string{domain}, chain...), " -> "))
+	r.countBlocked(domain, client, "cname-cloaking")
+	if r.domainMetrics {
+		cloakedDomainCounter.With(prometheus.Labels{"domain": domain, "cname": target}).Inc()
+	}
+	return r.blockedAnswer(domain, dnsType)
+}
+
+// countQuery counts an answered or failed query. The upstream label only ever holds configured upstreams, recursion and
+// the names of the local sources, so only the optional per domain series grows with the names queried
+func (r *DNSResolver) countQuery(domain, upstream, result string) {
+	queryCounter.With(prometheus.Labels{"upstream": upstream, "result": result}).Inc()
+	if r.domainMetrics {
+		queryDomainCounter.With(prometheus.Labels{"domain": domain}).Inc()
+	}
+}
+
+// countBlocked counts a blocked query, reason being blocklist, cname-cloaking or rpz
+func (r *DNSResolver) countBlocked(domain string, client net.IP, reason string) {
+	blockedCounter.With(prometheus.Labels{"reason": reason}).Inc()
+	if r.domainMetrics {
+		blockedDomainCounter.With(prometheus.Labels{"domain": domain}).Inc()
+	}
+	r.stats.RecordBlocked(domain, client, time.Now())
+}
+
+// rewrite answers a query as a rewrite rule says
+func (r *DNSResolver) rewrite(query Query, rule *rewriteRule) resolveStep {
+	log.Debugf("rewriting %s with %s rule %s", query.Domain, rule.Match, rule.Pattern)
+	switch rule.Action {
+	case RewriteActionCNAME:
+		return resolveStep{alias: rule.target, source: "rewrite"}
+	case RewriteActionNXDomain:
+		r.countQuery(query.Domain, "rewrite", "success")
+		return resolveStep{err: ErrNxDomain}
+	case RewriteActionForward:
+		return resolveStep{forward: rule}
+	default:
+		r.countQuery(query.Domain, "rewrite", "success")
+		return resolveStep{answers: []*DNSRecord{{
+			Name:       stringToDNSWireFormat(query.Domain),
+			Type:       query.Type,
+			Class:      DNSClassIN,
+			TTL:        uint32(r.cacheTTL.Seconds()),
+			ParsedName: query.Domain,
+			RData:      rule.ip,
+		}}}
+	}
+}
+
+// forward answers a query from the upstream a rewrite rule forwards to. The answers depend on the rule rather than the
+// name, so they bypass the cache
+func (r *DNSResolver) forward(query Query, rule *rewriteRule) (answers, authorities []*DNSRecord, err error) {
+	answers, authorities, err = r.lookup(query.Domain, query.Type, rule.ip)
+	result := "success"
+	if err != nil && err != ErrNxDomain {
+		result = "failed"
+	}
+	r.countQuery(query.Domain, rule.ip.String(), result)
+	return answers, authorities, err
+}
+
+// policyMatch finds the trigger for a name in the response policy zones, the first zone with a trigger wins
+func (r *DNSResolver) policyMatch(domain string) (*ResponsePolicyZone, *rpzTrigger) {
+	for _, zone := range r.policyZones {
+		if trigger := zone.lookup(domain); trigger != nil {
+			return zone, trigger
+		}
+	}
+	return nil, nil
+}
+
+// applyPolicy answers a query as a response policy zone trigger says
+func (r *DNSResolver) applyPolicy(query Query, trigger *rpzTrigger) resolveStep {
+	var answers []*DNSRecord
+	var err error
+	log.Debugf("applying %s policy to %s", trigger.action, query.Domain)
+	switch trigger.action {
+	case RPZActionNXDomain:
+		r.countBlocked(query.Domain, query.Client, "rpz")
+		err = ErrNxDomain
+	case RPZActionNoData:
+		r.countBlocked(query.Domain, query.Client, "rpz")
+	case RPZActionDrop:
+		r.countBlocked(query.Domain, query.Client, "rpz")
+		err = ErrQueryDropped
+	case RPZActionLocalData:
+		if trigger.target != "" {
+			return resolveStep{alias: trigger.target, source: "rpz"}
+		}
+		for _, record := range trigger.records {
+			if record.Type != query.Type {
+				continue
+			}
+			answers = append(answers, &DNSRecord{
+				Name:       stringToDNSWireFormat(query.Domain),
+				Type:       record.Type,
+				Class:      DNSClassIN,
+				TTL:        record.TTL,
+				ParsedName: query.Domain,
+				RData:      record.RData,
+			})
+		}
+	}
+	r.countQuery(query.Domain, "rpz", "success")
+	return resolveStep{answers: answers, err: err}
+}
+
+// resolveAlias answers a query with a CNAME to target, followed by the records of the target itself. source names what
+// made the alias for the query counter
+func (r *DNSResolver) resolveAlias(query Query, target, source string) (answers, authorities []*DNSRecord, err error) {
+	if query.hops >= maxRewriteHops {
+		log.Warnf("giving up on %s after following %d aliases", query.Domain, query.hops)
+		return nil, nil, ErrDNSServerFailure
+	}
+	log.Debugf("aliasing %s to %s for %s", query.Domain, target, query.Client)
+	targetAnswers, targetAuthorities, _, err := r.resolve(Query{Domain: target, Type: query.Type, Client: query.Client, Listener: query.Listener, View: query.View, hops: query.hops + 1})
+	if err != nil {
+		return nil, nil, err
+	}
+	r.countQuery(query.Domain, source, "success")
+	answers = append(answers, &DNSRecord{
+		Name:        stringToDNSWireFormat(query.Domain),
+		Type:        DNSTypeCNAME,
+		Class:       DNSClassIN,
+		TTL:         uint32(r.cacheTTL.Seconds()),
+		ParsedName:  query.Domain,
+		RData:       stringToDNSWireFormat(target),
+		ParsedRData: target,
+	})
+	return append(answers, targetAnswers...), append(authorities, targetAuthorities...), nil
+}
+
+func (r *DNSResolver) Upstreams() []UpstreamStatus {
+	return r.upstreams.status()
+}
+
+type upstreamResult struct {
+	answers     []*DNSRecord
+	authorities []*DNSRecord
+	upstream    net.IP
+	err         error
+}
+
+func (r *DNSResolver) resolveUpstream(domain string, dnsType DNSType) upstreamResult {
+	if r.recursor != nil {
+		return r.recursor.resolve(domain, dnsType)
+	}
+	servers, probes := r.upstreams.candidates()
+	if len(servers) == 0 {
+		return upstreamResult{err: ErrNxDomain}
+	}
+	for _, server := range probes {
+		// the answer is only wanted for the server's health, the query is answered by the healthy servers
+		go r.exchange(server, domain, dnsType)
+	}
+	if r.upstreams.strategy == UpstreamStrategyParallel {
+		return r.resolveParallel(servers, domain, dnsType)
+	}
+	return r.resolveSequential(servers, domain, dnsType)
+}
+
+// resolveParallel sends the query to every candidate at once and takes the first usable answer
+func (r *DNSResolver) resolveParallel(servers []*upstreamServer, domain string, dnsType DNSType) upstreamResult {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	results := make(chan result, len(r.upstream))
+	results := make(chan upstreamResult, len(servers))
 
-	for _, upstream := range r.upstream {
-		go func(up net.IP) {
-			ans, auth, err := r.lookup(domain, dnsType, up)
+	for _, server := range servers {
+		go func(up *upstreamServer) {
+			res := r.exchange(up, domain, dnsType)
 
 			select {
-			case results <- result{ans, auth, up, err}:
+			case results <- res:
 			case <-ctx.Done():
 			}
-		}(upstream)
+		}(server)
 	}
 
 	var lastErr error
 
-	for i := 0; i < len(r.upstream); i++ {
-		var res result
+	for i := 0; i < len(servers); i++ {
+		var res upstreamResult
 		select {
 		case res = <-results:
 		case <-time.After(r.upstreamTimeout):
@@ -210,51 +666,53 @@ func (r *DNSResolver) Resolve(domain string, dnsType DNSType) (answers, authorit
 		if res.err != nil {
 			log.Error("unable to lookup: ", res.err.Error())
 			lastErr = res.err
-
-			if res.err != ErrNxDomain {
-				queryCounter.With(prometheus.Labels{
-					"domain":   domain,
-					"upstream": res.upstream.String(),
-					"result":   "failed",
-				}).Inc()
-			}
 			continue
 		}
 
 		if res.answers != nil || res.authorities != nil {
-			cancel()
-
-			queryCounter.With(prometheus.Labels{
-				"domain":   domain,
-				"upstream": res.upstream.String(),
-				"result":   "success",
-			}).Inc()
-
-			var ttl time.Time
-			if res.answers != nil {
-				ttl = time.Now().Add(time.Duration(res.answers[0].TTL) * time.Second)
-			} else {
-				ttl = time.Now().Add(time.Duration(res.authorities[0].TTL) * time.Second)
-				log.Debugf("TTL: %v", ttl)
-			}
-			r.cache[cacheKey] = &DNSCacheItem{
-				records: res.answers,
-				ttl:     ttl,
-			}
-			log.Debugf("Processing response from upstream %v", res.upstream)
-
-			return res.answers, res.authorities, nil
+			return res
 		}
 	}
 
 	// All upstreams failed
-	if lastErr != nil {
-		return nil, nil, lastErr
+	return upstreamResult{err: lastErr}
+}
+
+// resolveSequential tries the candidates one after the other, moving on only when an upstream fails to answer
+func (r *DNSResolver) resolveSequential(servers []*upstreamServer, domain string, dnsType DNSType) upstreamResult {
+	var lastErr error
+	for _, server := range servers {
+		res := r.exchange(server, domain, dnsType)
+		switch res.err {
+		case nil, ErrNxDomain:
+			// an upstream that answered is authoritative enough, asking the next one will not change the outcome
+			return res
+		default:
+			log.Errorf("unable to lookup %s in %s: %v", domain, server.addr, res.err)
+			lastErr = res.err
+		}
+	}
+	return upstreamResult{err: lastErr}
+}
+
+// exchange performs a single upstream lookup and feeds the outcome into the upstream's health state
+func (r *DNSResolver) exchange(server *upstreamServer, domain string, dnsType DNSType) upstreamResult {
+	start := time.Now()
+	answers, authorities, err := r.lookup(domain, dnsType, server.addr)
+	if err != nil && err != ErrNxDomain {
+		r.upstreams.recordFailure(server)
+		r.countQuery(domain, server.addr.String(), "failed")
+	} else {
+		r.upstreams.recordSuccess(server, time.Since(start))
 	}
-	return nil, nil, ErrNxDomain
+	return upstreamResult{answers, authorities, server.addr, err}
 }
 
 func (r *DNSResolver) AddLocalDomain(domain string, ip net.IP) error {
+	domain, err := NormalizeDomain(domain)
+	if err != nil {
+		return err
+	}
 	defer r.domainLock.Unlock()
 	r.domainLock.Lock()
 	if localAddr := net.ParseIP(ip.String()).To4(); localAddr == nil || localAddr.Equal(net.IPv4zero) {
@@ -266,11 +724,104 @@ func (r *DNSResolver) AddLocalDomain(domain string, ip net.IP) error {
 }
 
 func (r *DNSResolver) DeleteLocalDomain(domain string) {
+	// a name that does not normalize was never added
+	domain, err := NormalizeDomain(domain)
+	if err != nil {
+		return
+	}
 	defer r.domainLock.Unlock()
 	r.domainLock.Lock()
 	delete(r.localDomains, domain)
 }
 
+// AddViewLocalDomain adds a local domain that only clients in view see. The default view "" is the global local domains
+func (r *DNSResolver) AddViewLocalDomain(view, domain string, ip net.IP) error {
+	if view == "" {
+		return r.AddLocalDomain(domain, ip)
+	}
+	domain, err := NormalizeDomain(domain)
+	if err != nil {
+		return err
+	}
+	defer r.domainLock.Unlock()
+	r.domainLock.Lock()
+	viewDomains, ok := r.views[view]
+	if !ok {
+		return ErrUnknownView
+	}
+	if localAddr := ip.To4(); localAddr == nil || localAddr.Equal(net.IPv4zero) {
+		return errors.New("invalid IP address")
+	} else {
+		viewDomains[domain] = localAddr
+	}
+	return nil
+}
+
+func (r *DNSResolver) DeleteViewLocalDomain(view, domain string) {
+	if view == "" {
+		r.DeleteLocalDomain(domain)
+		return
+	}
+	domain, err := NormalizeDomain(domain)
+	if err != nil {
+		return
+	}
+	defer r.domainLock.Unlock()
+	r.domainLock.Lock()
+	delete(r.views[view], domain)
+}
+
+// RegisterHost publishes name for a DHCP client until expiry. Static local domains always take precedence, and a name
+// already held by another client is rejected with ErrHostConflict
+func (r *DNSResolver) RegisterHost(name string, ip net.IP, owner string, expiry time.Time) error {
+	defer r.domainLock.Unlock()
+	r.domainLock.Lock()
+	addr := ip.To4()
+	if addr == nil || addr.Equal(net.IPv4zero) {
+		return errors.New("invalid IP address")
+	}
+	for domain := range r.localDomains {
+		if strings.EqualFold(domain, name) {
+			return ErrHostConflict
+		}
+	}
+	return r.leaseHosts.register(name, addr, owner, expiry, time.Now())
+}
+
+// UnregisterHost removes whatever name owner registered
+func (r *DNSResolver) UnregisterHost(owner string) {
+	defer r.domainLock.Unlock()
+	r.domainLock.Lock()
+	r.leaseHosts.unregister(owner)
+}
+
+// SetRewriteRules replaces the rewrite rules. Nothing changes if any of the rules is invalid
+func (r *DNSResolver) SetRewriteRules(rules []RewriteRule) error {
+	rewrites, err := compileRewriteRules(rules)
+	if err != nil {
+		return err
+	}
+	defer r.domainLock.Unlock()
+	r.domainLock.Lock()
+	r.rewrites = rewrites
+	return nil
+}
+
+// SetResponsePolicyZone loads a response policy zone, replacing the one with the same name. Zones keep the position
+// they were first set in, which decides which zone wins when several have a trigger for the same name
+func (r *DNSResolver) SetResponsePolicyZone(zone *ResponsePolicyZone) {
+	defer r.domainLock.Unlock()
+	r.domainLock.Lock()
+	for i, existing := range r.policyZones {
+		if existing.name == zone.name {
+			r.policyZones[i] = zone
+			return
+		}
+	}
+	r.policyZones = append(r.policyZones, zone)
+}
+
+// AddBlocklistEntries blocks every entry, which must already be normalized, see NormalizeDomain
 func (r *DNSResolver) AddBlocklistEntries(entries []string) {
 	defer r.domainLock.Unlock()
 	r.domainLock.Lock()
@@ -280,6 +831,10 @@ func (r *DNSResolver) AddBlocklistEntries(entries []string) {
 }
 
 func (r *DNSResolver) DeleteBlocklistEntry(domain string) {
+	domain, err := NormalizeDomain(domain)
+	if err != nil {
+		return
+	}
 	defer r.domainLock.Unlock()
 	r.domainLock.Lock()
 	delete(r.blacklist, domain)
@@ -293,34 +848,6 @@ func (r *DNSResolver) FlushBlocklist() {
 
 func (r *DNSResolver) lookup(domain string, dnsType DNSType, upstream net.IP) (answers, authorities []*DNSRecord, err error) {
 	log.Debugf("looking up %s in %s", domain, upstream.String())
-	if dnsType == DNSTypePTR {
-		reverseDNS := strings.TrimSuffix(domain, ".in-addr.arpa.")
-		reverseDNS = strings.TrimSuffix(domain, ".in-addr.arpa")
-		octets := strings.Split(reverseDNS, ".")
-		if len(octets) != 4 {
-			return nil, nil, errors.New("invalid reverse DNS")
-		}
-		ip := octets[3] + "." + octets[2] + "." + octets[1] + "." + octets[0]
-		log.Debugf("reverse lookup %s", ip)
-		if net.ParseIP(ip).IsPrivate() {
-			for host, localIp := range r.localDomains {
-				log.Tracef("checking %s against %v", host, localIp)
-				if localIp.String() == ip {
-					log.Tracef("found %s in local domains", host)
-					answers = append(answers, &DNSRecord{
-						Name:       compressedDomainVal,
-						Type:       dnsType,
-						Class:      DNSClassIN,
-						TTL:        uint32(r.cacheTTL.Seconds()),
-						ParsedName: host,
-						RData:      stringToDNSWireFormat(host),
-					})
-					return answers, nil, nil
-				}
-				return nil, nil, ErrNxDomain // we don't have this local domain defined, so we treat it as a bad name
-			}
-		}
-	}
 	message := NewDnsMessage()
 	message.Header.ID = uint16(rand.Intn(65535))
 	message.Header.SetRD(true)
@@ -340,7 +867,7 @@ func (r *DNSResolver) lookup(domain string, dnsType DNSType, upstream net.IP) (a
 		Timeout: r.dialTimeout,
 	}
 
-	raddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", upstream, 53))
+	raddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", upstream, r.upstreams.port))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -356,12 +883,14 @@ func (r *DNSResolver) lookup(domain string, dnsType DNSType, upstream net.IP) (a
 	if err != nil {
 		return nil, nil, err
 	}
+	r.tap.ForwarderQuery(conn.LocalAddr(), conn.RemoteAddr(), dat)
 
 	buff := make([]byte, 1500)
 	n, err := conn.Read(buff)
 	if err != nil {
 		return nil, nil, err
 	}
+	r.tap.ForwarderResponse(conn.LocalAddr(), conn.RemoteAddr(), buff[:n])
 
 	msg, err := ParseDNSMessage(buff[:n])
 	if err != nil {
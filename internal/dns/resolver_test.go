@@ -1,9 +1,13 @@
 package dns
 
 import (
+	"fmt"
 	"net"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
 )
 
 func TestDNSResolver_Blacklist_LookupBlockedDomainA(t *testing.T) {
@@ -177,3 +181,183 @@ func TestResolverOpts_CustomTimeouts(t *testing.T) {
 		t.Errorf("expected readTimeout 3s, got %v", resolver.readTimeout)
 	}
 }
+
+func TestDNSResolver_UpstreamLookupOutsideLock(t *testing.T) {
+	resolver := NewDNSResolverWithOpts(ResolverOpts{
+		Upstreams:    []string{"1.1.1.1"},
+		LocalDomains: map[string]net.IP{"nas.home": net.ParseIP("192.168.1.10")},
+	})
+
+	// hold an upstream lookup for slow.example.com open until the test is done with the resolver
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go resolver.inflight.do(cacheKey("slow.example.com", DNSTypeA), func() upstreamResult {
+		close(started)
+		<-release
+		return upstreamResult{
+			answers:  []*DNSRecord{{Name: stringToDNSWireFormat("slow.example.com"), ParsedName: "slow.example.com", Type: DNSTypeA, Class: DNSClassIN, TTL: 60, RData: []byte{93, 184, 216, 34}}},
+			upstream: net.ParseIP("1.1.1.1"),
+		}
+	})
+	<-started
+
+	coalesced := testutil.ToFloat64(coalescedCounter)
+	slow := make(chan []*DNSRecord)
+	go func() {
+		answers, _, _ := resolver.Resolve("slow.example.com", DNSTypeA)
+		slow <- answers
+	}()
+	// the query must have joined the held lookup before it is released, joining is counted before it starts waiting
+	for testutil.ToFloat64(coalescedCounter) == coalesced {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := resolver.AddLocalDomain("printer.home", net.ParseIP("192.168.1.20")); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if answers, _, err := resolver.Resolve("printer.home", DNSTypeA); err != nil || len(answers) != 1 {
+			t.Errorf("expected the local domain, got %v (%v)", answers, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("local domains were held up by an upstream lookup")
+	}
+
+	close(release)
+	select {
+	case answers := <-slow:
+		if len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.ParseIP("93.184.216.34")) {
+			t.Errorf("expected the coalesced upstream answer, got %v", answers)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("the waiting query never got the upstream answer")
+	}
+	if _, ok := resolver.cache.get(cacheKey("slow.example.com", DNSTypeA), time.Now()); !ok {
+		t.Error("expected the upstream answer to be cached")
+	}
+}
+
+func TestDNSCache_ExpiredItemsRemoved(t *testing.T) {
+	cache := newDNSCache()
+	now := time.Now()
+	cache.set("example.com|A", &DNSCacheItem{ttl: now.Add(-time.Second)})
+	if _, ok := cache.get("example.com|A", now); ok {
+		t.Error("expected an expired item to be a miss")
+	}
+	if _, ok := cache.items["example.com|A"]; ok {
+		t.Error("expected the expired item to be removed")
+	}
+}
+
+// newBenchmarkResolver returns a resolver with a blocklist the size of a typical ad list, a few local domains and a
+// cached upstream answer
+func newBenchmarkResolver(b *testing.B) *DNSResolver {
+	// blocked queries are logged at info level, which would otherwise be most of what is measured
+	level := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	b.Cleanup(func() { log.SetLevel(level) })
+
+	resolver := NewDNSResolverWithOpts(ResolverOpts{
+		Upstreams:    []string{},
+		LocalDomains: map[string]net.IP{"nas.home": net.ParseIP("192.168.1.10")},
+	})
+	blocklist := make([]string, 0, 100000)
+	for i := 0; i < cap(blocklist); i++ {
+		blocklist = append(blocklist, net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).String()+".ads.example")
+	}
+	resolver.AddBlocklistEntries(blocklist)
+	resolver.cache.set(cacheKey("example.com", DNSTypeA), &DNSCacheItem{
+		records: []*DNSRecord{{Name: stringToDNSWireFormat("example.com"), ParsedName: "example.com", Type: DNSTypeA, Class: DNSClassIN, TTL: 300, RData: []byte{93, 184, 216, 34}}},
+		ttl:     time.Now().Add(time.Hour),
+	})
+	b.ResetTimer()
+	return resolver
+}
+
+// the parallel benchmarks scale with -cpu when queries only take read locks, e.g. go test -bench Resolver -cpu 1,2,4,8
+
+func BenchmarkDNSResolver_Cached(b *testing.B) {
+	resolver := newBenchmarkResolver(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resolver.Resolve("example.com", DNSTypeA)
+		}
+	})
+}
+
+func BenchmarkDNSResolver_LocalDomain(b *testing.B) {
+	resolver := newBenchmarkResolver(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resolver.Resolve("nas.home", DNSTypeA)
+		}
+	})
+}
+
+func BenchmarkDNSResolver_Blocked(b *testing.B) {
+	resolver := newBenchmarkResolver(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resolver.Resolve("10.0.0.1.ads.example", DNSTypeA)
+		}
+	})
+}
+
+// BenchmarkDNSResolver_CachedDuringUpdates resolves cached names while local domains keep changing, as they do when
+// DHCP clients come and go
+func BenchmarkDNSResolver_CachedDuringUpdates(b *testing.B) {
+	resolver := newBenchmarkResolver(b)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				resolver.AddLocalDomain("host.home", net.IPv4(192, 168, 1, byte(i)))
+			}
+		}
+	}()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resolver.Resolve("example.com", DNSTypeA)
+		}
+	})
+}
+
+// BenchmarkDNSResolver_CoalescedUpstream resolves a name that is never cached from many goroutines at once against an
+// upstream that takes a millisecond to answer. Queries that arrive while one is waiting share its answer, so the rate
+// grows with -cpu instead of being held to a round trip per query
+func BenchmarkDNSResolver_CoalescedUpstream(b *testing.B) {
+	answer := addressRecord("uncached.example.com", net.IPv4(93, 184, 216, 34))
+	// a TTL of 0 expires the answer as soon as it is cached
+	answer.TTL = 0
+	upstream := &authority{zone: "example.com", records: []*DNSRecord{answer}, delay: time.Millisecond}
+
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+	upstream.serve(b, fmt.Sprintf("127.0.0.1:%d", port))
+
+	resolver := NewDNSResolverWithOpts(ResolverOpts{Upstreams: []string{"127.0.0.1"}})
+	resolver.upstreams.port = port
+	if answers, _, err := resolver.Resolve("uncached.example.com", DNSTypeA); err != nil || len(answers) != 1 {
+		b.Fatalf("expected the upstream to answer, got %v (%v)", answers, err)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resolver.Resolve("uncached.example.com", DNSTypeA)
+		}
+	})
+}
@@ -0,0 +1,185 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// privateReverseZones are the reverse zones of address space that is not routed on the internet. They are served
+// locally as empty zones, so lookups of them never leave the network, RFC 6303 and the IANA locally-served zones
+var privateReverseZones = func() []string {
+	zones := []string{
+		// RFC 1918, the rest of 172.16.0.0/12 is added below
+		"10.in-addr.arpa", "168.192.in-addr.arpa",
+		// this network, loopback, link-local and broadcast, RFC 6303 4.2 to 4.5
+		"0.in-addr.arpa", "127.in-addr.arpa", "254.169.in-addr.arpa", "255.255.255.255.in-addr.arpa",
+		// documentation, RFC 5737
+		"2.0.192.in-addr.arpa", "100.51.198.in-addr.arpa", "113.0.203.in-addr.arpa",
+		// unspecified, loopback, unique local and link-local IPv6 addresses, RFC 6303 4.7 to 4.10
+		reverseName(net.IPv6unspecified), reverseName(net.IPv6loopback), "d.f.ip6.arpa",
+		"8.e.f.ip6.arpa", "9.e.f.ip6.arpa", "a.e.f.ip6.arpa", "b.e.f.ip6.arpa",
+		// IPv6 documentation, RFC 6303 4.11
+		"8.b.d.0.1.0.0.2.ip6.arpa",
+	}
+	for octet := 16; octet <= 31; octet++ {
+		zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa", octet)) // RFC 1918
+	}
+	for octet := 64; octet <= 127; octet++ {
+		zones = append(zones, fmt.Sprintf("%d.100.in-addr.arpa", octet)) // shared address space, RFC 7793
+	}
+	return zones
+}()
+
+// privateReverseTTL is the TTL of the SOA of the private reverse zones, which is also how long negative answers from
+// them are cached, RFC 6303 3
+const privateReverseTTL = 10800
+
+// privateReverseZone returns the private reverse zone domain falls in
+func privateReverseZone(domain string) (string, bool) {
+	for _, zone := range privateReverseZones {
+		if inZone(domain, zone) {
+			return zone, true
+		}
+	}
+	return "", false
+}
+
+// privateReverseSOA is the SOA each private reverse zone is served with, "@ SOA @ nobody.invalid. 1 3600 1200 604800
+// 10800", RFC 6303 3
+func privateReverseSOA(zone string) *DNSRecord {
+	data, _ := MarshalRData(&SOARData{MName: zone, RName: "nobody.invalid", Serial: 1, Refresh: 3600, Retry: 1200, Expire: 604800, Minimum: privateReverseTTL})
+	return &DNSRecord{
+		Name:       stringToDNSWireFormat(zone),
+		ParsedName: zone,
+		Type:       DNSTypeSOA,
+		Class:      DNSClassIN,
+		TTL:        privateReverseTTL,
+		RData:      data,
+	}
+}
+
+// reverseName returns the name a reverse lookup of ip asks for, in in-addr.arpa for IPv4 and ip6.arpa for IPv6
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	var name strings.Builder
+	ip = ip.To16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&name, "%x.%x.", ip[i]&0x0f, ip[i]>>4)
+	}
+	name.WriteString("ip6.arpa")
+	return name.String()
+}
+
+// reverseIPv4 parses an in-addr.arpa name back into the address it refers to
+func reverseIPv4(domain string) net.IP {
+	reverse := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(domain), "."), ".in-addr.arpa")
+	if reverse == strings.TrimSuffix(strings.ToLower(domain), ".") {
+		return nil
+	}
+	octets := strings.Split(reverse, ".")
+	if len(octets) != 4 {
+		return nil
+	}
+	return net.ParseIP(octets[3] + "." + octets[2] + "." + octets[1] + "." + octets[0]).To4()
+}
+
+// reverseAddr parses a reverse lookup name back into the address it refers to, nil when it names no single address
+func reverseAddr(domain string) net.IP {
+	if ip := reverseIPv4(domain); ip != nil {
+		return ip
+	}
+	nibbles, ok := strings.CutSuffix(canonicalName(domain), ".ip6.arpa")
+	if !ok {
+		return nil
+	}
+	labels := strings.Split(nibbles, ".")
+	if len(labels) != 2*net.IPv6len {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	for i, label := range labels {
+		nibble, err := strconv.ParseUint(label, 16, 8)
+		if err != nil || len(label) != 1 {
+			return nil
+		}
+		ip[net.IPv6len-1-i/2] |= byte(nibble) << (4 * (i % 2))
+	}
+	return ip
+}
+
+// localAddrs calls fn for every name the resolver itself holds an address for: the local domains of the view and the
+// default view, the names registered for DHCP leases and the A and AAAA records of the local zone. The caller holds the
+// domain lock
+func (r *DNSResolver) localAddrs(view string, now time.Time, fn func(name string, ip net.IP, ttl uint32)) {
+	ttl := uint32(r.cacheTTL.Seconds())
+	for name, ip := range r.views[view] {
+		fn(name, ip, ttl)
+	}
+	for name, ip := range r.localDomains {
+		fn(name, ip, ttl)
+	}
+	r.leaseHosts.each(now, func(host *leaseHost) {
+		fn(host.name, host.ip, host.ttl(r.cacheTTL, now))
+	})
+	r.zone.addresses(fn)
+}
+
+// localPTR answers a reverse lookup of ip with every local name that points at it
+func (r *DNSResolver) localPTR(domain string, ip net.IP, view string, now time.Time) []*DNSRecord {
+	var answers []*DNSRecord
+	r.localAddrs(view, now, func(name string, addr net.IP, ttl uint32) {
+		if !addr.Equal(ip) || slices.ContainsFunc(answers, func(answer *DNSRecord) bool { return answer.ParsedRData == name }) {
+			return
+		}
+		answers = append(answers, &DNSRecord{
+			Name:        stringToDNSWireFormat(domain),
+			Type:        DNSTypePTR,
+			Class:       DNSClassIN,
+			TTL:         ttl,
+			ParsedName:  domain,
+			RData:       stringToDNSWireFormat(name),
+			ParsedRData: name,
+		})
+	})
+	// the maps are walked in no particular order
+	slices.SortFunc(answers, func(a, b *DNSRecord) int { return strings.Compare(a.ParsedRData, b.ParsedRData) })
+	return answers
+}
+
+// privateReverse answers a query in a private reverse zone that no local name answers. The zone is empty apart from
+// the reverse names of local addresses, and the names above them
+func (r *DNSResolver) privateReverse(query Query, zone string) resolveStep {
+	soa := privateReverseSOA(zone)
+	if query.Domain == zone {
+		switch query.Type {
+		case DNSTypeSOA:
+			return resolveStep{answers: []*DNSRecord{soa}}
+		case DNSTypeNS:
+			return resolveStep{answers: []*DNSRecord{{
+				Name:        soa.Name,
+				ParsedName:  zone,
+				Type:        DNSTypeNS,
+				Class:       DNSClassIN,
+				TTL:         privateReverseTTL,
+				RData:       stringToDNSWireFormat(zone),
+				ParsedRData: zone,
+			}}}
+		}
+		return resolveStep{authorities: []*DNSRecord{soa}}
+	}
+
+	exists := false
+	r.localAddrs(query.View, time.Now(), func(name string, ip net.IP, ttl uint32) {
+		exists = exists || inZone(reverseName(ip), query.Domain)
+	})
+	if !exists {
+		return resolveStep{authorities: []*DNSRecord{soa}, err: ErrNxDomain}
+	}
+	return resolveStep{authorities: []*DNSRecord{soa}}
+}
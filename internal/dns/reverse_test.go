@@ -0,0 +1,220 @@
+package dns
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReverseName(t *testing.T) {
+	tests := map[string]string{
+		"192.168.1.5": "5.1.168.192.in-addr.arpa",
+		"fd00::1":     "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa",
+		"2001:db8::":  "0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa",
+	}
+	for addr, expected := range tests {
+		ip := net.ParseIP(addr)
+		name := reverseName(ip)
+		if name != expected {
+			t.Errorf("%s: expected %s, got %s", addr, expected, name)
+		}
+		if parsed := reverseAddr(name + "."); !parsed.Equal(ip) {
+			t.Errorf("%s: expected the name to parse back, got %v", addr, parsed)
+		}
+	}
+	for _, name := range []string{"example.com", "1.168.192.in-addr.arpa", "d.f.ip6.arpa", "g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa"} {
+		if ip := reverseAddr(name); ip != nil {
+			t.Errorf("expected %s not to name an address, got %s", name, ip)
+		}
+	}
+}
+
+func TestReverseIPv4(t *testing.T) {
+	if ip := reverseIPv4("5.1.168.192.in-addr.arpa"); !ip.Equal(net.ParseIP("192.168.1.5")) {
+		t.Errorf("expected 192.168.1.5, got %v", ip)
+	}
+	if ip := reverseIPv4("5.1.168.192.in-addr.arpa."); !ip.Equal(net.ParseIP("192.168.1.5")) {
+		t.Errorf("expected trailing dot to be ignored, got %v", ip)
+	}
+	if ip := reverseIPv4("example.com"); ip != nil {
+		t.Errorf("expected nil for a forward name, got %v", ip)
+	}
+}
+
+func TestPrivateReverseZone(t *testing.T) {
+	tests := map[string]string{
+		"5.1.168.192.in-addr.arpa":          "168.192.in-addr.arpa",
+		"1.0.20.172.in-addr.arpa":           "20.172.in-addr.arpa",
+		"1.0.0.10.in-addr.arpa":             "10.in-addr.arpa",
+		"1.0.64.100.in-addr.arpa":           "64.100.in-addr.arpa",
+		"1.0.0.127.in-addr.arpa":            "127.in-addr.arpa",
+		reverseName(net.ParseIP("fe80::1")): "8.e.f.ip6.arpa",
+		reverseName(net.ParseIP("febf::1")): "b.e.f.ip6.arpa",
+		reverseName(net.ParseIP("fd12::1")): "d.f.ip6.arpa",
+		reverseName(net.IPv6loopback):       reverseName(net.IPv6loopback),
+		"168.192.in-addr.arpa":              "168.192.in-addr.arpa",
+		"8.b.d.0.1.0.0.2.ip6.arpa":          "8.b.d.0.1.0.0.2.ip6.arpa",
+	}
+	for name, expected := range tests {
+		if zone, ok := privateReverseZone(name); !ok || zone != expected {
+			t.Errorf("%s: expected %s, got %q", name, expected, zone)
+		}
+	}
+	for _, name := range []string{
+		"8.8.8.8.in-addr.arpa", "1.0.32.172.in-addr.arpa", "1.0.128.100.in-addr.arpa", "192.in-addr.arpa",
+		reverseName(net.ParseIP("2001:4860::8888")), reverseName(net.ParseIP("fec0::1")), "example.com",
+	} {
+		if zone, ok := privateReverseZone(name); ok {
+			t.Errorf("expected %s not to be private, got %s", name, zone)
+		}
+	}
+}
+
+func reverseResolver(t *testing.T) *DNSResolver {
+	zone, err := NewLocalZone(ZoneOpts{Name: "home.lan", TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone.SetAddress("printer.home.lan", net.ParseIP("192.168.1.30"))
+	zone.records["printer.home.lan"] = append(zone.records["printer.home.lan"],
+		zoneRecord{Name: "printer.home.lan", Type: DNSTypeAAAA, TTL: 60, RData: net.ParseIP("fd00::30")})
+
+	resolver := NewDNSResolverWithOpts(ResolverOpts{
+		Upstreams: []string{},
+		LocalDomains: map[string]net.IP{
+			"router.lan":  net.ParseIP("192.168.1.1"),
+			"gateway.lan": net.ParseIP("192.168.1.1"),
+			"nas.lan":     net.ParseIP("192.168.1.20"),
+			"public.lan":  net.ParseIP("203.0.114.7"),
+		},
+		Views: []ViewOpts{{Name: "guests", Clients: []string{"192.168.2.0/24"}, LocalDomains: map[string]net.IP{"portal.guest": net.ParseIP("192.168.2.1")}}},
+		Zone:  zone,
+	})
+	if err := resolver.RegisterHost("laptop.home.lan", net.ParseIP("192.168.1.50"), "aa:bb", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	return resolver
+}
+
+func ptrNames(answers []*DNSRecord) []string {
+	var names []string
+	for _, answer := range answers {
+		if answer.Type == DNSTypePTR {
+			names = append(names, answer.ParsedRData)
+		}
+	}
+	return names
+}
+
+func TestDNSResolver_LocalPTR(t *testing.T) {
+	resolver := reverseResolver(t)
+
+	tests := []struct {
+		query    Query
+		expected []string
+	}{
+		// every local domain of an address is found, not only the first one looked at
+		{Query{Domain: "1.1.168.192.in-addr.arpa"}, []string{"gateway.lan", "router.lan"}},
+		{Query{Domain: "20.1.168.192.in-addr.arpa."}, []string{"nas.lan"}},
+		{Query{Domain: "50.1.168.192.in-addr.arpa"}, []string{"laptop.home.lan"}},
+		{Query{Domain: "30.1.168.192.in-addr.arpa"}, []string{"printer.home.lan"}},
+		{Query{Domain: reverseName(net.ParseIP("fd00::30"))}, []string{"printer.home.lan"}},
+		// local names answer for public addresses too
+		{Query{Domain: "7.114.0.203.in-addr.arpa"}, []string{"public.lan"}},
+		{Query{Domain: "1.2.168.192.in-addr.arpa", View: "guests"}, []string{"portal.guest"}},
+	}
+	for _, test := range tests {
+		test.query.Type = DNSTypePTR
+		answers, _, authoritative, err := resolver.ResolveQuery(test.query)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.query.Domain, err)
+			continue
+		}
+		// only the names of private addresses are in the zones served here
+		if _, private := privateReverseZone(canonicalName(test.query.Domain)); authoritative != private {
+			t.Errorf("%s: expected the answer to be authoritative only in a private reverse zone, got %t", test.query.Domain, authoritative)
+		}
+		if names := ptrNames(answers); !slices.Equal(names, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.query.Domain, test.expected, names)
+		}
+	}
+}
+
+func TestDNSResolver_PrivateReverseZones(t *testing.T) {
+	resolver := reverseResolver(t)
+
+	// nothing in the private zones is asked upstream, a name without a local address does not exist
+	answers, authorities, err := resolver.Resolve("99.1.168.192.in-addr.arpa", DNSTypePTR)
+	if err != ErrNxDomain || len(answers) != 0 {
+		t.Fatalf("expected NXDOMAIN, got %v (%v)", answers, err)
+	}
+	if len(authorities) != 1 || authorities[0].Type != DNSTypeSOA || authorities[0].ParsedName != "168.192.in-addr.arpa" {
+		t.Fatalf("expected the SOA of the zone, got %v", authorities)
+	}
+	data, err := authorities[0].Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if soa := data.(*SOARData); soa.MName != "168.192.in-addr.arpa" || soa.RName != "nobody.invalid" || soa.Minimum != 10800 {
+		t.Errorf("expected the SOA of RFC 6303, got %v", soa)
+	}
+
+	// the view's names exist only for its clients
+	if _, _, err := resolver.Resolve("1.2.168.192.in-addr.arpa", DNSTypePTR); err != ErrNxDomain {
+		t.Errorf("expected NXDOMAIN outside the view, got %v", err)
+	}
+
+	// names above local addresses and other types at them exist, without data
+	for _, query := range []Query{
+		{Domain: "1.168.192.in-addr.arpa", Type: DNSTypePTR},
+		{Domain: "20.1.168.192.in-addr.arpa", Type: DNSTypeA},
+		{Domain: "168.192.in-addr.arpa", Type: DNSTypePTR},
+	} {
+		answers, authorities, authoritative, err := resolver.ResolveQuery(query)
+		if err != nil || len(answers) != 0 || len(authorities) != 1 || authorities[0].Type != DNSTypeSOA {
+			t.Errorf("%s %s: expected an empty answer with the SOA, got %v %v (%v)", query.Domain, query.Type, answers, authorities, err)
+		}
+		if !authoritative {
+			t.Errorf("%s %s: expected the answer to be authoritative", query.Domain, query.Type)
+		}
+	}
+
+	answers, _, err = resolver.Resolve("168.192.in-addr.arpa", DNSTypeSOA)
+	if err != nil || len(answers) != 1 || answers[0].Type != DNSTypeSOA {
+		t.Errorf("expected the SOA at the apex, got %v (%v)", answers, err)
+	}
+	answers, _, err = resolver.Resolve("10.in-addr.arpa", DNSTypeNS)
+	if err != nil || len(answers) != 1 || answers[0].ParsedRData != "10.in-addr.arpa" {
+		t.Errorf("expected the zone itself as its name server, got %v (%v)", answers, err)
+	}
+
+	// public reverse space is still resolved upstream, of which there are none
+	if _, authorities, err := resolver.Resolve("8.8.8.8.in-addr.arpa", DNSTypePTR); err != ErrNxDomain || authorities != nil {
+		t.Errorf("expected the lookup to go upstream, got %v (%v)", authorities, err)
+	}
+}
+
+func TestDNSServer_PrivateReverseNXDOMAINCarriesSOA(t *testing.T) {
+	_, addr := startZoneServer(t)
+
+	query := NewDnsMessage()
+	query.Header.ID = 0x4242
+	query.Header.SetRD(true)
+	query.Questions = append(query.Questions, &DNSQuestion{Name: stringToDNSWireFormat("9.0.0.10.in-addr.arpa"), Type: DNSTypePTR, Class: DNSClassIN})
+	data, err := MarshalDNSMessage(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := exchangeRaw(t, addr, data)
+	if response.Header.RCODE() != RCODENameFailure {
+		t.Fatalf("expected NXDOMAIN, got %d", response.Header.RCODE())
+	}
+	if len(response.Authorities) != 1 || response.Authorities[0].Type != DNSTypeSOA || response.Authorities[0].ParsedName != "10.in-addr.arpa" {
+		t.Errorf("expected the SOA of the zone, got %v", response.Authorities)
+	}
+	if !response.Header.AA() {
+		t.Error("expected the answer from the private reverse zone to be authoritative")
+	}
+}
@@ -0,0 +1,162 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+type RewriteMatch string
+
+const (
+	RewriteMatchExact  RewriteMatch = "exact"  // the name itself
+	RewriteMatchSuffix RewriteMatch = "suffix" // the name and everything below it, a leading *. is ignored
+	RewriteMatchRegex  RewriteMatch = "regex"  // a regular expression against the lower case name without the trailing dot
+)
+
+type RewriteAction string
+
+const (
+	RewriteActionCNAME    RewriteAction = "cname"    // alias the name to Value and answer with its records
+	RewriteActionA        RewriteAction = "a"        // answer A queries with the address in Value
+	RewriteActionAAAA     RewriteAction = "aaaa"     // answer AAAA queries with the address in Value
+	RewriteActionNXDomain RewriteAction = "nxdomain" // answer that the name does not exist
+	RewriteActionForward  RewriteAction = "forward"  // resolve the name with the upstream in Value instead
+)
+
+type RewriteRule struct {
+	Match   RewriteMatch  `json:"match"`
+	Pattern string        `json:"pattern"`
+	Clients []string      `json:"clients,omitempty"` // addresses or CIDRs the rule applies to, all clients when empty
+	Action  RewriteAction `json:"action"`
+	Value   string        `json:"value,omitempty"`
+}
+
+// how many aliases a single query may be rewritten through before it is given up on
+const maxRewriteHops = 8
+
+type rewriteRule struct {
+	RewriteRule
+	pattern string
+	regex   *regexp.Regexp
+	clients []*net.IPNet
+	target  string
+	ip      net.IP
+}
+
+func newRewriteRule(rule RewriteRule) (*rewriteRule, error) {
+	compiled := &rewriteRule{RewriteRule: rule, pattern: canonicalName(rule.Pattern)}
+	if compiled.pattern == "" {
+		return nil, fmt.Errorf("rewrite rule has no pattern")
+	}
+	switch rule.Match {
+	case RewriteMatchExact:
+	case RewriteMatchSuffix:
+		compiled.pattern = strings.TrimPrefix(compiled.pattern, "*.")
+	case RewriteMatchRegex:
+		regex, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite pattern %s: %w", rule.Pattern, err)
+		}
+		compiled.regex = regex
+	default:
+		return nil, fmt.Errorf("unknown rewrite match %q", rule.Match)
+	}
+
+	for _, client := range rule.Clients {
+		networks := parseNetworks([]string{client}, "rewrite client")
+		if len(networks) == 0 {
+			return nil, fmt.Errorf("invalid rewrite client %s", client)
+		}
+		compiled.clients = append(compiled.clients, networks...)
+	}
+
+	switch rule.Action {
+	case RewriteActionCNAME:
+		if compiled.target = canonicalName(rule.Value); compiled.target == "" {
+			return nil, fmt.Errorf("cname rewrite of %s has no target", rule.Pattern)
+		}
+	case RewriteActionA:
+		if compiled.ip = net.ParseIP(rule.Value).To4(); compiled.ip == nil {
+			return nil, fmt.Errorf("a rewrite of %s needs an IPv4 address, got %q", rule.Pattern, rule.Value)
+		}
+	case RewriteActionAAAA:
+		if compiled.ip = net.ParseIP(rule.Value); compiled.ip == nil || compiled.ip.To4() != nil {
+			return nil, fmt.Errorf("aaaa rewrite of %s needs an IPv6 address, got %q", rule.Pattern, rule.Value)
+		}
+	case RewriteActionForward:
+		if compiled.ip = net.ParseIP(rule.Value).To4(); compiled.ip == nil {
+			return nil, fmt.Errorf("forward rewrite of %s needs an upstream IPv4 address, got %q", rule.Pattern, rule.Value)
+		}
+	case RewriteActionNXDomain:
+	default:
+		return nil, fmt.Errorf("unknown rewrite action %q", rule.Action)
+	}
+	return compiled, nil
+}
+
+// ValidateRewriteRule reports what is wrong with a rule, if anything
+func ValidateRewriteRule(rule RewriteRule) error {
+	_, err := newRewriteRule(rule)
+	return err
+}
+
+// compileRewriteRules checks every rule, returning the first problem found
+func compileRewriteRules(rules []RewriteRule) ([]*rewriteRule, error) {
+	compiled := make([]*rewriteRule, 0, len(rules))
+	for i, rule := range rules {
+		rewrite, err := newRewriteRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		compiled = append(compiled, rewrite)
+	}
+	return compiled, nil
+}
+
+func (r *rewriteRule) matches(domain string, client net.IP) bool {
+	domain = canonicalName(domain)
+	switch r.Match {
+	case RewriteMatchExact:
+		if domain != r.pattern {
+			return false
+		}
+	case RewriteMatchSuffix:
+		if domain != r.pattern && !strings.HasSuffix(domain, "."+r.pattern) {
+			return false
+		}
+	case RewriteMatchRegex:
+		if !r.regex.MatchString(domain) {
+			return false
+		}
+	}
+	if len(r.clients) == 0 {
+		return true
+	}
+	for _, network := range r.clients {
+		if client != nil && network.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// findRewrite returns the first rule that applies to a query. Address rules only apply to queries for their own type,
+// so an A and an AAAA rule for the same name can sit next to each other. nodata is set when the only rules for the name
+// are address rules for another type
+func findRewrite(rules []*rewriteRule, query Query) (rule *rewriteRule, nodata bool) {
+	for _, rule := range rules {
+		if !rule.matches(query.Domain, query.Client) {
+			continue
+		}
+		switch {
+		case rule.Action == RewriteActionA && query.Type != DNSTypeA,
+			rule.Action == RewriteActionAAAA && query.Type != DNSTypeAAAA:
+			nodata = true
+			continue
+		}
+		return rule, false
+	}
+	return nil, nodata
+}
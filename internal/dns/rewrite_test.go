@@ -0,0 +1,153 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func rewriteResolver(t *testing.T, rules ...RewriteRule) *DNSResolver {
+	t.Helper()
+	resolver := NewDNSResolverWithOpts(ResolverOpts{
+		Upstreams:    []string{},
+		LocalDomains: map[string]net.IP{"nas.lan": net.ParseIP("192.168.1.10")},
+	})
+	if err := resolver.SetRewriteRules(rules); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return resolver
+}
+
+func TestRewriteRule_Matches(t *testing.T) {
+	tests := []struct {
+		rule     RewriteRule
+		domain   string
+		client   string
+		expected bool
+	}{
+		{RewriteRule{Match: RewriteMatchExact, Pattern: "Example.com."}, "example.com", "", true},
+		{RewriteRule{Match: RewriteMatchExact, Pattern: "example.com"}, "www.example.com", "", false},
+		{RewriteRule{Match: RewriteMatchSuffix, Pattern: "*.example.com"}, "example.com", "", true},
+		{RewriteRule{Match: RewriteMatchSuffix, Pattern: "example.com"}, "a.b.example.com", "", true},
+		{RewriteRule{Match: RewriteMatchSuffix, Pattern: "example.com"}, "badexample.com", "", false},
+		{RewriteRule{Match: RewriteMatchRegex, Pattern: `^ads[0-9]+\.`}, "ADS12.example.com.", "", true},
+		{RewriteRule{Match: RewriteMatchRegex, Pattern: `^ads[0-9]+\.`}, "ads.example.com", "", false},
+		{RewriteRule{Match: RewriteMatchExact, Pattern: "example.com", Clients: []string{"192.168.1.0/24"}}, "example.com", "192.168.1.5", true},
+		{RewriteRule{Match: RewriteMatchExact, Pattern: "example.com", Clients: []string{"192.168.1.0/24"}}, "example.com", "10.0.0.5", false},
+		{RewriteRule{Match: RewriteMatchExact, Pattern: "example.com", Clients: []string{"192.168.1.5"}}, "example.com", "", false},
+	}
+	for _, tt := range tests {
+		tt.rule.Action = RewriteActionNXDomain
+		rule, err := newRewriteRule(tt.rule)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", tt.rule, err)
+		}
+		if rule.matches(tt.domain, net.ParseIP(tt.client)) != tt.expected {
+			t.Errorf("%s %s against %s from %q: expected %t", tt.rule.Match, tt.rule.Pattern, tt.domain, tt.client, tt.expected)
+		}
+	}
+}
+
+func TestValidateRewriteRule(t *testing.T) {
+	invalid := []RewriteRule{
+		{Match: RewriteMatchExact, Action: RewriteActionNXDomain},
+		{Match: "glob", Pattern: "example.com", Action: RewriteActionNXDomain},
+		{Match: RewriteMatchRegex, Pattern: "(", Action: RewriteActionNXDomain},
+		{Match: RewriteMatchExact, Pattern: "example.com", Action: "drop"},
+		{Match: RewriteMatchExact, Pattern: "example.com", Action: RewriteActionCNAME},
+		{Match: RewriteMatchExact, Pattern: "example.com", Action: RewriteActionA, Value: "fd00::1"},
+		{Match: RewriteMatchExact, Pattern: "example.com", Action: RewriteActionAAAA, Value: "10.0.0.1"},
+		{Match: RewriteMatchExact, Pattern: "example.com", Action: RewriteActionForward, Value: "dns.example.com"},
+		{Match: RewriteMatchExact, Pattern: "example.com", Action: RewriteActionNXDomain, Clients: []string{"not-a-network"}},
+	}
+	for _, rule := range invalid {
+		if ValidateRewriteRule(rule) == nil {
+			t.Errorf("expected %v to be rejected", rule)
+		}
+	}
+}
+
+func TestFindRewrite_AddressRulesByType(t *testing.T) {
+	rules, err := compileRewriteRules([]RewriteRule{
+		{Match: RewriteMatchExact, Pattern: "host.example.com", Action: RewriteActionA, Value: "10.0.0.1"},
+		{Match: RewriteMatchExact, Pattern: "host.example.com", Action: RewriteActionAAAA, Value: "fd00::1"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rule, _ := findRewrite(rules, Query{Domain: "host.example.com", Type: DNSTypeAAAA}); rule == nil || rule.Action != RewriteActionAAAA {
+		t.Errorf("expected the AAAA rule, got %v", rule)
+	}
+	if rule, nodata := findRewrite(rules, Query{Domain: "host.example.com", Type: DNSTypeMX}); rule != nil || !nodata {
+		t.Errorf("expected no data for other types, got %v", rule)
+	}
+	if rule, nodata := findRewrite(rules, Query{Domain: "other.example.com", Type: DNSTypeA}); rule != nil || nodata {
+		t.Errorf("expected other names to be left alone, got %v", rule)
+	}
+}
+
+func TestDNSResolver_RewriteCNAME(t *testing.T) {
+	resolver := rewriteResolver(t, RewriteRule{Match: RewriteMatchSuffix, Pattern: "storage.example.com", Action: RewriteActionCNAME, Value: "nas.lan"})
+
+	answers, _, err := resolver.Resolve("files.storage.example.com", DNSTypeA)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(answers) != 2 || answers[0].Type != DNSTypeCNAME || answers[0].ParsedRData != "nas.lan" {
+		t.Fatalf("expected a CNAME to the target, got %v", answers)
+	}
+	if !bytes.Equal(answers[1].Name, stringToDNSWireFormat("nas.lan")) || !net.IP(answers[1].RData).Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("expected the target address under its own name, got %v", answers[1])
+	}
+}
+
+func TestDNSResolver_RewriteAddressPerClient(t *testing.T) {
+	resolver := rewriteResolver(t,
+		RewriteRule{Match: RewriteMatchExact, Pattern: "printer.example.com", Clients: []string{"192.168.2.0/24"}, Action: RewriteActionA, Value: "192.168.2.50"},
+		RewriteRule{Match: RewriteMatchExact, Pattern: "printer.example.com", Action: RewriteActionA, Value: "192.168.1.50"},
+	)
+
+	tests := map[string]string{"192.168.2.9": "192.168.2.50", "192.168.1.9": "192.168.1.50"}
+	for client, expected := range tests {
+		answers, _, _, err := resolver.ResolveQuery(Query{Domain: "printer.example.com", Type: DNSTypeA, Client: net.ParseIP(client)})
+		if err != nil || len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.ParseIP(expected)) {
+			t.Errorf("%s: expected %s, got %v (%v)", client, expected, answers, err)
+		}
+	}
+
+	answers, _, err := resolver.Resolve("printer.example.com", DNSTypeAAAA)
+	if err != nil || len(answers) != 0 {
+		t.Errorf("expected no data for AAAA, got %v (%v)", answers, err)
+	}
+}
+
+func TestDNSResolver_RewriteBeforeLocalDomains(t *testing.T) {
+	resolver := rewriteResolver(t, RewriteRule{Match: RewriteMatchExact, Pattern: "nas.lan", Action: RewriteActionNXDomain})
+	if _, _, err := resolver.Resolve("nas.lan", DNSTypeA); err != ErrNxDomain {
+		t.Errorf("expected the rewrite to win, got %v", err)
+	}
+}
+
+func TestDNSResolver_RewriteLoop(t *testing.T) {
+	resolver := rewriteResolver(t,
+		RewriteRule{Match: RewriteMatchExact, Pattern: "a.example.com", Action: RewriteActionCNAME, Value: "b.example.com"},
+		RewriteRule{Match: RewriteMatchExact, Pattern: "b.example.com", Action: RewriteActionCNAME, Value: "a.example.com"},
+	)
+	if _, _, err := resolver.Resolve("a.example.com", DNSTypeA); err != ErrDNSServerFailure {
+		t.Errorf("expected a rewrite loop to fail, got %v", err)
+	}
+}
+
+func TestDNSResolver_SetRewriteRulesAllOrNothing(t *testing.T) {
+	resolver := rewriteResolver(t, RewriteRule{Match: RewriteMatchExact, Pattern: "nas.lan", Action: RewriteActionNXDomain})
+	err := resolver.SetRewriteRules([]RewriteRule{
+		{Match: RewriteMatchExact, Pattern: "example.com", Action: RewriteActionNXDomain},
+		{Match: RewriteMatchRegex, Pattern: "(", Action: RewriteActionNXDomain},
+	})
+	if err == nil {
+		t.Fatal("expected an invalid rule to be rejected")
+	}
+	if _, _, err := resolver.Resolve("nas.lan", DNSTypeA); err != ErrNxDomain {
+		t.Errorf("expected the previous rules to stay in place, got %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	rpzHitCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_rpz_hit_count",
+		Help: "count of queries matched by a response policy zone by zone and action",
+	}, []string{"zone", "action"})
+
+	rpzLoadCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_rpz_load_count",
+		Help: "count of response policy zone loads by zone and result",
+	}, []string{"zone", "result"})
+
+	rpzTriggerGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_rpz_trigger_count",
+		Help: "number of triggers loaded from each response policy zone",
+	}, []string{"zone"})
+)
+
+// ErrQueryDropped is returned for queries that policy says must not be answered at all
+var ErrQueryDropped = errors.New("query dropped by policy")
+
+type RPZAction string
+
+const (
+	RPZActionNXDomain  RPZAction = "nxdomain"   // CNAME . answers that the name does not exist
+	RPZActionNoData    RPZAction = "nodata"     // CNAME *. answers that the name has no records of the type asked for
+	RPZActionPassthru  RPZAction = "passthru"   // CNAME rpz-passthru. exempts the name from blocking
+	RPZActionDrop      RPZAction = "drop"       // CNAME rpz-drop. sends no answer at all
+	RPZActionLocalData RPZAction = "local-data" // any other records answer in place of the real ones
+)
+
+// how often a response policy zone is reloaded when no interval is configured
+const defaultRPZRefreshInterval = time.Hour
+
+type ResponsePolicyZoneOpts struct {
+	Name            string        // the zone origin, triggers are the names below it
+	URL             string        // http(s) URL or path of the zone file
+	Primary         string        // host or host:port to transfer the zone from with AXFR instead of fetching URL
+	TSIGKey         string        // name of the TSIG key transfers from Primary are signed with
+	RefreshInterval time.Duration // how often the zone is reloaded
+}
+
+type rpzTrigger struct {
+	action  RPZAction
+	target  string       // CNAME local data
+	records []*DNSRecord // address and text local data
+}
+
+// ResponsePolicyZone holds the QNAME triggers of an RPZ feed. Triggers on client, response or name server addresses
+// are not supported and are skipped when the zone is loaded
+type ResponsePolicyZone struct {
+	name      string
+	serial    uint32
+	exact     map[string]*rpzTrigger
+	wildcards map[string]*rpzTrigger // keyed by the name below the *. label
+}
+
+func NewResponsePolicyZone(name string, records []*DNSRecord) *ResponsePolicyZone {
+	zone := &ResponsePolicyZone{
+		name:      canonicalName(name),
+		exact:     make(map[string]*rpzTrigger),
+		wildcards: make(map[string]*rpzTrigger),
+	}
+	skipped := 0
+	for _, record := range records {
+		owner := canonicalName(record.ParsedName)
+		if owner == zone.name {
+			if record.Type == DNSTypeSOA && len(record.RData) >= 20 {
+				zone.serial = binary.BigEndian.Uint32(record.RData[len(record.RData)-20:])
+			}
+			continue
+		}
+		trigger, ok := strings.CutSuffix(owner, "."+zone.name)
+		if !ok || !zone.add(trigger, record) {
+			skipped++
+		}
+	}
+	if skipped > 0 {
+		log.Debugf("skipped %d unsupported records in response policy zone %s", skipped, zone.name)
+	}
+	return zone
+}
+
+func (z *ResponsePolicyZone) Name() string {
+	return z.name
+}
+
+func (z *ResponsePolicyZone) Serial() uint32 {
+	return z.serial
+}
+
+// Len returns the number of triggers in the zone
+func (z *ResponsePolicyZone) Len() int {
+	return len(z.exact) + len(z.wildcards)
+}
+
+// add records the policy a record sets for a trigger name, reporting false if the record is not understood
+func (z *ResponsePolicyZone) add(name string, record *DNSRecord) bool {
+	labels := strings.Split(name, ".")
+	if strings.HasPrefix(labels[len(labels)-1], "rpz-") {
+		// rpz-ip, rpz-nsdname and the like trigger on something other than the query name
+		return false
+	}
+	triggers, key := z.exact, name
+	if wildcard, ok := strings.CutPrefix(name, "*."); ok {
+		triggers, key = z.wildcards, wildcard
+	}
+
+	var action RPZAction
+	var target string
+	switch record.Type {
+	case DNSTypeCNAME:
+		switch target = canonicalName(record.ParsedRData); {
+		case target == "":
+			action = RPZActionNXDomain
+		case target == "*":
+			action = RPZActionNoData
+		case target == "rpz-passthru" || target == name:
+			action = RPZActionPassthru
+		case target == "rpz-drop":
+			action = RPZActionDrop
+		case strings.HasPrefix(target, "rpz-") || strings.HasPrefix(target, "*."):
+			return false
+		default:
+			action = RPZActionLocalData
+		}
+	case DNSTypeA, DNSTypeAAAA, DNSTypeTXT:
+		action = RPZActionLocalData
+	default:
+		return false
+	}
+
+	trigger, ok := triggers[key]
+	if !ok {
+		trigger = &rpzTrigger{action: action}
+		triggers[key] = trigger
+	}
+	// a CNAME, whatever it points at, cannot sit alongside other data for the same name
+	switch {
+	case record.Type == DNSTypeCNAME:
+		trigger.action, trigger.target, trigger.records = action, "", nil
+		if action == RPZActionLocalData {
+			trigger.target = target
+		}
+	case trigger.action == RPZActionLocalData && trigger.target == "":
+		trigger.records = append(trigger.records, record)
+	default:
+		return false
+	}
+	return true
+}
+
+// lookup returns the trigger for a name, preferring an exact trigger over the most specific wildcard
+func (z *ResponsePolicyZone) lookup(domain string) *rpzTrigger {
+	domain = canonicalName(domain)
+	if trigger, ok := z.exact[domain]; ok {
+		return trigger
+	}
+	for name := domain; ; {
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return nil
+		}
+		name = name[i+1:]
+		if trigger, ok := z.wildcards[name]; ok {
+			return trigger
+		}
+	}
+}
+
+type ResponsePolicyFetcher interface {
+	Fetch(opts ResponsePolicyZoneOpts) ([]*DNSRecord, error)
+}
+
+// ZoneResponsePolicyFetcher loads zones from zone files over HTTP or from disk, or transfers them from a primary
+type ZoneResponsePolicyFetcher struct {
+	client *http.Client
+	keys   []TSIGKey
+}
+
+func NewZoneResponsePolicyFetcher(keys []TSIGKey) *ZoneResponsePolicyFetcher {
+	return &ZoneResponsePolicyFetcher{
+		client: &http.Client{
+			Timeout: time.Second * 30,
+		},
+		keys: keys,
+	}
+}
+
+func (f *ZoneResponsePolicyFetcher) Fetch(opts ResponsePolicyZoneOpts) ([]*DNSRecord, error) {
+	if opts.Primary != "" {
+		var key *TSIGKey
+		if opts.TSIGKey != "" {
+			for i := range f.keys {
+				if canonicalName(f.keys[i].Name) == canonicalName(opts.TSIGKey) {
+					key = &f.keys[i]
+				}
+			}
+			if key == nil {
+				return nil, fmt.Errorf("unknown TSIG key %s", opts.TSIGKey)
+			}
+		}
+		return requestTransfer(opts.Primary, canonicalName(opts.Name), key, f.client.Timeout)
+	}
+
+	var dat []byte
+	if strings.HasPrefix(opts.URL, "http") {
+		resp, err := f.client.Get(opts.URL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		if dat, err = io.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if dat, err = os.ReadFile(opts.URL); err != nil {
+			return nil, err
+		}
+	}
+	return parseZoneFile(string(dat), opts.Name)
+}
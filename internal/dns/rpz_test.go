@@ -0,0 +1,202 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+const testRPZ = `$TTL 300
+@ SOA ns.example. hostmaster.example. 42 3600 600 86400 300
+  NS  ns.example.
+malware.example.com       CNAME .
+*.malware.example.com     CNAME .
+tracker.example.com       CNAME *.
+ok.malware.example.com    CNAME rpz-passthru.
+silent.example.com        CNAME rpz-drop.
+walled.example.com        CNAME nas.lan.
+printer.example.com       A     10.0.0.50
+32.1.0.0.10.rpz-ip        CNAME .
+rewritten.example.com     CNAME *.example.org.
+`
+
+func testPolicyZone(t *testing.T) *ResponsePolicyZone {
+	t.Helper()
+	records, err := parseZoneFile(testRPZ, "rpz.example")
+	if err != nil {
+		t.Fatalf("unable to parse zone: %v", err)
+	}
+	return NewResponsePolicyZone("rpz.example.", records)
+}
+
+func TestResponsePolicyZone_Triggers(t *testing.T) {
+	zone := testPolicyZone(t)
+	if zone.Serial() != 42 {
+		t.Errorf("expected serial 42, got %d", zone.Serial())
+	}
+	if zone.Len() != 7 {
+		t.Errorf("expected the address and unsupported triggers to be skipped, got %d triggers", zone.Len())
+	}
+
+	tests := map[string]RPZAction{
+		"malware.example.com":     RPZActionNXDomain,
+		"a.b.malware.example.com": RPZActionNXDomain,
+		"ok.malware.example.com":  RPZActionPassthru,
+		"Tracker.Example.com.":    RPZActionNoData,
+		"silent.example.com":      RPZActionDrop,
+		"walled.example.com":      RPZActionLocalData,
+		"printer.example.com":     RPZActionLocalData,
+	}
+	for domain, expected := range tests {
+		trigger := zone.lookup(domain)
+		if trigger == nil || trigger.action != expected {
+			t.Errorf("%s: expected %s, got %v", domain, expected, trigger)
+		}
+	}
+	for _, domain := range []string{"example.com", "notmalware.example.com", "rewritten.example.com"} {
+		if trigger := zone.lookup(domain); trigger != nil {
+			t.Errorf("%s: expected no trigger, got %v", domain, trigger.action)
+		}
+	}
+}
+
+func TestDNSResolver_ResponsePolicy(t *testing.T) {
+	resolver := NewDNSResolverWithOpts(ResolverOpts{
+		Upstreams:    []string{},
+		LocalDomains: map[string]net.IP{"nas.lan": net.ParseIP("192.168.1.10")},
+	})
+	resolver.SetResponsePolicyZone(testPolicyZone(t))
+	resolver.AddBlocklistEntries([]string{"ok.malware.example.com"})
+
+	if _, _, err := resolver.Resolve("www.malware.example.com", DNSTypeA); err != ErrNxDomain {
+		t.Errorf("expected NXDOMAIN, got %v", err)
+	}
+	if answers, _, err := resolver.Resolve("tracker.example.com", DNSTypeA); err != nil || len(answers) != 0 {
+		t.Errorf("expected no data, got %v (%v)", answers, err)
+	}
+	if _, _, err := resolver.Resolve("silent.example.com", DNSTypeA); err != ErrQueryDropped {
+		t.Errorf("expected the query to be dropped, got %v", err)
+	}
+
+	answers, _, err := resolver.Resolve("printer.example.com", DNSTypeA)
+	if err != nil || len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.ParseIP("10.0.0.50")) || answers[0].ParsedName != "printer.example.com" {
+		t.Errorf("expected the local data address, got %v (%v)", answers, err)
+	}
+	if answers, _, err := resolver.Resolve("printer.example.com", DNSTypeAAAA); err != nil || len(answers) != 0 {
+		t.Errorf("expected no data for other types, got %v (%v)", answers, err)
+	}
+
+	answers, _, err = resolver.Resolve("walled.example.com", DNSTypeA)
+	if err != nil || len(answers) != 2 || answers[0].ParsedRData != "nas.lan" {
+		t.Errorf("expected a CNAME to the walled garden, got %v (%v)", answers, err)
+	}
+
+	// passthru exempts the name from the blocklist, and there are no upstreams to answer it
+	if _, _, err := resolver.Resolve("ok.malware.example.com", DNSTypeA); err != ErrNxDomain {
+		t.Errorf("expected the name to go upstream, got %v", err)
+	}
+}
+
+func TestDNSResolver_ResponsePolicyZoneOrder(t *testing.T) {
+	resolver := NewDNSResolverWithOpts(ResolverOpts{Upstreams: []string{}})
+	first, _ := parseZoneFile("example.com CNAME *.\n", "first.rpz")
+	second, _ := parseZoneFile("example.com CNAME .\n", "second.rpz")
+	resolver.SetResponsePolicyZone(NewResponsePolicyZone("first.rpz", nil))
+	resolver.SetResponsePolicyZone(NewResponsePolicyZone("second.rpz", second))
+	if _, _, err := resolver.Resolve("example.com", DNSTypeA); err != ErrNxDomain {
+		t.Fatalf("expected the second zone to apply, got %v", err)
+	}
+
+	// reloading the first zone keeps it ahead of the second
+	resolver.SetResponsePolicyZone(NewResponsePolicyZone("first.rpz", first))
+	if answers, _, err := resolver.Resolve("example.com", DNSTypeA); err != nil || len(answers) != 0 {
+		t.Errorf("expected the first zone to win, got %v (%v)", answers, err)
+	}
+}
+
+type mockPolicyFetcher struct {
+	records []*DNSRecord
+	err     error
+}
+
+func (m *mockPolicyFetcher) Fetch(opts ResponsePolicyZoneOpts) ([]*DNSRecord, error) {
+	return m.records, m.err
+}
+
+func TestDNSServer_LoadResponsePolicyZone(t *testing.T) {
+	resolver := NewDNSResolverWithOpts(ResolverOpts{Upstreams: []string{}})
+	server := NewDNSServerWithOpts(DNSServerOpts{}, resolver, nil)
+	records, _ := parseZoneFile(testRPZ, "rpz.example")
+	fetcher := &mockPolicyFetcher{records: records}
+	server.policyFetcher = fetcher
+	opts := ResponsePolicyZoneOpts{Name: "rpz.example", URL: "https://feeds.example/rpz"}
+
+	if err := server.LoadResponsePolicyZone(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := resolver.Resolve("malware.example.com", DNSTypeA); err != ErrNxDomain {
+		t.Errorf("expected the zone to be in place, got %v", err)
+	}
+
+	// a failed reload leaves the loaded zone alone
+	fetcher.err = errors.New("feed unavailable")
+	if err := server.LoadResponsePolicyZone(opts); err == nil {
+		t.Fatal("expected the fetch error")
+	}
+	if _, _, err := resolver.Resolve("malware.example.com", DNSTypeA); err != ErrNxDomain {
+		t.Errorf("expected the zone to stay in place, got %v", err)
+	}
+}
+
+func TestZoneResponsePolicyFetcher_Transfer(t *testing.T) {
+	server, addr := startZoneServerWithOpts(t, ZoneOpts{Name: "home.lan", TransferKeys: []string{testTSIGKey.Name}})
+	if err := server.AddLocalDomain("host.home.lan", "10.0.0.5"); err != nil {
+		t.Fatal(err)
+	}
+
+	fetcher := NewZoneResponsePolicyFetcher([]TSIGKey{testTSIGKey})
+	records, err := fetcher.Fetch(ResponsePolicyZoneOpts{Name: "home.lan", Primary: addr.String(), TSIGKey: "update-key"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 3 || records[0].Type != DNSTypeSOA || records[2].ParsedName != "host.home.lan" {
+		t.Errorf("expected the SOA, NS and A records, got %v", records)
+	}
+
+	// without the key the transfer is refused
+	if _, err := requestTransfer(addr.String(), "home.lan", nil, time.Second*2); err == nil {
+		t.Error("expected an unsigned transfer to be refused")
+	}
+	wrongKey := TSIGKey{Name: testTSIGKey.Name, Secret: []byte("not the secret")}
+	if _, err := requestTransfer(addr.String(), "home.lan", &wrongKey, time.Second*2); err == nil {
+		t.Error("expected a transfer with the wrong secret to fail")
+	}
+}
+
+func TestDNSServer_DropsResponsePolicyDrop(t *testing.T) {
+	server, addr := startZoneServer(t)
+	records, _ := parseZoneFile(testRPZ, "rpz.example")
+	server.resolver.SetResponsePolicyZone(NewResponsePolicyZone("rpz.example", records))
+
+	msg := NewDnsMessage()
+	msg.Header.ID = 0x4321
+	msg.Questions = append(msg.Questions, &DNSQuestion{
+		Name:       stringToDNSWireFormat("silent.example.com"),
+		ParsedName: "silent.example.com",
+		Type:       DNSTypeA,
+		Class:      DNSClassIN,
+	})
+	data, _ := MarshalDNSMessage(msg)
+
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(data)
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 300))
+	if _, err := conn.Read(make([]byte, 1500)); err == nil {
+		t.Error("expected no response to a dropped query")
+	}
+}
@@ -0,0 +1,64 @@
+package dns
+
+import (
+	"bufio"
+	_ "embed"
+	"net"
+	"strings"
+)
+
+//go:embed safesearch.txt
+var safeSearchTable string
+
+// safeSearchTargets maps search engine names to the endpoints that enforce safe search
+var safeSearchTargets = parseSafeSearchTable(safeSearchTable)
+
+func parseSafeSearchTable(table string) map[string]string {
+	targets := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(table))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		targets[canonicalName(fields[0])] = canonicalName(fields[1])
+	}
+	return targets
+}
+
+type SafeSearchOpts struct {
+	Enabled bool     // enforce safe search for every client
+	Groups  []string // client groups safe search is enforced for when it is not enabled for everyone
+}
+
+// safeSearchPolicy decides which clients get their searches rewritten. A nil policy rewrites nothing
+type safeSearchPolicy struct {
+	all    bool
+	groups []string
+}
+
+func newSafeSearchPolicy(opts *SafeSearchOpts) *safeSearchPolicy {
+	if opts == nil || (!opts.Enabled && len(opts.Groups) == 0) {
+		return nil
+	}
+	return &safeSearchPolicy{all: opts.Enabled, groups: opts.Groups}
+}
+
+// target returns the safe search endpoint a query should be answered with, if the client is subject to safe search
+func (p *safeSearchPolicy) target(domain string, client net.IP, groups clientGroups) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	target, ok := safeSearchTargets[canonicalName(domain)]
+	if !ok {
+		return "", false
+	}
+	if !p.all && !groups.contains(client, p.groups) {
+		return "", false
+	}
+	return target, true
+}
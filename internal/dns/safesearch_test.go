@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func safeSearchResolver(opts *SafeSearchOpts) *DNSResolver {
+	return NewDNSResolverWithOpts(ResolverOpts{
+		Upstreams: []string{},
+		LocalDomains: map[string]net.IP{
+			"forcesafesearch.google.com": net.ParseIP("216.239.38.120"),
+			"restrict.youtube.com":       net.ParseIP("216.239.38.119"),
+		},
+		ClientGroups: map[string][]string{"kids": {"192.168.1.0/28"}},
+		SafeSearch:   opts,
+	})
+}
+
+func TestSafeSearchTable(t *testing.T) {
+	tests := map[string]string{
+		"www.google.com":   "forcesafesearch.google.com",
+		"google.co.uk":     "forcesafesearch.google.com",
+		"www.google.co.za": "forcesafesearch.google.com",
+		"www.bing.com":     "strict.bing.com",
+		"duckduckgo.com":   "safe.duckduckgo.com",
+		"m.youtube.com":    "restrict.youtube.com",
+	}
+	for name, expected := range tests {
+		if target := safeSearchTargets[name]; target != expected {
+			t.Errorf("%s: expected %s, got %q", name, expected, target)
+		}
+	}
+	for _, name := range []string{"mail.google.com", "google.example.com", "# Google"} {
+		if _, ok := safeSearchTargets[name]; ok {
+			t.Errorf("expected %s not to be rewritten", name)
+		}
+	}
+}
+
+func TestParseSafeSearchTable(t *testing.T) {
+	targets := parseSafeSearchTable("# comment\n\nExample.com. safe.example.com\nbroken line with extra fields\n")
+	if len(targets) != 1 || targets["example.com"] != "safe.example.com" {
+		t.Errorf("expected a single normalised entry, got %v", targets)
+	}
+}
+
+func TestSafeSearchPolicy(t *testing.T) {
+	groups := newClientGroups(map[string][]string{"kids": {"192.168.1.0/28"}})
+	kid, adult := net.ParseIP("192.168.1.5"), net.ParseIP("192.168.1.100")
+
+	if newSafeSearchPolicy(nil) != nil || newSafeSearchPolicy(&SafeSearchOpts{}) != nil {
+		t.Error("expected no policy when safe search is not enabled for anyone")
+	}
+
+	everyone := newSafeSearchPolicy(&SafeSearchOpts{Enabled: true})
+	if _, ok := everyone.target("www.google.com", adult, groups); !ok {
+		t.Error("expected safe search for everyone")
+	}
+	if _, ok := everyone.target("www.google.com", nil, groups); !ok {
+		t.Error("expected safe search without a known client when enabled globally")
+	}
+	if _, ok := everyone.target("example.com", adult, groups); ok {
+		t.Error("expected other names to be left alone")
+	}
+
+	kidsOnly := newSafeSearchPolicy(&SafeSearchOpts{Groups: []string{"kids"}})
+	if target, ok := kidsOnly.target("WWW.YOUTUBE.COM.", kid, groups); !ok || target != "restrict.youtube.com" {
+		t.Errorf("expected safe search for the group, got %q", target)
+	}
+	if _, ok := kidsOnly.target("www.youtube.com", adult, groups); ok {
+		t.Error("expected clients outside the group to be left alone")
+	}
+}
+
+func TestDNSResolver_SafeSearch(t *testing.T) {
+	resolver := safeSearchResolver(&SafeSearchOpts{Groups: []string{"kids"}})
+
+	answers, _, _, err := resolver.ResolveQuery(Query{Domain: "www.google.com", Type: DNSTypeA, Client: net.ParseIP("192.168.1.5")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(answers) != 2 {
+		t.Fatalf("expected a CNAME and an A record, got %v", answers)
+	}
+	if answers[0].Type != DNSTypeCNAME || answers[0].ParsedRData != "forcesafesearch.google.com" {
+		t.Errorf("expected a CNAME to the safe search endpoint, got %v", answers[0])
+	}
+	if answers[1].Type != DNSTypeA || !bytes.Equal(answers[1].Name, stringToDNSWireFormat("forcesafesearch.google.com")) {
+		t.Errorf("expected the endpoint address under its own name, got %v", answers[1])
+	}
+
+	// clients outside the group go upstream as usual, and there are none here
+	if _, _, _, err := resolver.ResolveQuery(Query{Domain: "www.google.com", Type: DNSTypeA, Client: net.ParseIP("192.168.1.100")}); err != ErrNxDomain {
+		t.Errorf("expected the query to be left alone, got %v", err)
+	}
+}
+
+func TestDNSResolver_SafeSearchBlocklistWins(t *testing.T) {
+	resolver := safeSearchResolver(&SafeSearchOpts{Enabled: true})
+	resolver.AddBlocklistEntries([]string{"www.youtube.com"})
+
+	answers, _, err := resolver.Resolve("www.youtube.com", DNSTypeA)
+	if err != nil || len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.IPv4zero) {
+		t.Errorf("expected the blocklist to take precedence, got %v (%v)", answers, err)
+	}
+}
@@ -1,9 +1,10 @@
 package dns
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
-	"strings"
+	"runtime"
 	"sync"
 	"time"
 
@@ -12,14 +13,26 @@ import (
 )
 
 type DNSServerOpts struct {
-	Options        *DNSServerOpts
-	Interface      string
-	Port           int
-	Upstream       []string
-	ResolverOpts   *ResolverOpts
-	BlocklistUrls  []string
-	BlockedDomains []string
-	ReadDeadline   time.Duration
+	Options               *DNSServerOpts
+	Interface             string
+	ListenAddresses       []string
+	InterfacePollInterval time.Duration
+	Port                  int
+	Upstream              []string
+	ResolverOpts          *ResolverOpts
+	BlocklistUrls         []string
+	BlockedDomains        []string
+	ReadDeadline          time.Duration
+	Dnstap                *DnstapOpts
+	RateLimit             *RateLimitOpts
+	Zone                  *ZoneOpts
+	TSIGKeys              []TSIGKey
+	ResponsePolicyZones   []ResponsePolicyZoneOpts // checked in order, the first zone with a trigger for a name wins
+	Views                 []ViewOpts               // clients are placed in the first view they belong to
+	ClientMetrics         bool                     // keep per client metric series, which grow with every client seen
+	Workers               int                      // goroutines resolving queries, and as many sending responses
+	ListenSockets         int                      // UDP sockets bound to each address with SO_REUSEPORT, each with its own read loop
+	TCPConnections        int                      // TCP connections served at once across every address, more are closed on accept
 }
 
 var defaultDNSServerOpts = DNSServerOpts{
@@ -33,30 +46,92 @@ type DNSServer struct {
 	opts             *DNSServerOpts
 	resolver         Resolver
 	blocklistFetcher BlocklistFetcher
-	packetConn       net.PacketConn
+	policyFetcher    ResponsePolicyFetcher
+	tap              *DnstapWriter
+	limiter          *clientLimiter
+	zone             *LocalZone
+	transferACL      []*net.IPNet
+	views            []clientView
+	stats            *QueryStats
+	listeners        map[string]*dnsListener
+	listenerLock     sync.Mutex
 	receiverChan     chan *dnsWorkItem
 	responseChan     chan *dnsWorkItem
 	exitChan         chan struct{}
-	lock             sync.Mutex
+	wg               sync.WaitGroup
 	readDeadline     time.Duration
+	pollInterval     time.Duration
+	workers          int
+	sockets          int
+	tcpConns         chan struct{} // a slot for every TCP connection being served
 }
 
 type dnsWorkItem struct {
 	*DNSPacket
+	conn      net.PacketConn
+	buff      *[]byte // pooled buffer raw was read into, handed back once the query has been handled
+	raw       []byte
+	tsig      *tsigContext
 	err       error
 	startTime time.Time
 }
 
+// large enough for any query over plain UDP, EDNS clients asking for bigger responses still send small queries
+const udpReadBufferSize = 1500
+
+var packetBuffers = sync.Pool{
+	New: func() any {
+		buff := make([]byte, udpReadBufferSize)
+		return &buff
+	},
+}
+
+// release hands the packet's read buffer back to the pool, raw must not be used afterwards
+func (w *dnsWorkItem) release() {
+	if w.buff != nil {
+		packetBuffers.Put(w.buff)
+		w.buff, w.raw = nil, nil
+	}
+}
+
 func NewDNSServer() *DNSServer {
 	return NewDNSServerWithOpts(defaultDNSServerOpts, nil, nil)
 }
 
 func NewDNSServerWithOpts(opts DNSServerOpts, resolver Resolver, fetcher BlocklistFetcher) *DNSServer {
+	var tap *DnstapWriter
+	if opts.Dnstap != nil {
+		tap = NewDnstapWriter(*opts.Dnstap)
+	}
+	var zone *LocalZone
+	var transferACL []*net.IPNet
+	if opts.Zone != nil {
+		var err error
+		if zone, err = NewLocalZone(*opts.Zone); err != nil {
+			log.Errorf("unable to load zone %s: %v", opts.Zone.Name, err)
+		}
+		// local domains inside the zone are served from it too, so secondaries get them
+		if opts.ResolverOpts != nil {
+			for domain, ip := range normalizeLocalDomains(opts.ResolverOpts.LocalDomains) {
+				zone.SetAddress(domain, ip)
+			}
+		}
+		transferACL = parseNetworks(opts.Zone.AllowTransfer, "zone transfer address")
+	}
+	stats := NewQueryStats()
 	if resolver == nil {
-		resolver = NewDNSResolverWithOpts(ResolverOpts{
+		resolverOpts := ResolverOpts{
 			Upstreams:    opts.Upstream,
 			LocalDomains: make(map[string]net.IP),
-		})
+		}
+		if opts.ResolverOpts != nil {
+			resolverOpts = *opts.ResolverOpts
+		}
+		resolverOpts.Tap = tap
+		resolverOpts.Zone = zone
+		resolverOpts.Views = opts.Views
+		resolverOpts.Stats = stats
+		resolver = NewDNSResolverWithOpts(resolverOpts)
 	}
 	if fetcher == nil {
 		fetcher = NewHTTPBlocklistFetcher()
@@ -66,16 +141,47 @@ func NewDNSServerWithOpts(opts DNSServerOpts, resolver Resolver, fetcher Blockli
 	if readDeadline == 0 {
 		readDeadline = time.Second * 2
 	}
+	interfacePollInterval := opts.InterfacePollInterval
+	if interfacePollInterval == 0 {
+		interfacePollInterval = time.Second * 10
+	}
+	// workers spend most of their time waiting on upstreams, so there are several for every CPU
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0) * 8
+	}
+	sockets := opts.ListenSockets
+	if sockets <= 0 {
+		sockets = 1
+	}
+	if sockets > 1 && !reusePortSupported {
+		log.Warnf("SO_REUSEPORT is not supported on %s, binding a single DNS socket per address", runtime.GOOS)
+		sockets = 1
+	}
+	tcpConns := opts.TCPConnections
+	if tcpConns <= 0 {
+		tcpConns = defaultTCPConnections
+	}
 
 	return &DNSServer{
 		opts:             &opts,
 		resolver:         resolver,
 		blocklistFetcher: fetcher,
-		packetConn:       nil,
-		receiverChan:     make(chan *dnsWorkItem, 100),
-		responseChan:     make(chan *dnsWorkItem, 100),
-		lock:             sync.Mutex{},
+		policyFetcher:    NewZoneResponsePolicyFetcher(opts.TSIGKeys),
+		tap:              tap,
+		limiter:          newClientLimiter(opts.RateLimit),
+		zone:             zone,
+		transferACL:      transferACL,
+		views:            newClientViews(opts.Views),
+		stats:            stats,
+		listeners:        make(map[string]*dnsListener),
+		receiverChan:     make(chan *dnsWorkItem, max(100, workers*4)),
+		responseChan:     make(chan *dnsWorkItem, max(100, workers*4)),
 		readDeadline:     readDeadline,
+		pollInterval:     interfacePollInterval,
+		workers:          workers,
+		sockets:          sockets,
+		tcpConns:         make(chan struct{}, tcpConns),
 	}
 }
 
@@ -89,22 +195,47 @@ func (d *DNSServer) Start() error {
 	}
 	if len(d.opts.BlockedDomains) > 0 {
 		log.Debugf("adding %d blocked domains", len(d.opts.BlockedDomains))
-		d.resolver.AddBlocklistEntries(d.opts.BlockedDomains)
+		d.resolver.AddBlocklistEntries(normalizeDomains(d.opts.BlockedDomains))
 	}
 	log.Info("starting DNS server")
 	log.Tracef("starting DNS server on port %d", d.opts.Port)
-	var err error
-	if d.packetConn, err = net.ListenPacket("udp4", fmt.Sprintf(":%d", d.opts.Port)); err != nil {
+	addrs, err := d.listenAddresses()
+	if err != nil {
 		log.Error("unable to start DNS server: ", err.Error())
 		return err
 	}
+	if len(addrs) == 0 {
+		log.Warnf("interface %s has no usable addresses, waiting for one to be assigned", d.opts.Interface)
+	}
+	if d.opts.ResolverOpts != nil {
+		for _, addr := range dns64WildcardAddrs(d.opts.ResolverOpts.DNS64, addrs) {
+			log.Warnf("DNS64 listeners never match queries received on %s, list the addresses in ListenAddresses instead", addr)
+		}
+	}
 	d.exitChan = make(chan struct{})
-	go d.listen()
-	go d.receiverWorker()
-	go d.responseWorker()
+	d.startWorkers(d.exitChan)
+	// a single address failing to bind is survivable, having nothing to listen on is not
+	if err := d.syncListeners(addrs); err != nil && len(d.listeners) == 0 {
+		log.Error("unable to start DNS server: ", err.Error())
+		close(d.exitChan)
+		d.stopListeners()
+		d.wg.Wait()
+		return err
+	}
+	if len(d.opts.ListenAddresses) == 0 && d.opts.Interface != "" {
+		d.wg.Add(1)
+		go d.watchInterface(d.exitChan)
+	}
+	d.tap.Start()
 	if len(d.opts.BlocklistUrls) > 0 {
 		d.LoadBlocklistFromURLS(d.opts.BlocklistUrls)
 	}
+	for _, zone := range d.opts.ResponsePolicyZones {
+		// an empty zone holds the zone's place in the order until it has loaded
+		d.resolver.SetResponsePolicyZone(NewResponsePolicyZone(zone.Name, nil))
+		d.wg.Add(1)
+		go d.refreshResponsePolicyZone(zone, d.exitChan)
+	}
 	log.Info("DNS server started")
 	return nil
 }
@@ -112,8 +243,9 @@ func (d *DNSServer) Start() error {
 func (d *DNSServer) Stop() error {
 	close(d.exitChan)
 	log.Info("stopping DNS server")
-	d.lock.Lock() //wait for the goroutines to finish
-	defer d.lock.Unlock()
+	d.stopListeners()
+	d.wg.Wait() //wait for the goroutines to finish
+	d.tap.Stop()
 	return nil
 }
 
@@ -130,17 +262,98 @@ func (d *DNSServer) AddLocalDomain(domain string, ip string) error {
 	if parsedIP == nil {
 		return fmt.Errorf("invalid IP address: %s", ip)
 	}
-	return d.resolver.AddLocalDomain(domain, parsedIP.To4())
+	domain, err := NormalizeDomain(domain)
+	if err != nil {
+		return err
+	}
+	if err := d.resolver.AddLocalDomain(domain, parsedIP.To4()); err != nil {
+		return err
+	}
+	if d.zone.SetAddress(domain, parsedIP) {
+		d.notifySecondaries()
+	}
+	return nil
+}
+
+// RegisterDHCPHost makes a DHCP client resolvable as hostname.domain for as long as its lease lasts
+func (d *DNSServer) RegisterDHCPHost(hostname, domain string, ip net.IP, clientId string, expiry time.Time) error {
+	name := LeaseHostname(hostname, domain)
+	if name == "" {
+		return fmt.Errorf("unable to register hostname %q under %q", hostname, domain)
+	}
+	return d.resolver.RegisterHost(name, ip, clientId, expiry)
+}
+
+func (d *DNSServer) UnregisterDHCPHost(clientId string) {
+	d.resolver.UnregisterHost(clientId)
+}
+
+func (d *DNSServer) Upstreams() []UpstreamStatus {
+	return d.resolver.Upstreams()
+}
+
+// Stats reports the total queries and the count most queried names, blocked names and clients over period
+func (d *DNSServer) Stats(period StatsPeriod, count int) StatsReport {
+	return d.stats.Top(period, count, time.Now())
+}
+
+// Clients sums up the queries of every client seen over period, busiest first
+func (d *DNSServer) Clients(period StatsPeriod) []ClientStats {
+	return d.stats.Clients(period, time.Now())
+}
+
+// Client reports the queries of a single client over period, false if the client was not seen in that time
+func (d *DNSServer) Client(ip net.IP, period StatsPeriod, count int) (ClientReport, bool) {
+	return d.stats.Client(ip, period, count, time.Now())
 }
 
 func (d *DNSServer) DeleteLocalDomain(domain string) {
 	d.resolver.DeleteLocalDomain(domain)
+	if domain, err := NormalizeDomain(domain); err == nil && d.zone.DeleteAddress(domain) {
+		d.notifySecondaries()
+	}
+}
+
+// AddViewLocalDomain adds a local domain only clients in view see, the default view "" being the global local domains
+func (d *DNSServer) AddViewLocalDomain(view, domain, ip string) error {
+	if view == "" {
+		return d.AddLocalDomain(domain, ip)
+	}
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return fmt.Errorf("invalid IP address: %s", ip)
+	}
+	return d.resolver.AddViewLocalDomain(view, domain, parsedIP)
+}
+
+func (d *DNSServer) DeleteViewLocalDomain(view, domain string) {
+	if view == "" {
+		d.DeleteLocalDomain(domain)
+		return
+	}
+	d.resolver.DeleteViewLocalDomain(view, domain)
+}
+
+func (d *DNSServer) SetRewriteRules(rules []RewriteRule) error {
+	return d.resolver.SetRewriteRules(rules)
 }
 
 func (d *DNSServer) FlushBlocklist() {
 	d.resolver.FlushBlocklist()
 }
 
+func (d *DNSServer) PauseBlocking(client net.IP, duration time.Duration) BlockingPause {
+	return d.resolver.PauseBlocking(client, duration)
+}
+
+func (d *DNSServer) ResumeBlocking(client net.IP) {
+	d.resolver.ResumeBlocking(client)
+}
+
+func (d *DNSServer) BlockingPauses() []BlockingPause {
+	return d.resolver.BlockingPauses()
+}
+
 func (d *DNSServer) AddBlocklistFromURL(url string) error {
 	hosts, err := d.blocklistFetcher.Fetch(url)
 	if err != nil {
@@ -183,29 +396,87 @@ func (d *DNSServer) LoadBlocklistFromURLS(urls []string) {
 	d.resolver.AddBlocklistEntries(blockedDomains)
 }
 
+// LoadResponsePolicyZone fetches a response policy zone and puts it in place of the version currently loaded. The
+// loaded version stays in place if the zone cannot be fetched
+func (d *DNSServer) LoadResponsePolicyZone(opts ResponsePolicyZoneOpts) error {
+	records, err := d.policyFetcher.Fetch(opts)
+	if err != nil {
+		rpzLoadCounter.With(prometheus.Labels{"zone": opts.Name, "result": "failed"}).Inc()
+		return err
+	}
+	zone := NewResponsePolicyZone(opts.Name, records)
+	d.resolver.SetResponsePolicyZone(zone)
+	rpzLoadCounter.With(prometheus.Labels{"zone": opts.Name, "result": "success"}).Inc()
+	rpzTriggerGauge.With(prometheus.Labels{"zone": opts.Name}).Set(float64(zone.Len()))
+	log.Infof("loaded %d triggers from response policy zone %s serial %d", zone.Len(), zone.Name(), zone.Serial())
+	return nil
+}
+
+func (d *DNSServer) refreshResponsePolicyZone(opts ResponsePolicyZoneOpts, exitChan chan struct{}) {
+	defer d.wg.Done()
+	interval := opts.RefreshInterval
+	if interval == 0 {
+		interval = defaultRPZRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.LoadResponsePolicyZone(opts); err != nil {
+			log.Warnf("unable to load response policy zone %s: %v", opts.Name, err)
+		}
+		select {
+		case <-exitChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func (d *DNSServer) DeleteBlockedDomain(domain string) {
 	d.resolver.DeleteBlocklistEntry(domain)
 }
 
-func (d *DNSServer) AddBlockedDomain(domain string) {
+func (d *DNSServer) AddBlockedDomain(domain string) error {
+	domain, err := NormalizeDomain(domain)
+	if err != nil {
+		return err
+	}
 	d.resolver.AddBlocklistEntries([]string{domain})
+	return nil
 }
 
-func (d *DNSServer) listen() {
-	d.lock.Lock()
+// startWorkers starts the goroutines that resolve queries and send responses, they run until exitChan is closed
+func (d *DNSServer) startWorkers(exitChan chan struct{}) {
+	log.Debugf("starting %d DNS workers", d.workers)
+	for i := 0; i < d.workers; i++ {
+		d.wg.Add(2)
+		go d.receiverWorker(exitChan)
+		go d.responseWorker(exitChan)
+	}
+}
+
+// listen is the read loop of a single UDP socket, a listener bound with several sockets runs one for each
+func (d *DNSServer) listen(l *dnsListener, conn net.PacketConn) {
+	var buff *[]byte
 	defer func() {
-		log.Tracef("closing DNS server")
-		d.packetConn.Close()
-		d.lock.Unlock()
+		log.Tracef("closing DNS listener on %s", l.addr)
+		if buff != nil {
+			packetBuffers.Put(buff)
+		}
+		conn.Close()
+		d.wg.Done()
 	}()
 	for {
 		select {
-		case <-d.exitChan:
+		case <-l.exitChan:
 			return
 		default:
-			buff := make([]byte, 1500)
-			d.packetConn.SetReadDeadline(time.Now().Add(d.readDeadline))
-			n, addr, err := d.packetConn.ReadFrom(buff)
+			// a buffer is only taken from the pool once the last one has been handed to a worker
+			if buff == nil {
+				buff = packetBuffers.Get().(*[]byte)
+			}
+			conn.SetReadDeadline(time.Now().Add(d.readDeadline))
+			n, addr, err := conn.ReadFrom(*buff)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					log.Tracef("timeout error, no packet")
@@ -215,88 +486,251 @@ func (d *DNSServer) listen() {
 				log.Error("unable to read datastream: ", err.Error())
 				continue
 			}
+			if !d.limiter.allowQuery(addr, time.Now()) {
+				log.Tracef("dropping rate limited query from %s", addr.String())
+				continue
+			}
 			workItem := &dnsWorkItem{
+				conn:      conn,
+				buff:      buff,
+				raw:       (*buff)[:n],
 				startTime: time.Now(),
 			}
-			buff = buff[:n]
+			buff = nil
 			log.Tracef("received %d bytes from %s", n, addr.String())
-			msg, err := ParseDNSMessage(buff)
+			msg, err := ParseDNSMessage(workItem.raw)
 			if err != nil {
 				log.Error("unable to parse DNS message: ", err.Error())
 				workItem.err = err
-			} else if msg.Header == nil {
-				log.Error("unable to parse DNS message: no header")
-			} else {
+				msg = formatErrorResponse(workItem.raw)
+			}
+			if msg != nil {
 				workItem.DNSPacket = &DNSPacket{
 					DNSMessage:   msg,
 					ResponseAddr: addr,
 				}
 			}
 			log.Tracef("push packet to worker")
-			d.receiverChan <- workItem
+			select {
+			case d.receiverChan <- workItem:
+			case <-l.exitChan:
+				workItem.release()
+				return
+			}
 			log.Tracef("packet pushed to worker")
 		}
 	}
 }
 
-func (d *DNSServer) receiverWorker() {
-	for packet := range d.receiverChan {
-		if packet.err != nil {
-			log.Errorf("skipping malformed packet: %v", packet.err)
+func (d *DNSServer) receiverWorker(exitChan chan struct{}) {
+	defer d.wg.Done()
+	for {
+		var packet *dnsWorkItem
+		select {
+		case <-exitChan:
+			return
+		case packet = <-d.receiverChan:
+		}
+		if !d.handlePacket(packet) {
 			continue
 		}
 
-		if packet.DNSMessage == nil || packet.DNSMessage.Header == nil {
-			log.Error("received packet with nil DNSMessage or Header")
-			continue
+		log.Tracef("push packet to response worker")
+		select {
+		case d.responseChan <- packet:
+		case <-exitChan:
+			return
 		}
+		log.Tracef("packet pushed to response worker")
 
-		log.Tracef("received DNS packet from %s", packet.ResponseAddr.String())
-		responses, authorities, err := d.resolver.Resolve(packet.DNSMessage.Questions[0].ParsedName, packet.DNSMessage.Questions[0].Type)
+		// we do this afterwards to not interfere with the response timing
+		d.countQuery(packet)
+	}
+}
 
-		if err != nil {
-			if err == ErrNxDomain {
-				packet.DNSMessage.Header.SetRCODE(RCODENameFailure)
-			} else {
-				packet.DNSMessage.Header.SetRCODE(RCODEServerFailure)
-			}
-		} else {
-			packet.DNSMessage.Header.SetRCODE(RCODESuccess)
-			if responses != nil {
-				packet.DNSMessage.Answers = responses
-				log.Tracef("adding answer %v", responses)
-			}
-			if authorities != nil {
-				packet.DNSMessage.Authorities = authorities
-				log.Tracef("adding authority %s", authorities)
-			}
+// handlePacket answers a query read from a UDP socket in place and hands its read buffer back. It reports false when
+// there is nothing to send back
+func (d *DNSServer) handlePacket(packet *dnsWorkItem) bool {
+	defer packet.release()
+	if packet.DNSPacket == nil {
+		log.Errorf("skipping malformed packet: %v", packet.err)
+		return false
+	}
+
+	log.Tracef("received DNS packet from %s", packet.ResponseAddr.String())
+	d.tap.ClientQuery(packet.ResponseAddr, packet.conn.LocalAddr(), packet.raw)
+	if packet.err != nil {
+		// the reply to a packet that did not parse was already made from its header
+		return true
+	}
+	switch rcode := checkQuery(packet.DNSMessage); {
+	case rcode != RCODESuccess:
+		rejectQuery(packet.DNSMessage, rcode)
+	case packet.DNSMessage.Header.Opcode() == DNSOpCodeUpdate:
+		d.handleUpdate(packet)
+	case isZoneTransfer(packet.DNSMessage):
+		// transfers only run over TCP, a truncated reply tells the client to retry there
+		packet.Header.SetTC(true)
+		packet.Header.SetRCODE(RCODESuccess)
+	default:
+		if !d.resolveQuery(packet.DNSMessage, packet.ResponseAddr, packet.conn.LocalAddr()) {
+			log.Tracef("dropping response to %s", packet.ResponseAddr)
+			d.countQuery(packet)
+			return false
 		}
+	}
+	return true
+}
 
-		log.Tracef("push packet to response worker")
-		d.responseChan <- packet
-		log.Tracef("packet pushed to response worker")
+// formatErrorResponse returns the FORMERR reply to a packet that did not parse, built from its header. It returns nil
+// when there is no header to reply to or the packet is itself a response, which must never be answered
+func formatErrorResponse(raw []byte) *DNSMessage {
+	if len(raw) < 12 {
+		return nil
+	}
+	header := &DNSHeader{ID: binary.BigEndian.Uint16(raw), Flags: binary.BigEndian.Uint16(raw[2:])}
+	if header.QR() {
+		return nil
+	}
+	// only the opcode and whether recursion was desired carry over from the query
+	header.Flags &= 0x7900
+	header.SetRCODE(RCODEFormatError)
+	return &DNSMessage{Header: header}
+}
 
-		// we do this afterwards to not interfere with the response timing
-		if packet.err != nil {
-			queryByIPCounter.With(prometheus.Labels{"ip": strings.Split(packet.ResponseAddr.String(), ":")[0], "result": "failed"}).Inc()
-		} else {
-			queryByIPCounter.With(prometheus.Labels{"ip": strings.Split(packet.ResponseAddr.String(), ":")[0], "result": "success"}).Inc()
+// checkQuery returns the error to answer a query the server does not handle with, or RCODESuccess when it can be
+// handled. Updates check their own sections in handleUpdate
+func checkQuery(msg *DNSMessage) RCODE {
+	switch msg.Header.Opcode() {
+	case DNSOpCodeUpdate:
+		return RCODESuccess
+	case DNSOpCodeQuery:
+	default:
+		return RCODENotImplemented
+	}
+	// a query holds exactly one question, RFC 9619
+	if len(msg.Questions) != 1 {
+		return RCODEFormatError
+	}
+	switch msg.Questions[0].Class {
+	case DNSClassIN, DNSClassANY:
+		return RCODESuccess
+	default:
+		// every record served lives in the internet class, CHAOS queries such as version.bind included
+		return RCODERefused
+	}
+}
+
+// rejectQuery turns msg into a reply that carries nothing but rcode. The question is echoed back unless it is what was
+// wrong with the query
+func rejectQuery(msg *DNSMessage, rcode RCODE) {
+	if rcode == RCODEFormatError {
+		msg.Questions = nil
+	}
+	msg.Answers = nil
+	msg.Authorities = nil
+	msg.Header.SetRCODE(rcode)
+}
+
+// resolveQuery answers the question client asked in msg on the local address, in place. It reports false when policy
+// says the query must go unanswered. msg must have passed checkQuery
+func (d *DNSServer) resolveQuery(msg *DNSMessage, client, local net.Addr) bool {
+	clientIP, _ := splitAddr(client)
+	listenerIP, _ := splitAddr(local)
+	d.stats.RecordQuery(msg.Questions[0].ParsedName, clientIP, time.Now())
+	responses, authorities, authoritative, err := d.resolver.ResolveQuery(Query{
+		Domain:   msg.Questions[0].ParsedName,
+		Type:     msg.Questions[0].Type,
+		Client:   clientIP,
+		Listener: listenerIP,
+		View:     selectView(d.views, clientIP),
+	})
+	msg.Header.SetAA(authoritative)
+
+	if err != nil {
+		switch err {
+		case ErrQueryDropped:
+			return false
+		case ErrNxDomain:
+			msg.Header.SetRCODE(RCODENameFailure)
+			// names in locally served zones say which zone they do not exist in
+			msg.Answers, msg.Authorities = nil, authorities
+		default:
+			msg.Header.SetRCODE(RCODEServerFailure)
 		}
+		return true
+	}
+	msg.Header.SetRCODE(RCODESuccess)
+	if responses != nil {
+		msg.Answers = responses
+		log.Tracef("adding answer %v", responses)
+	}
+	if authorities != nil {
+		msg.Authorities = authorities
+		log.Tracef("adding authority %s", authorities)
+	}
+	return true
+}
+
+func (d *DNSServer) countQuery(packet *dnsWorkItem) {
+	result := "success"
+	if packet.err != nil {
+		result = "failed"
+	}
+	requestCounter.With(prometheus.Labels{"result": result}).Inc()
+	if d.opts.ClientMetrics {
+		ip, _ := splitAddr(packet.ResponseAddr)
+		queryByIPCounter.With(prometheus.Labels{"ip": ip.String(), "result": result}).Inc()
 	}
 }
 
-func (d *DNSServer) responseWorker() {
-	for packet := range d.responseChan {
+// marshalResponse appends the response to a handled request to buf, signed if the request was
+func marshalResponse(buf []byte, packet *dnsWorkItem) ([]byte, error) {
+	packet.Header.SetQR(true)
+	packet.Header.SetRA(true)
+	packet.DNSMessage.Additionals = nil
+	data, err := AppendDNSMessage(buf, packet.DNSMessage)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal DNS packet: %w", err)
+	}
+	if packet.tsig != nil {
+		if data, err = packet.tsig.sign(data, time.Now()); err != nil {
+			return nil, fmt.Errorf("unable to sign DNS packet: %w", err)
+		}
+	}
+	return data, nil
+}
+
+func (d *DNSServer) responseWorker(exitChan chan struct{}) {
+	defer d.wg.Done()
+	// responses are written out before the next one is marshaled, so each worker reuses a single buffer
+	buf := make([]byte, 0, udpReadBufferSize)
+	for {
+		var packet *dnsWorkItem
+		select {
+		case <-exitChan:
+			return
+		case packet = <-d.responseChan:
+		}
 		log.Tracef("sending DNS response packet to %s", packet.ResponseAddr.String())
-		packet.Header.SetQR(true)
-		packet.Header.SetRA(true)
-		packet.DNSMessage.Additionals = nil
-		data, err := MarshalDNSMessage(packet.DNSMessage)
+		switch d.limiter.checkResponse(packet.ResponseAddr, packet.DNSMessage, time.Now()) {
+		case rrlDrop:
+			log.Tracef("dropping rate limited response to %s", packet.ResponseAddr.String())
+			continue
+		case rrlSlip:
+			// a truncated reply lets a legitimate client retry over TCP while giving an attacker nothing to amplify
+			packet.Header.SetTC(true)
+			packet.DNSMessage.Answers = nil
+			packet.DNSMessage.Authorities = nil
+		}
+		data, err := marshalResponse(buf[:0], packet)
 		if err != nil {
-			log.Error("unable to marshal DNS packet: ", err.Error())
+			log.Error(err.Error())
 			continue
 		}
-		n, err := d.packetConn.WriteTo(data, packet.ResponseAddr)
+		buf = data
+		n, err := packet.conn.WriteTo(data, packet.ResponseAddr)
+		d.tap.ClientResponse(packet.ResponseAddr, packet.conn.LocalAddr(), data)
 		log.Tracef("sent %d bytes to %s", n, packet.ResponseAddr.String())
 		timeElapsed := time.Since(packet.startTime).Round(time.Millisecond)
 		reqDuration.Observe(float64(timeElapsed.Milliseconds()))
@@ -1,9 +1,12 @@
 package dns
 
 import (
+	"bytes"
 	"net"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type mockResolver struct {
@@ -23,6 +26,27 @@ func (m *mockResolver) Resolve(domain string, dnsType DNSType) (answers, authori
 	return nil, nil, nil
 }
 
+func (m *mockResolver) ResolveQuery(query Query) (answers, authorities []*DNSRecord, authoritative bool, err error) {
+	answers, authorities, err = m.Resolve(query.Domain, query.Type)
+	return answers, authorities, false, err
+}
+
+func (m *mockResolver) AddViewLocalDomain(view, domain string, ip net.IP) error {
+	return nil
+}
+
+func (m *mockResolver) DeleteViewLocalDomain(view, domain string) {}
+
+func (m *mockResolver) SetResponsePolicyZone(zone *ResponsePolicyZone) {}
+
+func (m *mockResolver) SetRewriteRules(rules []RewriteRule) error {
+	return nil
+}
+
+func (m *mockResolver) Upstreams() []UpstreamStatus {
+	return nil
+}
+
 func (m *mockResolver) AddLocalDomain(domain string, ip net.IP) error {
 	if m.addLocalDomainErr != nil {
 		return m.addLocalDomainErr
@@ -35,6 +59,12 @@ func (m *mockResolver) DeleteLocalDomain(domain string) {
 	delete(m.localDomains, domain)
 }
 
+func (m *mockResolver) RegisterHost(name string, ip net.IP, owner string, expiry time.Time) error {
+	return nil
+}
+
+func (m *mockResolver) UnregisterHost(owner string) {}
+
 func (m *mockResolver) AddBlocklistEntries(entries []string) {
 	for _, entry := range entries {
 		m.blocklist[entry] = struct{}{}
@@ -49,6 +79,16 @@ func (m *mockResolver) FlushBlocklist() {
 	m.blocklist = make(map[string]struct{})
 }
 
+func (m *mockResolver) PauseBlocking(client net.IP, d time.Duration) BlockingPause {
+	return BlockingPause{Until: time.Now().Add(d)}
+}
+
+func (m *mockResolver) ResumeBlocking(client net.IP) {}
+
+func (m *mockResolver) BlockingPauses() []BlockingPause {
+	return nil
+}
+
 func TestNewDNSServer_DefaultOpts(t *testing.T) {
 	server := NewDNSServer()
 
@@ -221,3 +261,215 @@ func TestDNSServerOpts_DefaultReadDeadline(t *testing.T) {
 		t.Errorf("expected default readDeadline 2s, got %v", server.readDeadline)
 	}
 }
+
+func TestDNSServer_CountQueryByClientIP(t *testing.T) {
+	server := NewDNSServerWithOpts(DNSServerOpts{ClientMetrics: true}, newMockResolver(), nil)
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.ParseIP("192.168.1.20"), Port: 5353},
+		{IP: net.ParseIP("2001:db8::20"), Port: 5353},
+	} {
+		before := testutil.ToFloat64(queryByIPCounter.WithLabelValues(addr.IP.String(), "success"))
+		server.countQuery(&dnsWorkItem{DNSPacket: &DNSPacket{ResponseAddr: addr}})
+		if after := testutil.ToFloat64(queryByIPCounter.WithLabelValues(addr.IP.String(), "success")); after != before+1 {
+			t.Errorf("expected the query to be counted for %s", addr.IP)
+		}
+	}
+}
+
+func TestDNSServer_RejectsQueries(t *testing.T) {
+	_, addr := startZoneServerWithOpts(t, ZoneOpts{Name: "home.lan"})
+
+	question := func(name string, class uint16) *DNSQuestion {
+		return &DNSQuestion{Name: stringToDNSWireFormat(name), ParsedName: name, Type: DNSTypeA, Class: class}
+	}
+	tests := map[string]struct {
+		opcode    DNSOpCode
+		questions []*DNSQuestion
+		rcode     RCODE
+		echoed    bool
+	}{
+		"no question":     {DNSOpCodeQuery, nil, RCODEFormatError, false},
+		"two questions":   {DNSOpCodeQuery, []*DNSQuestion{question("a.home.lan", DNSClassIN), question("b.home.lan", DNSClassIN)}, RCODEFormatError, false},
+		"status opcode":   {DNSOpCodeStatus, []*DNSQuestion{question("home.lan", DNSClassIN)}, RCODENotImplemented, true},
+		"chaos class":     {DNSOpCodeQuery, []*DNSQuestion{question("version.bind", DNSClassCH)}, RCODERefused, true},
+		"hesiod class":    {DNSOpCodeQuery, []*DNSQuestion{question("home.lan", DNSClassHS)}, RCODERefused, true},
+		"any class query": {DNSOpCodeQuery, []*DNSQuestion{question("home.lan", DNSClassANY)}, RCODESuccess, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			msg := NewDnsMessage()
+			msg.Header.ID = 0x4321
+			msg.Header.SetOpcode(test.opcode)
+			msg.Questions = test.questions
+			data, err := MarshalDNSMessage(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := exchangeRaw(t, addr, data)
+			if response.Header.ID != 0x4321 || response.Header.RCODE() != test.rcode {
+				t.Errorf("expected rcode %d for ID 4321, got rcode %d for ID %x", test.rcode, response.Header.RCODE(), response.Header.ID)
+			}
+			if echoed := len(response.Questions) > 0; echoed != test.echoed {
+				t.Errorf("expected the question echoed to be %t, got %d questions", test.echoed, len(response.Questions))
+			}
+		})
+	}
+}
+
+func TestDNSServer_FormatErrorForMalformedQuery(t *testing.T) {
+	_, addr := startZoneServerWithOpts(t, ZoneOpts{Name: "home.lan"})
+
+	// a header that promises a question the packet does not hold
+	data := []byte{0xab, 0xcd, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 4, 'h', 'o'}
+	response := exchangeRaw(t, addr, data)
+	if response.Header.ID != 0xabcd || response.Header.RCODE() != RCODEFormatError {
+		t.Errorf("expected FORMERR for ID abcd, got rcode %d for ID %x", response.Header.RCODE(), response.Header.ID)
+	}
+	if response.Header.Flags&0x0100 == 0 {
+		t.Error("expected the RD bit of the query to be kept")
+	}
+
+	// over TCP the connection carries on to the next message
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 2))
+	query := NewDnsMessage()
+	query.Header.ID = 0x1111
+	query.Questions = append(query.Questions, &DNSQuestion{ParsedName: "home.lan", Type: DNSTypeSOA, Class: DNSClassIN})
+	valid, _ := MarshalDNSMessage(query)
+	for _, msg := range [][]byte{data, valid} {
+		if err := writeTCPMessage(conn, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range []struct {
+		id    uint16
+		rcode RCODE
+	}{{0xabcd, RCODEFormatError}, {0x1111, RCODESuccess}} {
+		raw, err := readTCPMessage(conn)
+		if err != nil {
+			t.Fatalf("no response over TCP: %v", err)
+		}
+		response, err := ParseDNSMessage(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Header.ID != expected.id || response.Header.RCODE() != expected.rcode {
+			t.Errorf("expected rcode %d for ID %x, got rcode %d for ID %x", expected.rcode, expected.id, response.Header.RCODE(), response.Header.ID)
+		}
+	}
+}
+
+func TestFormatErrorResponse(t *testing.T) {
+	if formatErrorResponse([]byte{0xab, 0xcd, 0x01}) != nil {
+		t.Error("expected no reply to a packet shorter than a header")
+	}
+	// a response must never be answered, or two servers could bounce errors between them
+	if formatErrorResponse([]byte{0xab, 0xcd, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}) != nil {
+		t.Error("expected no reply to a response")
+	}
+	msg := formatErrorResponse([]byte{0xab, 0xcd, 0x2f, 0xff, 0, 1, 0, 0, 0, 0, 0, 0})
+	data, err := MarshalDNSMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// opcode 5 and RD carried over, every other bit of the query dropped
+	if !bytes.Equal(data, []byte{0xab, 0xcd, 0x29, 0x01, 0, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("unexpected reply %x", data)
+	}
+}
+
+func TestDNSServer_LimitsTCPConnections(t *testing.T) {
+	server := NewDNSServerWithOpts(DNSServerOpts{
+		ListenAddresses: []string{"127.0.0.1:0"},
+		ReadDeadline:    time.Millisecond * 100,
+		ResolverOpts:    &ResolverOpts{Upstreams: []string{}, LocalDomains: map[string]net.IP{"host.home.lan": net.IPv4(10, 0, 0, 5)}},
+		TCPConnections:  1,
+	}, nil, nil)
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	t.Cleanup(func() { server.Stop() })
+	server.listenerLock.Lock()
+	addr := server.listeners["127.0.0.1:0"].conns[0].LocalAddr().String()
+	server.listenerLock.Unlock()
+
+	query := NewDnsMessage()
+	query.Questions = append(query.Questions, &DNSQuestion{ParsedName: "host.home.lan", Type: DNSTypeA, Class: DNSClassIN})
+	data, _ := MarshalDNSMessage(query)
+	exchange := func(conn net.Conn) error {
+		conn.SetDeadline(time.Now().Add(time.Second * 2))
+		if err := writeTCPMessage(conn, data); err != nil {
+			return err
+		}
+		_, err := readTCPMessage(conn)
+		return err
+	}
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exchange(first); err != nil {
+		t.Fatalf("expected the first connection to be served: %v", err)
+	}
+
+	// the first connection is still open, so the second is closed without an answer
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if err := exchange(second); err == nil {
+		t.Error("expected the connection over the limit to be closed")
+	}
+
+	first.Close()
+	for deadline := time.Now().Add(time.Second * 2); ; time.Sleep(time.Millisecond * 10) {
+		third, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = exchange(third)
+		third.Close()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a connection once the first was closed: %v", err)
+		}
+	}
+}
+
+func TestDNSServer_AuthoritativeAnswers(t *testing.T) {
+	_, addr := startZoneServer(t)
+
+	tests := map[string]struct {
+		name          string
+		dnsType       DNSType
+		authoritative bool
+	}{
+		"local zone":             {"home.lan", DNSTypeSOA, true},
+		"missing from the zone":  {"missing.home.lan", DNSTypeA, true},
+		"private reverse zone":   {"9.0.0.10.in-addr.arpa", DNSTypePTR, true},
+		"outside the local zone": {"example.com", DNSTypeA, false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			query := NewDnsMessage()
+			// a client setting the bit in its query does not make the answer authoritative
+			query.Header.SetAA(true)
+			query.Questions = append(query.Questions, &DNSQuestion{Name: stringToDNSWireFormat(test.name), ParsedName: test.name, Type: test.dnsType, Class: DNSClassIN})
+			data, err := MarshalDNSMessage(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response := exchangeRaw(t, addr, data); response.Header.AA() != test.authoritative {
+				t.Errorf("expected AA to be %t, got rcode %d with AA %t", test.authoritative, response.Header.RCODE(), response.Header.AA())
+			}
+		})
+	}
+}
@@ -0,0 +1,453 @@
+package dns
+
+import (
+	"container/heap"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type StatsPeriod string
+
+const (
+	StatsPeriodHour StatsPeriod = "hour"
+	StatsPeriodDay  StatsPeriod = "day"
+	StatsPeriodWeek StatsPeriod = "week"
+)
+
+// ParseStatsPeriod returns the period named by s, defaulting to a day
+func ParseStatsPeriod(s string) (StatsPeriod, bool) {
+	switch period := StatsPeriod(s); period {
+	case StatsPeriodHour, StatsPeriodDay, StatsPeriodWeek:
+		return period, true
+	case "":
+		return StatsPeriodDay, true
+	default:
+		return StatsPeriodDay, false
+	}
+}
+
+func (p StatsPeriod) duration() time.Duration {
+	switch p {
+	case StatsPeriodHour:
+		return time.Hour
+	case StatsPeriodWeek:
+		return time.Hour * 24 * 7
+	default:
+		return time.Hour * 24
+	}
+}
+
+// how many of the busiest names a single bucket tracks for each table. Queries for the rest still count towards the
+// totals, which keeps a flood of random names from growing the stats without bound or pushing out the busy names
+const maxStatsBucketKeys = 5000
+
+// how many clients a single bucket tracks, queries from clients beyond that still count towards the totals
+const maxStatsBucketClients = 256
+
+// how many of each client's busiest names a minute and an hour bucket track, per table. Hours are kept for a week, so
+// they only hold the few that make it into a client's report
+const (
+	minuteClientStatsKeys = 100
+	hourClientStatsKeys   = 20
+)
+
+type StatsEntry struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+type StatsReport struct {
+	Period     StatsPeriod  `json:"period"`
+	Queries    uint64       `json:"queries"`
+	Blocked    uint64       `json:"blocked"`
+	TopQueried []StatsEntry `json:"topQueried"`
+	TopBlocked []StatsEntry `json:"topBlocked"`
+	TopClients []StatsEntry `json:"topClients"`
+}
+
+// ClientStats sums up the queries of a single client
+type ClientStats struct {
+	IP       string    `json:"ip"`
+	Queries  uint64    `json:"queries"`
+	Blocked  uint64    `json:"blocked"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// StatsPoint is the number of queries in one step of a timeline
+type StatsPoint struct {
+	Time    time.Time `json:"time"`
+	Queries uint64    `json:"queries"`
+	Blocked uint64    `json:"blocked"`
+}
+
+type ClientReport struct {
+	ClientStats
+	Period     StatsPeriod  `json:"period"`
+	TopDomains []StatsEntry `json:"topDomains"`
+	TopBlocked []StatsEntry `json:"topBlocked"`
+	Timeline   []StatsPoint `json:"timeline"`
+}
+
+type statsBucket struct {
+	start      time.Time
+	clientKeys int // names tracked in each table of a client
+	queries    uint64
+	blocked    uint64
+	domains    *topCounts
+	blocks     *topCounts
+	clients    map[string]*clientBucket
+}
+
+type clientBucket struct {
+	queries  uint64
+	blocked  uint64
+	lastSeen time.Time
+	domains  *topCounts
+	blocks   *topCounts
+}
+
+// client returns the counts of a client, or nil when the bucket already tracks as many clients as it may
+func (b *statsBucket) client(ip net.IP) *clientBucket {
+	if ip == nil {
+		return nil
+	}
+	key := ip.String()
+	if client, ok := b.clients[key]; ok {
+		return client
+	}
+	if len(b.clients) >= maxStatsBucketClients {
+		return nil
+	}
+	client := &clientBucket{domains: newTopCounts(b.clientKeys), blocks: newTopCounts(b.clientKeys)}
+	b.clients[key] = client
+	return client
+}
+
+// topCounts counts keys, holding at most max of them. Once it is full the least counted key makes way for a new one,
+// which takes over its count, so the busiest keys stay in the table however many others pass through. This is the
+// Space-Saving algorithm, counts may be overestimated by at most the count of the key they replaced. The keys are kept
+// in a heap, least counted first, so a new key does not have to look through the whole table
+type topCounts struct {
+	max   int
+	index map[string]int
+	keys  []StatsEntry
+}
+
+func newTopCounts(max int) *topCounts {
+	return &topCounts{max: max, index: make(map[string]int)}
+}
+
+func (t *topCounts) count(key string) {
+	if i, ok := t.index[key]; ok {
+		t.keys[i].Count++
+		heap.Fix(t, i)
+		return
+	}
+	if len(t.keys) < t.max {
+		heap.Push(t, StatsEntry{Name: key, Count: 1})
+		return
+	}
+	least := t.keys[0]
+	delete(t.index, least.Name)
+	t.keys[0] = StatsEntry{Name: key, Count: least.Count + 1}
+	t.index[key] = 0
+	heap.Fix(t, 0)
+}
+
+func (t *topCounts) Len() int { return len(t.keys) }
+
+func (t *topCounts) Less(i, j int) bool {
+	if t.keys[i].Count != t.keys[j].Count {
+		return t.keys[i].Count < t.keys[j].Count
+	}
+	return t.keys[i].Name < t.keys[j].Name
+}
+
+func (t *topCounts) Swap(i, j int) {
+	t.keys[i], t.keys[j] = t.keys[j], t.keys[i]
+	t.index[t.keys[i].Name] = i
+	t.index[t.keys[j].Name] = j
+}
+
+func (t *topCounts) Push(x any) {
+	entry := x.(StatsEntry)
+	t.index[entry.Name] = len(t.keys)
+	t.keys = append(t.keys, entry)
+}
+
+func (t *topCounts) Pop() any {
+	entry := t.keys[len(t.keys)-1]
+	t.keys = t.keys[:len(t.keys)-1]
+	delete(t.index, entry.Name)
+	return entry
+}
+
+// statsRing is a fixed number of buckets of equal width, reused as time moves on
+type statsRing struct {
+	width      time.Duration
+	clientKeys int
+	buckets    []*statsBucket
+}
+
+func newStatsRing(width time.Duration, count, clientKeys int) statsRing {
+	return statsRing{width: width, clientKeys: clientKeys, buckets: make([]*statsBucket, count)}
+}
+
+// bucket returns the bucket now falls in, or nil when now is too old for the ring to hold
+func (r *statsRing) bucket(now time.Time) *statsBucket {
+	start := now.Truncate(r.width)
+	i := int(start.UnixNano()/int64(r.width)) % len(r.buckets)
+	if bucket := r.buckets[i]; bucket != nil && !bucket.start.Before(start) {
+		if bucket.start.Equal(start) {
+			return bucket
+		}
+		return nil
+	}
+	r.buckets[i] = &statsBucket{
+		start:      start,
+		clientKeys: r.clientKeys,
+		domains:    newTopCounts(maxStatsBucketKeys),
+		blocks:     newTopCounts(maxStatsBucketKeys),
+		clients:    make(map[string]*clientBucket),
+	}
+	return r.buckets[i]
+}
+
+// since returns the start of the oldest bucket in the window ending now, the window covers the bucket now falls in and
+// the ones before it
+func (r *statsRing) since(now time.Time, window time.Duration) time.Time {
+	return now.Add(-window).Truncate(r.width).Add(r.width)
+}
+
+// within returns the buckets in the window ending now
+func (r *statsRing) within(now time.Time, window time.Duration) []*statsBucket {
+	since := r.since(now, window)
+	var buckets []*statsBucket
+	for _, bucket := range r.buckets {
+		if bucket != nil && !bucket.start.Before(since) && !bucket.start.After(now) {
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+// QueryStats counts queries, blocked names and clients in time buckets so the busiest of each can be reported for the
+// last hour, day or week. A nil QueryStats counts nothing
+type QueryStats struct {
+	lock    sync.Mutex
+	minutes statsRing // the last hour
+	hours   statsRing // the last week
+}
+
+func NewQueryStats() *QueryStats {
+	return &QueryStats{
+		minutes: newStatsRing(time.Minute, 60, minuteClientStatsKeys),
+		hours:   newStatsRing(time.Hour, 24*7, hourClientStatsKeys),
+	}
+}
+
+// RecordQuery counts a query for domain from client, which may be nil
+func (s *QueryStats) RecordQuery(domain string, client net.IP, now time.Time) {
+	if s == nil {
+		return
+	}
+	domain = canonicalName(domain)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, bucket := range []*statsBucket{s.minutes.bucket(now), s.hours.bucket(now)} {
+		if bucket == nil {
+			continue
+		}
+		bucket.queries++
+		bucket.domains.count(domain)
+		if counts := bucket.client(client); counts != nil {
+			counts.queries++
+			counts.lastSeen = now
+			counts.domains.count(domain)
+		}
+	}
+}
+
+// RecordBlocked counts a query for domain from client that was blocked, client may be nil
+func (s *QueryStats) RecordBlocked(domain string, client net.IP, now time.Time) {
+	if s == nil {
+		return
+	}
+	domain = canonicalName(domain)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, bucket := range []*statsBucket{s.minutes.bucket(now), s.hours.bucket(now)} {
+		if bucket == nil {
+			continue
+		}
+		bucket.blocked++
+		bucket.blocks.count(domain)
+		if counts := bucket.client(client); counts != nil {
+			counts.blocked++
+			counts.blocks.count(domain)
+		}
+	}
+}
+
+// Top reports the totals and the count busiest names and clients over period
+func (s *QueryStats) Top(period StatsPeriod, count int, now time.Time) StatsReport {
+	report := StatsReport{Period: period, TopQueried: []StatsEntry{}, TopBlocked: []StatsEntry{}, TopClients: []StatsEntry{}}
+	if s == nil {
+		return report
+	}
+
+	// the tables are copied and added up once the lock is released, a week of them would hold up every query meanwhile
+	var domains, blocks [][]StatsEntry
+	var clients []StatsEntry
+	s.lock.Lock()
+	for _, bucket := range s.ring(period).within(now, period.duration()) {
+		report.Queries += bucket.queries
+		report.Blocked += bucket.blocked
+		domains = append(domains, slices.Clone(bucket.domains.keys))
+		blocks = append(blocks, slices.Clone(bucket.blocks.keys))
+		for ip, client := range bucket.clients {
+			clients = append(clients, StatsEntry{Name: ip, Count: client.queries})
+		}
+	}
+	s.lock.Unlock()
+
+	report.TopQueried = topEntries(sumEntries(domains...), count)
+	report.TopBlocked = topEntries(sumEntries(blocks...), count)
+	report.TopClients = topEntries(sumEntries(clients), count)
+	return report
+}
+
+// Clients sums up every client seen over period, busiest first
+func (s *QueryStats) Clients(period StatsPeriod, now time.Time) []ClientStats {
+	if s == nil {
+		return []ClientStats{}
+	}
+
+	var seen []ClientStats
+	s.lock.Lock()
+	for _, bucket := range s.ring(period).within(now, period.duration()) {
+		for ip, client := range bucket.clients {
+			seen = append(seen, client.stats(ip))
+		}
+	}
+	s.lock.Unlock()
+
+	totals := make(map[string]*ClientStats)
+	for _, stats := range seen {
+		total, ok := totals[stats.IP]
+		if !ok {
+			total = &ClientStats{IP: stats.IP}
+			totals[stats.IP] = total
+		}
+		total.add(stats)
+	}
+	clients := make([]ClientStats, 0, len(totals))
+	for _, total := range totals {
+		clients = append(clients, *total)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Queries != clients[j].Queries {
+			return clients[i].Queries > clients[j].Queries
+		}
+		return clients[i].IP < clients[j].IP
+	})
+	return clients
+}
+
+// Client reports the queries of a single client over period, with the count names it queried and had blocked most and
+// a timeline of its queries. It reports false if the client was not seen in that time
+func (s *QueryStats) Client(ip net.IP, period StatsPeriod, count int, now time.Time) (ClientReport, bool) {
+	report := ClientReport{
+		ClientStats: ClientStats{IP: ip.String()},
+		Period:      period,
+		TopDomains:  []StatsEntry{},
+		TopBlocked:  []StatsEntry{},
+		Timeline:    []StatsPoint{},
+	}
+	if s == nil {
+		return report, false
+	}
+
+	ring := s.ring(period)
+	points := make(map[time.Time]ClientStats)
+	var domains, blocks [][]StatsEntry
+	s.lock.Lock()
+	for _, bucket := range ring.within(now, period.duration()) {
+		client, ok := bucket.clients[report.IP]
+		if !ok {
+			continue
+		}
+		points[bucket.start] = client.stats(report.IP)
+		domains = append(domains, slices.Clone(client.domains.keys))
+		blocks = append(blocks, slices.Clone(client.blocks.keys))
+	}
+	s.lock.Unlock()
+
+	if len(points) == 0 {
+		return report, false
+	}
+	for _, stats := range points {
+		report.add(stats)
+	}
+	report.TopDomains = topEntries(sumEntries(domains...), count)
+	report.TopBlocked = topEntries(sumEntries(blocks...), count)
+	for start := ring.since(now, period.duration()); !start.After(now); start = start.Add(ring.width) {
+		point := StatsPoint{Time: start}
+		if stats, ok := points[start]; ok {
+			point.Queries, point.Blocked = stats.Queries, stats.Blocked
+		}
+		report.Timeline = append(report.Timeline, point)
+	}
+	return report, true
+}
+
+// ring returns the ring that holds period at the finest resolution
+func (s *QueryStats) ring(period StatsPeriod) *statsRing {
+	if period == StatsPeriodHour {
+		return &s.minutes
+	}
+	return &s.hours
+}
+
+func (c *clientBucket) stats(ip string) ClientStats {
+	return ClientStats{IP: ip, Queries: c.queries, Blocked: c.blocked, LastSeen: c.lastSeen}
+}
+
+func (c *ClientStats) add(other ClientStats) {
+	c.Queries += other.Queries
+	c.Blocked += other.Blocked
+	if other.LastSeen.After(c.LastSeen) {
+		c.LastSeen = other.LastSeen
+	}
+}
+
+// sumEntries adds up the counts of each name across tables
+func sumEntries(tables ...[]StatsEntry) map[string]uint64 {
+	counts := make(map[string]uint64)
+	for _, table := range tables {
+		for _, entry := range table {
+			counts[entry.Name] += entry.Count
+		}
+	}
+	return counts
+}
+
+func topEntries(counts map[string]uint64, count int) []StatsEntry {
+	entries := make([]StatsEntry, 0, len(counts))
+	for name, n := range counts {
+		entries = append(entries, StatsEntry{Name: name, Count: n})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	if len(entries) > count {
+		entries = entries[:count]
+	}
+	return entries
+}
@@ -0,0 +1,281 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseStatsPeriod(t *testing.T) {
+	tests := map[string]StatsPeriod{"": StatsPeriodDay, "hour": StatsPeriodHour, "day": StatsPeriodDay, "week": StatsPeriodWeek}
+	for value, expected := range tests {
+		if period, ok := ParseStatsPeriod(value); !ok || period != expected {
+			t.Errorf("%q: expected %s, got %s (%v)", value, expected, period, ok)
+		}
+	}
+	if _, ok := ParseStatsPeriod("month"); ok {
+		t.Error("expected month to be rejected")
+	}
+}
+
+func TestQueryStats_Top(t *testing.T) {
+	stats := NewQueryStats()
+	now := time.Date(2024, 5, 10, 12, 30, 0, 0, time.UTC)
+	laptop, phone := net.ParseIP("192.168.1.10"), net.ParseIP("192.168.1.11")
+
+	for i := 0; i < 3; i++ {
+		stats.RecordQuery("Example.com.", laptop, now)
+	}
+	stats.RecordQuery("ads.tracker.net", phone, now)
+	stats.RecordBlocked("ads.tracker.net", phone, now)
+	// outside the last hour but inside the last day
+	stats.RecordQuery("old.example.com", phone, now.Add(-time.Hour*3))
+	// outside the last week
+	stats.RecordQuery("ancient.example.com", phone, now.Add(-time.Hour*24*8))
+
+	hour := stats.Top(StatsPeriodHour, 10, now)
+	if hour.Queries != 4 || hour.Blocked != 1 {
+		t.Errorf("expected 4 queries and 1 blocked in the last hour, got %d and %d", hour.Queries, hour.Blocked)
+	}
+	expected := []StatsEntry{{"example.com", 3}, {"ads.tracker.net", 1}}
+	if !reflect.DeepEqual(hour.TopQueried, expected) {
+		t.Errorf("expected %v, got %v", expected, hour.TopQueried)
+	}
+	if expected := []StatsEntry{{"ads.tracker.net", 1}}; !reflect.DeepEqual(hour.TopBlocked, expected) {
+		t.Errorf("expected %v, got %v", expected, hour.TopBlocked)
+	}
+	if expected := []StatsEntry{{"192.168.1.10", 3}, {"192.168.1.11", 1}}; !reflect.DeepEqual(hour.TopClients, expected) {
+		t.Errorf("expected %v, got %v", expected, hour.TopClients)
+	}
+
+	if day := stats.Top(StatsPeriodDay, 10, now); day.Queries != 5 {
+		t.Errorf("expected 5 queries in the last day, got %d", day.Queries)
+	}
+	if week := stats.Top(StatsPeriodWeek, 10, now); week.Queries != 5 {
+		t.Errorf("expected 5 queries in the last week, got %d", week.Queries)
+	}
+
+	if top := stats.Top(StatsPeriodDay, 1, now); len(top.TopQueried) != 1 || top.TopQueried[0].Name != "example.com" {
+		t.Errorf("expected only example.com, got %v", top.TopQueried)
+	}
+}
+
+func TestQueryStats_ReusesExpiredBuckets(t *testing.T) {
+	stats := NewQueryStats()
+	now := time.Date(2024, 5, 10, 12, 30, 0, 0, time.UTC)
+	stats.RecordQuery("example.com", nil, now)
+
+	// exactly one ring length later lands in the same slot, which must start afresh
+	later := now.Add(time.Hour)
+	stats.RecordQuery("example.org", nil, later)
+	hour := stats.Top(StatsPeriodHour, 10, later)
+	if hour.Queries != 1 || len(hour.TopQueried) != 1 || hour.TopQueried[0].Name != "example.org" {
+		t.Errorf("expected only example.org in the last hour, got %+v", hour)
+	}
+	if len(hour.TopClients) != 0 {
+		t.Errorf("expected no clients without an address, got %v", hour.TopClients)
+	}
+}
+
+func TestQueryStats_BoundsNames(t *testing.T) {
+	stats := NewQueryStats()
+	now := time.Now()
+	for i := 0; i < maxStatsBucketKeys+10; i++ {
+		stats.RecordQuery(net.IPv4(10, 0, byte(i>>8), byte(i)).String()+".example.com", nil, now)
+	}
+	report := stats.Top(StatsPeriodHour, maxStatsBucketKeys*2, now)
+	if report.Queries != maxStatsBucketKeys+10 {
+		t.Errorf("expected every query in the total, got %d", report.Queries)
+	}
+	if len(report.TopQueried) != maxStatsBucketKeys {
+		t.Errorf("expected %d names tracked, got %d", maxStatsBucketKeys, len(report.TopQueried))
+	}
+}
+
+func TestQueryStats_BoundsClients(t *testing.T) {
+	stats := NewQueryStats()
+	now := time.Now()
+	for i := 0; i < maxStatsBucketClients+10; i++ {
+		stats.RecordQuery("example.com", net.IPv4(10, 0, byte(i>>8), byte(i)), now)
+	}
+	if clients := stats.Clients(StatsPeriodHour, now); len(clients) != maxStatsBucketClients {
+		t.Errorf("expected %d clients tracked, got %d", maxStatsBucketClients, len(clients))
+	}
+	if report := stats.Top(StatsPeriodHour, 10, now); report.Queries != maxStatsBucketClients+10 {
+		t.Errorf("expected every query in the total, got %d", report.Queries)
+	}
+}
+
+func TestTopCounts(t *testing.T) {
+	counts := newTopCounts(3)
+	for _, name := range []string{"a", "a", "a", "b", "b", "c", "d", "a", "e", "b"} {
+		counts.count(name)
+	}
+	if len(counts.keys) != 3 || len(counts.index) != 3 {
+		t.Fatalf("expected the table to stay at 3 keys, got %v", counts.keys)
+	}
+	kept := make(map[string]uint64)
+	for name, i := range counts.index {
+		kept[name] = counts.keys[i].Count
+	}
+	// the busiest keys stay with their counts, the one slot left over goes to the latest arrival
+	if kept["a"] != 4 || kept["b"] != 3 {
+		t.Errorf("expected the busiest keys to be kept, got %v", counts.keys)
+	}
+}
+
+func TestQueryStats_KeepsBusiestNames(t *testing.T) {
+	stats := NewQueryStats()
+	now := time.Date(2024, 5, 10, 12, 30, 0, 0, time.UTC)
+
+	// a burst of random names early in the hour fills the tables before the usual names are queried
+	for i := 0; i < maxStatsBucketKeys*2; i++ {
+		stats.RecordQuery(fmt.Sprintf("%d.random.example.org", i), nil, now)
+		stats.RecordBlocked(fmt.Sprintf("%d.random.example.org", i), nil, now)
+	}
+	for i := 0; i < 5; i++ {
+		stats.RecordQuery("example.com", nil, now)
+		stats.RecordBlocked("ads.tracker.net", nil, now)
+	}
+
+	report := stats.Top(StatsPeriodHour, 1, now)
+	if len(report.TopQueried) != 1 || report.TopQueried[0].Name != "example.com" {
+		t.Errorf("expected example.com to be the top name, got %v", report.TopQueried)
+	}
+	if len(report.TopBlocked) != 1 || report.TopBlocked[0].Name != "ads.tracker.net" {
+		t.Errorf("expected ads.tracker.net to be the top blocked name, got %v", report.TopBlocked)
+	}
+}
+
+func TestQueryStats_ClientKeepsBusiestNames(t *testing.T) {
+	stats := NewQueryStats()
+	now := time.Date(2024, 5, 10, 12, 30, 0, 0, time.UTC)
+	laptop := net.ParseIP("192.168.1.10")
+
+	for i := 0; i < 20; i++ {
+		stats.RecordQuery("example.com", laptop, now)
+	}
+	// a long tail of names queried once each, more than an hour bucket tracks
+	for i := 0; i < hourClientStatsKeys*5; i++ {
+		stats.RecordQuery(fmt.Sprintf("%d.example.org", i), laptop, now)
+	}
+	stats.RecordQuery("example.com", laptop, now)
+
+	report, ok := stats.Client(laptop, StatsPeriodDay, 1, now)
+	if !ok {
+		t.Fatal("expected the laptop to have been seen")
+	}
+	if expected := []StatsEntry{{"example.com", 21}}; !reflect.DeepEqual(report.TopDomains, expected) {
+		t.Errorf("expected %v, got %v", expected, report.TopDomains)
+	}
+	bucket := stats.hours.bucket(now)
+	if names := len(bucket.clients[laptop.String()].domains.keys); names != hourClientStatsKeys {
+		t.Errorf("expected %d names tracked for the client in the hour, got %d", hourClientStatsKeys, names)
+	}
+}
+
+func TestDNSResolver_RecordsBlockedStats(t *testing.T) {
+	stats := NewQueryStats()
+	resolver := NewDNSResolverWithOpts(ResolverOpts{Upstreams: []string{}, Stats: stats})
+	resolver.AddBlocklistEntries([]string{"ads.tracker.net"})
+
+	if _, _, _, err := resolver.ResolveQuery(Query{Domain: "ads.tracker.net", Type: DNSTypeA}); err != nil {
+		t.Fatal(err)
+	}
+	report := stats.Top(StatsPeriodHour, 10, time.Now())
+	if expected := []StatsEntry{{"ads.tracker.net", 1}}; !reflect.DeepEqual(report.TopBlocked, expected) {
+		t.Errorf("expected %v, got %v", expected, report.TopBlocked)
+	}
+}
+
+func TestQueryStats_Clients(t *testing.T) {
+	stats := NewQueryStats()
+	now := time.Date(2024, 5, 10, 12, 30, 0, 0, time.UTC)
+	laptop, phone := net.ParseIP("192.168.1.10"), net.ParseIP("192.168.1.11")
+
+	stats.RecordQuery("example.com", laptop, now.Add(-time.Hour*2))
+	stats.RecordQuery("example.com", laptop, now.Add(-time.Minute))
+	stats.RecordQuery("ads.tracker.net", phone, now)
+	stats.RecordBlocked("ads.tracker.net", phone, now)
+	stats.RecordQuery("example.org", phone, now)
+
+	clients := stats.Clients(StatsPeriodDay, now)
+	expected := []ClientStats{
+		{IP: "192.168.1.10", Queries: 2, LastSeen: now.Add(-time.Minute)},
+		{IP: "192.168.1.11", Queries: 2, Blocked: 1, LastSeen: now},
+	}
+	if !reflect.DeepEqual(clients, expected) {
+		t.Errorf("expected %+v, got %+v", expected, clients)
+	}
+	if clients := stats.Clients(StatsPeriodHour, now); len(clients) != 2 || clients[0].IP != "192.168.1.11" || clients[1].Queries != 1 {
+		t.Errorf("expected the laptop's older query outside the last hour, got %+v", clients)
+	}
+}
+
+func TestQueryStats_Client(t *testing.T) {
+	stats := NewQueryStats()
+	now := time.Date(2024, 5, 10, 12, 30, 0, 0, time.UTC)
+	phone := net.ParseIP("192.168.1.11")
+
+	stats.RecordQuery("ads.tracker.net", phone, now.Add(-time.Hour*2))
+	stats.RecordBlocked("ads.tracker.net", phone, now.Add(-time.Hour*2))
+	stats.RecordQuery("example.org", phone, now)
+	stats.RecordQuery("example.org", phone, now)
+
+	report, ok := stats.Client(phone, StatsPeriodDay, 10, now)
+	if !ok {
+		t.Fatal("expected the phone to have been seen")
+	}
+	if report.Queries != 3 || report.Blocked != 1 || !report.LastSeen.Equal(now) {
+		t.Errorf("expected 3 queries, 1 blocked and last seen now, got %+v", report.ClientStats)
+	}
+	if expected := []StatsEntry{{"example.org", 2}, {"ads.tracker.net", 1}}; !reflect.DeepEqual(report.TopDomains, expected) {
+		t.Errorf("expected %v, got %v", expected, report.TopDomains)
+	}
+	if expected := []StatsEntry{{"ads.tracker.net", 1}}; !reflect.DeepEqual(report.TopBlocked, expected) {
+		t.Errorf("expected %v, got %v", expected, report.TopBlocked)
+	}
+
+	if len(report.Timeline) != 24 {
+		t.Fatalf("expected a point for every hour of the day, got %d", len(report.Timeline))
+	}
+	if last := report.Timeline[23]; !last.Time.Equal(now.Truncate(time.Hour)) || last.Queries != 2 {
+		t.Errorf("expected 2 queries in the current hour, got %+v", last)
+	}
+	if point := report.Timeline[21]; point.Queries != 1 || point.Blocked != 1 {
+		t.Errorf("expected the blocked query two hours ago, got %+v", point)
+	}
+
+	if _, ok := stats.Client(net.ParseIP("192.168.1.99"), StatsPeriodDay, 10, now); ok {
+		t.Error("expected an unseen client not to be found")
+	}
+}
+
+func TestQueryStats_ReportsWhileRecording(t *testing.T) {
+	stats := NewQueryStats()
+	laptop := net.ParseIP("192.168.1.10")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			stats.RecordQuery(fmt.Sprintf("%d.example.com", i%50), laptop, time.Now())
+			stats.RecordBlocked("ads.tracker.net", laptop, time.Now())
+		}
+	}()
+	// the reports add up copies of the tables, run with -race to check they never read one being counted
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		stats.Top(StatsPeriodWeek, 10, time.Now())
+		stats.Clients(StatsPeriodDay, time.Now())
+		stats.Client(laptop, StatsPeriodHour, 10, time.Now())
+	}
+	if report := stats.Top(StatsPeriodHour, 10, time.Now()); report.Queries != 1000 || report.Blocked != 1000 {
+		t.Errorf("expected every query counted, got %d and %d", report.Queries, report.Blocked)
+	}
+}
@@ -0,0 +1,160 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how long a TCP client may keep a connection open without sending anything
+	tcpIdleTimeout = time.Second * 10
+	// how many TCP connections are served at once unless configured otherwise, each holds a goroutine and a descriptor
+	// for up to tcpIdleTimeout
+	defaultTCPConnections = 256
+)
+
+func (d *DNSServer) serveTCP(l *dnsListener) {
+	defer func() {
+		log.Tracef("closing DNS TCP listener on %s", l.addr)
+		l.tcp.Close()
+		d.wg.Done()
+	}()
+	for {
+		select {
+		case <-l.exitChan:
+			return
+		default:
+			l.tcp.SetDeadline(time.Now().Add(d.readDeadline))
+			conn, err := l.tcp.Accept()
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					continue
+				}
+				log.Error("unable to accept TCP connection: ", err.Error())
+				continue
+			}
+			select {
+			case d.tcpConns <- struct{}{}:
+			default:
+				log.Debugf("closing TCP connection from %s, %d connections are already open", conn.RemoteAddr(), cap(d.tcpConns))
+				conn.Close()
+				continue
+			}
+			d.wg.Add(1)
+			go d.handleTCPConn(conn, l.exitChan)
+		}
+	}
+}
+
+// handleTCPConn answers length prefixed messages on conn until the client goes quiet or hangs up
+func (d *DNSServer) handleTCPConn(conn net.Conn, exitChan chan struct{}) {
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		conn.Close()
+		<-d.tcpConns
+		d.wg.Done()
+	}()
+	// a blocked read must not hold up the server stopping
+	go func() {
+		select {
+		case <-exitChan:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		raw, err := readTCPMessage(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Debugf("closing TCP connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if !d.limiter.allowQuery(conn.RemoteAddr(), time.Now()) {
+			log.Tracef("dropping rate limited query from %s", conn.RemoteAddr())
+			continue
+		}
+		msg, err := ParseDNSMessage(raw)
+		if err != nil {
+			log.Error("unable to parse DNS message: ", err.Error())
+			// the length prefix keeps the stream in step, so a connection can carry on past a malformed message
+			if msg = formatErrorResponse(raw); msg == nil {
+				return
+			}
+		}
+		packet := &dnsWorkItem{
+			DNSPacket: &DNSPacket{
+				DNSMessage:   msg,
+				ResponseAddr: conn.RemoteAddr(),
+			},
+			raw:       raw,
+			err:       err,
+			startTime: time.Now(),
+		}
+		d.tap.ClientQuery(conn.RemoteAddr(), conn.LocalAddr(), raw)
+
+		switch rcode := checkQuery(msg); {
+		case err != nil:
+			// msg is already the reply to the malformed message
+		case rcode != RCODESuccess:
+			rejectQuery(msg, rcode)
+		case msg.Header.Opcode() == DNSOpCodeUpdate:
+			d.handleUpdate(packet)
+		case isZoneTransfer(msg):
+			// transfers write their own, possibly many, responses
+			if err := d.transferZone(conn, packet); err != nil {
+				log.Errorf("zone transfer to %s failed: %v", conn.RemoteAddr(), err)
+				return
+			}
+			d.countQuery(packet)
+			continue
+		default:
+			if !d.resolveQuery(msg, conn.RemoteAddr(), conn.LocalAddr()) {
+				d.countQuery(packet)
+				continue
+			}
+		}
+
+		data, err := marshalResponse(nil, packet)
+		if err != nil {
+			log.Error(err.Error())
+			return
+		}
+		if err := writeTCPMessage(conn, data); err != nil {
+			log.Errorf("unable to send DNS packet to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		d.tap.ClientResponse(conn.RemoteAddr(), conn.LocalAddr(), data)
+		reqDuration.Observe(float64(time.Since(packet.startTime).Round(time.Millisecond).Milliseconds()))
+		d.countQuery(packet)
+	}
+}
+
+func readTCPMessage(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(conn net.Conn, msg []byte) error {
+	if len(msg) > 0xffff {
+		return errors.New("message too large for TCP")
+	}
+	conn.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+	_, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
@@ -0,0 +1,297 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	zoneTransferCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_zone_transfer_count",
+		Help: "count of zone transfer requests by type and result",
+	}, []string{"type", "result"})
+
+	zoneNotifyCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_zone_notify_count",
+		Help: "count of NOTIFY messages sent to secondaries by result",
+	}, []string{"result"})
+)
+
+const (
+	// transfers are split into messages of roughly this size, well under the TCP message limit
+	transferMessageSize = 16 * 1024
+	notifyTimeout       = time.Second * 2
+	notifyAttempts      = 3
+)
+
+func isZoneTransfer(msg *DNSMessage) bool {
+	return len(msg.Questions) > 0 && (msg.Questions[0].Type == DNSTypeAXFR || msg.Questions[0].Type == DNSTypeIXFR)
+}
+
+// transferAllowed reports whether a client may transfer the zone, either by signing with one of the transfer keys or
+// by coming from an allowed address
+func (d *DNSServer) transferAllowed(addr net.Addr, ctx *tsigContext) bool {
+	if ctx != nil && ctx.err == TSIGErrorNone {
+		for _, name := range d.opts.Zone.TransferKeys {
+			if canonicalName(name) == canonicalName(ctx.key.Name) {
+				return true
+			}
+		}
+	}
+	ip, _ := splitAddr(addr)
+	for _, network := range d.transferACL {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// transferZone answers an AXFR or IXFR request on a TCP connection. Errors are only returned when the connection is
+// no longer usable
+func (d *DNSServer) transferZone(conn net.Conn, packet *dnsWorkItem) error {
+	msg := packet.DNSMessage
+	question := msg.Questions[0]
+	transferType := question.Type.String()
+	reply := func(rcode RCODE, result string) error {
+		zoneTransferCounter.With(prometheus.Labels{"type": transferType, "result": result}).Inc()
+		msg.Header.SetRCODE(rcode)
+		msg.Answers, msg.Authorities = nil, nil
+		data, err := marshalResponse(nil, packet)
+		if err != nil {
+			return err
+		}
+		return writeTCPMessage(conn, data)
+	}
+
+	ctx, err := verifyTSIG(packet.raw, msg, d.opts.TSIGKeys, time.Now())
+	switch {
+	case err != nil:
+		log.Warnf("malformed %s request from %s: %v", transferType, packet.ResponseAddr, err)
+		return reply(RCODEFormatError, "malformed")
+	case ctx != nil && ctx.err != TSIGErrorNone:
+		log.Warnf("%s request from %s failed TSIG verification with key %s (error %d)", transferType, packet.ResponseAddr, ctx.request.KeyName, ctx.err)
+		packet.tsig = ctx
+		return reply(RCODENotAuth, "bad-signature")
+	}
+	packet.tsig = ctx
+
+	if d.zone == nil || canonicalName(question.ParsedName) != d.zone.Name() {
+		log.Debugf("refusing %s of %s from %s, not our zone", transferType, question.ParsedName, packet.ResponseAddr)
+		return reply(RCODENotAuth, "not-authoritative")
+	}
+	if !d.transferAllowed(packet.ResponseAddr, ctx) {
+		log.Warnf("refusing %s of %s from %s", transferType, question.ParsedName, packet.ResponseAddr)
+		return reply(RCODERefused, "refused")
+	}
+
+	// an IXFR carries the serial the client has as an SOA in the authority section
+	var fromSerial uint32
+	incremental := question.Type == DNSTypeIXFR
+	if incremental {
+		if len(msg.Authorities) != 1 || msg.Authorities[0].Type != DNSTypeSOA || len(msg.Authorities[0].RData) < 22 {
+			log.Warnf("malformed IXFR request from %s, no SOA in the authority section", packet.ResponseAddr)
+			return reply(RCODEFormatError, "malformed")
+		}
+		rdata := msg.Authorities[0].RData
+		fromSerial = binary.BigEndian.Uint32(rdata[len(rdata)-20:])
+	}
+
+	records, full := d.zone.transferRecords(fromSerial, incremental)
+	log.Infof("sending %s of %s to %s (%d records, full transfer %t)", transferType, question.ParsedName, packet.ResponseAddr, len(records), full)
+
+	var mac []byte
+	for first := true; len(records) > 0; first = false {
+		count, size := 0, 0
+		for count < len(records) {
+			recordSize := len(records[count].Name) + 10 + len(records[count].RData)
+			if count > 0 && size+recordSize > transferMessageSize {
+				break
+			}
+			size += recordSize
+			count++
+		}
+
+		response := &DNSMessage{
+			Header:  &DNSHeader{ID: msg.Header.ID, Flags: msg.Header.Flags},
+			Answers: records[:count],
+		}
+		if first {
+			response.Questions = msg.Questions
+		}
+		response.Header.SetQR(true)
+		response.Header.SetAA(true)
+		response.Header.SetRCODE(RCODESuccess)
+		data, err := MarshalDNSMessage(response)
+		if err != nil {
+			return err
+		}
+		// every message of a signed transfer is chained to the one before it
+		if ctx != nil {
+			priorMAC := mac
+			if first {
+				priorMAC = ctx.requestMAC
+			}
+			if data, mac, err = signTSIG(data, ctx.key, priorMAC, TSIGErrorNone, !first, time.Now()); err != nil {
+				return err
+			}
+		}
+		if err := writeTCPMessage(conn, data); err != nil {
+			return err
+		}
+		d.tap.ClientResponse(conn.RemoteAddr(), conn.LocalAddr(), data)
+		records = records[count:]
+	}
+	zoneTransferCounter.With(prometheus.Labels{"type": transferType, "result": "success"}).Inc()
+	return nil
+}
+
+// notifySecondaries tells every configured secondary that the zone has changed, RFC 1996
+func (d *DNSServer) notifySecondaries() {
+	if d.zone == nil || len(d.opts.Zone.Notify) == 0 {
+		return
+	}
+	soa, _, _, err := d.zone.Lookup(d.zone.Name(), DNSTypeSOA)
+	if err != nil || len(soa) == 0 {
+		return
+	}
+	for _, secondary := range d.opts.Zone.Notify {
+		addr := secondary
+		if _, _, err := net.SplitHostPort(secondary); err != nil {
+			addr = net.JoinHostPort(secondary, "53")
+		}
+		go func() {
+			if err := sendNotify(addr, d.zone.Name(), soa[0]); err != nil {
+				log.Warnf("unable to notify %s of changes to %s: %v", addr, d.zone.Name(), err)
+				zoneNotifyCounter.With(prometheus.Labels{"result": "failed"}).Inc()
+				return
+			}
+			log.Debugf("notified %s of serial %d for %s", addr, binary.BigEndian.Uint32(soa[0].RData[len(soa[0].RData)-20:]), d.zone.Name())
+			zoneNotifyCounter.With(prometheus.Labels{"result": "success"}).Inc()
+		}()
+	}
+}
+
+// sendNotify sends a NOTIFY for zone to addr, retrying until the secondary acknowledges it
+func sendNotify(addr, zone string, soa *DNSRecord) error {
+	msg := NewDnsMessage()
+	msg.Header.ID = uint16(rand.Intn(65535))
+	msg.Header.SetOpcode(DNSOpCodeNotify)
+	msg.Header.SetAA(true)
+	msg.Questions = append(msg.Questions, &DNSQuestion{
+		ParsedName: zone,
+		Name:       stringToDNSWireFormat(zone),
+		Type:       DNSTypeSOA,
+		Class:      DNSClassIN,
+	})
+	msg.Answers = append(msg.Answers, soa)
+	data, err := MarshalDNSMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	buff := make([]byte, 1500)
+	for attempt := 0; attempt < notifyAttempts; attempt++ {
+		if _, err = conn.Write(data); err != nil {
+			continue
+		}
+		conn.SetReadDeadline(time.Now().Add(notifyTimeout))
+		for {
+			var n int
+			if n, err = conn.Read(buff); err != nil {
+				break
+			}
+			response, parseErr := ParseDNSMessage(buff[:n])
+			if parseErr != nil || response.Header.ID != msg.Header.ID || !response.Header.QR() {
+				continue
+			}
+			if rcode := response.Header.RCODE(); rcode != RCODESuccess {
+				return fmt.Errorf("secondary answered with rcode %d", rcode)
+			}
+			return nil
+		}
+	}
+	return err
+}
+
+// requestTransfer pulls a whole zone from primary with AXFR. With a key the request is signed and every message of the
+// response must carry a signature chained to the one before it
+func requestTransfer(primary, zone string, key *TSIGKey, timeout time.Duration) ([]*DNSRecord, error) {
+	addr := primary
+	if _, _, err := net.SplitHostPort(primary); err != nil {
+		addr = net.JoinHostPort(primary, "53")
+	}
+	msg := NewDnsMessage()
+	msg.Header.ID = uint16(rand.Intn(65535))
+	msg.Questions = append(msg.Questions, &DNSQuestion{
+		ParsedName: zone,
+		Name:       stringToDNSWireFormat(zone),
+		Type:       DNSTypeAXFR,
+		Class:      DNSClassIN,
+	})
+	data, err := MarshalDNSMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	var mac []byte
+	if key != nil {
+		if data, mac, err = signTSIG(data, key, nil, TSIGErrorNone, false, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := writeTCPMessage(conn, data); err != nil {
+		return nil, err
+	}
+
+	var records []*DNSRecord
+	for first := true; ; first = false {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		raw, err := readTCPMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		response, err := ParseDNSMessage(raw)
+		if err != nil {
+			return nil, err
+		}
+		if response.Header.ID != msg.Header.ID || !response.Header.QR() {
+			return nil, fmt.Errorf("unexpected message from %s", addr)
+		}
+		if rcode := response.Header.RCODE(); rcode != RCODESuccess {
+			return nil, fmt.Errorf("%s refused the transfer of %s with rcode %d", addr, zone, rcode)
+		}
+		if key != nil {
+			if mac, err = verifyTSIGResponse(raw, response, key, mac, !first, time.Now()); err != nil {
+				return nil, err
+			}
+		}
+		for _, answer := range response.Answers {
+			// a transfer starts and ends with the SOA
+			if answer.Type == DNSTypeSOA && len(records) > 0 {
+				return records, nil
+			}
+			if len(records) == 0 && answer.Type != DNSTypeSOA {
+				return nil, fmt.Errorf("transfer of %s from %s does not start with an SOA", zone, addr)
+			}
+			records = append(records, answer)
+		}
+	}
+}
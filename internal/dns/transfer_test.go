@@ -0,0 +1,182 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func transferRequest(t *testing.T, dnsType DNSType, authorities ...*DNSRecord) *DNSMessage {
+	msg := NewDnsMessage()
+	msg.Header.ID = 0x1234
+	msg.Questions = append(msg.Questions, &DNSQuestion{
+		Name:       stringToDNSWireFormat("home.lan"),
+		ParsedName: "home.lan",
+		Type:       dnsType,
+		Class:      DNSClassIN,
+	})
+	msg.Authorities = append(msg.Authorities, authorities...)
+	return msg
+}
+
+// exchangeTransfer sends a request over TCP and reads responses until the closing SOA, or an error response
+func exchangeTransfer(t *testing.T, addr net.Addr, data []byte) []*DNSMessage {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 2))
+	if err := writeTCPMessage(conn, data); err != nil {
+		t.Fatal(err)
+	}
+
+	var responses []*DNSMessage
+	soaCount := 0
+	for soaCount < 2 {
+		raw, err := readTCPMessage(conn)
+		if err != nil {
+			t.Fatalf("unable to read transfer: %v", err)
+		}
+		msg, err := ParseDNSMessage(raw)
+		if err != nil {
+			t.Fatalf("unable to parse transfer message: %v", err)
+		}
+		responses = append(responses, msg)
+		if msg.Header.RCODE() != RCODESuccess {
+			break
+		}
+		for _, answer := range msg.Answers {
+			if answer.Type == DNSTypeSOA {
+				soaCount++
+			}
+		}
+	}
+	return responses
+}
+
+func transferAnswers(responses []*DNSMessage) []*DNSRecord {
+	var answers []*DNSRecord
+	for _, response := range responses {
+		answers = append(answers, response.Answers...)
+	}
+	return answers
+}
+
+func TestDNSServer_AXFR(t *testing.T) {
+	server, addr := startZoneServerWithOpts(t, ZoneOpts{Name: "home.lan", AllowTransfer: []string{"127.0.0.1"}})
+	if err := server.AddLocalDomain("host.home.lan", "10.0.0.5"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := MarshalDNSMessage(transferRequest(t, DNSTypeAXFR))
+	answers := transferAnswers(exchangeTransfer(t, addr, data))
+	if len(answers) != 4 {
+		t.Fatalf("expected SOA, NS, A and SOA, got %v", answers)
+	}
+	if answers[0].Type != DNSTypeSOA || answers[3].Type != DNSTypeSOA {
+		t.Error("expected the transfer to start and end with the SOA")
+	}
+	if answers[2].ParsedName != "host.home.lan" || !net.IP(answers[2].RData).Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("expected the local domain to be transferred, got %v", answers[2])
+	}
+}
+
+func TestDNSServer_AXFRRefused(t *testing.T) {
+	_, addr := startZoneServerWithOpts(t, ZoneOpts{Name: "home.lan", AllowTransfer: []string{"10.0.0.0/8"}})
+
+	data, _ := MarshalDNSMessage(transferRequest(t, DNSTypeAXFR))
+	responses := exchangeTransfer(t, addr, data)
+	if len(responses) != 1 || responses[0].Header.RCODE() != RCODERefused {
+		t.Errorf("expected a single REFUSED response, got %v", responses)
+	}
+}
+
+func TestDNSServer_AXFRWithTransferKey(t *testing.T) {
+	_, addr := startZoneServerWithOpts(t, ZoneOpts{Name: "home.lan", TransferKeys: []string{"update-key"}})
+
+	data, _ := MarshalDNSMessage(transferRequest(t, DNSTypeAXFR))
+	signed, _, err := signTSIG(data, &testTSIGKey, nil, TSIGErrorNone, false, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses := exchangeTransfer(t, addr, signed)
+	if responses[0].Header.RCODE() != RCODESuccess {
+		t.Fatalf("expected the key to allow the transfer, got rcode %d", responses[0].Header.RCODE())
+	}
+	if additionals := responses[0].Additionals; len(additionals) != 1 || additionals[0].Type != DNSTypeTSIG {
+		t.Error("expected the transfer to be signed")
+	}
+}
+
+func TestDNSServer_TransferOverUDPIsTruncated(t *testing.T) {
+	_, addr := startZoneServerWithOpts(t, ZoneOpts{Name: "home.lan", AllowTransfer: []string{"127.0.0.1"}})
+
+	data, _ := MarshalDNSMessage(transferRequest(t, DNSTypeAXFR))
+	response := exchangeRaw(t, addr, data)
+	if response.Header.Flags&0x0200 == 0 || len(response.Answers) != 0 {
+		t.Errorf("expected an empty truncated response, got %v", response)
+	}
+}
+
+func TestDNSServer_IXFR(t *testing.T) {
+	server, addr := startZoneServerWithOpts(t, ZoneOpts{Name: "home.lan", AllowTransfer: []string{"127.0.0.1"}})
+	oldSerial := server.zone.Serial()
+	clientSOA := server.zone.soaWithSerial(oldSerial)
+	server.AddLocalDomain("host.home.lan", "10.0.0.5")
+
+	data, _ := MarshalDNSMessage(transferRequest(t, DNSTypeIXFR, clientSOA))
+	answers := transferAnswers(exchangeTransfer(t, addr, data))
+	if len(answers) != 5 {
+		t.Fatalf("expected SOA, old SOA, new SOA, A and SOA, got %v", answers)
+	}
+	serials := make([]uint32, 0)
+	for _, answer := range answers {
+		if answer.Type == DNSTypeSOA {
+			serials = append(serials, binary.BigEndian.Uint32(answer.RData[len(answer.RData)-20:]))
+		}
+	}
+	expected := []uint32{oldSerial + 1, oldSerial, oldSerial + 1, oldSerial + 1}
+	for i := range expected {
+		if serials[i] != expected[i] {
+			t.Fatalf("expected SOA serials %v, got %v", expected, serials)
+		}
+	}
+	if answers[3].Type != DNSTypeA {
+		t.Errorf("expected the added record after the new SOA, got %v", answers[3])
+	}
+}
+
+func TestDNSServer_NotifyOnLocalDomainChange(t *testing.T) {
+	secondary, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Close()
+
+	server, _ := startZoneServerWithOpts(t, ZoneOpts{Name: "home.lan", Notify: []string{secondary.LocalAddr().String()}})
+	server.AddLocalDomain("host.home.lan", "10.0.0.5")
+
+	secondary.SetReadDeadline(time.Now().Add(time.Second * 2))
+	buff := make([]byte, 1500)
+	n, from, err := secondary.ReadFrom(buff)
+	if err != nil {
+		t.Fatalf("expected a NOTIFY: %v", err)
+	}
+	msg, err := ParseDNSMessage(buff[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Opcode() != DNSOpCodeNotify || len(msg.Questions) != 1 || msg.Questions[0].ParsedName != "home.lan" {
+		t.Errorf("expected a NOTIFY for home.lan, got %v", msg)
+	}
+	if len(msg.Answers) != 1 || msg.Answers[0].Type != DNSTypeSOA {
+		t.Errorf("expected the new SOA in the NOTIFY, got %v", msg.Answers)
+	}
+
+	msg.Header.SetQR(true)
+	msg.Answers = nil
+	reply, _ := MarshalDNSMessage(msg)
+	secondary.WriteTo(reply, from)
+}
@@ -0,0 +1,363 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tsigCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_tsig_count",
+		Help: "count of TSIG signed requests by result",
+	}, []string{"result"})
+)
+
+var (
+	ErrTSIGFormat = errors.New("malformed TSIG record")
+)
+
+// TSIG error codes carried in the TSIG record itself, RFC 8945
+const (
+	TSIGErrorNone    uint16 = 0
+	TSIGErrorBadSig  uint16 = 16
+	TSIGErrorBadKey  uint16 = 17
+	TSIGErrorBadTime uint16 = 18
+)
+
+// how far a signature's timestamp may be from our clock
+const tsigFudge = 300
+
+type TSIGKey struct {
+	Name      string
+	Algorithm string // hmac-sha1, hmac-sha256 (default), hmac-sha384 or hmac-sha512
+	Secret    []byte
+}
+
+func tsigHash(algorithm string) func() hash.Hash {
+	switch canonicalName(algorithm) {
+	case "hmac-sha1":
+		return sha1.New
+	case "hmac-sha256", "":
+		return sha256.New
+	case "hmac-sha384":
+		return sha512.New384
+	case "hmac-sha512":
+		return sha512.New
+	default:
+		return nil
+	}
+}
+
+func canonicalName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+func (k *TSIGKey) algorithm() string {
+	if k.Algorithm == "" {
+		return "hmac-sha256"
+	}
+	return canonicalName(k.Algorithm)
+}
+
+type tsigRecord struct {
+	KeyName    string
+	Algorithm  string
+	TimeSigned uint64
+	Fudge      uint16
+	MAC        []byte
+	OriginalID uint16
+	Error      uint16
+	OtherData  []byte
+}
+
+func parseTSIGRecord(record *DNSRecord) (*tsigRecord, error) {
+	data := record.RData
+	algorithm, offset, err := parseDNSName(data, 0)
+	if err != nil {
+		return nil, ErrTSIGFormat
+	}
+	if offset+10 > len(data) {
+		return nil, ErrTSIGFormat
+	}
+	tsig := &tsigRecord{
+		KeyName:   record.ParsedName,
+		Algorithm: algorithm,
+	}
+	tsig.TimeSigned = uint64(binary.BigEndian.Uint16(data[offset:]))<<32 | uint64(binary.BigEndian.Uint32(data[offset+2:]))
+	tsig.Fudge = binary.BigEndian.Uint16(data[offset+6:])
+	macSize := int(binary.BigEndian.Uint16(data[offset+8:]))
+	offset += 10
+	if offset+macSize+6 > len(data) {
+		return nil, ErrTSIGFormat
+	}
+	tsig.MAC = data[offset : offset+macSize]
+	offset += macSize
+	tsig.OriginalID = binary.BigEndian.Uint16(data[offset:])
+	tsig.Error = binary.BigEndian.Uint16(data[offset+2:])
+	otherLen := int(binary.BigEndian.Uint16(data[offset+4:]))
+	offset += 6
+	if offset+otherLen != len(data) {
+		return nil, ErrTSIGFormat
+	}
+	tsig.OtherData = data[offset:]
+	return tsig, nil
+}
+
+// variables are the TSIG fields that are covered by the MAC alongside the message
+func (t *tsigRecord) variables() []byte {
+	buf := stringToDNSWireFormat(canonicalName(t.KeyName))
+	buf = binary.BigEndian.AppendUint16(buf, DNSClassANY)
+	buf = binary.BigEndian.AppendUint32(buf, 0)
+	buf = append(buf, stringToDNSWireFormat(canonicalName(t.Algorithm))...)
+	buf = append(buf, t.timers()...)
+	buf = binary.BigEndian.AppendUint16(buf, t.Error)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(t.OtherData)))
+	return append(buf, t.OtherData...)
+}
+
+func (t *tsigRecord) timers() []byte {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(t.TimeSigned>>32))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(t.TimeSigned))
+	return binary.BigEndian.AppendUint16(buf, t.Fudge)
+}
+
+func (t *tsigRecord) marshal() []byte {
+	rdata := stringToDNSWireFormat(canonicalName(t.Algorithm))
+	rdata = append(rdata, t.timers()...)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(t.MAC)))
+	rdata = append(rdata, t.MAC...)
+	rdata = binary.BigEndian.AppendUint16(rdata, t.OriginalID)
+	rdata = binary.BigEndian.AppendUint16(rdata, t.Error)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(t.OtherData)))
+	rdata = append(rdata, t.OtherData...)
+
+	record, _ := marshalResourceRecord(&DNSRecord{
+		Name:  stringToDNSWireFormat(canonicalName(t.KeyName)),
+		Type:  DNSTypeTSIG,
+		Class: DNSClassANY,
+		RData: rdata,
+	})
+	return record
+}
+
+// lastRecordOffset walks a raw message and returns where its final resource record starts
+func lastRecordOffset(data []byte) (int, error) {
+	if len(data) < 12 {
+		return 0, ErrDNSPacketTooShort
+	}
+	offset := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(data[4:6])); i++ {
+		_, next, err := parseDNSName(data, offset)
+		if err != nil {
+			return 0, err
+		}
+		offset = next + 4
+	}
+	records := int(binary.BigEndian.Uint16(data[6:8])) + int(binary.BigEndian.Uint16(data[8:10])) + int(binary.BigEndian.Uint16(data[10:12]))
+	last := -1
+	for i := 0; i < records; i++ {
+		last = offset
+		_, next, err := parseResourceRecord(data, offset)
+		if err != nil {
+			return 0, err
+		}
+		offset = next
+	}
+	if last < 0 {
+		return 0, errors.New("message has no records")
+	}
+	return last, nil
+}
+
+// tsigContext is what is needed to sign the response to a verified request
+type tsigContext struct {
+	key        *TSIGKey
+	request    *tsigRecord
+	requestMAC []byte
+	err        uint16
+}
+
+// verifyTSIG checks the TSIG record on a request, if there is one. A nil context with a nil error means the request was
+// not signed. A context with a TSIG error set means the request was signed but did not verify, the caller must reply
+// with NOTAUTH signed through that context
+func verifyTSIG(raw []byte, msg *DNSMessage, keys []TSIGKey, now time.Time) (*tsigContext, error) {
+	if len(msg.Additionals) == 0 {
+		return nil, nil
+	}
+	last := msg.Additionals[len(msg.Additionals)-1]
+	for _, record := range msg.Additionals[:len(msg.Additionals)-1] {
+		if record.Type == DNSTypeTSIG {
+			return nil, errors.New("TSIG record must be the last record")
+		}
+	}
+	if last.Type != DNSTypeTSIG {
+		return nil, nil
+	}
+	tsig, err := parseTSIGRecord(last)
+	if err != nil {
+		return nil, err
+	}
+	start, err := lastRecordOffset(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := &tsigContext{request: tsig}
+	for i := range keys {
+		if canonicalName(keys[i].Name) == canonicalName(tsig.KeyName) && keys[i].algorithm() == canonicalName(tsig.Algorithm) {
+			ctx.key = &keys[i]
+			break
+		}
+	}
+	if ctx.key == nil || tsigHash(ctx.key.algorithm()) == nil {
+		tsigCounter.With(prometheus.Labels{"result": "bad-key"}).Inc()
+		ctx.err = TSIGErrorBadKey
+		return ctx, nil
+	}
+
+	// the MAC covers the message as it was before the TSIG record was added
+	unsigned := make([]byte, start)
+	copy(unsigned, raw[:start])
+	binary.BigEndian.PutUint16(unsigned[0:2], tsig.OriginalID)
+	binary.BigEndian.PutUint16(unsigned[10:12], binary.BigEndian.Uint16(unsigned[10:12])-1)
+
+	mac := hmac.New(tsigHash(ctx.key.algorithm()), ctx.key.Secret)
+	mac.Write(unsigned)
+	mac.Write(tsig.variables())
+	if !hmac.Equal(mac.Sum(nil), tsig.MAC) {
+		tsigCounter.With(prometheus.Labels{"result": "bad-signature"}).Inc()
+		ctx.err = TSIGErrorBadSig
+		return ctx, nil
+	}
+	ctx.requestMAC = tsig.MAC
+
+	signed := int64(tsig.TimeSigned)
+	if diff := now.Unix() - signed; diff > int64(tsig.Fudge) || -diff > int64(tsig.Fudge) {
+		tsigCounter.With(prometheus.Labels{"result": "bad-time"}).Inc()
+		ctx.err = TSIGErrorBadTime
+		return ctx, nil
+	}
+	tsigCounter.With(prometheus.Labels{"result": "verified"}).Inc()
+	return ctx, nil
+}
+
+// sign appends a TSIG record to a marshaled response. Responses to requests that failed with a bad key or signature
+// carry the error unsigned, as the client has no way to check them
+func (c *tsigContext) sign(msg []byte, now time.Time) ([]byte, error) {
+	if c.err == TSIGErrorBadKey || c.err == TSIGErrorBadSig {
+		tsig := &tsigRecord{
+			KeyName:    c.request.KeyName,
+			Algorithm:  c.request.Algorithm,
+			TimeSigned: c.request.TimeSigned,
+			Fudge:      c.request.Fudge,
+			OriginalID: binary.BigEndian.Uint16(msg[0:2]),
+			Error:      c.err,
+		}
+		return appendTSIG(msg, tsig), nil
+	}
+	signed, _, err := signTSIG(msg, c.key, c.requestMAC, c.err, false, now)
+	return signed, err
+}
+
+// signTSIG signs msg with key, chaining it to a prior MAC when the message is a response. Messages after the first in
+// a stream such as a zone transfer only cover the timers rather than all of the TSIG variables. It returns the signed
+// message and the MAC so that further messages in a stream can be chained to it
+func signTSIG(msg []byte, key *TSIGKey, priorMAC []byte, tsigErr uint16, timersOnly bool, now time.Time) ([]byte, []byte, error) {
+	hashFn := tsigHash(key.algorithm())
+	if hashFn == nil {
+		return nil, nil, fmt.Errorf("unsupported TSIG algorithm %s", key.Algorithm)
+	}
+	tsig := &tsigRecord{
+		KeyName:    key.Name,
+		Algorithm:  key.algorithm(),
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      tsigFudge,
+		OriginalID: binary.BigEndian.Uint16(msg[0:2]),
+		Error:      tsigErr,
+	}
+	if tsigErr == TSIGErrorBadTime {
+		// tell the client what our clock says
+		tsig.OtherData = binary.BigEndian.AppendUint16(nil, uint16(tsig.TimeSigned>>32))
+		tsig.OtherData = binary.BigEndian.AppendUint32(tsig.OtherData, uint32(tsig.TimeSigned))
+	}
+
+	mac := hmac.New(hashFn, key.Secret)
+	if priorMAC != nil {
+		mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(priorMAC))))
+		mac.Write(priorMAC)
+	}
+	mac.Write(msg)
+	if timersOnly {
+		mac.Write(tsig.timers())
+	} else {
+		mac.Write(tsig.variables())
+	}
+	tsig.MAC = mac.Sum(nil)
+	return appendTSIG(msg, tsig), tsig.MAC, nil
+}
+
+func appendTSIG(msg []byte, tsig *tsigRecord) []byte {
+	signed := make([]byte, len(msg), len(msg)+128)
+	copy(signed, msg)
+	binary.BigEndian.PutUint16(signed[10:12], binary.BigEndian.Uint16(signed[10:12])+1)
+	return append(signed, tsig.marshal()...)
+}
+
+// verifyTSIGResponse checks the signature on a response to a request signed with key, returning its MAC so that the
+// next message of a stream such as a zone transfer can be checked against it
+func verifyTSIGResponse(raw []byte, msg *DNSMessage, key *TSIGKey, priorMAC []byte, timersOnly bool, now time.Time) ([]byte, error) {
+	if len(msg.Additionals) == 0 || msg.Additionals[len(msg.Additionals)-1].Type != DNSTypeTSIG {
+		return nil, errors.New("response is not signed")
+	}
+	tsig, err := parseTSIGRecord(msg.Additionals[len(msg.Additionals)-1])
+	if err != nil {
+		return nil, err
+	}
+	if canonicalName(tsig.KeyName) != canonicalName(key.Name) {
+		return nil, fmt.Errorf("response is signed with key %s", tsig.KeyName)
+	}
+	if tsig.Error != TSIGErrorNone {
+		return nil, fmt.Errorf("response carries TSIG error %d", tsig.Error)
+	}
+	hashFn := tsigHash(key.algorithm())
+	if hashFn == nil {
+		return nil, fmt.Errorf("unsupported TSIG algorithm %s", key.Algorithm)
+	}
+	start, err := lastRecordOffset(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	unsigned := make([]byte, start)
+	copy(unsigned, raw[:start])
+	binary.BigEndian.PutUint16(unsigned[0:2], tsig.OriginalID)
+	binary.BigEndian.PutUint16(unsigned[10:12], binary.BigEndian.Uint16(unsigned[10:12])-1)
+
+	mac := hmac.New(hashFn, key.Secret)
+	mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(priorMAC))))
+	mac.Write(priorMAC)
+	mac.Write(unsigned)
+	if timersOnly {
+		mac.Write(tsig.timers())
+	} else {
+		mac.Write(tsig.variables())
+	}
+	if !hmac.Equal(mac.Sum(nil), tsig.MAC) {
+		return nil, errors.New("response signature does not verify")
+	}
+	if diff := now.Unix() - int64(tsig.TimeSigned); diff > int64(tsig.Fudge) || -diff > int64(tsig.Fudge) {
+		return nil, errors.New("response was signed outside the allowed time window")
+	}
+	return tsig.MAC, nil
+}
@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+var testTSIGKey = TSIGKey{Name: "update-key.", Algorithm: "hmac-sha256", Secret: []byte("0123456789abcdef")}
+
+func signedUpdate(t *testing.T, key TSIGKey, now time.Time, updates ...*DNSRecord) ([]byte, []byte) {
+	msg := updateMessage(nil, updates)
+	msg.Header.ID = 0x4242
+	msg.Questions[0].Name = stringToDNSWireFormat("home.lan")
+	for _, update := range msg.Authorities {
+		update.Name = stringToDNSWireFormat(update.ParsedName)
+	}
+	data, err := MarshalDNSMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, mac, err := signTSIG(data, &key, nil, TSIGErrorNone, false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed, mac
+}
+
+func verifySigned(t *testing.T, raw []byte, keys []TSIGKey, now time.Time) *tsigContext {
+	msg, err := ParseDNSMessage(raw)
+	if err != nil {
+		t.Fatalf("unable to parse signed message: %v", err)
+	}
+	ctx, err := verifyTSIG(raw, msg, keys, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return ctx
+}
+
+func TestVerifyTSIG(t *testing.T) {
+	now := time.Now()
+	raw, mac := signedUpdate(t, testTSIGKey, now, addressRecord("host.home.lan", net.IPv4(10, 0, 0, 5)))
+
+	ctx := verifySigned(t, raw, []TSIGKey{testTSIGKey}, now)
+	if ctx == nil || ctx.err != TSIGErrorNone {
+		t.Fatalf("expected signature to verify, got %+v", ctx)
+	}
+	if !hmac.Equal(ctx.requestMAC, mac) {
+		t.Error("expected request MAC to be kept for signing the response")
+	}
+}
+
+func TestVerifyTSIG_Unsigned(t *testing.T) {
+	data, _ := MarshalDNSMessage(NewDnsMessage())
+	if ctx := verifySigned(t, data, []TSIGKey{testTSIGKey}, time.Now()); ctx != nil {
+		t.Error("expected no context for an unsigned message")
+	}
+}
+
+func TestVerifyTSIG_Failures(t *testing.T) {
+	now := time.Now()
+	raw, _ := signedUpdate(t, testTSIGKey, now, addressRecord("host.home.lan", net.IPv4(10, 0, 0, 5)))
+
+	if ctx := verifySigned(t, raw, nil, now); ctx.err != TSIGErrorBadKey {
+		t.Errorf("expected BADKEY for an unknown key, got %d", ctx.err)
+	}
+
+	wrongSecret := testTSIGKey
+	wrongSecret.Secret = []byte("not the secret")
+	if ctx := verifySigned(t, raw, []TSIGKey{wrongSecret}, now); ctx.err != TSIGErrorBadSig {
+		t.Errorf("expected BADSIG for the wrong secret, got %d", ctx.err)
+	}
+
+	tampered := append([]byte(nil), raw...)
+	tampered[len(tampered)-60] ^= 0xff
+	if msg, err := ParseDNSMessage(tampered); err == nil {
+		if ctx, _ := verifyTSIG(tampered, msg, []TSIGKey{testTSIGKey}, now); ctx == nil || ctx.err == TSIGErrorNone {
+			t.Error("expected a tampered message to fail verification")
+		}
+	}
+
+	if ctx := verifySigned(t, raw, []TSIGKey{testTSIGKey}, now.Add(time.Hour)); ctx.err != TSIGErrorBadTime {
+		t.Errorf("expected BADTIME for an old signature, got %d", ctx.err)
+	}
+}
+
+func TestTSIGContext_SignResponse(t *testing.T) {
+	now := time.Now()
+	raw, requestMAC := signedUpdate(t, testTSIGKey, now)
+	ctx := verifySigned(t, raw, []TSIGKey{testTSIGKey}, now)
+
+	response := NewDnsMessage()
+	response.Header.ID = 0x4242
+	response.Header.SetQR(true)
+	data, _ := MarshalDNSMessage(response)
+	signed, err := ctx.sign(data, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := ParseDNSMessage(signed)
+	if err != nil || len(msg.Additionals) != 1 || msg.Additionals[0].Type != DNSTypeTSIG {
+		t.Fatalf("expected a TSIG record on the response, got %v (%v)", msg, err)
+	}
+	tsig, err := parseTSIGRecord(msg.Additionals[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a client checks the response MAC chained to the MAC of its request
+	mac := hmac.New(sha256.New, testTSIGKey.Secret)
+	mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(requestMAC))))
+	mac.Write(requestMAC)
+	mac.Write(data)
+	mac.Write(tsig.variables())
+	if !hmac.Equal(mac.Sum(nil), tsig.MAC) {
+		t.Error("response MAC does not verify")
+	}
+}
+
+func TestTSIGContext_SignBadKeyIsUnsigned(t *testing.T) {
+	now := time.Now()
+	raw, _ := signedUpdate(t, testTSIGKey, now)
+	ctx := verifySigned(t, raw, nil, now)
+
+	data, _ := MarshalDNSMessage(NewDnsMessage())
+	signed, err := ctx.sign(data, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := ParseDNSMessage(signed)
+	tsig, err := parseTSIGRecord(msg.Additionals[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tsig.Error != TSIGErrorBadKey || len(tsig.MAC) != 0 {
+		t.Errorf("expected an unsigned BADKEY record, got error %d with %d byte MAC", tsig.Error, len(tsig.MAC))
+	}
+}
@@ -21,8 +21,25 @@ var (
 
 	queryCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "dns_query_count",
-		Help: "Count by domain",
-	}, []string{"domain", "upstream", "result"})
+		Help: "count of queries by where they were answered from and result",
+	}, []string{"upstream", "result"})
+
+	blockedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_blocked_count",
+		Help: "count of blocked queries by what blocked them",
+	}, []string{"reason"})
+
+	requestCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_request_count",
+		Help: "count of requests by result",
+	}, []string{"result"})
+
+	// the per domain and per client series grow with every name and client seen, so they are only kept when asked for
+
+	queryDomainCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_query_domain_count",
+		Help: "count of queries by domain",
+	}, []string{"domain"})
 
 	blockedDomainCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "dns_blocked_domain_count",
@@ -35,23 +52,31 @@ var (
 	}, []string{"ip", "result"})
 )
 
-var (
-	ErrDNSPacketTooShort   = errors.New("DNS packet too short for header")
-	ErrDNSTooManyQuestions = errors.New("DNS packet contains more than 1 question")
-)
+var ErrDNSPacketTooShort = errors.New("DNS packet too short for header")
 
 type DNSType uint16
 
 const (
-	DNSTypeA     DNSType = 1
-	DNSTypeAAAA  DNSType = 28
-	DNSTypeCNAME DNSType = 5
-	DNSTypeMX    DNSType = 15
-	DNSTypeNS    DNSType = 2
-	DNSTypeTXT   DNSType = 16
-	DNSTypeOPT   DNSType = 41
-	DNSTypePTR   DNSType = 12
-	DNSTypeSOA   DNSType = 6
+	DNSTypeA      DNSType = 1
+	DNSTypeAAAA   DNSType = 28
+	DNSTypeCNAME  DNSType = 5
+	DNSTypeMX     DNSType = 15
+	DNSTypeNS     DNSType = 2
+	DNSTypeTXT    DNSType = 16
+	DNSTypeOPT    DNSType = 41
+	DNSTypePTR    DNSType = 12
+	DNSTypeSOA    DNSType = 6
+	DNSTypeSRV    DNSType = 33
+	DNSTypeNAPTR  DNSType = 35
+	DNSTypeDS     DNSType = 43
+	DNSTypeDNSKEY DNSType = 48
+	DNSTypeSVCB   DNSType = 64
+	DNSTypeHTTPS  DNSType = 65
+	DNSTypeTSIG   DNSType = 250
+	DNSTypeIXFR   DNSType = 251
+	DNSTypeAXFR   DNSType = 252
+	DNSTypeANY    DNSType = 255
+	DNSTypeCAA    DNSType = 257
 )
 
 func (t DNSType) String() string {
@@ -74,8 +99,31 @@ func (t DNSType) String() string {
 		return "PTR"
 	case DNSTypeSOA:
 		return "SOA"
+	case DNSTypeSRV:
+		return "SRV"
+	case DNSTypeNAPTR:
+		return "NAPTR"
+	case DNSTypeDS:
+		return "DS"
+	case DNSTypeDNSKEY:
+		return "DNSKEY"
+	case DNSTypeSVCB:
+		return "SVCB"
+	case DNSTypeHTTPS:
+		return "HTTPS"
+	case DNSTypeCAA:
+		return "CAA"
+	case DNSTypeTSIG:
+		return "TSIG"
+	case DNSTypeIXFR:
+		return "IXFR"
+	case DNSTypeAXFR:
+		return "AXFR"
+	case DNSTypeANY:
+		return "ANY"
 	default:
-		return "unknown"
+		// the generic form from RFC 3597, which keeps types apart in logs and cache keys
+		return fmt.Sprintf("TYPE%d", uint16(t))
 	}
 }
 
@@ -85,6 +133,8 @@ const (
 	DNSOpCodeQuery  DNSOpCode = 0 // standard query
 	DNSOpCodeIQuery DNSOpCode = 1 // inverse query
 	DNSOpCodeStatus DNSOpCode = 2 // server status request
+	DNSOpCodeNotify DNSOpCode = 4 // zone change notification, RFC 1996
+	DNSOpCodeUpdate DNSOpCode = 5 // dynamic update, RFC 2136
 )
 
 func (o DNSOpCode) String() string {
@@ -95,6 +145,10 @@ func (o DNSOpCode) String() string {
 		return "IQuery"
 	case DNSOpCodeStatus:
 		return "Status"
+	case DNSOpCodeNotify:
+		return "Notify"
+	case DNSOpCodeUpdate:
+		return "Update"
 	default:
 		return "unknown"
 	}
@@ -109,6 +163,23 @@ const (
 	DNSClassANY  uint16 = 255
 )
 
+func classString(class uint16) string {
+	switch class {
+	case DNSClassIN:
+		return "IN"
+	case DNSClassCH:
+		return "CH"
+	case DNSClassHS:
+		return "HS"
+	case DNSClassNone:
+		return "NONE"
+	case DNSClassANY:
+		return "ANY"
+	default:
+		return fmt.Sprintf("CLASS%d", class)
+	}
+}
+
 type DNSRecord struct {
 	ParsedName  string
 	Name        []byte
@@ -119,8 +190,18 @@ type DNSRecord struct {
 	ParsedRData string
 }
 
+// String returns the record the way a zone file would hold it
 func (r *DNSRecord) String() string {
-	return fmt.Sprintf("%s %s %d %d", r.ParsedName, r.Type, r.Class, r.TTL)
+	data := (&UnknownRData{Data: r.RData}).String()
+	if typed, err := r.Data(); err == nil {
+		data = typed.String()
+	}
+	return fmt.Sprintf("%s %d %s %s %s", presentationName(r.ParsedName), r.TTL, classString(r.Class), r.Type, data)
+}
+
+// Data decodes the data of the record into its typed form, see ParseRData
+func (r *DNSRecord) Data() (RData, error) {
+	return ParseRData(r.Type, r.RData)
 }
 
 type DNSMessage struct {
@@ -158,10 +239,18 @@ func (h *DNSHeader) SetQR(qr bool) { //where true is a response
 	}
 }
 
+func (h *DNSHeader) QR() bool {
+	return h.Flags&0x8000 != 0
+}
+
 func (h *DNSHeader) SetOpcode(opcode DNSOpCode) {
 	h.Flags = (h.Flags & 0x87FF) | (uint16(opcode) << 11)
 }
 
+func (h *DNSHeader) Opcode() DNSOpCode {
+	return DNSOpCode((h.Flags >> 11) & 0x0F)
+}
+
 func (h *DNSHeader) SetAA(aa bool) {
 	if aa {
 		h.Flags |= 0x0400
@@ -170,6 +259,10 @@ func (h *DNSHeader) SetAA(aa bool) {
 	}
 }
 
+func (h *DNSHeader) AA() bool {
+	return h.Flags&0x0400 != 0
+}
+
 func (h *DNSHeader) SetTC(tc bool) {
 	if tc {
 		h.Flags |= 0x0200
@@ -178,6 +271,10 @@ func (h *DNSHeader) SetTC(tc bool) {
 	}
 }
 
+func (h *DNSHeader) TC() bool {
+	return h.Flags&0x0200 != 0
+}
+
 func (h *DNSHeader) SetRD(rd bool) {
 	if rd {
 		h.Flags |= 0x0100
@@ -209,10 +306,17 @@ func (h *DNSHeader) RCODE() RCODE {
 type RCODE uint8
 
 const (
-	RCODESuccess       RCODE = 0
-	RCODEFormatError   RCODE = 1
-	RCODEServerFailure RCODE = 2
-	RCODENameFailure   RCODE = 3
+	RCODESuccess        RCODE = 0
+	RCODEFormatError    RCODE = 1
+	RCODEServerFailure  RCODE = 2
+	RCODENameFailure    RCODE = 3
+	RCODENotImplemented RCODE = 4
+	RCODERefused        RCODE = 5
+	RCODEYXDomain       RCODE = 6  // a name exists that should not, RFC 2136
+	RCODEYXRRSet        RCODE = 7  // an RRset exists that should not
+	RCODENXRRSet        RCODE = 8  // an RRset that should exist does not
+	RCODENotAuth        RCODE = 9  // not authoritative for the zone, or the TSIG did not verify
+	RCODENotZone        RCODE = 10 // a name is outside the zone
 )
 
 type DNSQuestion struct {
@@ -222,6 +326,65 @@ type DNSQuestion struct {
 	Class      uint16
 }
 
+// DNSUpdate is an RFC 2136 UPDATE message. The wire format reuses the query layout, with the question section holding
+// the zone, the answer section the prerequisites and the authority section the updates
+type DNSUpdate struct {
+	Zone          *DNSQuestion
+	Prerequisites []*DNSRecord
+	Updates       []*DNSRecord
+}
+
+func ParseDNSUpdate(msg *DNSMessage) (*DNSUpdate, error) {
+	if msg.Header.Opcode() != DNSOpCodeUpdate {
+		return nil, fmt.Errorf("unexpected opcode %s for update", msg.Header.Opcode())
+	}
+	if len(msg.Questions) != 1 {
+		return nil, errors.New("update must contain exactly one zone")
+	}
+	if msg.Questions[0].Type != DNSTypeSOA {
+		return nil, fmt.Errorf("update zone has type %s, expected SOA", msg.Questions[0].Type)
+	}
+	update := &DNSUpdate{
+		Zone:          msg.Questions[0],
+		Prerequisites: msg.Answers,
+		Updates:       msg.Authorities,
+	}
+	zoneClass := update.Zone.Class
+	for _, prereq := range update.Prerequisites {
+		if prereq.TTL != 0 {
+			return nil, fmt.Errorf("prerequisite for %s has a non zero TTL", prereq.ParsedName)
+		}
+		switch prereq.Class {
+		case DNSClassANY, DNSClassNone:
+			if len(prereq.RData) != 0 {
+				return nil, fmt.Errorf("prerequisite for %s has unexpected data", prereq.ParsedName)
+			}
+		case zoneClass:
+		default:
+			return nil, fmt.Errorf("prerequisite for %s has invalid class %d", prereq.ParsedName, prereq.Class)
+		}
+	}
+	for _, rr := range update.Updates {
+		switch rr.Class {
+		case zoneClass:
+			if rr.Type == DNSTypeANY {
+				return nil, fmt.Errorf("cannot add a record of type ANY for %s", rr.ParsedName)
+			}
+		case DNSClassANY:
+			if rr.TTL != 0 || len(rr.RData) != 0 {
+				return nil, fmt.Errorf("delete of %s must have no TTL or data", rr.ParsedName)
+			}
+		case DNSClassNone:
+			if rr.TTL != 0 || rr.Type == DNSTypeANY {
+				return nil, fmt.Errorf("invalid delete of a single record for %s", rr.ParsedName)
+			}
+		default:
+			return nil, fmt.Errorf("update for %s has invalid class %d", rr.ParsedName, rr.Class)
+		}
+	}
+	return update, nil
+}
+
 type DNSPacket struct {
 	*DNSMessage
 	ResponseAddr net.Addr
@@ -253,42 +416,17 @@ func stringToDNSWireFormat(domain string) []byte {
 	return result
 }
 
+// parseDNSNameWithWireFormat parses the name at offset, returning it along with its wire format written out in full
 func parseDNSNameWithWireFormat(data []byte, offset int) (string, []byte, int, error) {
-	startOffset := offset
 	parsedName, newOffset, err := parseDNSName(data, offset)
 	if err != nil {
 		return "", nil, offset, err
 	}
-
-	var wireFormat []byte
-
-	if startOffset < len(data) && data[startOffset] == 0 {
-		wireFormat = []byte{0}
-		return parsedName, wireFormat, newOffset, nil
-	}
-
-	currentPos := startOffset
-	for currentPos < len(data) {
-		length := data[currentPos]
-
-		if (length & 0xC0) == 0xC0 {
-			wireFormat = append(wireFormat, data[currentPos:currentPos+2]...)
-			break
-		}
-
-		wireFormat = append(wireFormat, length)
-		currentPos++
-
-		if length == 0 {
-			break
-		}
-
-		if currentPos+int(length) <= len(data) {
-			wireFormat = append(wireFormat, data[currentPos:currentPos+int(length)]...)
-			currentPos += int(length)
-		}
+	var nilCompressor *nameCompressor
+	wireFormat, err := nilCompressor.appendName(nil, parsedName)
+	if err != nil {
+		return "", nil, offset, err
 	}
-
 	return parsedName, wireFormat, newOffset, nil
 }
 
@@ -322,11 +460,6 @@ func ParseDNSMessage(data []byte) (*DNSMessage, error) {
 
 	log.Tracef("parsing %d questions, %d answers, %d authorities, %d additionals", qdCount, anCount, nsCount, arCount)
 
-	// 99% of real world traffic only uses 1 question, so we will FORMERR if we see more than 1
-	if qdCount > 1 {
-		return nil, ErrDNSTooManyQuestions
-	}
-
 	dnsMessage.Questions = make([]*DNSQuestion, 0, qdCount)
 	for i := 0; i < int(qdCount); i++ {
 		var question DNSQuestion
@@ -516,8 +649,7 @@ func parseResourceRecord(data []byte, offset int) (*DNSRecord, int, error) {
 		return nil, offset, fmt.Errorf("resource record data extends beyond packet at offset %d (need %d, have %d, rdlength %d)", offset, offset+int(dataLength), len(data), dataLength)
 	}
 
-	record.RData = make([]byte, dataLength)
-	if record.Type == DNSTypeCNAME || record.Type == DNSTypeNS {
+	if record.Type == DNSTypeCNAME || record.Type == DNSTypeNS || record.Type == DNSTypePTR {
 		parsedTarget, _, err := parseDNSName(data, offset)
 		if err != nil {
 			log.Debugf("unable to parse domain in RData for %s record: %v", record.Type, err)
@@ -525,73 +657,71 @@ func parseResourceRecord(data []byte, offset int) (*DNSRecord, int, error) {
 			record.ParsedRData = parsedTarget
 		}
 	}
-	copy(record.RData, data[offset:offset+int(dataLength)])
+	if record.RData, err = expandRData(data, offset, int(dataLength), record.Type); err != nil {
+		return nil, offset, fmt.Errorf("error parsing RData of %s record at offset %d: %v", record.Type, offset, err)
+	}
 	offset += int(dataLength)
 
 	return &record, offset, nil
 }
 
+// MarshalDNSMessage returns msg in wire format, with names compressed
 func MarshalDNSMessage(msg *DNSMessage) ([]byte, error) {
-	var buf []byte
+	return AppendDNSMessage(make([]byte, 0, 512), msg)
+}
 
-	header := make([]byte, 12)
-	binary.BigEndian.PutUint16(header[0:2], msg.Header.ID)
-	binary.BigEndian.PutUint16(header[2:4], msg.Header.Flags)
-	binary.BigEndian.PutUint16(header[4:6], uint16(len(msg.Questions)))
-	binary.BigEndian.PutUint16(header[6:8], uint16(len(msg.Answers)))
-	binary.BigEndian.PutUint16(header[8:10], uint16(len(msg.Authorities)))
-	binary.BigEndian.PutUint16(header[10:12], uint16(len(msg.Additionals)))
-	buf = append(buf, header...)
+// AppendDNSMessage appends msg in wire format to buf, with names compressed, and returns the extended buffer. buf may
+// already hold something, such as the length prefix of a TCP message, compression pointers are relative to where msg
+// starts
+func AppendDNSMessage(buf []byte, msg *DNSMessage) ([]byte, error) {
+	names := newNameCompressor(len(buf))
+	buf = binary.BigEndian.AppendUint16(buf, msg.Header.ID)
+	buf = binary.BigEndian.AppendUint16(buf, msg.Header.Flags)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(msg.Questions)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(msg.Answers)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(msg.Authorities)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(msg.Additionals)))
 
+	var err error
 	for _, q := range msg.Questions {
-		buf = append(buf, q.Name...)
-
-		typeClass := make([]byte, 4)
-		binary.BigEndian.PutUint16(typeClass[0:2], uint16(q.Type))
-		binary.BigEndian.PutUint16(typeClass[2:4], q.Class)
-		buf = append(buf, typeClass...)
+		name := q.ParsedName
+		if name == "" && len(q.Name) > 0 {
+			if name, _, err = parseDNSName(q.Name, 0); err != nil {
+				return nil, fmt.Errorf("error marshaling question: %v", err)
+			}
+		}
+		if buf, err = names.appendName(buf, name); err != nil {
+			return nil, fmt.Errorf("error marshaling question: %v", err)
+		}
+		buf = binary.BigEndian.AppendUint16(buf, uint16(q.Type))
+		buf = binary.BigEndian.AppendUint16(buf, q.Class)
 	}
 
 	for _, r := range msg.Answers {
-		recordBytes, err := marshalResourceRecord(r)
-		if err != nil {
+		if buf, err = names.appendRecord(buf, r); err != nil {
 			return nil, fmt.Errorf("error marshaling answer record: %v", err)
 		}
-		buf = append(buf, recordBytes...)
 	}
 
 	for _, r := range msg.Authorities {
 		log.Tracef("marshaling authority record %v", r)
-		recordBytes, err := marshalResourceRecord(r)
-		if err != nil {
+		if buf, err = names.appendRecord(buf, r); err != nil {
 			return nil, fmt.Errorf("error marshaling authority record: %v", err)
 		}
-		buf = append(buf, recordBytes...)
 	}
 
 	for _, r := range msg.Additionals {
-		recordBytes, err := marshalResourceRecord(r)
-		if err != nil {
+		if buf, err = names.appendRecord(buf, r); err != nil {
 			return nil, fmt.Errorf("error marshaling additional record: %v", err)
 		}
-		log.Debugf("Marshaled additional record: %d bytes", len(recordBytes))
-		buf = append(buf, recordBytes...)
 	}
 
 	return buf, nil
 }
 
+// marshalResourceRecord returns a single record in wire format, with its names written out in full as there is no
+// message around it to point into
 func marshalResourceRecord(record *DNSRecord) ([]byte, error) {
-	var buf []byte
-	if record.Name != nil {
-		buf = append(buf, record.Name...)
-	}
-	rrHeader := make([]byte, 10)
-	binary.BigEndian.PutUint16(rrHeader[0:2], uint16(record.Type))
-	binary.BigEndian.PutUint16(rrHeader[2:4], record.Class)
-	binary.BigEndian.PutUint32(rrHeader[4:8], record.TTL)
-	binary.BigEndian.PutUint16(rrHeader[8:10], uint16(len(record.RData)))
-	buf = append(buf, rrHeader...)
-	buf = append(buf, record.RData...)
-	return buf, nil
+	var nilCompressor *nameCompressor
+	return nilCompressor.appendRecord(nil, record)
 }
@@ -12,6 +12,8 @@ func TestDNSOpCodeString(t *testing.T) {
 		{DNSOpCodeQuery, "Query"},
 		{DNSOpCodeIQuery, "IQuery"},
 		{DNSOpCodeStatus, "Status"},
+		{DNSOpCodeNotify, "Notify"},
+		{DNSOpCodeUpdate, "Update"},
 		{99, "unknown"},
 	}
 
@@ -162,7 +164,83 @@ func TestDNSTypeString(t *testing.T) {
 	if DNSTypePTR.String() != "PTR" {
 		t.Errorf("expected 'PTR', got %s", DNSTypePTR.String())
 	}
-	if DNSType(99).String() != "unknown" {
-		t.Error("expected 'unknown' for unknown type")
+	if DNSTypeHTTPS.String() != "HTTPS" {
+		t.Errorf("expected 'HTTPS', got %s", DNSTypeHTTPS.String())
+	}
+	if DNSType(99).String() != "TYPE99" {
+		t.Errorf("expected 'TYPE99' for unknown type, got %s", DNSType(99).String())
+	}
+}
+
+func TestDNSHeaderOpcode(t *testing.T) {
+	h := &DNSHeader{}
+	h.SetQR(true)
+	h.SetOpcode(DNSOpCodeUpdate)
+	h.SetRCODE(RCODERefused)
+	if h.Opcode() != DNSOpCodeUpdate {
+		t.Errorf("expected opcode Update, got %s", h.Opcode())
+	}
+}
+
+func updateMessage(prereqs, updates []*DNSRecord) *DNSMessage {
+	msg := NewDnsMessage()
+	msg.Header.SetOpcode(DNSOpCodeUpdate)
+	msg.Questions = append(msg.Questions, &DNSQuestion{ParsedName: "home.lan", Type: DNSTypeSOA, Class: DNSClassIN})
+	msg.Answers = prereqs
+	msg.Authorities = updates
+	return msg
+}
+
+func TestParseDNSUpdate(t *testing.T) {
+	msg := updateMessage(
+		[]*DNSRecord{{ParsedName: "host.home.lan", Type: DNSTypeANY, Class: DNSClassNone}},
+		[]*DNSRecord{{ParsedName: "host.home.lan", Type: DNSTypeA, Class: DNSClassIN, TTL: 60, RData: []byte{10, 0, 0, 1}}},
+	)
+
+	update, err := ParseDNSUpdate(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if update.Zone.ParsedName != "home.lan" || len(update.Prerequisites) != 1 || len(update.Updates) != 1 {
+		t.Errorf("unexpected update %+v", update)
+	}
+}
+
+func TestParseDNSUpdate_Invalid(t *testing.T) {
+	tests := map[string]*DNSMessage{
+		"query opcode": NewDnsMessage(),
+		"prerequisite with TTL": updateMessage(
+			[]*DNSRecord{{ParsedName: "host.home.lan", Type: DNSTypeA, Class: DNSClassANY, TTL: 10}}, nil),
+		"add of type ANY": updateMessage(nil,
+			[]*DNSRecord{{ParsedName: "host.home.lan", Type: DNSTypeANY, Class: DNSClassIN}}),
+		"delete with data": updateMessage(nil,
+			[]*DNSRecord{{ParsedName: "host.home.lan", Type: DNSTypeA, Class: DNSClassANY, RData: []byte{10, 0, 0, 1}}}),
+		"unknown class": updateMessage(nil,
+			[]*DNSRecord{{ParsedName: "host.home.lan", Type: DNSTypeA, Class: DNSClassCH}}),
+	}
+
+	for name, msg := range tests {
+		if _, err := ParseDNSUpdate(msg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseDNSMessage_MultipleQuestions(t *testing.T) {
+	msg := NewDnsMessage()
+	msg.Questions = append(msg.Questions,
+		&DNSQuestion{ParsedName: "a.example.com", Type: DNSTypeA, Class: DNSClassIN},
+		&DNSQuestion{ParsedName: "b.example.com", Type: DNSTypeAAAA, Class: DNSClassIN},
+	)
+	data, err := MarshalDNSMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseDNSMessage(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(parsed.Questions) != 2 || parsed.Questions[1].ParsedName != "b.example.com" || parsed.Questions[1].Type != DNSTypeAAAA {
+		t.Errorf("expected both questions, got %+v", parsed.Questions)
 	}
 }
@@ -0,0 +1,54 @@
+package dns
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handleUpdate applies an RFC 2136 dynamic update to the local zone. Only updates signed with one of the configured
+// TSIG keys are accepted
+func (d *DNSServer) handleUpdate(packet *dnsWorkItem) {
+	msg := packet.DNSMessage
+	// the response carries only the zone section
+	defer func() {
+		msg.Answers, msg.Authorities = nil, nil
+	}()
+
+	ctx, err := verifyTSIG(packet.raw, msg, d.opts.TSIGKeys, time.Now())
+	switch {
+	case err != nil:
+		log.Warnf("malformed update from %s: %v", packet.ResponseAddr, err)
+		msg.Header.SetRCODE(RCODEFormatError)
+		return
+	case ctx == nil:
+		log.Warnf("refusing unsigned update from %s", packet.ResponseAddr)
+		msg.Header.SetRCODE(RCODERefused)
+		return
+	case ctx.err != TSIGErrorNone:
+		log.Warnf("update from %s failed TSIG verification with key %s (error %d)", packet.ResponseAddr, ctx.request.KeyName, ctx.err)
+		msg.Header.SetRCODE(RCODENotAuth)
+		packet.tsig = ctx
+		return
+	}
+	packet.tsig = ctx
+
+	if d.zone == nil {
+		log.Warnf("refusing update from %s, no local zone is configured", packet.ResponseAddr)
+		msg.Header.SetRCODE(RCODENotAuth)
+		return
+	}
+	update, err := ParseDNSUpdate(msg)
+	if err != nil {
+		log.Warnf("malformed update from %s: %v", packet.ResponseAddr, err)
+		msg.Header.SetRCODE(RCODEFormatError)
+		return
+	}
+	serial := d.zone.Serial()
+	rcode := d.zone.Update(update)
+	log.Infof("update to %s from %s signed by %s finished with rcode %d", update.Zone.ParsedName, packet.ResponseAddr, ctx.key.Name, rcode)
+	msg.Header.SetRCODE(rcode)
+	if d.zone.Serial() != serial {
+		d.notifySecondaries()
+	}
+}
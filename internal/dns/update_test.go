@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func startZoneServer(t *testing.T) (*DNSServer, net.Addr) {
+	return startZoneServerWithOpts(t, ZoneOpts{Name: "home.lan"})
+}
+
+func startZoneServerWithOpts(t *testing.T, zoneOpts ZoneOpts) (*DNSServer, net.Addr) {
+	server := NewDNSServerWithOpts(DNSServerOpts{
+		ListenAddresses: []string{"127.0.0.1:0"},
+		ReadDeadline:    time.Millisecond * 100,
+		ResolverOpts:    &ResolverOpts{Upstreams: []string{}, LocalDomains: map[string]net.IP{}},
+		Zone:            &zoneOpts,
+		TSIGKeys:        []TSIGKey{testTSIGKey},
+	}, nil, nil)
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	t.Cleanup(func() { server.Stop() })
+
+	server.listenerLock.Lock()
+	defer server.listenerLock.Unlock()
+	return server, server.listeners["127.0.0.1:0"].conns[0].LocalAddr()
+}
+
+func exchangeRaw(t *testing.T, addr net.Addr, data []byte) *DNSMessage {
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(data)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	buff := make([]byte, 1500)
+	n, err := conn.Read(buff)
+	if err != nil {
+		t.Fatalf("no response from server: %v", err)
+	}
+	msg, err := ParseDNSMessage(buff[:n])
+	if err != nil {
+		t.Fatalf("unable to parse response: %v", err)
+	}
+	return msg
+}
+
+func TestDNSServer_SignedUpdate(t *testing.T) {
+	server, addr := startZoneServer(t)
+
+	raw, _ := signedUpdate(t, testTSIGKey, time.Now(), addressRecord("host.home.lan", net.IPv4(10, 0, 0, 5)))
+	response := exchangeRaw(t, addr, raw)
+	if response.Header.RCODE() != RCODESuccess {
+		t.Fatalf("expected update to succeed, got rcode %d", response.Header.RCODE())
+	}
+	if response.Header.Opcode() != DNSOpCodeUpdate {
+		t.Errorf("expected response opcode Update, got %s", response.Header.Opcode())
+	}
+	if len(response.Additionals) != 1 || response.Additionals[0].Type != DNSTypeTSIG {
+		t.Error("expected the response to be signed")
+	}
+
+	answers, _, err := server.resolver.Resolve("host.home.lan", DNSTypeA)
+	if err != nil || len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("expected the update to be resolvable, got %v (%v)", answers, err)
+	}
+}
+
+func TestDNSServer_UnsignedUpdateRefused(t *testing.T) {
+	server, addr := startZoneServer(t)
+
+	msg := updateMessage(nil, []*DNSRecord{addressRecord("host.home.lan", net.IPv4(10, 0, 0, 5))})
+	msg.Questions[0].Name = stringToDNSWireFormat("home.lan")
+	msg.Authorities[0].Name = stringToDNSWireFormat("host.home.lan")
+	data, _ := MarshalDNSMessage(msg)
+
+	if response := exchangeRaw(t, addr, data); response.Header.RCODE() != RCODERefused {
+		t.Errorf("expected REFUSED, got rcode %d", response.Header.RCODE())
+	}
+	if _, _, err := server.resolver.Resolve("host.home.lan", DNSTypeA); err != ErrNxDomain {
+		t.Errorf("expected the zone to be unchanged, got %v", err)
+	}
+}
+
+func TestDNSServer_UpdateWithUnknownKey(t *testing.T) {
+	_, addr := startZoneServer(t)
+
+	unknown := TSIGKey{Name: "someone-else.", Secret: []byte("secret")}
+	raw, _ := signedUpdate(t, unknown, time.Now(), addressRecord("host.home.lan", net.IPv4(10, 0, 0, 5)))
+
+	response := exchangeRaw(t, addr, raw)
+	if response.Header.RCODE() != RCODENotAuth {
+		t.Errorf("expected NOTAUTH, got rcode %d", response.Header.RCODE())
+	}
+}
@@ -0,0 +1,200 @@
+package dns
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	upstreamLatencyGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_upstream_latency_ms",
+		Help: "exponentially weighted moving average of upstream response time in ms",
+	}, []string{"upstream"})
+
+	upstreamHealthyGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_upstream_healthy",
+		Help: "1 if the upstream is considered healthy, 0 if it has been marked down",
+	}, []string{"upstream"})
+)
+
+type UpstreamStrategy string
+
+const (
+	UpstreamStrategyParallel   UpstreamStrategy = "parallel"    // query every upstream at once, first answer wins
+	UpstreamStrategyFastest    UpstreamStrategy = "fastest"     // lowest average latency first
+	UpstreamStrategyRoundRobin UpstreamStrategy = "round-robin" // rotate through the upstreams
+	UpstreamStrategyFailover   UpstreamStrategy = "failover"    // strictly in configured order
+)
+
+func ParseUpstreamStrategy(strategy string) (UpstreamStrategy, bool) {
+	switch UpstreamStrategy(strategy) {
+	case "", UpstreamStrategyParallel:
+		return UpstreamStrategyParallel, true
+	case UpstreamStrategyFastest, UpstreamStrategyRoundRobin, UpstreamStrategyFailover:
+		return UpstreamStrategy(strategy), true
+	default:
+		return UpstreamStrategyParallel, false
+	}
+}
+
+// weight of the newest sample in the latency moving average
+const upstreamLatencyAlpha = 0.3
+
+type UpstreamStatus struct {
+	Address             string    `json:"address"`
+	Healthy             bool      `json:"healthy"`
+	LatencyMs           float64   `json:"latencyMs"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	Queries             uint64    `json:"queries"`
+	Failures            uint64    `json:"failures"`
+	LastFailure         time.Time `json:"lastFailure,omitempty"`
+}
+
+type upstreamServer struct {
+	addr                net.IP
+	lock                sync.Mutex
+	latency             time.Duration
+	consecutiveFailures int
+	down                bool
+	nextProbe           time.Time
+	queries             uint64
+	failures            uint64
+	lastFailure         time.Time
+}
+
+func (s *upstreamServer) status() UpstreamStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return UpstreamStatus{
+		Address:             s.addr.String(),
+		Healthy:             !s.down,
+		LatencyMs:           float64(s.latency.Microseconds()) / 1000,
+		ConsecutiveFailures: s.consecutiveFailures,
+		Queries:             s.queries,
+		Failures:            s.failures,
+		LastFailure:         s.lastFailure,
+	}
+}
+
+type upstreamPool struct {
+	servers          []*upstreamServer
+	strategy         UpstreamStrategy
+	failureThreshold int
+	probeInterval    time.Duration
+	port             int // the port upstreams listen on
+	next             uint32
+}
+
+func newUpstreamPool(addrs []net.IP, strategy UpstreamStrategy, failureThreshold int, probeInterval time.Duration) *upstreamPool {
+	servers := make([]*upstreamServer, 0, len(addrs))
+	for _, addr := range addrs {
+		servers = append(servers, &upstreamServer{addr: addr})
+		upstreamHealthyGauge.With(prometheus.Labels{"upstream": addr.String()}).Set(1)
+	}
+	return &upstreamPool{
+		servers:          servers,
+		strategy:         strategy,
+		failureThreshold: failureThreshold,
+		probeInterval:    probeInterval,
+		port:             53,
+	}
+}
+
+// candidates returns the upstreams to try for a query, in the order the strategy prefers them,
+// and the servers marked down whose probe is due. Probes are sent alongside the query rather
+// than in its path, so the client never waits on a server that is likely still down. If
+// everything is down, every server is returned rather than failing the query outright.
+func (p *upstreamPool) candidates() (servers, probes []*upstreamServer) {
+	if len(p.servers) == 0 {
+		return nil, nil
+	}
+
+	ordered := make([]*upstreamServer, len(p.servers))
+	switch p.strategy {
+	case UpstreamStrategyRoundRobin:
+		start := int(atomic.AddUint32(&p.next, 1)-1) % len(p.servers)
+		for i := range p.servers {
+			ordered[i] = p.servers[(start+i)%len(p.servers)]
+		}
+	case UpstreamStrategyFastest:
+		copy(ordered, p.servers)
+		latencies := make(map[*upstreamServer]time.Duration, len(ordered))
+		for _, server := range ordered {
+			server.lock.Lock()
+			latencies[server] = server.latency
+			server.lock.Unlock()
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return latencies[ordered[i]] < latencies[ordered[j]]
+		})
+	default:
+		copy(ordered, p.servers)
+	}
+
+	now := time.Now()
+	healthy := make([]*upstreamServer, 0, len(ordered))
+	for _, server := range ordered {
+		server.lock.Lock()
+		switch {
+		case !server.down:
+			healthy = append(healthy, server)
+		case now.After(server.nextProbe):
+			server.nextProbe = now.Add(p.probeInterval)
+			probes = append(probes, server)
+		}
+		server.lock.Unlock()
+	}
+
+	if len(healthy) == 0 {
+		return ordered, nil
+	}
+	return healthy, probes
+}
+
+func (p *upstreamPool) recordSuccess(server *upstreamServer, rtt time.Duration) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.queries++
+	server.consecutiveFailures = 0
+	if server.latency == 0 {
+		server.latency = rtt
+	} else {
+		server.latency = time.Duration(upstreamLatencyAlpha*float64(rtt) + (1-upstreamLatencyAlpha)*float64(server.latency))
+	}
+	if server.down {
+		log.Infof("upstream %s is healthy again", server.addr)
+		server.down = false
+	}
+	upstreamLatencyGauge.With(prometheus.Labels{"upstream": server.addr.String()}).Set(float64(server.latency.Microseconds()) / 1000)
+	upstreamHealthyGauge.With(prometheus.Labels{"upstream": server.addr.String()}).Set(1)
+}
+
+func (p *upstreamPool) recordFailure(server *upstreamServer) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.queries++
+	server.failures++
+	server.consecutiveFailures++
+	server.lastFailure = time.Now()
+	if !server.down && server.consecutiveFailures >= p.failureThreshold {
+		log.Warnf("marking upstream %s down after %d consecutive failures", server.addr, server.consecutiveFailures)
+		server.down = true
+		server.nextProbe = time.Now().Add(p.probeInterval)
+		upstreamHealthyGauge.With(prometheus.Labels{"upstream": server.addr.String()}).Set(0)
+	}
+}
+
+func (p *upstreamPool) status() []UpstreamStatus {
+	statuses := make([]UpstreamStatus, 0, len(p.servers))
+	for _, server := range p.servers {
+		statuses = append(statuses, server.status())
+	}
+	return statuses
+}
@@ -0,0 +1,231 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testUpstreamPool(strategy UpstreamStrategy) *upstreamPool {
+	return newUpstreamPool([]net.IP{
+		net.ParseIP("10.0.0.1").To4(),
+		net.ParseIP("10.0.0.2").To4(),
+		net.ParseIP("10.0.0.3").To4(),
+	}, strategy, 2, time.Minute)
+}
+
+func candidateAddrs(servers []*upstreamServer) []string {
+	addrs := make([]string, 0, len(servers))
+	for _, server := range servers {
+		addrs = append(addrs, server.addr.String())
+	}
+	return addrs
+}
+
+func TestParseUpstreamStrategy(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected UpstreamStrategy
+		ok       bool
+	}{
+		{"", UpstreamStrategyParallel, true},
+		{"parallel", UpstreamStrategyParallel, true},
+		{"fastest", UpstreamStrategyFastest, true},
+		{"round-robin", UpstreamStrategyRoundRobin, true},
+		{"failover", UpstreamStrategyFailover, true},
+		{"random", UpstreamStrategyParallel, false},
+	}
+
+	for _, tt := range tests {
+		strategy, ok := ParseUpstreamStrategy(tt.input)
+		if strategy != tt.expected || ok != tt.ok {
+			t.Errorf("ParseUpstreamStrategy(%q) = %s, %v; want %s, %v", tt.input, strategy, ok, tt.expected, tt.ok)
+		}
+	}
+}
+
+func TestUpstreamPool_FailoverKeepsOrder(t *testing.T) {
+	pool := testUpstreamPool(UpstreamStrategyFailover)
+
+	servers, _ := pool.candidates()
+	addrs := candidateAddrs(servers)
+	if addrs[0] != "10.0.0.1" || addrs[1] != "10.0.0.2" || addrs[2] != "10.0.0.3" {
+		t.Errorf("expected configured order, got %v", addrs)
+	}
+}
+
+func TestUpstreamPool_RoundRobinRotates(t *testing.T) {
+	pool := testUpstreamPool(UpstreamStrategyRoundRobin)
+
+	servers, _ := pool.candidates()
+	first := candidateAddrs(servers)
+	servers, _ = pool.candidates()
+	second := candidateAddrs(servers)
+	if first[0] == second[0] {
+		t.Errorf("expected round robin to rotate, got %v then %v", first, second)
+	}
+	if second[0] != "10.0.0.2" {
+		t.Errorf("expected 10.0.0.2 to be first on the second query, got %v", second)
+	}
+}
+
+func TestUpstreamPool_FastestPrefersLowestLatency(t *testing.T) {
+	pool := testUpstreamPool(UpstreamStrategyFastest)
+	pool.recordSuccess(pool.servers[0], time.Millisecond*80)
+	pool.recordSuccess(pool.servers[1], time.Millisecond*10)
+	pool.recordSuccess(pool.servers[2], time.Millisecond*40)
+
+	servers, _ := pool.candidates()
+	addrs := candidateAddrs(servers)
+	if addrs[0] != "10.0.0.2" || addrs[1] != "10.0.0.3" || addrs[2] != "10.0.0.1" {
+		t.Errorf("expected servers ordered by latency, got %v", addrs)
+	}
+}
+
+func TestUpstreamPool_LatencyIsMovingAverage(t *testing.T) {
+	pool := testUpstreamPool(UpstreamStrategyFastest)
+	server := pool.servers[0]
+
+	pool.recordSuccess(server, time.Millisecond*100)
+	pool.recordSuccess(server, time.Millisecond*200)
+
+	if server.latency <= time.Millisecond*100 || server.latency >= time.Millisecond*200 {
+		t.Errorf("expected latency between samples, got %v", server.latency)
+	}
+}
+
+func TestUpstreamPool_MarksDownAfterConsecutiveFailures(t *testing.T) {
+	pool := testUpstreamPool(UpstreamStrategyFailover)
+	server := pool.servers[0]
+
+	pool.recordFailure(server)
+	if server.down {
+		t.Fatal("expected server to stay up below the failure threshold")
+	}
+	pool.recordFailure(server)
+	if !server.down {
+		t.Fatal("expected server to be marked down at the failure threshold")
+	}
+
+	servers, probes := pool.candidates()
+	if addrs := candidateAddrs(servers); len(addrs) != 2 || addrs[0] != "10.0.0.2" || len(probes) != 0 {
+		t.Errorf("expected down server to be skipped, got %v", addrs)
+	}
+
+	status := server.status()
+	if status.Healthy || status.Failures != 2 || status.ConsecutiveFailures != 2 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestUpstreamPool_ProbesDownServer(t *testing.T) {
+	pool := testUpstreamPool(UpstreamStrategyFailover)
+	server := pool.servers[0]
+	pool.recordFailure(server)
+	pool.recordFailure(server)
+	server.nextProbe = time.Now().Add(-time.Second)
+
+	servers, probes := pool.candidates()
+	if addrs := candidateAddrs(servers); len(addrs) != 2 || addrs[0] != "10.0.0.2" {
+		t.Errorf("expected the query to go to the healthy servers only, got %v", addrs)
+	}
+	if addrs := candidateAddrs(probes); len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+		t.Fatalf("expected down server to be probed, got %v", addrs)
+	}
+
+	// the probe slot is used up until the next interval
+	if _, probes := pool.candidates(); len(probes) != 0 {
+		t.Errorf("expected a single probe per interval, got %v", candidateAddrs(probes))
+	}
+
+	pool.recordSuccess(server, time.Millisecond)
+	if server.down {
+		t.Error("expected successful probe to mark the server healthy")
+	}
+}
+
+func TestUpstreamPool_AllDownReturnsEverything(t *testing.T) {
+	pool := testUpstreamPool(UpstreamStrategyParallel)
+	for _, server := range pool.servers {
+		pool.recordFailure(server)
+		pool.recordFailure(server)
+	}
+
+	if servers, _ := pool.candidates(); len(servers) != 3 {
+		t.Errorf("expected all servers when every upstream is down, got %v", candidateAddrs(servers))
+	}
+}
+
+func TestDNSResolver_FailoverReturnsToRecoveredPrimary(t *testing.T) {
+	records := []*DNSRecord{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		records = append(records, addressRecord(name+".example.test", net.IPv4(192, 0, 2, 1)))
+	}
+	primary := &authority{zone: "example.test", records: records}
+	secondary := &authority{zone: "example.test", records: records}
+
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+	secondary.serve(t, fmt.Sprintf("127.0.0.2:%d", port))
+	// the primary takes queries but never answers them until it recovers
+	unresponsive, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := NewDNSResolverWithOpts(ResolverOpts{
+		Upstreams:        []string{"127.0.0.1", "127.0.0.2"},
+		Strategy:         UpstreamStrategyFailover,
+		FailureThreshold: 1,
+		ProbeInterval:    time.Millisecond * 100,
+		ReadTimeout:      time.Millisecond * 200,
+	})
+	resolver.upstreams.port = port
+
+	// the primary is not answering yet, so it is marked down and the secondary answers
+	if answers, _, err := resolver.Resolve("a.example.test", DNSTypeA); err != nil || len(answers) != 1 {
+		t.Fatalf("expected the secondary's answer, got %v (%v)", answers, err)
+	}
+	if resolver.upstreams.servers[0].status().Healthy {
+		t.Fatal("expected the primary to be marked down")
+	}
+
+	// a probe that is due goes to the primary alongside the query, which does not wait on it
+	time.Sleep(time.Millisecond * 150)
+	start := time.Now()
+	if answers, _, err := resolver.Resolve("b.example.test", DNSTypeA); err != nil || len(answers) != 1 {
+		t.Fatalf("expected the secondary's answer, got %v (%v)", answers, err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Millisecond*100 {
+		t.Errorf("expected the query not to wait on the probe, took %v", elapsed)
+	}
+
+	unresponsive.Close()
+	primary.serve(t, fmt.Sprintf("127.0.0.1:%d", port))
+	time.Sleep(time.Millisecond * 250)
+
+	// the next probe finds the primary answering, and from then on the primary is used again
+	if answers, _, err := resolver.Resolve("c.example.test", DNSTypeA); err != nil || len(answers) != 1 {
+		t.Fatalf("expected an answer, got %v (%v)", answers, err)
+	}
+	for deadline := time.Now().Add(time.Second); !resolver.upstreams.servers[0].status().Healthy; time.Sleep(time.Millisecond * 10) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the probe to mark the primary healthy")
+		}
+	}
+	if answers, _, err := resolver.Resolve("d.example.test", DNSTypeA); err != nil || len(answers) != 1 {
+		t.Fatalf("expected an answer, got %v (%v)", answers, err)
+	}
+	if asked := primary.questions(); !slices.Equal(asked, []string{"c.example.test A", "d.example.test A"}) {
+		t.Errorf("expected the probe then the query to go to the recovered primary, it was asked %v", asked)
+	}
+	if asked := secondary.questions(); !slices.Equal(asked, []string{"a.example.test A", "b.example.test A", "c.example.test A"}) {
+		t.Errorf("expected the secondary to be left alone once the primary recovered, it was asked %v", asked)
+	}
+}
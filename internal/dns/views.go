@@ -0,0 +1,47 @@
+package dns
+
+import (
+	"errors"
+	"net"
+)
+
+var ErrUnknownView = errors.New("unknown view")
+
+// ViewOpts describes a split horizon view. Clients in the view see its local domains in place of the global ones of
+// the same name, and everything else as usual
+type ViewOpts struct {
+	Name         string
+	Clients      []string // addresses or CIDRs of the clients in the view
+	LocalDomains map[string]net.IP
+}
+
+type clientView struct {
+	name     string
+	networks []*net.IPNet
+}
+
+func newClientViews(views []ViewOpts) []clientView {
+	clientViews := make([]clientView, 0, len(views))
+	for _, view := range views {
+		clientViews = append(clientViews, clientView{
+			name:     view.Name,
+			networks: parseNetworks(view.Clients, "view client"),
+		})
+	}
+	return clientViews
+}
+
+// selectView returns the first view a client belongs to, or the default view, named "", if it belongs to none
+func selectView(views []clientView, client net.IP) string {
+	if client == nil {
+		return ""
+	}
+	for _, view := range views {
+		for _, network := range view.networks {
+			if network.Contains(client) {
+				return view.name
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSelectView(t *testing.T) {
+	views := newClientViews([]ViewOpts{
+		{Name: "vpn", Clients: []string{"10.8.0.0/24"}},
+		{Name: "lan", Clients: []string{"192.168.1.0/24", "10.8.0.5"}},
+	})
+	tests := map[string]string{
+		"10.8.0.5":     "vpn",
+		"192.168.1.20": "lan",
+		"172.16.0.1":   "",
+	}
+	for client, expected := range tests {
+		if view := selectView(views, net.ParseIP(client)); view != expected {
+			t.Errorf("%s: expected view %q, got %q", client, expected, view)
+		}
+	}
+	if view := selectView(views, nil); view != "" {
+		t.Errorf("expected an unknown client in the default view, got %q", view)
+	}
+}
+
+func TestDNSResolver_Views(t *testing.T) {
+	resolver := NewDNSResolverWithOpts(ResolverOpts{
+		Upstreams:    []string{},
+		LocalDomains: map[string]net.IP{"nas.home": net.ParseIP("192.168.1.10"), "printer.home": net.ParseIP("192.168.1.20")},
+		Views: []ViewOpts{
+			{Name: "vpn", LocalDomains: map[string]net.IP{"nas.home": net.ParseIP("10.8.0.10")}},
+		},
+	})
+
+	tests := map[string]string{"": "192.168.1.10", "vpn": "10.8.0.10"}
+	for view, expected := range tests {
+		answers, _, _, err := resolver.ResolveQuery(Query{Domain: "nas.home", Type: DNSTypeA, View: view})
+		if err != nil || len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.ParseIP(expected)) {
+			t.Errorf("view %q: expected %s, got %v (%v)", view, expected, answers, err)
+		}
+	}
+
+	// names the view does not have fall through to the global ones
+	answers, _, _, err := resolver.ResolveQuery(Query{Domain: "printer.home", Type: DNSTypeA, View: "vpn"})
+	if err != nil || len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.ParseIP("192.168.1.20")) {
+		t.Errorf("expected the global record, got %v (%v)", answers, err)
+	}
+
+	// a cached answer for the same name does not leak into the view
+	resolver.cache.set("files.home|A", &DNSCacheItem{
+		records: []*DNSRecord{{Name: stringToDNSWireFormat("files.home"), ParsedName: "files.home", Type: DNSTypeA, Class: DNSClassIN, RData: []byte{203, 0, 113, 1}}},
+		ttl:     time.Now().Add(time.Minute),
+	})
+	if err := resolver.AddViewLocalDomain("vpn", "files.home", net.ParseIP("10.8.0.11")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	answers, _, _, err = resolver.ResolveQuery(Query{Domain: "files.home", Type: DNSTypeA, View: "vpn"})
+	if err != nil || len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.ParseIP("10.8.0.11")) {
+		t.Errorf("expected the view record over the cache, got %v (%v)", answers, err)
+	}
+
+	resolver.DeleteViewLocalDomain("vpn", "nas.home")
+	answers, _, _, _ = resolver.ResolveQuery(Query{Domain: "nas.home", Type: DNSTypeA, View: "vpn"})
+	if len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("expected the global record once the view record is gone, got %v", answers)
+	}
+
+	if err := resolver.AddViewLocalDomain("guests", "nas.home", net.ParseIP("10.9.0.1")); err != ErrUnknownView {
+		t.Errorf("expected ErrUnknownView, got %v", err)
+	}
+}
+
+func TestDNSServer_Views(t *testing.T) {
+	server := NewDNSServerWithOpts(DNSServerOpts{
+		ListenAddresses: []string{"127.0.0.1:0"},
+		ReadDeadline:    time.Millisecond * 100,
+		ResolverOpts:    &ResolverOpts{Upstreams: []string{}, LocalDomains: map[string]net.IP{"nas.home": net.ParseIP("192.168.1.10")}},
+		Views: []ViewOpts{
+			{Name: "loopback", Clients: []string{"127.0.0.0/8"}, LocalDomains: map[string]net.IP{"nas.home": net.ParseIP("127.0.0.10")}},
+		},
+	}, nil, nil)
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	t.Cleanup(func() { server.Stop() })
+	server.listenerLock.Lock()
+	addr := server.listeners["127.0.0.1:0"].conns[0].LocalAddr()
+	server.listenerLock.Unlock()
+
+	msg := NewDnsMessage()
+	msg.Header.ID = 0x2222
+	msg.Questions = append(msg.Questions, &DNSQuestion{
+		Name:       stringToDNSWireFormat("nas.home"),
+		ParsedName: "nas.home",
+		Type:       DNSTypeA,
+		Class:      DNSClassIN,
+	})
+	data, _ := MarshalDNSMessage(msg)
+	response := exchangeRaw(t, addr, data)
+	if len(response.Answers) != 1 || !net.IP(response.Answers[0].RData).Equal(net.ParseIP("127.0.0.10")) {
+		t.Errorf("expected the loopback view's address, got %v", response.Answers)
+	}
+
+	if err := server.AddViewLocalDomain("loopback", "nas.home", "127.0.0.11"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	response = exchangeRaw(t, addr, data)
+	if len(response.Answers) != 1 || !net.IP(response.Answers[0].RData).Equal(net.ParseIP("127.0.0.11")) {
+		t.Errorf("expected the updated view address, got %v", response.Answers)
+	}
+}
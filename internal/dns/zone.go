@@ -0,0 +1,665 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	zoneSerialGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dns_zone_serial",
+		Help: "current serial of the local zone",
+	})
+
+	zoneUpdateCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_zone_update_count",
+		Help: "count of dynamic updates to the local zone by result",
+	}, []string{"result"})
+)
+
+// how many changes are kept in memory for incremental transfers. The journal file is compacted down to these and a
+// snapshot of the zone once it holds twice as many, so it does not grow with every change
+const zoneJournalLimit = 1000
+
+type ZoneOpts struct {
+	Name          string
+	NameServer    string        // SOA primary name server, defaults to ns.<zone>
+	Admin         string        // SOA responsible mailbox, defaults to hostmaster.<zone>
+	TTL           time.Duration // default record TTL, also used for negative answers
+	JournalFile   string        // changes are appended here and replayed on start, empty keeps them in memory only
+	AllowTransfer []string      // addresses or CIDRs that may transfer the zone
+	TransferKeys  []string      // names of TSIG keys that may transfer the zone from anywhere
+	Notify        []string      // secondaries told about every change, as host or host:port
+}
+
+type zoneRecord struct {
+	Name  string  `json:"name"`
+	Type  DNSType `json:"type"`
+	TTL   uint32  `json:"ttl"`
+	RData []byte  `json:"rdata"`
+}
+
+func (r zoneRecord) same(other zoneRecord) bool {
+	return r.Name == other.Name && r.Type == other.Type && bytes.Equal(r.RData, other.RData)
+}
+
+func (r zoneRecord) dnsRecord() *DNSRecord {
+	record := &DNSRecord{
+		ParsedName: r.Name,
+		Name:       stringToDNSWireFormat(r.Name),
+		Type:       r.Type,
+		Class:      DNSClassIN,
+		TTL:        r.TTL,
+		RData:      r.RData,
+	}
+	if r.Type == DNSTypeCNAME || r.Type == DNSTypePTR {
+		record.ParsedRData, _, _ = parseDNSName(r.RData, 0)
+	}
+	return record
+}
+
+// zoneChange is a single journal entry, moving the zone to Serial. A snapshot entry holds every record of the zone at
+// Serial in Added, and replaces whatever the entries before it built
+type zoneChange struct {
+	Serial   uint32       `json:"serial"`
+	Snapshot bool         `json:"snapshot,omitempty"`
+	Deleted  []zoneRecord `json:"deleted,omitempty"`
+	Added    []zoneRecord `json:"added,omitempty"`
+}
+
+// LocalZone is the zone gatekeeper is authoritative for. Records are changed through dynamic updates and every change
+// bumps the serial and is written to the journal
+type LocalZone struct {
+	name        string
+	nameServer  string
+	admin       string
+	ttl         uint32
+	journalFile string
+	lock        sync.RWMutex
+	serial      uint32
+	records     map[string][]zoneRecord
+	journal     []zoneChange
+	written     int // entries in the journal file
+}
+
+func NewLocalZone(opts ZoneOpts) (*LocalZone, error) {
+	name := canonicalName(opts.Name)
+	nameServer := canonicalName(opts.NameServer)
+	if nameServer == "" {
+		nameServer = "ns." + name
+	}
+	admin := canonicalName(opts.Admin)
+	if admin == "" {
+		admin = "hostmaster." + name
+	}
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = time.Minute * 5
+	}
+	zone := &LocalZone{
+		name:        name,
+		nameServer:  nameServer,
+		admin:       admin,
+		ttl:         uint32(ttl.Seconds()),
+		journalFile: opts.JournalFile,
+		serial:      uint32(time.Now().Unix()),
+		records:     make(map[string][]zoneRecord),
+	}
+	if err := zone.loadJournal(); err != nil {
+		return nil, err
+	}
+	zoneSerialGauge.Set(float64(zone.serial))
+	return zone, nil
+}
+
+func (z *LocalZone) Name() string {
+	if z == nil {
+		return ""
+	}
+	return z.name
+}
+
+func (z *LocalZone) Serial() uint32 {
+	z.lock.RLock()
+	defer z.lock.RUnlock()
+	return z.serial
+}
+
+// contains reports whether name is the zone apex or below it
+func (z *LocalZone) contains(name string) bool {
+	name = canonicalName(name)
+	return name == z.name || strings.HasSuffix(name, "."+z.name)
+}
+
+// exists reports whether name owns records, or is an empty non-terminal above names that do
+func (z *LocalZone) exists(name string) bool {
+	if name == z.name {
+		return true
+	}
+	if len(z.records[name]) > 0 {
+		return true
+	}
+	for owner, records := range z.records {
+		if len(records) > 0 && strings.HasSuffix(owner, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (z *LocalZone) rrset(name string, dnsType DNSType) []zoneRecord {
+	var set []zoneRecord
+	for _, record := range z.records[name] {
+		if dnsType == DNSTypeANY || record.Type == dnsType {
+			set = append(set, record)
+		}
+	}
+	return set
+}
+
+func (z *LocalZone) soa() *DNSRecord {
+	return z.soaWithSerial(z.serial)
+}
+
+func (z *LocalZone) soaWithSerial(serial uint32) *DNSRecord {
+	rdata := stringToDNSWireFormat(z.nameServer)
+	rdata = append(rdata, stringToDNSWireFormat(z.admin)...)
+	rdata = binary.BigEndian.AppendUint32(rdata, serial)
+	rdata = binary.BigEndian.AppendUint32(rdata, 3600)    // refresh
+	rdata = binary.BigEndian.AppendUint32(rdata, 600)     // retry
+	rdata = binary.BigEndian.AppendUint32(rdata, 1209600) // expire
+	rdata = binary.BigEndian.AppendUint32(rdata, z.ttl)   // minimum, the negative caching TTL
+	return zoneRecord{Name: z.name, Type: DNSTypeSOA, TTL: z.ttl, RData: rdata}.dnsRecord()
+}
+
+func (z *LocalZone) ns() *DNSRecord {
+	return zoneRecord{Name: z.name, Type: DNSTypeNS, TTL: z.ttl, RData: stringToDNSWireFormat(z.nameServer)}.dnsRecord()
+}
+
+// Lookup answers a query for a name in the zone. ok is false when the name is outside the zone and has to be resolved
+// elsewhere. A name in the zone without records is NXDOMAIN, and a name without records of the requested type gets the
+// SOA as its authority
+func (z *LocalZone) Lookup(name string, dnsType DNSType) (answers, authorities []*DNSRecord, ok bool, err error) {
+	if z == nil || !z.contains(name) {
+		return nil, nil, false, nil
+	}
+	z.lock.RLock()
+	defer z.lock.RUnlock()
+
+	name = canonicalName(name)
+	if name == z.name {
+		switch dnsType {
+		case DNSTypeSOA:
+			return []*DNSRecord{z.soa()}, nil, true, nil
+		case DNSTypeNS:
+			return []*DNSRecord{z.ns()}, nil, true, nil
+		}
+	}
+	if !z.exists(name) {
+		return nil, nil, true, ErrNxDomain
+	}
+
+	set := z.rrset(name, dnsType)
+	if len(set) == 0 && dnsType != DNSTypeCNAME {
+		// a CNAME stands in for every other type at its name
+		set = z.rrset(name, DNSTypeCNAME)
+	}
+	if len(set) == 0 {
+		return nil, []*DNSRecord{z.soa()}, true, nil
+	}
+	for _, record := range set {
+		answers = append(answers, record.dnsRecord())
+	}
+	return answers, nil, true, nil
+}
+
+// addresses calls fn for every A and AAAA record in the zone
+func (z *LocalZone) addresses(fn func(name string, ip net.IP, ttl uint32)) {
+	if z == nil {
+		return
+	}
+	z.lock.RLock()
+	defer z.lock.RUnlock()
+	for name, records := range z.records {
+		for _, record := range records {
+			if record.Type == DNSTypeA || record.Type == DNSTypeAAAA {
+				fn(name, net.IP(record.RData), record.TTL)
+			}
+		}
+	}
+}
+
+// SetAddress makes ip the only address of name, so local domains inside the zone are part of it and reach secondaries.
+// It reports whether the zone changed
+func (z *LocalZone) SetAddress(name string, ip net.IP) bool {
+	if z == nil || !z.contains(name) || ip.To4() == nil {
+		return false
+	}
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	name = canonicalName(name)
+	record := zoneRecord{Name: name, Type: DNSTypeA, TTL: z.ttl, RData: ip.To4()}
+	if set := z.rrset(name, DNSTypeA); len(set) == 1 && set[0].same(record) && set[0].TTL == record.TTL {
+		return false
+	}
+	change := zoneChange{}
+	z.remove(&change, name, func(other zoneRecord) bool {
+		return other.Type == DNSTypeA || other.Type == DNSTypeCNAME
+	})
+	z.records[name] = append(z.records[name], record)
+	change.Added = append(change.Added, record)
+	z.commit(change)
+	return true
+}
+
+// DeleteAddress removes the addresses of name, reporting whether the zone changed
+func (z *LocalZone) DeleteAddress(name string) bool {
+	if z == nil || !z.contains(name) {
+		return false
+	}
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	change := zoneChange{}
+	z.remove(&change, canonicalName(name), func(other zoneRecord) bool { return other.Type == DNSTypeA })
+	z.commit(change)
+	return len(change.Deleted) > 0
+}
+
+// transferRecords lists the records of a zone transfer, starting and ending with the current SOA. An incremental
+// transfer from a serial the journal still covers is the RFC 1995 sequence of differences, a client that is up to date
+// gets the SOA alone, and anything else gets the whole zone
+func (z *LocalZone) transferRecords(fromSerial uint32, incremental bool) (records []*DNSRecord, full bool) {
+	z.lock.RLock()
+	defer z.lock.RUnlock()
+
+	current := z.soa()
+	if incremental {
+		if fromSerial == z.serial {
+			return []*DNSRecord{current}, false
+		}
+		for i, change := range z.journal {
+			if change.Serial-1 != fromSerial {
+				continue
+			}
+			records = append(records, current)
+			for _, change := range z.journal[i:] {
+				records = append(records, z.soaWithSerial(change.Serial-1))
+				for _, deleted := range change.Deleted {
+					records = append(records, deleted.dnsRecord())
+				}
+				records = append(records, z.soaWithSerial(change.Serial))
+				for _, added := range change.Added {
+					records = append(records, added.dnsRecord())
+				}
+			}
+			return append(records, current), false
+		}
+	}
+
+	names := make([]string, 0, len(z.records))
+	for name := range z.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	records = append(records, current, z.ns())
+	for _, name := range names {
+		for _, record := range z.records[name] {
+			records = append(records, record.dnsRecord())
+		}
+	}
+	return append(records, current), true
+}
+
+// zoneRData turns an update record into its stored form. Names inside the data may have been compressed against the
+// update message, so they are rewritten from the parsed name
+func zoneRData(record *DNSRecord) ([]byte, bool) {
+	switch record.Type {
+	case DNSTypeA:
+		return record.RData, len(record.RData) == 4
+	case DNSTypeAAAA:
+		return record.RData, len(record.RData) == 16
+	case DNSTypeTXT:
+		return record.RData, len(record.RData) > 0
+	case DNSTypeCNAME, DNSTypePTR:
+		if record.ParsedRData == "" {
+			return nil, false
+		}
+		return stringToDNSWireFormat(canonicalName(record.ParsedRData)), true
+	default:
+		return nil, false
+	}
+}
+
+// Update applies an RFC 2136 update. Prerequisites are checked and the updates applied under a single lock, so the
+// update either happens as a whole or not at all
+func (z *LocalZone) Update(update *DNSUpdate) RCODE {
+	if z == nil || canonicalName(update.Zone.ParsedName) != z.name {
+		zoneUpdateCounter.With(prometheus.Labels{"result": "not-auth"}).Inc()
+		return RCODENotAuth
+	}
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	if rcode := z.checkPrerequisites(update.Prerequisites); rcode != RCODESuccess {
+		zoneUpdateCounter.With(prometheus.Labels{"result": "prerequisite-failed"}).Inc()
+		return rcode
+	}
+
+	for _, rr := range update.Updates {
+		if !z.contains(rr.ParsedName) {
+			zoneUpdateCounter.With(prometheus.Labels{"result": "not-zone"}).Inc()
+			return RCODENotZone
+		}
+		if rr.Class == DNSClassIN || rr.Class == DNSClassNone {
+			if _, ok := zoneRData(rr); !ok {
+				log.Warnf("rejecting update of %s record for %s", rr.Type, rr.ParsedName)
+				zoneUpdateCounter.With(prometheus.Labels{"result": "not-implemented"}).Inc()
+				return RCODENotImplemented
+			}
+		}
+	}
+
+	change := zoneChange{}
+	for _, rr := range update.Updates {
+		name := canonicalName(rr.ParsedName)
+		switch rr.Class {
+		case DNSClassIN:
+			rdata, _ := zoneRData(rr)
+			z.add(&change, zoneRecord{Name: name, Type: rr.Type, TTL: rr.TTL, RData: rdata})
+		case DNSClassANY:
+			z.remove(&change, name, func(record zoneRecord) bool {
+				return rr.Type == DNSTypeANY || record.Type == rr.Type
+			})
+		case DNSClassNone:
+			rdata, _ := zoneRData(rr)
+			z.remove(&change, name, func(record zoneRecord) bool {
+				return record.Type == rr.Type && bytes.Equal(record.RData, rdata)
+			})
+		}
+	}
+
+	z.commit(change)
+	zoneUpdateCounter.With(prometheus.Labels{"result": "success"}).Inc()
+	return RCODESuccess
+}
+
+func (z *LocalZone) checkPrerequisites(prereqs []*DNSRecord) RCODE {
+	// value dependent prerequisites have to match the whole RRset, so collect them up first
+	type rrsetKey struct {
+		name    string
+		dnsType DNSType
+	}
+	expected := make(map[rrsetKey][][]byte)
+
+	for _, prereq := range prereqs {
+		name := canonicalName(prereq.ParsedName)
+		if !z.contains(name) {
+			return RCODENotZone
+		}
+		switch prereq.Class {
+		case DNSClassANY:
+			if prereq.Type == DNSTypeANY {
+				if !z.exists(name) {
+					return RCODENameFailure
+				}
+			} else if len(z.rrset(name, prereq.Type)) == 0 {
+				return RCODENXRRSet
+			}
+		case DNSClassNone:
+			if prereq.Type == DNSTypeANY {
+				if z.exists(name) {
+					return RCODEYXDomain
+				}
+			} else if len(z.rrset(name, prereq.Type)) > 0 {
+				return RCODEYXRRSet
+			}
+		default:
+			rdata, ok := zoneRData(prereq)
+			if !ok {
+				rdata = prereq.RData
+			}
+			key := rrsetKey{name, prereq.Type}
+			expected[key] = append(expected[key], rdata)
+		}
+	}
+
+	for key, rdatas := range expected {
+		set := z.rrset(key.name, key.dnsType)
+		if len(set) != len(rdatas) {
+			return RCODENXRRSet
+		}
+		for _, record := range set {
+			found := false
+			for _, rdata := range rdatas {
+				if bytes.Equal(record.RData, rdata) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return RCODENXRRSet
+			}
+		}
+	}
+	return RCODESuccess
+}
+
+// add puts record into the zone, following the RFC 2136 rules for CNAMEs and duplicates
+func (z *LocalZone) add(change *zoneChange, record zoneRecord) {
+	if record.Name == z.name && (record.Type == DNSTypeSOA || record.Type == DNSTypeNS || record.Type == DNSTypeCNAME) {
+		log.Debugf("ignoring update to %s record at the zone apex", record.Type)
+		return
+	}
+	existing := z.records[record.Name]
+	for _, other := range existing {
+		if record.Type == DNSTypeCNAME && other.Type != DNSTypeCNAME {
+			log.Debugf("ignoring CNAME for %s, the name has other records", record.Name)
+			return
+		}
+		if record.Type != DNSTypeCNAME && other.Type == DNSTypeCNAME {
+			log.Debugf("ignoring %s for %s, the name is a CNAME", record.Type, record.Name)
+			return
+		}
+	}
+	if record.Type == DNSTypeCNAME {
+		// only one CNAME may exist at a name, a new one replaces it
+		z.remove(change, record.Name, func(other zoneRecord) bool { return other.Type == DNSTypeCNAME })
+	}
+	for _, other := range z.records[record.Name] {
+		if other.same(record) {
+			if other.TTL == record.TTL {
+				return
+			}
+			z.remove(change, record.Name, func(r zoneRecord) bool { return r.same(record) })
+			break
+		}
+	}
+	// records of the same type share a TTL
+	for i, other := range z.records[record.Name] {
+		if other.Type == record.Type && other.TTL != record.TTL {
+			change.Deleted = append(change.Deleted, other)
+			other.TTL = record.TTL
+			z.records[record.Name][i] = other
+			change.Added = append(change.Added, other)
+		}
+	}
+	z.records[record.Name] = append(z.records[record.Name], record)
+	change.Added = append(change.Added, record)
+}
+
+func (z *LocalZone) remove(change *zoneChange, name string, match func(zoneRecord) bool) {
+	kept := z.records[name][:0]
+	for _, record := range z.records[name] {
+		if match(record) {
+			change.Deleted = append(change.Deleted, record)
+		} else {
+			kept = append(kept, record)
+		}
+	}
+	if len(kept) == 0 {
+		delete(z.records, name)
+	} else {
+		z.records[name] = kept
+	}
+}
+
+// commit gives a change its serial and records it in the journal. The records must already have been changed
+func (z *LocalZone) commit(change zoneChange) {
+	if len(change.Added) == 0 && len(change.Deleted) == 0 {
+		return
+	}
+	z.serial++
+	change.Serial = z.serial
+	zoneSerialGauge.Set(float64(z.serial))
+	z.journal = append(z.journal, change)
+	if len(z.journal) > zoneJournalLimit {
+		z.journal = z.journal[len(z.journal)-zoneJournalLimit:]
+	}
+	if err := z.appendJournal(change); err != nil {
+		log.Errorf("unable to write zone journal: %v", err)
+	} else if z.written > 2*zoneJournalLimit {
+		if err := z.compactJournal(); err != nil {
+			log.Errorf("unable to compact zone journal: %v", err)
+		}
+	}
+}
+
+func (z *LocalZone) apply(change zoneChange) {
+	for _, deleted := range change.Deleted {
+		z.remove(&zoneChange{}, deleted.Name, func(record zoneRecord) bool { return record.same(deleted) })
+	}
+	for _, added := range change.Added {
+		z.records[added.Name] = append(z.records[added.Name], added)
+	}
+}
+
+func (z *LocalZone) appendJournal(change zoneChange) error {
+	if z.journalFile == "" {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(z.journalFile), os.ModePerm); err != nil && !os.IsExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(z.journalFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	z.written++
+	return nil
+}
+
+// compactJournal rewrites the journal file as the changes kept in memory followed by a snapshot of the zone. The file is
+// written aside and renamed over the old one, so a failure leaves the old journal in place
+func (z *LocalZone) compactJournal() error {
+	snapshot := zoneChange{Serial: z.serial, Snapshot: true}
+	names := make([]string, 0, len(z.records))
+	for name := range z.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		snapshot.Added = append(snapshot.Added, z.records[name]...)
+	}
+
+	compacted := z.journalFile + ".compact"
+	f, err := os.OpenFile(compacted, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, change := range z.journal {
+		if err = encoder.Encode(change); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = encoder.Encode(snapshot)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(compacted, z.journalFile)
+	}
+	if err != nil {
+		os.Remove(compacted)
+		return err
+	}
+	log.Debugf("compacted the journal of zone %s from %d to %d entries", z.name, z.written, len(z.journal)+1)
+	z.written = len(z.journal) + 1
+	return nil
+}
+
+// loadJournal replays the journal file so the zone comes back with the records and serial it had
+func (z *LocalZone) loadJournal() error {
+	if z.journalFile == "" {
+		return nil
+	}
+	f, err := os.Open(z.journalFile)
+	switch {
+	case err == nil:
+		defer f.Close()
+	case os.IsNotExist(err):
+		return nil
+	default:
+		return err
+	}
+
+	// a snapshot holds the whole zone on one line, so entries are decoded from the stream rather than scanned by line
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var change zoneChange
+		if err := decoder.Decode(&change); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		z.written++
+		z.serial = change.Serial
+		if change.Snapshot {
+			z.records = make(map[string][]zoneRecord)
+			z.apply(change)
+			continue
+		}
+		z.apply(change)
+		z.journal = append(z.journal, change)
+	}
+	if len(z.journal) > zoneJournalLimit {
+		z.journal = z.journal[len(z.journal)-zoneJournalLimit:]
+	}
+	log.Debugf("replayed %d journal entries of zone %s, serial is %d", z.written, z.name, z.serial)
+	if z.written > 2*zoneJournalLimit {
+		if err := z.compactJournal(); err != nil {
+			log.Errorf("unable to compact zone journal: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testZone(t *testing.T, journal string) *LocalZone {
+	zone, err := NewLocalZone(ZoneOpts{Name: "home.lan.", JournalFile: journal})
+	if err != nil {
+		t.Fatalf("unable to create zone: %v", err)
+	}
+	return zone
+}
+
+func addRecord(name string, dnsType DNSType, rdata []byte) *DNSRecord {
+	return &DNSRecord{ParsedName: name, Type: dnsType, Class: DNSClassIN, TTL: 60, RData: rdata}
+}
+
+func TestLocalZone_LookupOutsideZone(t *testing.T) {
+	zone := testZone(t, "")
+	if _, _, ok, _ := zone.Lookup("example.com", DNSTypeA); ok {
+		t.Error("expected names outside the zone to be left alone")
+	}
+
+	var nilZone *LocalZone
+	if _, _, ok, _ := nilZone.Lookup("host.home.lan", DNSTypeA); ok {
+		t.Error("expected nil zone to answer nothing")
+	}
+}
+
+func TestLocalZone_Apex(t *testing.T) {
+	zone := testZone(t, "")
+
+	answers, _, ok, err := zone.Lookup("home.lan", DNSTypeSOA)
+	if !ok || err != nil || len(answers) != 1 || answers[0].Type != DNSTypeSOA {
+		t.Fatalf("expected SOA at the apex, got %v (%v)", answers, err)
+	}
+	answers, _, _, _ = zone.Lookup("home.lan", DNSTypeNS)
+	if len(answers) != 1 || answers[0].Type != DNSTypeNS {
+		t.Errorf("expected NS at the apex, got %v", answers)
+	}
+}
+
+func TestLocalZone_UpdateAndLookup(t *testing.T) {
+	zone := testZone(t, "")
+	serial := zone.Serial()
+
+	rcode := zone.Update(updateFor(addressRecord("host.home.lan", net.IPv4(10, 0, 0, 5))))
+	if rcode != RCODESuccess {
+		t.Fatalf("expected success, got %d", rcode)
+	}
+	if zone.Serial() != serial+1 {
+		t.Errorf("expected serial to be bumped to %d, got %d", serial+1, zone.Serial())
+	}
+
+	answers, _, ok, err := zone.Lookup("HOST.home.lan", DNSTypeA)
+	if !ok || err != nil || len(answers) != 1 {
+		t.Fatalf("expected one answer, got %v (%v)", answers, err)
+	}
+
+	// the name exists but has no TXT records
+	answers, authorities, _, err := zone.Lookup("host.home.lan", DNSTypeTXT)
+	if err != nil || len(answers) != 0 || len(authorities) != 1 || authorities[0].Type != DNSTypeSOA {
+		t.Errorf("expected NODATA with SOA, got %v %v (%v)", answers, authorities, err)
+	}
+
+	if _, _, _, err := zone.Lookup("missing.home.lan", DNSTypeA); err != ErrNxDomain {
+		t.Errorf("expected NXDOMAIN for a missing name, got %v", err)
+	}
+
+	// applying the same record again is not a change
+	zone.Update(updateFor(addressRecord("host.home.lan", net.IPv4(10, 0, 0, 5))))
+	if zone.Serial() != serial+1 {
+		t.Errorf("expected duplicate add to leave the serial alone, got %d", zone.Serial())
+	}
+}
+
+func TestLocalZone_EmptyNonTerminal(t *testing.T) {
+	zone := testZone(t, "")
+	zone.Update(updateFor(addRecord("_acme-challenge.www.home.lan", DNSTypeTXT, []byte("\x05token"))))
+
+	if _, _, _, err := zone.Lookup("www.home.lan", DNSTypeA); err != nil {
+		t.Errorf("expected NODATA for an empty non-terminal, got %v", err)
+	}
+}
+
+func TestLocalZone_Deletes(t *testing.T) {
+	zone := testZone(t, "")
+	zone.Update(updateFor(
+		addressRecord("host.home.lan", net.IPv4(10, 0, 0, 5)),
+		addressRecord("host.home.lan", net.IPv4(10, 0, 0, 6)),
+		addRecord("host.home.lan", DNSTypeTXT, []byte("\x03txt")),
+	))
+
+	zone.Update(updateFor(&DNSRecord{ParsedName: "host.home.lan", Type: DNSTypeA, Class: DNSClassNone, RData: []byte{10, 0, 0, 5}}))
+	if answers, _, _, _ := zone.Lookup("host.home.lan", DNSTypeA); len(answers) != 1 {
+		t.Errorf("expected a single A record to be deleted, got %v", answers)
+	}
+
+	zone.Update(updateFor(&DNSRecord{ParsedName: "host.home.lan", Type: DNSTypeA, Class: DNSClassANY}))
+	if answers, _, _, _ := zone.Lookup("host.home.lan", DNSTypeA); len(answers) != 0 {
+		t.Errorf("expected the A RRset to be deleted, got %v", answers)
+	}
+
+	zone.Update(updateFor(&DNSRecord{ParsedName: "host.home.lan", Type: DNSTypeANY, Class: DNSClassANY}))
+	if _, _, _, err := zone.Lookup("host.home.lan", DNSTypeTXT); err != ErrNxDomain {
+		t.Errorf("expected the name to be gone, got %v", err)
+	}
+}
+
+func TestLocalZone_CNAMERules(t *testing.T) {
+	zone := testZone(t, "")
+	zone.Update(updateFor(addressRecord("host.home.lan", net.IPv4(10, 0, 0, 5))))
+
+	alias := addRecord("host.home.lan", DNSTypeCNAME, nil)
+	alias.ParsedRData = "other.home.lan"
+	zone.Update(updateFor(alias))
+	if answers, _, _, _ := zone.Lookup("host.home.lan", DNSTypeCNAME); len(answers) != 0 {
+		t.Error("expected CNAME to be ignored on a name with other records")
+	}
+
+	www := addRecord("www.home.lan", DNSTypeCNAME, nil)
+	www.ParsedRData = "host.home.lan"
+	zone.Update(updateFor(www))
+	answers, _, _, _ := zone.Lookup("www.home.lan", DNSTypeA)
+	if len(answers) != 1 || answers[0].Type != DNSTypeCNAME || answers[0].ParsedRData != "host.home.lan" {
+		t.Errorf("expected the CNAME to answer an A query, got %v", answers)
+	}
+}
+
+func TestLocalZone_Prerequisites(t *testing.T) {
+	zone := testZone(t, "")
+	zone.Update(updateFor(addressRecord("host.home.lan", net.IPv4(10, 0, 0, 5))))
+
+	tests := []struct {
+		name     string
+		prereq   *DNSRecord
+		expected RCODE
+	}{
+		{"name in use", &DNSRecord{ParsedName: "host.home.lan", Type: DNSTypeANY, Class: DNSClassANY}, RCODESuccess},
+		{"name not in use", &DNSRecord{ParsedName: "new.home.lan", Type: DNSTypeANY, Class: DNSClassANY}, RCODENameFailure},
+		{"rrset exists", &DNSRecord{ParsedName: "host.home.lan", Type: DNSTypeA, Class: DNSClassANY}, RCODESuccess},
+		{"rrset missing", &DNSRecord{ParsedName: "host.home.lan", Type: DNSTypeTXT, Class: DNSClassANY}, RCODENXRRSet},
+		{"name must not exist", &DNSRecord{ParsedName: "host.home.lan", Type: DNSTypeANY, Class: DNSClassNone}, RCODEYXDomain},
+		{"rrset must not exist", &DNSRecord{ParsedName: "host.home.lan", Type: DNSTypeA, Class: DNSClassNone}, RCODEYXRRSet},
+		{"value matches", addressRecord("host.home.lan", net.IPv4(10, 0, 0, 5)), RCODESuccess},
+		{"value differs", addressRecord("host.home.lan", net.IPv4(10, 0, 0, 6)), RCODENXRRSet},
+		{"outside zone", &DNSRecord{ParsedName: "example.com", Type: DNSTypeANY, Class: DNSClassANY}, RCODENotZone},
+	}
+
+	for _, tt := range tests {
+		if tt.prereq.Class == DNSClassIN {
+			tt.prereq.TTL = 0
+		}
+		update := &DNSUpdate{
+			Zone:          &DNSQuestion{ParsedName: "home.lan", Type: DNSTypeSOA, Class: DNSClassIN},
+			Prerequisites: []*DNSRecord{tt.prereq},
+		}
+		if rcode := zone.Update(update); rcode != tt.expected {
+			t.Errorf("%s: expected rcode %d, got %d", tt.name, tt.expected, rcode)
+		}
+	}
+}
+
+func TestLocalZone_UpdateRejections(t *testing.T) {
+	zone := testZone(t, "")
+
+	update := updateFor(addressRecord("host.home.lan", net.IPv4(10, 0, 0, 5)))
+	update.Zone.ParsedName = "other.lan"
+	if rcode := zone.Update(update); rcode != RCODENotAuth {
+		t.Errorf("expected NOTAUTH for another zone, got %d", rcode)
+	}
+	if rcode := zone.Update(updateFor(addressRecord("host.example.com", net.IPv4(10, 0, 0, 5)))); rcode != RCODENotZone {
+		t.Errorf("expected NOTZONE for a name outside the zone, got %d", rcode)
+	}
+	if rcode := zone.Update(updateFor(addRecord("host.home.lan", DNSTypeMX, []byte{0, 10, 0}))); rcode != RCODENotImplemented {
+		t.Errorf("expected NOTIMP for an unsupported type, got %d", rcode)
+	}
+}
+
+func TestLocalZone_JournalReplay(t *testing.T) {
+	journal := filepath.Join(t.TempDir(), "zone", "journal")
+	zone := testZone(t, journal)
+	zone.Update(updateFor(
+		addressRecord("host.home.lan", net.IPv4(10, 0, 0, 5)),
+		addressRecord("gone.home.lan", net.IPv4(10, 0, 0, 6)),
+	))
+	zone.Update(updateFor(&DNSRecord{ParsedName: "gone.home.lan", Type: DNSTypeANY, Class: DNSClassANY}))
+
+	reloaded := testZone(t, journal)
+	if reloaded.Serial() != zone.Serial() {
+		t.Errorf("expected serial %d after replay, got %d", zone.Serial(), reloaded.Serial())
+	}
+	if answers, _, _, _ := reloaded.Lookup("host.home.lan", DNSTypeA); len(answers) != 1 {
+		t.Errorf("expected host to survive a restart, got %v", answers)
+	}
+	if _, _, _, err := reloaded.Lookup("gone.home.lan", DNSTypeA); err != ErrNxDomain {
+		t.Errorf("expected deleted name to stay deleted, got %v", err)
+	}
+}
+
+func TestLocalZone_JournalCompaction(t *testing.T) {
+	journal := filepath.Join(t.TempDir(), "journal")
+	zone := testZone(t, journal)
+	zone.SetAddress("host.home.lan", net.ParseIP("10.0.0.5"))
+	// an ACME client adding and removing its challenge over and over
+	for i := 0; i < zoneJournalLimit; i++ {
+		zone.Update(updateFor(addRecord("_acme-challenge.home.lan", DNSTypeTXT, []byte{5, 't', 'o', 'k', 'e', 'n'})))
+		zone.Update(updateFor(&DNSRecord{ParsedName: "_acme-challenge.home.lan", Type: DNSTypeANY, Class: DNSClassANY}))
+	}
+
+	data, err := os.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := bytes.Count(data, []byte{'\n'}); entries > 2*zoneJournalLimit {
+		t.Errorf("expected the journal file to be compacted, it holds %d entries", entries)
+	}
+
+	reloaded := testZone(t, journal)
+	if reloaded.Serial() != zone.Serial() {
+		t.Errorf("expected serial %d after replay, got %d", zone.Serial(), reloaded.Serial())
+	}
+	if answers, _, _, _ := reloaded.Lookup("host.home.lan", DNSTypeA); len(answers) != 1 {
+		t.Errorf("expected host to survive compaction, got %v", answers)
+	}
+	if _, _, _, err := reloaded.Lookup("_acme-challenge.home.lan", DNSTypeTXT); err != ErrNxDomain {
+		t.Errorf("expected the removed challenge to stay removed, got %v", err)
+	}
+	// the changes kept for incremental transfers survive compaction too
+	if _, full := reloaded.transferRecords(zone.Serial()-10, true); full || len(reloaded.journal) != zoneJournalLimit {
+		t.Errorf("expected an incremental transfer from the last %d changes, got full %t", len(reloaded.journal), full)
+	}
+}
+
+func TestLocalZone_SetAddress(t *testing.T) {
+	zone := testZone(t, "")
+	serial := zone.Serial()
+
+	if !zone.SetAddress("host.home.lan", net.ParseIP("10.0.0.5")) {
+		t.Fatal("expected a new address to change the zone")
+	}
+	if zone.SetAddress("host.home.lan", net.ParseIP("10.0.0.5")) {
+		t.Error("expected the same address to leave the zone alone")
+	}
+	if zone.SetAddress("host.example.com", net.ParseIP("10.0.0.5")) {
+		t.Error("expected names outside the zone to be ignored")
+	}
+	zone.SetAddress("host.home.lan", net.ParseIP("10.0.0.6"))
+	answers, _, _, _ := zone.Lookup("host.home.lan", DNSTypeA)
+	if len(answers) != 1 || !net.IP(answers[0].RData).Equal(net.ParseIP("10.0.0.6")) {
+		t.Errorf("expected the address to be replaced, got %v", answers)
+	}
+	if zone.Serial() != serial+2 {
+		t.Errorf("expected two changes, got serial %d from %d", zone.Serial(), serial)
+	}
+
+	if !zone.DeleteAddress("host.home.lan") || zone.DeleteAddress("host.home.lan") {
+		t.Error("expected only the first delete to change the zone")
+	}
+}
+
+func TestLocalZone_TransferRecords(t *testing.T) {
+	zone := testZone(t, "")
+	serial := zone.Serial()
+	zone.SetAddress("b.home.lan", net.ParseIP("10.0.0.2"))
+	zone.SetAddress("a.home.lan", net.ParseIP("10.0.0.1"))
+
+	records, full := zone.transferRecords(0, false)
+	if !full || len(records) != 5 || records[2].ParsedName != "a.home.lan" || records[3].ParsedName != "b.home.lan" {
+		t.Errorf("expected SOA, NS, the sorted records and SOA, got %v", records)
+	}
+
+	if records, _ := zone.transferRecords(zone.Serial(), true); len(records) != 1 {
+		t.Errorf("expected an up to date client to get the SOA alone, got %v", records)
+	}
+
+	records, full = zone.transferRecords(serial+1, true)
+	if full || len(records) != 5 || records[3].ParsedName != "a.home.lan" {
+		t.Errorf("expected the last change alone, got %v", records)
+	}
+
+	// a serial the journal does not cover falls back to the whole zone
+	if _, full := zone.transferRecords(serial-10, true); !full {
+		t.Error("expected a full transfer for an unknown serial")
+	}
+}
+
+func updateFor(updates ...*DNSRecord) *DNSUpdate {
+	return &DNSUpdate{
+		Zone:    &DNSQuestion{ParsedName: "home.lan", Type: DNSTypeSOA, Class: DNSClassIN},
+		Updates: updates,
+	}
+}
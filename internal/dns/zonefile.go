@@ -0,0 +1,304 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TTL given to records in a zone file without one when the file has no $TTL either
+const defaultZoneFileTTL = time.Hour
+
+type zoneFileLine struct {
+	number     int
+	tokens     []string
+	blankOwner bool // the line started with whitespace, so the record belongs to the previous owner
+}
+
+// parseZoneFile reads records in RFC 1035 master file format. Names are returned canonical, relative names are completed
+// with origin, and record types gatekeeper has no use for are skipped
+func parseZoneFile(data, origin string) ([]*DNSRecord, error) {
+	lines, err := zoneFileLines(data)
+	if err != nil {
+		return nil, err
+	}
+
+	origin = canonicalName(origin)
+	ttl := uint32(defaultZoneFileTTL.Seconds())
+	var owner string
+	var hasOwner bool
+	var records []*DNSRecord
+	for _, line := range lines {
+		tokens := line.tokens
+		switch strings.ToUpper(tokens[0]) {
+		case "$ORIGIN":
+			if len(tokens) < 2 {
+				return nil, fmt.Errorf("line %d: $ORIGIN without a name", line.number)
+			}
+			origin = zoneFileName(tokens[1], origin)
+			continue
+		case "$TTL":
+			if len(tokens) < 2 {
+				return nil, fmt.Errorf("line %d: $TTL without a value", line.number)
+			}
+			if ttl, err = parseZoneFileTTL(tokens[1]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line.number, err)
+			}
+			continue
+		case "$INCLUDE":
+			return nil, fmt.Errorf("line %d: $INCLUDE is not supported", line.number)
+		}
+
+		if !line.blankOwner {
+			owner, hasOwner = zoneFileName(tokens[0], origin), true
+			tokens = tokens[1:]
+		} else if !hasOwner {
+			return nil, fmt.Errorf("line %d: record without an owner", line.number)
+		}
+
+		// the TTL and class are both optional and may come in either order
+		recordTTL := ttl
+		for i := 0; i < 2 && len(tokens) > 0; i++ {
+			if isZoneFileClass(tokens[0]) {
+				tokens = tokens[1:]
+			} else if value, err := parseZoneFileTTL(tokens[0]); err == nil {
+				recordTTL = value
+				tokens = tokens[1:]
+			}
+		}
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("line %d: record without a type", line.number)
+		}
+
+		record, err := zoneFileRecord(owner, strings.ToUpper(tokens[0]), tokens[1:], origin)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line.number, err)
+		}
+		if record == nil {
+			log.Debugf("skipping %s record for %s on line %d", tokens[0], owner, line.number)
+			continue
+		}
+		record.TTL = recordTTL
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// zoneFileLines splits a zone file into logical lines, dropping comments and joining lines inside parentheses
+func zoneFileLines(data string) ([]zoneFileLine, error) {
+	var lines []zoneFileLine
+	var current zoneFileLine
+	var token strings.Builder
+	var inToken, quoted bool
+	depth, number := 0, 1
+	current.number = number
+
+	endToken := func() {
+		if inToken {
+			current.tokens = append(current.tokens, token.String())
+			token.Reset()
+			inToken = false
+		}
+	}
+	endLine := func() {
+		if len(current.tokens) > 0 {
+			lines = append(lines, current)
+		}
+		current = zoneFileLine{number: number}
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\\' && i+1 < len(data):
+			token.WriteByte(data[i+1])
+			inToken = true
+			i++
+		case quoted:
+			if c == '"' {
+				quoted = false
+				endToken()
+			} else {
+				token.WriteByte(c)
+			}
+		case c == '"':
+			quoted, inToken = true, true
+		case c == ';':
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case c == '(':
+			endToken()
+			depth++
+		case c == ')':
+			if depth == 0 {
+				return nil, fmt.Errorf("line %d: unbalanced parentheses", number)
+			}
+			endToken()
+			depth--
+		case c == '\n':
+			endToken()
+			number++
+			if depth == 0 {
+				endLine()
+			}
+		case c == ' ' || c == '\t' || c == '\r':
+			if len(current.tokens) == 0 && !inToken && depth == 0 && (i == 0 || data[i-1] == '\n') {
+				current.blankOwner = true
+			}
+			endToken()
+		default:
+			token.WriteByte(c)
+			inToken = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("line %d: unterminated quote", number)
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("line %d: unbalanced parentheses", number)
+	}
+	endToken()
+	endLine()
+	return lines, nil
+}
+
+// zoneFileName turns a name as written in a zone file into a canonical absolute name
+func zoneFileName(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return canonicalName(name)
+	case origin == "":
+		return strings.ToLower(name)
+	default:
+		return strings.ToLower(name) + "." + origin
+	}
+}
+
+func isZoneFileClass(token string) bool {
+	switch strings.ToUpper(token) {
+	case "IN", "CH", "HS", "CS":
+		return true
+	}
+	return false
+}
+
+// parseZoneFileTTL accepts plain seconds as well as the BIND style 1h30m
+func parseZoneFileTTL(value string) (uint32, error) {
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return uint32(seconds), nil
+	}
+	var total, current uint64
+	var digits bool
+	for _, c := range strings.ToLower(value) {
+		if c >= '0' && c <= '9' {
+			current = current*10 + uint64(c-'0')
+			digits = true
+			continue
+		}
+		if !digits {
+			return 0, fmt.Errorf("invalid TTL %q", value)
+		}
+		switch c {
+		case 's':
+		case 'm':
+			current *= 60
+		case 'h':
+			current *= 60 * 60
+		case 'd':
+			current *= 60 * 60 * 24
+		case 'w':
+			current *= 60 * 60 * 24 * 7
+		default:
+			return 0, fmt.Errorf("invalid TTL %q", value)
+		}
+		total += current
+		current, digits = 0, false
+	}
+	if value == "" || digits || total > 0xffffffff {
+		return 0, fmt.Errorf("invalid TTL %q", value)
+	}
+	return uint32(total), nil
+}
+
+// zoneFileRecord builds a record from its type and data. A nil record means the type is not one gatekeeper keeps
+func zoneFileRecord(owner, recordType string, rdata []string, origin string) (*DNSRecord, error) {
+	record := &DNSRecord{
+		ParsedName: owner,
+		Name:       stringToDNSWireFormat(owner),
+		Class:      DNSClassIN,
+	}
+	need := func(count int) error {
+		if len(rdata) < count {
+			return fmt.Errorf("%s record for %s needs %d fields, got %d", recordType, owner, count, len(rdata))
+		}
+		return nil
+	}
+
+	switch recordType {
+	case "A":
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		record.Type = DNSTypeA
+		if record.RData = net.ParseIP(rdata[0]).To4(); record.RData == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q for %s", rdata[0], owner)
+		}
+	case "AAAA":
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		record.Type = DNSTypeAAAA
+		ip := net.ParseIP(rdata[0])
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q for %s", rdata[0], owner)
+		}
+		record.RData = ip.To16()
+	case "CNAME", "NS", "PTR":
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		record.Type = map[string]DNSType{"CNAME": DNSTypeCNAME, "NS": DNSTypeNS, "PTR": DNSTypePTR}[recordType]
+		record.ParsedRData = zoneFileName(rdata[0], origin)
+		record.RData = stringToDNSWireFormat(record.ParsedRData)
+	case "TXT":
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		record.Type = DNSTypeTXT
+		for _, text := range rdata {
+			if len(text) > 255 {
+				return nil, fmt.Errorf("TXT string for %s is longer than 255 characters", owner)
+			}
+			record.RData = append(append(record.RData, byte(len(text))), text...)
+		}
+	case "SOA":
+		if err := need(7); err != nil {
+			return nil, err
+		}
+		record.Type = DNSTypeSOA
+		record.RData = append(stringToDNSWireFormat(zoneFileName(rdata[0], origin)), stringToDNSWireFormat(zoneFileName(rdata[1], origin))...)
+		for i, field := range rdata[2:7] {
+			value, err := strconv.ParseUint(field, 10, 32)
+			if i > 0 && err != nil {
+				var ttl uint32
+				ttl, err = parseZoneFileTTL(field)
+				value = uint64(ttl)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid SOA field %q for %s", field, owner)
+			}
+			record.RData = binary.BigEndian.AppendUint32(record.RData, uint32(value))
+		}
+	default:
+		return nil, nil
+	}
+	return record, nil
+}
@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+const testZoneFile = `$TTL 1h
+$ORIGIN rpz.example.
+@   IN SOA ns.example. hostmaster.example. (
+        2024010101 ; serial
+        3600 600 1w 300 )
+    IN NS  ns.example.
+bad.example.com     CNAME .
+*.bad.example.com   300 IN CNAME .
+empty.example.com   IN 60 CNAME *.
+printer.lan         A     10.0.0.50
+                    AAAA  fd00::50
+                    TXT   "managed by" "policy"
+mx.example.com      MX    10 mail.example.com.
+`
+
+func TestParseZoneFile(t *testing.T) {
+	records, err := parseZoneFile(testZoneFile, "ignored.example")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 8 {
+		t.Fatalf("expected the MX record to be skipped and 8 records kept, got %d: %v", len(records), records)
+	}
+
+	soa := records[0]
+	if soa.Type != DNSTypeSOA || soa.ParsedName != "rpz.example" || soa.TTL != 3600 {
+		t.Errorf("expected the SOA at the origin with the $TTL, got %v", soa)
+	}
+	if serial := binary.BigEndian.Uint32(soa.RData[len(soa.RData)-20:]); serial != 2024010101 {
+		t.Errorf("expected serial 2024010101, got %d", serial)
+	}
+	if minimum := binary.BigEndian.Uint32(soa.RData[len(soa.RData)-4:]); minimum != 300 {
+		t.Errorf("expected the SOA fields to span the parentheses, got minimum %d", minimum)
+	}
+	if records[1].Type != DNSTypeNS || records[1].ParsedName != "rpz.example" || records[1].ParsedRData != "ns.example" {
+		t.Errorf("expected the NS record to inherit the owner, got %v", records[1])
+	}
+	if records[2].ParsedName != "bad.example.com.rpz.example" || records[2].ParsedRData != "" {
+		t.Errorf("expected a relative owner and a CNAME to the root, got %v %q", records[2], records[2].ParsedRData)
+	}
+	if records[3].ParsedName != "*.bad.example.com.rpz.example" || records[3].TTL != 300 {
+		t.Errorf("expected a wildcard with its own TTL, got %v", records[3])
+	}
+	if records[4].TTL != 60 || records[4].ParsedRData != "*" {
+		t.Errorf("expected the class and TTL in either order, got %v %q", records[4], records[4].ParsedRData)
+	}
+	if !net.IP(records[5].RData).Equal(net.ParseIP("10.0.0.50")) || records[6].ParsedName != "printer.lan.rpz.example" {
+		t.Errorf("expected address records for printer.lan, got %v %v", records[5], records[6])
+	}
+	if string(records[7].RData) != "\x0amanaged by\x06policy" {
+		t.Errorf("expected quoted TXT strings, got %q", records[7].RData)
+	}
+}
+
+func TestParseZoneFile_Errors(t *testing.T) {
+	invalid := map[string]string{
+		"unbalanced":     "@ SOA ns. host. ( 1 2 3 4 5\n",
+		"include":        "$INCLUDE other.zone\n",
+		"bad address":    "host A 10.0.0\n",
+		"no owner":       "  A 10.0.0.1\n",
+		"missing fields": "host CNAME\n",
+		"bad ttl":        "$TTL 1x\n",
+	}
+	for name, zone := range invalid {
+		if _, err := parseZoneFile(zone, "example"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseZoneFileTTL(t *testing.T) {
+	tests := map[string]uint32{"300": 300, "1h": 3600, "1h30m": 5400, "2D": 172800, "1w": 604800}
+	for value, expected := range tests {
+		if ttl, err := parseZoneFileTTL(value); err != nil || ttl != expected {
+			t.Errorf("%s: expected %d, got %d (%v)", value, expected, ttl, err)
+		}
+	}
+	for _, value := range []string{"", "h", "1h2", "IN"} {
+		if _, err := parseZoneFileTTL(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
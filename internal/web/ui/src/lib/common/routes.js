@@ -9,4 +9,5 @@ export const Routes = {
   DNSSettings: "/dns/settings",
   DNSLocalDomains: "/dns/local-domains",
   DNSStatistics: "/dns/statistics",
+  DNSClients: "/dns/clients",
 };
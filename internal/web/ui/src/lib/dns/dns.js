@@ -42,3 +42,15 @@ export const deleteDNSBlockedDomain = (index) => {
 export const addDNSBlockedDomain = (domain) => {
   return api.put(`/dns/blockeddomains`, { url: domain });
 };
+
+export const getDNSStats = (period, count) => {
+  return api.get(`/dns/stats?period=${period}&count=${count}`);
+};
+
+export const getDNSClients = (period) => {
+  return api.get(`/dns/clients?period=${period}`);
+};
+
+export const getDNSClient = (ip, period, count) => {
+  return api.get(`/dns/clients/${ip}?period=${period}&count=${count}`);
+};
@@ -111,6 +111,11 @@ func setupDNSRoutes(g *gin.RouterGroup) {
 	dns := g.Group("/dns")
 	dns.GET("/config", getDNSConfig)
 	dns.PUT("/config", updateDNSConfig)
+	dns.GET("/upstreams", getUpstreams)
+	dns.GET("/stats", getStats)
+	dns.GET("/clients", getClients)
+	dns.GET("/clients/:ip", getClient)
+	dns.GET("/views", getViews)
 	dns.GET("/local-domains", getLocalDomains)
 	dns.POST("/local-domains", addLocalDomain)
 	dns.PUT("/local-domains/:domain", updateLocalDomain)
@@ -119,6 +124,14 @@ func setupDNSRoutes(g *gin.RouterGroup) {
 	dns.DELETE("/blocklist/:id", deleteBlocklist)
 	dns.PUT("/blockeddomains", addBlockedDomain)
 	dns.DELETE("/blockeddomains/:id", deleteBlockedDomain)
+	dns.GET("/blocking", getBlocking)
+	dns.POST("/blocking/pause", pauseBlocking)
+	dns.DELETE("/blocking/pause", resumeBlocking)
+	dns.GET("/rewrites", getRewriteRules)
+	dns.POST("/rewrites", addRewriteRule)
+	dns.PUT("/rewrites", replaceRewriteRules)
+	dns.PUT("/rewrites/:id", updateRewriteRule)
+	dns.DELETE("/rewrites/:id", deleteRewriteRule)
 }
 
 func setupSystemRoutes(g *gin.RouterGroup) {
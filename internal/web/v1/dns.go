@@ -1,23 +1,32 @@
 package v1
 
 import (
+	"fmt"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 	"gitlab.com/thatjames-go/gatekeeper-go/internal/config"
+	"gitlab.com/thatjames-go/gatekeeper-go/internal/dhcp"
 	"gitlab.com/thatjames-go/gatekeeper-go/internal/dns"
 	"gitlab.com/thatjames-go/gatekeeper-go/internal/service"
 )
 
-func getDNSConfig(c *gin.Context) {
-	c.JSON(200, DNSConfigResponse{
+// dnsConfigResponse returns the DNS settings in place, with blocked domains shown the way users type them
+func dnsConfigResponse() DNSConfigResponse {
+	return DNSConfigResponse{
 		Upstreams:      config.Config.DNS.UpstreamServers,
 		Interface:      config.Config.DNS.Interface,
 		Blocklist:      config.Config.DNS.BlockLists,
-		BlockedDomains: config.Config.DNS.BlockedDomains,
-	})
+		BlockedDomains: MapDomains(config.Config.DNS.BlockedDomains),
+	}
+}
+
+func getDNSConfig(c *gin.Context) {
+	c.JSON(200, dnsConfigResponse())
 }
 
 func updateDNSConfig(c *gin.Context) {
@@ -58,19 +67,143 @@ func updateDNSConfig(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(200, DNSConfigResponse{
-		Upstreams:      config.Config.DNS.UpstreamServers,
-		Interface:      config.Config.DNS.Interface,
-		Blocklist:      config.Config.DNS.BlockLists,
-		BlockedDomains: config.Config.DNS.BlockedDomains,
+	c.JSON(200, dnsConfigResponse())
+}
+
+func getUpstreams(c *gin.Context) {
+	dnsService := service.GetService[*dns.DNSServer](service.DNS)
+	c.JSON(http.StatusOK, dnsService.Upstreams())
+}
+
+// the number of entries in each top list when the request does not ask for a count
+const defaultStatsCount = 10
+
+// statsQuery reads the period and number of entries per list a statistics request asks for
+func statsQuery(c *gin.Context) (dns.StatsPeriod, int, bool) {
+	period, ok := dns.ParseStatsPeriod(c.Query("period"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid period, expected hour, day or week"})
+		return period, 0, false
+	}
+	count := defaultStatsCount
+	if value := c.Query("count"); value != "" {
+		var err error
+		if count, err = strconv.Atoi(value); err != nil || count < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid count"})
+			return period, 0, false
+		}
+	}
+	return period, count, true
+}
+
+func getStats(c *gin.Context) {
+	period, count, ok := statsQuery(c)
+	if !ok {
+		return
+	}
+	dnsService := service.GetService[*dns.DNSServer](service.DNS)
+	report := dnsService.Stats(period, count)
+	report.TopQueried = MapStatsEntries(report.TopQueried)
+	report.TopBlocked = MapStatsEntries(report.TopBlocked)
+	c.JSON(http.StatusOK, report)
+}
+
+// clientLeases returns the DHCP leases by address, reserved ones first so an active lease on the same address wins
+func clientLeases() map[string]dhcp.Lease {
+	leases := make(map[string]dhcp.Lease)
+	if !service.IsRegistered(service.DHCP) {
+		return leases
+	}
+	leaseDB := service.GetService[*dhcp.DHCPServer](service.DHCP).LeaseDB()
+	for _, lease := range append(leaseDB.ReservedLeases(), leaseDB.ActiveLeases()...) {
+		leases[lease.IP.String()] = lease
+	}
+	return leases
+}
+
+func getClients(c *gin.Context) {
+	period, ok := dns.ParseStatsPeriod(c.Query("period"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid period, expected hour, day or week"})
+		return
+	}
+	dnsService := service.GetService[*dns.DNSServer](service.DNS)
+	c.JSON(http.StatusOK, MapDNSClients(dnsService.Clients(period), clientLeases()))
+}
+
+func getClient(c *gin.Context) {
+	ip := net.ParseIP(c.Param("ip"))
+	if ip == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid client IP"})
+		return
+	}
+	period, count, ok := statsQuery(c)
+	if !ok {
+		return
+	}
+	dnsService := service.GetService[*dns.DNSServer](service.DNS)
+	report, ok := dnsService.Client(ip, period, count)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not seen in this period"})
+		return
+	}
+	c.JSON(http.StatusOK, DNSClientDetail{
+		DNSClient:  MapDNSClient(report.ClientStats, clientLeases()),
+		Period:     report.Period,
+		TopDomains: MapStatsEntries(report.TopDomains),
+		TopBlocked: MapStatsEntries(report.TopBlocked),
+		Timeline:   report.Timeline,
 	})
 }
 
+// viewLocalDomains returns the configured local domains of the view named in the request, the global ones when no view
+// is named
+func viewLocalDomains(c *gin.Context) (string, map[string]string, bool) {
+	view := c.Query("view")
+	if view == "" {
+		if config.Config.DNS.LocalDomains == nil {
+			config.Config.DNS.LocalDomains = make(map[string]string)
+		}
+		return view, config.Config.DNS.LocalDomains, true
+	}
+	for i := range config.Config.DNS.Views {
+		if config.Config.DNS.Views[i].Name == view {
+			if config.Config.DNS.Views[i].LocalDomains == nil {
+				config.Config.DNS.Views[i].LocalDomains = make(map[string]string)
+			}
+			return view, config.Config.DNS.Views[i].LocalDomains, true
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Unknown view %s", view)})
+	return view, nil, false
+}
+
+// deleteConfigDomain removes a local domain from the configuration both as given and normalized, names saved before
+// they were normalized are held as they were typed
+func deleteConfigDomain(localDomains map[string]string, domain string) {
+	delete(localDomains, domain)
+	if normalized, err := dns.NormalizeDomain(domain); err == nil {
+		delete(localDomains, normalized)
+	}
+}
+
+func getViews(c *gin.Context) {
+	c.JSON(http.StatusOK, MapViews(config.Config.DNS.Views))
+}
+
 func getLocalDomains(c *gin.Context) {
-	c.JSON(200, config.Config.DNS.LocalDomains)
+	_, localDomains, ok := viewLocalDomains(c)
+	if !ok {
+		return
+	}
+	c.JSON(200, MapLocalDomains(localDomains))
 }
 
 func addLocalDomain(c *gin.Context) {
+	view, localDomains, ok := viewLocalDomains(c)
+	if !ok {
+		return
+	}
 	var req LocalDomainRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
@@ -85,37 +218,46 @@ func addLocalDomain(c *gin.Context) {
 		return
 	}
 
-	log.Info("Adding local domain: ", req)
+	log.Infof("Adding local domain %v to view %q", req, view)
 
 	dnsService := service.GetService[*dns.DNSServer](service.DNS)
-	if err := dnsService.AddLocalDomain(req.Domain, req.IP); err != nil {
+	if err := dnsService.AddViewLocalDomain(view, req.Domain, req.IP); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	config.Config.DNS.LocalDomains[req.Domain] = req.IP
+	localDomains[req.Domain] = req.IP
 	if err := config.UpdateConfig(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, config.Config.DNS.LocalDomains)
+	c.JSON(http.StatusOK, MapLocalDomains(localDomains))
 }
 
 func deleteLocalDomain(c *gin.Context) {
+	view, localDomains, ok := viewLocalDomains(c)
+	if !ok {
+		return
+	}
 	domain := c.Param("domain")
-	log.Info("Deleting local domain: ", domain)
+	log.Infof("Deleting local domain %s from view %q", domain, view)
 
-	delete(config.Config.DNS.LocalDomains, domain)
+	deleteConfigDomain(localDomains, domain)
 	if err := config.UpdateConfig(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	dnsService := service.GetService[*dns.DNSServer](service.DNS)
-	dnsService.DeleteLocalDomain(domain)
-	c.JSON(http.StatusOK, config.Config.DNS.LocalDomains)
+	dnsService.DeleteViewLocalDomain(view, domain)
+	c.JSON(http.StatusOK, MapLocalDomains(localDomains))
 }
 
 func updateLocalDomain(c *gin.Context) {
+	view, localDomains, ok := viewLocalDomains(c)
+	if !ok {
+		return
+	}
 	var req LocalDomainRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
@@ -129,20 +271,20 @@ func updateLocalDomain(c *gin.Context) {
 		return
 	}
 	originalDomain := c.Param("domain")
-	log.Info("Updating local domain: ", originalDomain)
+	log.Infof("Updating local domain %s in view %q", originalDomain, view)
 	dnsService := service.GetService[*dns.DNSServer](service.DNS)
-	dnsService.DeleteLocalDomain(originalDomain)
-	if err := dnsService.AddLocalDomain(req.Domain, req.IP); err != nil {
+	dnsService.DeleteViewLocalDomain(view, originalDomain)
+	if err := dnsService.AddViewLocalDomain(view, req.Domain, req.IP); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	delete(config.Config.DNS.LocalDomains, originalDomain)
-	config.Config.DNS.LocalDomains[req.Domain] = req.IP
+	deleteConfigDomain(localDomains, originalDomain)
+	localDomains[req.Domain] = req.IP
 	if err := config.UpdateConfig(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, config.Config.DNS.LocalDomains)
+	c.JSON(http.StatusOK, MapLocalDomains(localDomains))
 }
 
 func addBlocklist(c *gin.Context) {
@@ -229,12 +371,7 @@ func deleteBlockedDomain(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, DNSConfigResponse{
-		Upstreams:      config.Config.DNS.UpstreamServers,
-		Interface:      config.Config.DNS.Interface,
-		Blocklist:      config.Config.DNS.BlockLists,
-		BlockedDomains: config.Config.DNS.BlockedDomains,
-	})
+	c.JSON(http.StatusOK, dnsConfigResponse())
 }
 
 func addBlockedDomain(c *gin.Context) {
@@ -243,7 +380,7 @@ func addBlockedDomain(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
 		return
 	}
-	if validationErrors := req.Validate(); validationErrors != nil && len(validationErrors) > 0 {
+	if validationErrors := req.ValidateDomain(); validationErrors != nil {
 		c.JSON(http.StatusBadRequest, ErrorResponse{
 			Error:  "Unable to add blocked domain",
 			Fields: validationErrors,
@@ -262,11 +399,153 @@ func addBlockedDomain(c *gin.Context) {
 		return
 	}
 
-	dnsService.AddBlockedDomain(req.Url)
-	c.JSON(http.StatusOK, DNSConfigResponse{
-		Upstreams:      config.Config.DNS.UpstreamServers,
-		Interface:      config.Config.DNS.Interface,
-		Blocklist:      config.Config.DNS.BlockLists,
-		BlockedDomains: config.Config.DNS.BlockedDomains,
-	})
+	if err := dnsService.AddBlockedDomain(req.Url); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, dnsConfigResponse())
+}
+
+func getBlocking(c *gin.Context) {
+	dnsService := service.GetService[*dns.DNSServer](service.DNS)
+	c.JSON(http.StatusOK, MapBlockingStatus(dnsService.BlockingPauses(), time.Now()))
+}
+
+func pauseBlocking(c *gin.Context) {
+	var req BlockingPauseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if validationErrors := req.Validate(); validationErrors != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:  "Unable to pause blocking",
+			Fields: validationErrors,
+		})
+		return
+	}
+	dnsService := service.GetService[*dns.DNSServer](service.DNS)
+	// a nil client pauses blocking for every client
+	dnsService.PauseBlocking(net.ParseIP(req.Client), time.Duration(req.Duration)*time.Second)
+	c.JSON(http.StatusOK, MapBlockingStatus(dnsService.BlockingPauses(), time.Now()))
+}
+
+// resumeBlocking ends the pause for the client in the client query parameter, the one for every client without it
+func resumeBlocking(c *gin.Context) {
+	var client net.IP
+	if value := c.Query("client"); value != "" {
+		if client = net.ParseIP(value); client == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid client IP"})
+			return
+		}
+	}
+	dnsService := service.GetService[*dns.DNSServer](service.DNS)
+	dnsService.ResumeBlocking(client)
+	c.JSON(http.StatusOK, MapBlockingStatus(dnsService.BlockingPauses(), time.Now()))
+}
+
+func getRewriteRules(c *gin.Context) {
+	c.JSON(http.StatusOK, MapRewriteRules(config.Config.DNS.RewriteRules))
+}
+
+func addRewriteRule(c *gin.Context) {
+	var req RewriteRule
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if validationErrors := req.Validate(); validationErrors != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:  "Unable to add rewrite rule",
+			Fields: validationErrors,
+		})
+		return
+	}
+	log.Info("Adding rewrite rule: ", req)
+	rules := append(MapRewriteRules(config.Config.DNS.RewriteRules), req)
+	setRewriteRules(c, rules)
+}
+
+// replaceRewriteRules swaps the whole list at once, which is how rules are reordered
+func replaceRewriteRules(c *gin.Context) {
+	var req []RewriteRule
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	for i := range req {
+		if validationErrors := req[i].Validate(); validationErrors != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error:  fmt.Sprintf("Unable to update rewrite rule %d", i+1),
+				Fields: validationErrors,
+			})
+			return
+		}
+	}
+	log.Infof("Replacing rewrite rules with %d rules", len(req))
+	setRewriteRules(c, req)
+}
+
+func updateRewriteRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 0 || id >= len(config.Config.DNS.RewriteRules) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rewrite rule id"})
+		return
+	}
+	var req RewriteRule
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if validationErrors := req.Validate(); validationErrors != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:  "Unable to update rewrite rule",
+			Fields: validationErrors,
+		})
+		return
+	}
+	log.Info("Updating rewrite rule: ", req)
+	rules := MapRewriteRules(config.Config.DNS.RewriteRules)
+	rules[id] = req
+	setRewriteRules(c, rules)
+}
+
+func deleteRewriteRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 0 || id >= len(config.Config.DNS.RewriteRules) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rewrite rule id"})
+		return
+	}
+	rules := MapRewriteRules(config.Config.DNS.RewriteRules)
+	log.Info("Deleting rewrite rule: ", rules[id])
+	setRewriteRules(c, append(rules[:id], rules[id+1:]...))
+}
+
+// setRewriteRules applies rules to the running server and saves them, responding with the rules now in place
+func setRewriteRules(c *gin.Context, rules []RewriteRule) {
+	dnsRules := make([]dns.RewriteRule, 0, len(rules))
+	configRules := make([]config.RewriteRule, 0, len(rules))
+	for i := range rules {
+		dnsRules = append(dnsRules, rules[i].DNSRule())
+		configRules = append(configRules, rules[i].ConfigRule())
+	}
+
+	dnsService := service.GetService[*dns.DNSServer](service.DNS)
+	if err := dnsService.SetRewriteRules(dnsRules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	oldRules := config.Config.DNS.RewriteRules
+	config.Config.DNS.RewriteRules = configRules
+	if err := config.UpdateConfig(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		config.Config.DNS.RewriteRules = oldRules
+		oldDNSRules := make([]dns.RewriteRule, 0, len(oldRules))
+		for _, rule := range MapRewriteRules(oldRules) {
+			oldDNSRules = append(oldDNSRules, rule.DNSRule())
+		}
+		dnsService.SetRewriteRules(oldDNSRules)
+		return
+	}
+	c.JSON(http.StatusOK, MapRewriteRules(config.Config.DNS.RewriteRules))
 }
@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"gitlab.com/thatjames-go/gatekeeper-go/internal/config"
 	"gitlab.com/thatjames-go/gatekeeper-go/internal/dhcp"
+	"gitlab.com/thatjames-go/gatekeeper-go/internal/dns"
 )
 
 type Role string
@@ -107,6 +110,7 @@ type LocalDomainRequest struct {
 	IP     string `json:"ip"`
 }
 
+// Validate checks the request and normalizes the domain to the form queries are matched against
 func (z *LocalDomainRequest) Validate() []ValidationError {
 	validationErrors := make([]ValidationError, 0)
 	if z.Domain == "" {
@@ -114,6 +118,13 @@ func (z *LocalDomainRequest) Validate() []ValidationError {
 			Field:   "domain",
 			Message: "Domain is required",
 		})
+	} else if domain, err := dns.NormalizeDomain(z.Domain); err != nil {
+		validationErrors = append(validationErrors, ValidationError{
+			Field:   "domain",
+			Message: "Domain must be a valid domain name",
+		})
+	} else {
+		z.Domain = domain
 	}
 	if z.IP == "" {
 		validationErrors = append(validationErrors, ValidationError{
@@ -346,6 +357,17 @@ func (z *DNSConfigRequest) Validate() []ValidationError {
 			}
 		}
 	}
+	for i, blocked := range z.BlockedDomains {
+		domain, err := dns.NormalizeDomain(blocked)
+		if err != nil || domain == "" {
+			validationErrors = append(validationErrors, ValidationError{
+				Field:   "blockedDomains",
+				Message: fmt.Sprintf("Blocked domain %d must be a valid domain name", i+1),
+			})
+			continue
+		}
+		z.BlockedDomains[i] = domain
+	}
 	if len(validationErrors) > 0 {
 		return validationErrors
 	}
@@ -367,6 +389,238 @@ func (z *BlocklistRequest) Validate() []ValidationError {
 	return validationErrors
 }
 
+// ValidateDomain checks a request to block a single domain, which Url holds, and normalizes the domain to the form
+// queries are matched against
+func (z *BlocklistRequest) ValidateDomain() []ValidationError {
+	if z.Url == "" {
+		return []ValidationError{{
+			Field:   "url",
+			Message: "Domain is required",
+		}}
+	}
+	domain, err := dns.NormalizeDomain(z.Url)
+	if err != nil || domain == "" {
+		return []ValidationError{{
+			Field:   "url",
+			Message: "Domain must be a valid domain name",
+		}}
+	}
+	z.Url = domain
+	return nil
+}
+
+// the longest blocking can be paused for, in seconds, so a forgotten pause does not leave the network unfiltered
+const maxBlockingPause = 24 * 60 * 60
+
+// BlockingPauseRequest pauses blocking for Duration seconds, for the client at Client or for every client when it is
+// empty
+type BlockingPauseRequest struct {
+	Duration int    `json:"duration"`
+	Client   string `json:"client,omitempty"`
+}
+
+func (z *BlockingPauseRequest) Validate() []ValidationError {
+	validationErrors := make([]ValidationError, 0)
+	if z.Duration <= 0 || z.Duration > maxBlockingPause {
+		validationErrors = append(validationErrors, ValidationError{
+			Field:   "duration",
+			Message: fmt.Sprintf("Duration must be between 1 and %d seconds", maxBlockingPause),
+		})
+	}
+	if z.Client != "" {
+		if ip := net.ParseIP(z.Client); ip == nil {
+			validationErrors = append(validationErrors, ValidationError{
+				Field:   "client",
+				Message: "Client must be a valid IP address",
+			})
+		} else {
+			z.Client = ip.String()
+		}
+	}
+	if len(validationErrors) > 0 {
+		return validationErrors
+	}
+	return nil
+}
+
+type BlockingPause struct {
+	Client    string `json:"client,omitempty"`
+	Until     string `json:"until"`
+	Remaining int    `json:"remaining"` // seconds until blocking resumes
+}
+
+type BlockingStatus struct {
+	Paused bool            `json:"paused"` // blocking is paused for every client
+	Pauses []BlockingPause `json:"pauses"`
+}
+
+// MapBlockingStatus counts down the running pauses from now, rounding up so a pause never shows 0 while it still applies
+func MapBlockingStatus(pauses []dns.BlockingPause, now time.Time) BlockingStatus {
+	status := BlockingStatus{Pauses: make([]BlockingPause, 0, len(pauses))}
+	for _, pause := range pauses {
+		status.Paused = status.Paused || pause.Client == ""
+		status.Pauses = append(status.Pauses, BlockingPause{
+			Client:    pause.Client,
+			Until:     pause.Until.Format(time.RFC3339),
+			Remaining: int((pause.Until.Sub(now) + time.Second - 1) / time.Second),
+		})
+	}
+	return status
+}
+
+type RewriteRule struct {
+	Match   string   `json:"match"`
+	Pattern string   `json:"pattern"`
+	Clients []string `json:"clients,omitempty"`
+	Action  string   `json:"action"`
+	Value   string   `json:"value,omitempty"`
+}
+
+func (z *RewriteRule) Validate() []ValidationError {
+	validationErrors := make([]ValidationError, 0)
+	if z.Pattern == "" {
+		validationErrors = append(validationErrors, ValidationError{
+			Field:   "pattern",
+			Message: "Pattern is required",
+		})
+	}
+	if z.Match == "" {
+		validationErrors = append(validationErrors, ValidationError{
+			Field:   "match",
+			Message: "Match is required",
+		})
+	}
+	if z.Action == "" {
+		validationErrors = append(validationErrors, ValidationError{
+			Field:   "action",
+			Message: "Action is required",
+		})
+	}
+	if len(validationErrors) > 0 {
+		return validationErrors
+	}
+	if err := dns.ValidateRewriteRule(z.DNSRule()); err != nil {
+		return []ValidationError{{
+			Field:   "rule",
+			Message: err.Error(),
+		}}
+	}
+	return nil
+}
+
+func (z *RewriteRule) DNSRule() dns.RewriteRule {
+	return dns.RewriteRule{
+		Match:   dns.RewriteMatch(z.Match),
+		Pattern: z.Pattern,
+		Clients: z.Clients,
+		Action:  dns.RewriteAction(z.Action),
+		Value:   z.Value,
+	}
+}
+
+func (z *RewriteRule) ConfigRule() config.RewriteRule {
+	return config.RewriteRule{
+		Match:   z.Match,
+		Pattern: z.Pattern,
+		Clients: z.Clients,
+		Action:  z.Action,
+		Value:   z.Value,
+	}
+}
+
+func MapRewriteRules(rules []config.RewriteRule) []RewriteRule {
+	ruleList := make([]RewriteRule, 0, len(rules))
+	for _, rule := range rules {
+		ruleList = append(ruleList, RewriteRule{
+			Match:   rule.Match,
+			Pattern: rule.Pattern,
+			Clients: rule.Clients,
+			Action:  rule.Action,
+			Value:   rule.Value,
+		})
+	}
+	return ruleList
+}
+
+type View struct {
+	Name         string            `json:"name"`
+	Clients      []string          `json:"clients"`
+	LocalDomains map[string]string `json:"localDomains"`
+}
+
+func MapViews(views []config.View) []View {
+	viewList := make([]View, 0, len(views))
+	for _, view := range views {
+		viewList = append(viewList, View{
+			Name:         view.Name,
+			Clients:      view.Clients,
+			LocalDomains: MapLocalDomains(view.LocalDomains),
+		})
+	}
+	return viewList
+}
+
+// MapDomains shows internationalized domains the way users type them, see dns.DisplayDomain
+func MapDomains(domains []string) []string {
+	domainList := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domainList = append(domainList, dns.DisplayDomain(domain))
+	}
+	return domainList
+}
+
+func MapLocalDomains(localDomains map[string]string) map[string]string {
+	domains := make(map[string]string, len(localDomains))
+	for domain, ip := range localDomains {
+		domains[dns.DisplayDomain(domain)] = ip
+	}
+	return domains
+}
+
+func MapStatsEntries(entries []dns.StatsEntry) []dns.StatsEntry {
+	entryList := make([]dns.StatsEntry, 0, len(entries))
+	for _, entry := range entries {
+		entryList = append(entryList, dns.StatsEntry{Name: dns.DisplayDomain(entry.Name), Count: entry.Count})
+	}
+	return entryList
+}
+
+type DNSClient struct {
+	dns.ClientStats
+	Hostname   string  `json:"hostname"`
+	MAC        string  `json:"mac"`
+	BlockRatio float64 `json:"blockRatio"`
+}
+
+type DNSClientDetail struct {
+	DNSClient
+	Period     dns.StatsPeriod  `json:"period"`
+	TopDomains []dns.StatsEntry `json:"topDomains"`
+	TopBlocked []dns.StatsEntry `json:"topBlocked"`
+	Timeline   []dns.StatsPoint `json:"timeline"`
+}
+
+// MapDNSClient names a client after the DHCP lease for its address, if there is one
+func MapDNSClient(stats dns.ClientStats, leases map[string]dhcp.Lease) DNSClient {
+	client := DNSClient{ClientStats: stats}
+	if lease, ok := leases[stats.IP]; ok {
+		client.Hostname = lease.Hostname
+		client.MAC = lease.ClientId
+	}
+	if stats.Queries > 0 {
+		client.BlockRatio = float64(stats.Blocked) / float64(stats.Queries)
+	}
+	return client
+}
+
+func MapDNSClients(clients []dns.ClientStats, leases map[string]dhcp.Lease) []DNSClient {
+	clientList := make([]DNSClient, 0, len(clients))
+	for _, client := range clients {
+		clientList = append(clientList, MapDNSClient(client, leases))
+	}
+	return clientList
+}
+
 func MapLease(lease dhcp.Lease) Lease {
 	return Lease{
 		ClientId: lease.ClientId,
@@ -1,7 +1,12 @@
 package v1
 
 import (
+	"net"
 	"testing"
+	"time"
+
+	"gitlab.com/thatjames-go/gatekeeper-go/internal/dhcp"
+	"gitlab.com/thatjames-go/gatekeeper-go/internal/dns"
 )
 
 func TestDhcpLeaseRequestValidate_Valid(t *testing.T) {
@@ -101,6 +106,30 @@ func TestLocalDomainRequestValidate_EmptyDomain(t *testing.T) {
 	}
 }
 
+func TestLocalDomainRequestValidate_NormalizesDomain(t *testing.T) {
+	req := &LocalDomainRequest{
+		Domain: "Bücher.LAN.",
+		IP:     "192.168.1.1",
+	}
+	if errs := req.Validate(); errs != nil {
+		t.Fatalf("expected no validation errors, got %v", errs)
+	}
+	if req.Domain != "xn--bcher-kva.lan" {
+		t.Errorf("expected the A-label form, got %s", req.Domain)
+	}
+}
+
+func TestLocalDomainRequestValidate_InvalidDomain(t *testing.T) {
+	req := &LocalDomainRequest{
+		Domain: "a\u200d.lan",
+		IP:     "192.168.1.1",
+	}
+	errs := req.Validate()
+	if len(errs) != 1 || errs[0].Field != "domain" {
+		t.Errorf("expected domain error, got %v", errs)
+	}
+}
+
 func TestLocalDomainRequestValidate_EmptyIP(t *testing.T) {
 	req := &LocalDomainRequest{
 		Domain: "example.com",
@@ -292,3 +321,127 @@ func TestBlocklistRequestValidate_EmptyUrl(t *testing.T) {
 		t.Error("expected validation error for empty URL")
 	}
 }
+
+func TestBlocklistRequestValidateDomain(t *testing.T) {
+	req := &BlocklistRequest{
+		Url: "Tracker.Bücher.example",
+	}
+	if errs := req.ValidateDomain(); errs != nil {
+		t.Fatalf("expected no validation errors, got %v", errs)
+	}
+	if req.Url != "tracker.xn--bcher-kva.example" {
+		t.Errorf("expected the A-label form, got %s", req.Url)
+	}
+
+	for _, domain := range []string{"", ".", "a\u200d.example"} {
+		req := &BlocklistRequest{Url: domain}
+		if errs := req.ValidateDomain(); len(errs) != 1 || errs[0].Field != "url" {
+			t.Errorf("expected url error for %q, got %v", domain, errs)
+		}
+	}
+}
+
+func TestBlockingPauseRequestValidate(t *testing.T) {
+	req := &BlockingPauseRequest{Duration: 300, Client: "::FFFF:192.168.1.20"}
+	if errs := req.Validate(); errs != nil {
+		t.Fatalf("expected no validation errors, got %v", errs)
+	}
+	if req.Client != "192.168.1.20" {
+		t.Errorf("expected the client address in its usual form, got %s", req.Client)
+	}
+	if errs := (&BlockingPauseRequest{Duration: 60}).Validate(); errs != nil {
+		t.Errorf("expected a pause for every client to be valid, got %v", errs)
+	}
+
+	for _, duration := range []int{0, -1, 24*60*60 + 1} {
+		req := &BlockingPauseRequest{Duration: duration}
+		if errs := req.Validate(); len(errs) != 1 || errs[0].Field != "duration" {
+			t.Errorf("expected duration error for %d, got %v", duration, errs)
+		}
+	}
+	req = &BlockingPauseRequest{Duration: 60, Client: "kitchen-tablet"}
+	if errs := req.Validate(); len(errs) != 1 || errs[0].Field != "client" {
+		t.Errorf("expected client error, got %v", errs)
+	}
+}
+
+func TestMapBlockingStatus(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	status := MapBlockingStatus([]dns.BlockingPause{
+		{Until: now.Add(90 * time.Second)},
+		{Client: "192.168.1.20", Until: now.Add(1500 * time.Millisecond)},
+	}, now)
+	if !status.Paused || len(status.Pauses) != 2 {
+		t.Fatalf("expected blocking paused for every client, got %+v", status)
+	}
+	if status.Pauses[0].Remaining != 90 || status.Pauses[0].Until != "2026-10-18T12:01:30Z" {
+		t.Errorf("unexpected countdown %+v", status.Pauses[0])
+	}
+	if status.Pauses[1].Client != "192.168.1.20" || status.Pauses[1].Remaining != 2 {
+		t.Errorf("expected the remaining time rounded up, got %+v", status.Pauses[1])
+	}
+
+	status = MapBlockingStatus(nil, now)
+	if status.Paused || status.Pauses == nil {
+		t.Errorf("expected an empty list of pauses, got %+v", status)
+	}
+}
+
+func TestRewriteRuleValidate_Valid(t *testing.T) {
+	req := &RewriteRule{
+		Match:   "suffix",
+		Pattern: "*.ads.example.com",
+		Action:  "nxdomain",
+	}
+	if errs := req.Validate(); errs != nil {
+		t.Errorf("expected no validation errors, got %v", errs)
+	}
+}
+
+func TestRewriteRuleValidate_MissingFields(t *testing.T) {
+	req := &RewriteRule{}
+	errs := req.Validate()
+	if len(errs) != 3 {
+		t.Errorf("expected pattern, match and action errors, got %v", errs)
+	}
+}
+
+func TestRewriteRuleValidate_InvalidValue(t *testing.T) {
+	req := &RewriteRule{
+		Match:   "exact",
+		Pattern: "nas.example.com",
+		Action:  "a",
+		Value:   "fd00::1",
+	}
+	errs := req.Validate()
+	if len(errs) != 1 || errs[0].Field != "rule" {
+		t.Errorf("expected rule error, got %v", errs)
+	}
+}
+
+func TestMapDNSClient_NamedByLease(t *testing.T) {
+	leases := map[string]dhcp.Lease{
+		"10.0.0.23": {ClientId: "aa:bb:cc:dd:ee:ff", Hostname: "kitchen-tablet", IP: net.ParseIP("10.0.0.23")},
+	}
+	client := MapDNSClient(dns.ClientStats{IP: "10.0.0.23", Queries: 4, Blocked: 1}, leases)
+	if client.Hostname != "kitchen-tablet" || client.MAC != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("expected the lease's hostname and MAC, got %q and %q", client.Hostname, client.MAC)
+	}
+	if client.BlockRatio != 0.25 {
+		t.Errorf("expected a block ratio of 0.25, got %v", client.BlockRatio)
+	}
+}
+
+func TestMapDNSClient_WithoutLease(t *testing.T) {
+	client := MapDNSClient(dns.ClientStats{IP: "10.0.0.50"}, nil)
+	if client.Hostname != "" || client.MAC != "" || client.BlockRatio != 0 {
+		t.Errorf("expected an unnamed client with no block ratio, got %+v", client)
+	}
+}
+
+func TestMapLocalDomains_ShowsUnicode(t *testing.T) {
+	domains := MapLocalDomains(map[string]string{"xn--bcher-kva.lan": "10.0.0.2", "router.lan": "10.0.0.1"})
+	if domains["bücher.lan"] != "10.0.0.2" || domains["router.lan"] != "10.0.0.1" {
+		t.Errorf("expected the Unicode name, got %v", domains)
+	}
+}